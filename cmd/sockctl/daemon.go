@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"parkerdgabel/sockd/pkg/message"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+func newDaemonCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "daemon",
+		Short: "Manage the sockd daemon",
+	}
+
+	cmd.AddCommand(
+		newDaemonReloadCmd(),
+		newDaemonDrainCmd(),
+		newDaemonResumeCmd(),
+	)
+
+	return cmd
+}
+
+func newDaemonReloadCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "reload",
+		Short: "Make the daemon re-read its config file",
+		Run: func(cmd *cobra.Command, args []string) {
+			c := newClient()
+			defer c.Close()
+			res, err := c.Reload(cmd.Context())
+			if err != nil {
+				log.Fatalf("Failed to reload daemon: %v", err)
+			}
+			if len(res.Applied) == 0 && len(res.RestartRequired) == 0 {
+				fmt.Println("Config unchanged")
+				return
+			}
+			if len(res.Applied) > 0 {
+				fmt.Printf("Applied: %s\n", strings.Join(res.Applied, ", "))
+			}
+			if len(res.RestartRequired) > 0 {
+				fmt.Printf("Restart required: %s\n", strings.Join(res.RestartRequired, ", "))
+			}
+		},
+	}
+
+	return cmd
+}
+
+func newDaemonDrainCmd() *cobra.Command {
+	var wait bool
+
+	cmd := &cobra.Command{
+		Use:   "drain",
+		Short: "Make the daemon refuse new containers and invocations, e.g. before maintenance",
+		Run: func(cmd *cobra.Command, args []string) {
+			c := newClient()
+			defer c.Close()
+			err := c.Drain(cmd.Context(), wait, func(res *message.DrainResponse) error {
+				fmt.Printf("Draining: %d in flight, %d containers\n", res.InFlight, res.Containers)
+				return nil
+			})
+			if err != nil {
+				log.Fatalf("Failed to drain daemon: %v", err)
+			}
+			if wait {
+				fmt.Println("Drained")
+			}
+		},
+	}
+
+	cmd.Flags().BoolVar(&wait, "wait", false, "Wait for the creates and invocations in flight to finish, showing their progress")
+
+	return cmd
+}
+
+func newDaemonResumeCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "resume",
+		Short: "Make a draining daemon accept new containers and invocations again",
+		Run: func(cmd *cobra.Command, args []string) {
+			c := newClient()
+			defer c.Close()
+			if err := c.Resume(cmd.Context()); err != nil {
+				log.Fatalf("Failed to resume daemon: %v", err)
+			}
+			fmt.Println("Resumed")
+		},
+	}
+
+	return cmd
+}
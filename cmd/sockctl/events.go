@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"parkerdgabel/sockd/pkg/message"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+func newEventsCmd() *cobra.Command {
+	var filters []string
+	var since string
+
+	cmd := &cobra.Command{
+		Use:   "events",
+		Short: "Stream container lifecycle and resource events",
+		Run: func(cmd *cobra.Command, args []string) {
+			filter, err := parseFilters(filters)
+			if err != nil {
+				log.Fatalf("Invalid --filter: %v", err)
+			}
+			start, err := parseSince(since)
+			if err != nil {
+				log.Fatalf("Invalid --since: %v", err)
+			}
+			c := newClient()
+			defer c.Close()
+			err = c.Events(cmd.Context(), filter, start, func(events []message.Event) error {
+				for _, e := range events {
+					printEvent(e)
+				}
+				return nil
+			})
+			if err != nil && !errors.Is(err, context.Canceled) {
+				log.Fatalf("Failed to stream events: %v", err)
+			}
+		},
+	}
+
+	cmd.Flags().StringArrayVar(&filters, "filter", nil, "Only show events matching key=value, with key one of type, container or parent (repeatable)")
+	cmd.Flags().StringVar(&since, "since", "", "Replay buffered events since a duration ago (e.g. 5m) or an RFC3339 time")
+
+	return cmd
+}
+
+func parseFilters(filters []string) (map[string][]string, error) {
+	res := make(map[string][]string)
+	for _, f := range filters {
+		key, value, ok := strings.Cut(f, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not key=value", f)
+		}
+		res[key] = append(res[key], value)
+	}
+	return res, nil
+}
+
+func printEvent(e message.Event) {
+	fmt.Printf("%s %s container=%s", e.Time.Format(time.RFC3339Nano), e.Type, e.ContainerId)
+	if e.ParentId != "" {
+		fmt.Printf(" parent=%s", e.ParentId)
+	}
+	if e.Cgroup != "" {
+		fmt.Printf(" cgroup=%s", e.Cgroup)
+	}
+	fmt.Println()
+}
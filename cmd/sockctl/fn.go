@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"parkerdgabel/sockd/pkg/container"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+func newFnCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "fn",
+		Short: "Manage registered functions",
+	}
+
+	cmd.AddCommand(
+		newFnRegisterCmd(),
+		newFnListCmd(),
+		newFnDescribeCmd(),
+		newFnDeleteCmd(),
+		newFnAliasCmd(),
+		newFnRollbackCmd(),
+	)
+
+	return cmd
+}
+
+func newFnRegisterCmd() *cobra.Command {
+	var meta container.Meta
+	var name string
+
+	cmd := &cobra.Command{
+		Use:   "register",
+		Short: "Register a function",
+		Run: func(cmd *cobra.Command, args []string) {
+			c := newClient()
+			defer c.Close()
+			fn, err := c.RegisterFunction(cmd.Context(), name, meta)
+			if err != nil {
+				log.Fatalf("Failed to register function: %v", err)
+			}
+			fmt.Printf("Registered function: %s version %s\n", fn.Name, fn.Latest)
+		},
+	}
+
+	cmd.Flags().StringVar(&name, "name", "", "Function name")
+	cmd.Flags().StringSliceVar(&meta.Installs, "installs", nil, "List of installs")
+	cmd.Flags().StringSliceVar(&meta.Imports, "imports", nil, "List of imports")
+	cmd.Flags().StringVar((*string)(&meta.Runtime), "runtime", "", "Container runtime")
+	cmd.Flags().StringVar(&meta.BaseImageName, "base-image-name", "", "Base image name")
+	cmd.Flags().StringVar(&meta.BaseImageVersion, "base-image-version", "latest", "Base image version")
+	cmd.Flags().StringVar(&meta.CodeUrl, "code-url", "", "Location of the function code")
+	addLimitFlags(cmd, &meta)
+
+	cmd.MarkFlagRequired("name")
+	cmd.MarkFlagRequired("runtime")
+	cmd.MarkFlagRequired("base-image-name")
+	cmd.MarkFlagRequired("code-url")
+
+	return cmd
+}
+
+func newFnListCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List registered functions",
+		Run: func(cmd *cobra.Command, args []string) {
+			c := newClient()
+			defer c.Close()
+			res, err := c.ListFunctions(cmd.Context())
+			if err != nil {
+				log.Fatalf("Failed to list functions: %v", err)
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "NAME\tLATEST\tVERSIONS\tALIASES\tREGISTERED")
+			for _, fn := range res.Functions {
+				aliases := make([]string, 0, len(fn.Aliases))
+				for _, a := range fn.Aliases {
+					aliases = append(aliases, a.Name)
+				}
+				fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", fn.Name, fn.Latest, len(fn.Versions), strings.Join(aliases, ","), fn.Registered.Format("2006-01-02 15:04:05"))
+			}
+			w.Flush()
+		},
+	}
+
+	return cmd
+}
+
+func newFnDescribeCmd() *cobra.Command {
+	var name string
+
+	cmd := &cobra.Command{
+		Use:   "describe",
+		Short: "Describe a registered function",
+		Run: func(cmd *cobra.Command, args []string) {
+			c := newClient()
+			defer c.Close()
+			fn, err := c.DescribeFunction(cmd.Context(), name)
+			if err != nil {
+				log.Fatalf("Failed to describe function: %v", err)
+			}
+			fmt.Printf("Name:       %s\n", fn.Name)
+			fmt.Printf("Latest:     %s\n", fn.Latest)
+			fmt.Printf("Registered: %s\n", fn.Registered.Format("2006-01-02 15:04:05"))
+			fmt.Println("Aliases:")
+			for _, a := range fn.Aliases {
+				if a.Canary != "" {
+					fmt.Printf("  %s -> %s (%d%% to %s)\n", a.Name, a.Version, a.CanaryWeight, a.Canary)
+				} else {
+					fmt.Printf("  %s -> %s\n", a.Name, a.Version)
+				}
+			}
+			fmt.Println("Versions:")
+			for _, v := range fn.Versions {
+				fmt.Printf("  %s\n", v.Id)
+				fmt.Printf("    Runtime:  %s\n", v.Meta.Runtime)
+				fmt.Printf("    Image:    %s:%s\n", v.Meta.BaseImageName, v.Meta.BaseImageVersion)
+				fmt.Printf("    Installs: %s\n", strings.Join(v.Meta.Installs, ", "))
+				fmt.Printf("    Imports:  %s\n", strings.Join(v.Meta.Imports, ", "))
+				fmt.Printf("    Memory:   %d MB\n", v.Meta.MemLimitMB)
+				fmt.Printf("    CPU:      %d%%\n", v.Meta.CPUPercent)
+				fmt.Printf("    Code URL: %s\n", v.Meta.CodeUrl)
+				fmt.Printf("    Code dir: %s\n", v.CodeDir)
+				fmt.Printf("    Created:  %s\n", v.Created.Format("2006-01-02 15:04:05"))
+			}
+		},
+	}
+
+	cmd.Flags().StringVar(&name, "name", "", "Function name")
+	cmd.MarkFlagRequired("name")
+
+	return cmd
+}
+
+func newFnDeleteCmd() *cobra.Command {
+	var name string
+
+	cmd := &cobra.Command{
+		Use:   "delete",
+		Short: "Delete a registered function",
+		Run: func(cmd *cobra.Command, args []string) {
+			c := newClient()
+			defer c.Close()
+			err := c.DeleteFunction(cmd.Context(), name)
+			if err != nil {
+				log.Fatalf("Failed to delete function: %v", err)
+			}
+			fmt.Printf("Deleted function: %s\n", name)
+		},
+	}
+
+	cmd.Flags().StringVar(&name, "name", "", "Function name")
+	cmd.MarkFlagRequired("name")
+
+	return cmd
+}
+
+func newFnAliasCmd() *cobra.Command {
+	var name string
+	var alias string
+	var version string
+	var canary string
+	var canaryWeight int
+
+	cmd := &cobra.Command{
+		Use:   "alias",
+		Short: "Point an alias of a function at a version",
+		Run: func(cmd *cobra.Command, args []string) {
+			c := newClient()
+			defer c.Close()
+			_, err := c.SetFunctionAlias(cmd.Context(), name, alias, version, canary, canaryWeight)
+			if err != nil {
+				log.Fatalf("Failed to set alias: %v", err)
+			}
+			fmt.Printf("Alias %s of function %s points at %s\n", alias, name, version)
+		},
+	}
+
+	cmd.Flags().StringVar(&name, "name", "", "Function name")
+	cmd.Flags().StringVar(&alias, "alias", "", "Alias name (e.g. prod)")
+	cmd.Flags().StringVar(&version, "version", "", "Version the alias points at")
+	cmd.Flags().StringVar(&canary, "canary", "", "Version that receives a share of the alias traffic")
+	cmd.Flags().IntVar(&canaryWeight, "canary-weight", 0, "Percent of the alias traffic sent to the canary version")
+	cmd.MarkFlagRequired("name")
+	cmd.MarkFlagRequired("alias")
+	cmd.MarkFlagRequired("version")
+
+	return cmd
+}
+
+func newFnRollbackCmd() *cobra.Command {
+	var name string
+	var alias string
+
+	cmd := &cobra.Command{
+		Use:   "rollback",
+		Short: "Move an alias of a function back to its previous version",
+		Run: func(cmd *cobra.Command, args []string) {
+			c := newClient()
+			defer c.Close()
+			res, err := c.RollbackFunctionAlias(cmd.Context(), name, alias)
+			if err != nil {
+				log.Fatalf("Failed to roll back alias: %v", err)
+			}
+			for _, a := range res.Aliases {
+				if a.Name == alias {
+					fmt.Printf("Alias %s of function %s points at %s\n", alias, name, a.Version)
+				}
+			}
+		},
+	}
+
+	cmd.Flags().StringVar(&name, "name", "", "Function name")
+	cmd.Flags().StringVar(&alias, "alias", "", "Alias name (e.g. prod)")
+	cmd.MarkFlagRequired("name")
+	cmd.MarkFlagRequired("alias")
+
+	return cmd
+}
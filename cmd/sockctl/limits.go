@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"parkerdgabel/sockd/pkg/cgroup"
+	"parkerdgabel/sockd/pkg/container"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// addLimitFlags adds the flags of the cgroup controls of a container to
+// cmd
+func addLimitFlags(cmd *cobra.Command, meta *container.Meta) {
+	flags := cmd.Flags()
+	flags.IntVar(&meta.MemLimitMB, "mem-limit-mb", 0, "Memory limit in MB, 0 for the default of the daemon")
+	flags.IntVar(&meta.CPUPercent, "cpu-percent", 0, "CPU limit in percent of a core, 0 for the default of the daemon")
+	flags.Int64Var(&meta.PidsMax, "pids-max", 0, "Maximum number of processes, 0 for the default of the daemon")
+	flags.IntVar(&meta.CPUWeight, "cpu-weight", 0, "Share of the CPU when it is contended, from 1 to 10000 (default 100)")
+	flags.StringVar(&meta.CPUs, "cpus", "", "CPUs to pin the container to, e.g. 0-3,6")
+	flags.StringVar(&meta.Mems, "mems", "", "Memory nodes to pin the container to, e.g. 0")
+	flags.IntVar(&meta.MemHighMB, "mem-high-mb", 0, "Memory in MB above which the container is throttled")
+	flags.IntVar(&meta.MemLowMB, "mem-low-mb", 0, "Memory in MB protected from reclaim")
+	flags.IntVar(&meta.MemSwapMaxMB, "mem-swap-max-mb", 0, "Swap in MB the container may use (default none)")
+	flags.Var((*ioMaxFlag)(&meta.IOMax), "io-max", `IO limit of a device, e.g. "8:0 rbps=1048576 wiops=100" (repeatable)`)
+	flags.Var((*ioWeightFlag)(&meta.IOWeight), "io-weight", `IO weight of a device, e.g. "8:0 200" (repeatable)`)
+}
+
+// ioMaxFlag collects the --io-max flags
+type ioMaxFlag []cgroup.IOMax
+
+func (f *ioMaxFlag) String() string {
+	lines := make([]string, len(*f))
+	for i, limit := range *f {
+		lines[i] = limit.String()
+	}
+	return strings.Join(lines, ", ")
+}
+
+func (f *ioMaxFlag) Set(s string) error {
+	limit, err := cgroup.ParseIOMax(s)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, limit)
+	return nil
+}
+
+func (f *ioMaxFlag) Type() string {
+	return "device limits"
+}
+
+// ioWeightFlag collects the --io-weight flags
+type ioWeightFlag []cgroup.IOWeight
+
+func (f *ioWeightFlag) String() string {
+	lines := make([]string, len(*f))
+	for i, weight := range *f {
+		lines[i] = weight.String()
+	}
+	return strings.Join(lines, ", ")
+}
+
+func (f *ioWeightFlag) Set(s string) error {
+	weight, err := cgroup.ParseIOWeight(s)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, weight)
+	return nil
+}
+
+func (f *ioWeightFlag) Type() string {
+	return "device weight"
+}
+
+// limitSummary lists the cgroup controls a container sets beyond its
+// memory and CPU limits
+func limitSummary(meta container.Meta) string {
+	var controls []string
+	add := func(isSet bool, format string, a ...any) {
+		if isSet {
+			controls = append(controls, fmt.Sprintf(format, a...))
+		}
+	}
+	add(meta.PidsMax > 0, "pids-max=%d", meta.PidsMax)
+	add(meta.CPUWeight > 0, "cpu-weight=%d", meta.CPUWeight)
+	add(meta.CPUs != "", "cpus=%s", meta.CPUs)
+	add(meta.Mems != "", "mems=%s", meta.Mems)
+	add(meta.MemHighMB > 0, "mem-high=%dMB", meta.MemHighMB)
+	add(meta.MemLowMB > 0, "mem-low=%dMB", meta.MemLowMB)
+	add(meta.MemSwapMaxMB > 0, "mem-swap-max=%dMB", meta.MemSwapMaxMB)
+	for _, limit := range meta.IOMax {
+		add(true, "io-max=%q", limit.String())
+	}
+	for _, weight := range meta.IOWeight {
+		add(true, "io-weight=%q", weight.String())
+	}
+	return strings.Join(controls, " ")
+}
@@ -1,13 +1,22 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
+	"os/signal"
+	"parkerdgabel/sockd/internal/auth"
 	"parkerdgabel/sockd/pkg/client"
 	"parkerdgabel/sockd/pkg/container"
 	"parkerdgabel/sockd/pkg/message"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -32,6 +41,13 @@ func init() {
 	rootCmd.PersistentFlags().StringVar(&socketPath, "socket", "/var/run/sockd.sock", "Unix socket path")
 	rootCmd.PersistentFlags().StringVar(&connectionType, "connection-type", "unix", "Connection type (unix or tcp)")
 	rootCmd.PersistentFlags().StringVar(&connectionAddr, "connection-addr", socketPath, "Connection address (socket path for unix or host:port for tcp)")
+	rootCmd.PersistentFlags().Bool("tls", false, "Connect over TLS (implied by the other --tls-* flags)")
+	rootCmd.PersistentFlags().String("tls-ca", "", "PEM file of the CAs to trust instead of the system ones")
+	rootCmd.PersistentFlags().String("tls-cert", "", "PEM client certificate, for servers that require one")
+	rootCmd.PersistentFlags().String("tls-key", "", "PEM key of the client certificate")
+	rootCmd.PersistentFlags().String("tls-server-name", "", "Server name to verify instead of the host of --connection-addr")
+	rootCmd.PersistentFlags().String("token", "", "Token to authenticate with (or set SOCKCTL_TOKEN)")
+	rootCmd.PersistentFlags().String("tenant", "", "Tenant to work in (or set SOCKCTL_TENANT)")
 }
 
 func initConfig() {
@@ -47,6 +63,11 @@ func initConfig() {
 
 	viper.BindPFlag("connection-type", rootCmd.PersistentFlags().Lookup("connection-type"))
 	viper.BindPFlag("connection-addr", rootCmd.PersistentFlags().Lookup("connection-addr"))
+	for _, name := range []string{"tls", "tls-ca", "tls-cert", "tls-key", "tls-server-name", "token", "tenant"} {
+		viper.BindPFlag(name, rootCmd.PersistentFlags().Lookup(name))
+	}
+	viper.BindEnv("token", "SOCKCTL_TOKEN")
+	viper.BindEnv("tenant", "SOCKCTL_TENANT")
 
 	viper.AutomaticEnv()
 
@@ -64,38 +85,80 @@ func main() {
 		newListCmd(),
 		newInspectCmd(),
 		newLogsCmd(),
+		newEventsCmd(),
+		newStatsCmd(),
 		newForkCmd(),
 		newPauseCmd(),
 		newUnpauseCmd(),
+		newInvokeCmd(),
+		newFnCmd(),
+		newDaemonCmd(),
 	)
-	cobra.CheckErr(rootCmd.Execute())
+	// stop following logs and abandon requests on Ctrl-C
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	cobra.CheckErr(rootCmd.ExecuteContext(ctx))
 }
 
 func newClient() *client.Client {
 	connType := viper.GetString("connection-type")
 	connAddr := viper.GetString("connection-addr")
 
-	conn, err := net.Dial(connType, connAddr)
+	var conn net.Conn
+	var err error
+	if useTLS() {
+		var tlsConfig *tls.Config
+		tlsConfig, err = auth.ClientConfig(viper.GetString("tls-ca"), viper.GetString("tls-cert"), viper.GetString("tls-key"), viper.GetString("tls-server-name"))
+		if err != nil {
+			log.Fatalf("Failed to set up TLS: %v", err)
+		}
+		conn, err = tls.Dial(connType, connAddr, tlsConfig)
+	} else {
+		conn, err = net.Dial(connType, connAddr)
+	}
 	if err != nil {
 		log.Fatalf("Failed to connect to socket: %v", err)
 	}
-	return client.NewClient(client.WithConn(conn))
+	return client.NewClient(client.WithConn(conn), client.WithToken(viper.GetString("token")), client.WithTenant(viper.GetString("tenant")))
+}
+
+// useTLS tells whether any of the TLS flags is set
+func useTLS() bool {
+	if viper.GetBool("tls") {
+		return true
+	}
+	for _, name := range []string{"tls-ca", "tls-cert", "tls-key", "tls-server-name"} {
+		if viper.GetString(name) != "" {
+			return true
+		}
+	}
+	return false
 }
 func newCreateCmd() *cobra.Command {
 	var meta container.Meta
 	var name string
+	var function string
 
 	cmd := &cobra.Command{
 		Use:   "create",
 		Short: "Create a new container",
 		Run: func(cmd *cobra.Command, args []string) {
+			if function == "" && (meta.Runtime == "" || meta.BaseImageName == "") {
+				log.Fatalf("--runtime and --base-image-name are required unless --function is set")
+			}
 			c := newClient()
 			defer c.Close()
-			res, err := c.Create(meta, name)
+			var res *message.CreateResponse
+			var err error
+			if function != "" {
+				res, err = c.CreateFromFunction(cmd.Context(), function, name)
+			} else {
+				res, err = c.Create(cmd.Context(), meta, name)
+			}
 			if err != nil {
 				log.Fatalf("Failed to create container: %v", err)
 			}
-			fmt.Printf("Created container: %s\n", res.Payload.(message.CreateResponse).Id)
+			fmt.Printf("Created container: %s\n", res.Id)
 		},
 	}
 
@@ -105,13 +168,12 @@ func newCreateCmd() *cobra.Command {
 	cmd.Flags().StringSliceVar(&meta.Installs, "installs", nil, "List of installs")
 	cmd.Flags().StringSliceVar(&meta.Imports, "imports", nil, "List of imports")
 	cmd.Flags().StringVar((*string)(&meta.Runtime), "runtime", "", "Container runtime")
-	cmd.Flags().IntVar(&meta.MemLimitMB, "mem-limit-mb", 0, "Memory limit in MB")
-	cmd.Flags().IntVar(&meta.CPUPercent, "cpu-percent", 0, "CPU percentage limit")
 	cmd.Flags().StringVar(&meta.BaseImageName, "base-image-name", "", "Base image name")
 	cmd.Flags().StringVar(&meta.BaseImageVersion, "base-image-version", "latest", "Base image version")
+	cmd.Flags().StringVar(&meta.CodeUrl, "code-url", "", "Location of the container code")
+	addLimitFlags(cmd, &meta)
+	cmd.Flags().StringVar(&function, "function", "", "Create the container from a registered function")
 
-	cmd.MarkFlagRequired("runtime")
-	cmd.MarkFlagRequired("base-image-name")
 	cmd.MarkFlagRequired("name")
 
 	return cmd
@@ -126,7 +188,7 @@ func newDeleteCmd() *cobra.Command {
 		Run: func(cmd *cobra.Command, args []string) {
 			c := newClient()
 			defer c.Close()
-			_, err := c.Delete(id)
+			err := c.Delete(cmd.Context(), id)
 			if err != nil {
 				log.Fatalf("Failed to delete container: %v", err)
 			}
@@ -149,7 +211,7 @@ func newStartCmd() *cobra.Command {
 		Run: func(cmd *cobra.Command, args []string) {
 			c := newClient()
 			defer c.Close()
-			_, err := c.Start(id)
+			err := c.Start(cmd.Context(), id)
 			if err != nil {
 				log.Fatalf("Failed to start container: %v", err)
 			}
@@ -172,7 +234,7 @@ func newStopCmd() *cobra.Command {
 		Run: func(cmd *cobra.Command, args []string) {
 			c := newClient()
 			defer c.Close()
-			_, err := c.Stop(id)
+			err := c.Stop(cmd.Context(), id)
 			if err != nil {
 				log.Fatalf("Failed to stop container: %v", err)
 			}
@@ -193,11 +255,11 @@ func newListCmd() *cobra.Command {
 		Run: func(cmd *cobra.Command, args []string) {
 			c := newClient()
 			defer c.Close()
-			res, err := c.List()
+			res, err := c.List(cmd.Context())
 			if err != nil {
 				log.Fatalf("Failed to list containers: %v", err)
 			}
-			fmt.Printf("Containers: %v\n", res.Payload.(message.ListResponse).Ids)
+			fmt.Printf("Containers: %v\n", res.Ids)
 		},
 	}
 
@@ -213,11 +275,11 @@ func newInspectCmd() *cobra.Command {
 		Run: func(cmd *cobra.Command, args []string) {
 			c := newClient()
 			defer c.Close()
-			res, err := c.Inspect(id)
+			res, err := c.Inspect(cmd.Context(), id)
 			if err != nil {
 				log.Fatalf("Failed to inspect container: %v", err)
 			}
-			fmt.Printf("Container details: %v\n", res.Payload)
+			printInspect(*res)
 		},
 	}
 
@@ -227,29 +289,113 @@ func newInspectCmd() *cobra.Command {
 	return cmd
 }
 
+func printInspect(in message.InspectResponse) {
+	const timeFormat = "2006-01-02 15:04:05.000"
+	fmt.Printf("ID:          %s\n", in.Id)
+	fmt.Printf("Status:      %s\n", in.Status)
+	fmt.Printf("Parent:      %s\n", in.ParentId)
+	fmt.Printf("Children:    %s\n", strings.Join(in.ChildIds, ", "))
+	fmt.Printf("Cgroup:      %s\n", in.Cgroup)
+	fmt.Printf("Memory:      %d MB / %d MB\n", in.MemUsageMB, in.MemLimitMB)
+	if in.CPUPercent > 0 {
+		fmt.Printf("CPU:         %d%%\n", in.CPUPercent)
+	} else {
+		fmt.Printf("CPU:         unlimited\n")
+	}
+	if limits := limitSummary(in.Meta); limits != "" {
+		fmt.Printf("Limits:      %s\n", limits)
+	}
+	fmt.Printf("PIDs:        %s\n", strings.Join(in.PIDs, ", "))
+	fmt.Printf("Root dir:    %s\n", in.RootDir)
+	fmt.Printf("Code dir:    %s\n", in.CodeDir)
+	fmt.Printf("Scratch dir: %s\n", in.ScratchDir)
+	fmt.Printf("Runtime:     %s\n", in.Meta.Runtime)
+	fmt.Printf("Image:       %s:%s\n", in.Meta.BaseImageName, in.Meta.BaseImageVersion)
+	fmt.Printf("Installs:    %s\n", strings.Join(in.Meta.Installs, ", "))
+	fmt.Printf("Imports:     %s\n", strings.Join(in.Meta.Imports, ", "))
+	fmt.Printf("Created:     %s\n", in.Created.Format(timeFormat))
+	events := make([]string, 0, len(in.Events))
+	for event := range in.Events {
+		events = append(events, event)
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return in.Events[events[i]].Before(in.Events[events[j]])
+	})
+	for _, event := range events {
+		fmt.Printf("  %-10s %s\n", event+":", in.Events[event].Format(timeFormat))
+	}
+}
+
 func newLogsCmd() *cobra.Command {
 	var id string
+	var follow bool
+	var since string
+	var tail int
+	var timestamps bool
 
 	cmd := &cobra.Command{
 		Use:   "logs",
 		Short: "Get logs of a container",
 		Run: func(cmd *cobra.Command, args []string) {
+			start, err := parseSince(since)
+			if err != nil {
+				log.Fatalf("Invalid --since: %v", err)
+			}
 			c := newClient()
 			defer c.Close()
-			res, err := c.Logs(id)
+			if follow {
+				err := c.FollowLogs(cmd.Context(), id, start, tail, func(entries []message.LogEntry) error {
+					printLogs(entries, timestamps)
+					return nil
+				})
+				if err != nil && !errors.Is(err, context.Canceled) {
+					log.Fatalf("Failed to follow logs: %v", err)
+				}
+				return
+			}
+			res, err := c.Logs(cmd.Context(), id, start, tail)
 			if err != nil {
 				log.Fatalf("Failed to get logs: %v", err)
 			}
-			fmt.Printf("Logs: %v\n", res.Payload)
+			printLogs(res.Entries, timestamps)
 		},
 	}
 
 	cmd.Flags().StringVar(&id, "id", "", "Container ID")
+	cmd.Flags().BoolVarP(&follow, "follow", "f", false, "Keep streaming new log lines")
+	cmd.Flags().StringVar(&since, "since", "", "Only show lines since a duration ago (e.g. 5m) or an RFC3339 time")
+	cmd.Flags().IntVar(&tail, "tail", 0, "Only show this many of the most recent lines")
+	cmd.Flags().BoolVarP(&timestamps, "timestamps", "t", false, "Prefix each line with its time")
 	cmd.MarkFlagRequired("id")
 
 	return cmd
 }
 
+func parseSince(since string) (time.Time, error) {
+	if since == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(since); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, since)
+}
+
+// print log lines to stdout or stderr, as the container wrote them
+func printLogs(entries []message.LogEntry, timestamps bool) {
+	for _, e := range entries {
+		out := os.Stdout
+		if e.Stream == container.StreamStderr {
+			out = os.Stderr
+		}
+		if timestamps {
+			fmt.Fprintf(out, "%s %s\n", e.Time.Format(time.RFC3339Nano), e.Line)
+		} else {
+			fmt.Fprintln(out, e.Line)
+		}
+	}
+}
+
 func newForkCmd() *cobra.Command {
 	var id string
 
@@ -259,7 +405,7 @@ func newForkCmd() *cobra.Command {
 		Run: func(cmd *cobra.Command, args []string) {
 			c := newClient()
 			defer c.Close()
-			_, err := c.Fork(id)
+			err := c.Fork(cmd.Context(), id)
 			if err != nil {
 				log.Fatalf("Failed to fork container: %v", err)
 			}
@@ -282,7 +428,7 @@ func newPauseCmd() *cobra.Command {
 		Run: func(cmd *cobra.Command, args []string) {
 			c := newClient()
 			defer c.Close()
-			_, err := c.Pause(id)
+			err := c.Pause(cmd.Context(), id)
 			if err != nil {
 				log.Fatalf("Failed to pause container: %v", err)
 			}
@@ -305,7 +451,7 @@ func newUnpauseCmd() *cobra.Command {
 		Run: func(cmd *cobra.Command, args []string) {
 			c := newClient()
 			defer c.Close()
-			_, err := c.Unpause(id)
+			err := c.Unpause(cmd.Context(), id)
 			if err != nil {
 				log.Fatalf("Failed to unpause container: %v", err)
 			}
@@ -318,3 +464,45 @@ func newUnpauseCmd() *cobra.Command {
 
 	return cmd
 }
+
+func newInvokeCmd() *cobra.Command {
+	var id string
+	var data string
+	var file string
+	var contentType string
+
+	cmd := &cobra.Command{
+		Use:   "invoke",
+		Short: "Invoke the handler of a container",
+		Run: func(cmd *cobra.Command, args []string) {
+			body := []byte(data)
+			if file != "" {
+				var err error
+				if file == "-" {
+					body, err = io.ReadAll(os.Stdin)
+				} else {
+					body, err = os.ReadFile(file)
+				}
+				if err != nil {
+					log.Fatalf("Failed to read request body: %v", err)
+				}
+			}
+			c := newClient()
+			defer c.Close()
+			inv, err := c.Invoke(cmd.Context(), id, body, contentType)
+			if err != nil {
+				log.Fatalf("Failed to invoke container: %v", err)
+			}
+			fmt.Fprintf(os.Stderr, "Status: %d (%v)\n", inv.StatusCode, inv.Duration)
+			os.Stdout.Write(inv.Body)
+		},
+	}
+
+	cmd.Flags().StringVar(&id, "id", "", "Container ID")
+	cmd.Flags().StringVar(&data, "data", "", "Request body")
+	cmd.Flags().StringVar(&file, "file", "", "Read the request body from a file (- for stdin)")
+	cmd.Flags().StringVar(&contentType, "content-type", "application/json", "Content type of the request body")
+	cmd.MarkFlagRequired("id")
+
+	return cmd
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"parkerdgabel/sockd/pkg/message"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// how far apart the two samples of a one-shot stats are, to tell the CPU
+// usage
+const statsSample = 500 * time.Millisecond
+
+var errStatsDone = errors.New("done")
+
+func newStatsCmd() *cobra.Command {
+	var id string
+	var watch bool
+	var interval time.Duration
+
+	cmd := &cobra.Command{
+		Use:   "stats",
+		Short: "Show the resource usage of containers, Zygotes included",
+		Run: func(cmd *cobra.Command, args []string) {
+			c := newClient()
+			defer c.Close()
+			if !watch {
+				interval = statsSample
+			}
+			var prev *message.StatsResponse
+			err := c.Stats(cmd.Context(), id, interval, func(stats *message.StatsResponse) error {
+				if prev == nil && !watch {
+					prev = stats
+					return nil
+				}
+				if watch {
+					// clear the screen, as top does
+					fmt.Print("\033[H\033[2J")
+				}
+				printStats(stats, prev)
+				prev = stats
+				if !watch {
+					return errStatsDone
+				}
+				return nil
+			})
+			if err != nil && !errors.Is(err, errStatsDone) && !errors.Is(err, context.Canceled) {
+				log.Fatalf("Failed to get stats: %v", err)
+			}
+		},
+	}
+
+	cmd.Flags().StringVar(&id, "id", "", "Only show this container")
+	cmd.Flags().BoolVar(&watch, "watch", false, "Keep refreshing the stats")
+	cmd.Flags().DurationVar(&interval, "interval", 2*time.Second, "How often to refresh the stats with --watch")
+
+	return cmd
+}
+
+// printStats prints a table of the stats, children indented below their
+// parents. The CPU usage is measured since prev, if any.
+func printStats(stats, prev *message.StatsResponse) {
+	before := make(map[string]message.ContainerStats)
+	var elapsed time.Duration
+	if prev != nil {
+		for _, c := range prev.Containers {
+			before[c.Id] = c
+		}
+		elapsed = stats.Time.Sub(prev.Time)
+	}
+	depth := make(map[string]int)
+	for _, c := range stats.Containers {
+		if d, ok := depth[c.ParentId]; ok {
+			depth[c.Id] = d + 1
+		} else {
+			depth[c.Id] = 0
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tKIND\tSTATUS\tCPU %\tMEM\tLIMIT\tPEAK\tPIDS\tIO READ\tIO WRITE")
+	for _, c := range stats.Containers {
+		kind := "container"
+		if c.Zygote {
+			kind = "zygote"
+		}
+		cpu := "-"
+		if b, ok := before[c.Id]; ok && elapsed > 0 {
+			used := time.Duration(c.Stats.CPU.UsageUsec-b.Stats.CPU.UsageUsec) * time.Microsecond
+			cpu = fmt.Sprintf("%.1f", 100*used.Seconds()/elapsed.Seconds())
+		}
+		limit := "-"
+		if c.Stats.Memory.LimitBytes > 0 {
+			limit = formatBytes(c.Stats.Memory.LimitBytes)
+		}
+		var read, written int64
+		for _, io := range c.Stats.IO {
+			read += io.ReadBytes
+			written += io.WriteBytes
+		}
+		fmt.Fprintf(w, "%s%s\t%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			strings.Repeat("  ", depth[c.Id]), c.Id, kind, c.Status, cpu,
+			formatBytes(c.Stats.Memory.CurrentBytes), limit, formatBytes(c.Stats.Memory.PeakBytes),
+			c.Stats.Pids.Current, formatBytes(read), formatBytes(written))
+	}
+	w.Flush()
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
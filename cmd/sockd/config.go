@@ -0,0 +1,24 @@
+package main
+
+import (
+	"os"
+	"parkerdgabel/sockd/internal/config"
+
+	"github.com/spf13/cobra"
+)
+
+func newConfigCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: "Inspect the configuration of sockd",
+	}
+	cmd.AddCommand(&cobra.Command{
+		Use:   "print-defaults",
+		Short: "Print the default configuration as a config file",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return config.WriteDefaults(os.Stdout)
+		},
+	})
+	return cmd
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"parkerdgabel/sockd/internal/auth"
+	"parkerdgabel/sockd/internal/tracing"
+	"parkerdgabel/sockd/pkg/message"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+const (
+	// maxInFlight is how many requests with an id one connection may
+	// have in progress before the server stops reading more of them
+	maxInFlight = 256
+	// how often an idle stream checks that the client is still there
+	streamKeepAlive = 5 * time.Second
+	// how long a client has to complete the TLS handshake
+	handshakeTimeout = 10 * time.Second
+)
+
+// connection serves the requests of a single client. Requests with an id
+// are handled concurrently; the rest one at a time, in order.
+type connection struct {
+	conn    net.Conn
+	ctx     context.Context
+	version int
+	// tokens is nil when the client needs none
+	tokens    *auth.Tokens
+	principal auth.Principal
+
+	writeMutex sync.Mutex
+	encoder    *json.Encoder
+
+	mutex    sync.Mutex
+	inFlight map[string]context.CancelFunc
+	slots    chan struct{}
+	wg       sync.WaitGroup
+
+	logger *slog.Logger
+}
+
+func handleConnection(conn net.Conn, sec *security) {
+	// requests still in progress are abandoned with the connection
+	defer conn.Close()
+	log := logger.With("remote", conn.RemoteAddr().String())
+	var principal auth.Principal
+	if unixConn, ok := conn.(*net.UnixConn); ok {
+		var err error
+		if principal, err = auth.PeerPrincipal(unixConn); err != nil {
+			log.Warn("failed to get peer credentials", "error", err)
+			return
+		}
+	}
+	var tokens *auth.Tokens
+	if sec != nil {
+		tokens = sec.tokens
+	}
+	if sec != nil && sec.tls != nil {
+		tlsConn := tls.Server(conn, sec.tls)
+		conn = tlsConn
+		tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			log.Warn("TLS handshake failed", "error", err)
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+		if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+			principal.Identity = certs[0].Subject.CommonName
+			log = log.With("identity", principal.Identity)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &connection{
+		conn:      conn,
+		ctx:       ctx,
+		tokens:    tokens,
+		principal: principal,
+		encoder:   json.NewEncoder(conn),
+		inFlight:  make(map[string]context.CancelFunc),
+		slots:     make(chan struct{}, maxInFlight),
+		logger:    log,
+	}
+	defer cancel()
+	c.serve()
+}
+
+// authenticate checks the token of a hello, if the client needs one
+func (c *connection) authenticate(payload message.PayloadHello) error {
+	if c.tokens == nil {
+		return nil
+	}
+	name, ok := c.tokens.Authenticate(payload.Token)
+	if !ok {
+		return message.NewError(message.ErrCodeUnauthorized, "missing or invalid token")
+	}
+	c.logger.Debug("authenticated with token", "token", name)
+	c.principal.Token = name
+	return nil
+}
+
+func (c *connection) serve() {
+	decoder := json.NewDecoder(c.conn)
+	for {
+		var msg message.Request
+		if err := decoder.Decode(&msg); err != nil {
+			if err == io.EOF {
+				return
+			}
+			c.logger.Warn("failed to decode request", "error", err)
+			// the stream cannot be resynchronized after a syntax error
+			var syntaxErr *json.SyntaxError
+			if errors.As(err, &syntaxErr) || errors.Is(err, io.ErrUnexpectedEOF) {
+				c.reply(msg.Id, errorResponse(message.NewError(message.ErrCodeBadRequest, "%v", err)))
+				return
+			}
+			if err := c.reply(msg.Id, errorResponse(message.NewError(message.ErrCodeBadRequest, "%v", err))); err != nil {
+				return
+			}
+			continue
+		}
+		c.logger.Debug("received request", "command", msg.Command, "request_id", msg.Id)
+
+		switch {
+		case msg.Command == message.CommandHello:
+			payload := msg.Payload.(message.PayloadHello)
+			if err := c.authenticate(payload); err != nil {
+				c.logger.Warn("rejected connection", "client", payload.Client, "error", err)
+				c.reply(msg.Id, errorResponse(err))
+				return
+			}
+			c.version = message.NegotiateVersion(payload.Versions)
+			if err := c.reply(msg.Id, helloResponse(payload, c.version)); err != nil {
+				return
+			}
+		case c.version == 0:
+			if err := c.reply(msg.Id, errorResponse(message.NewError(message.ErrCodeHandshakeRequired, "send %s before %s", message.CommandHello, msg.Command))); err != nil {
+				return
+			}
+		case !policy.Load().Allowed(c.principal, tenantOf(msg), msg.Command):
+			c.logger.Warn("denied command", "command", msg.Command, "tenant", tenantOf(msg), "principal", c.principal.String())
+			if err := c.reply(msg.Id, errorResponse(message.NewError(message.ErrCodeForbidden, "%s may not run %s in tenant %s", c.principal, msg.Command, tenantOf(msg)))); err != nil {
+				return
+			}
+		case msg.Command == message.CommandCancel:
+			if err := c.reply(msg.Id, c.cancel(msg.Payload.(message.PayloadCancel))); err != nil {
+				return
+			}
+		case msg.Command == message.CommandShutdown:
+			if err := c.reply(msg.Id, handleRequest(c.ctx, msg)); err != nil {
+				return
+			}
+			c.logger.Info("received shutdown command, closing connection")
+			sigChan <- syscall.SIGINT
+			return
+		case msg.Command == message.CommandCloseConnection:
+			// answer everything already asked before going away,
+			// except streams, which never finish on their own
+			c.wg.Wait()
+			c.reply(msg.Id, handleRequest(c.ctx, msg))
+			c.logger.Debug("received close connection command, closing connection")
+			return
+		case msg.Id == "":
+			if err := c.handle(c.ctx, msg); err != nil {
+				c.logger.Warn("failed to send response", "request_id", msg.Id, "error", err)
+				return
+			}
+		default:
+			c.start(msg)
+		}
+	}
+}
+
+// start handles a request in its own goroutine, so it can be cancelled
+// by its id until it has been answered
+func (c *connection) start(msg message.Request) {
+	c.mutex.Lock()
+	if _, ok := c.inFlight[msg.Id]; ok {
+		c.mutex.Unlock()
+		c.reply(msg.Id, errorResponse(message.NewError(message.ErrCodeDuplicateId, "request %s is still in progress", msg.Id)))
+		return
+	}
+	ctx, cancel := context.WithCancel(c.ctx)
+	c.inFlight[msg.Id] = cancel
+	c.mutex.Unlock()
+
+	stream := isStream(msg)
+	c.slots <- struct{}{}
+	if !stream {
+		c.wg.Add(1)
+	}
+	go func() {
+		defer func() {
+			c.mutex.Lock()
+			delete(c.inFlight, msg.Id)
+			c.mutex.Unlock()
+			cancel()
+			<-c.slots
+			if !stream {
+				c.wg.Done()
+			}
+		}()
+		if err := c.handle(ctx, msg); err != nil {
+			c.logger.Warn("failed to send response", "request_id", msg.Id, "error", err)
+			// unblocks serve, which ends the connection
+			c.conn.Close()
+		}
+	}()
+}
+
+// isStream tells whether a request is answered until it is cancelled
+func isStream(msg message.Request) bool {
+	switch msg.Command {
+	case message.CommandLogs:
+		return msg.Payload.(message.PayloadLogs).Follow
+	case message.CommandEvents:
+		return true
+	case message.CommandStats:
+		return msg.Payload.(message.PayloadStats).Interval > 0
+	case message.CommandDrain:
+		return msg.Payload.(message.PayloadDrain).Wait
+	}
+	return false
+}
+
+func (c *connection) cancel(payload message.PayloadCancel) message.Response {
+	c.mutex.Lock()
+	cancel, ok := c.inFlight[payload.Id]
+	c.mutex.Unlock()
+	if !ok {
+		return errorResponse(message.NewError(message.ErrCodeNotFound, "no request %s in progress", payload.Id))
+	}
+	c.logger.Debug("cancelling request", "request_id", payload.Id)
+	cancel()
+	return message.Response{
+		Success: true,
+		Message: "Cancelled request: " + payload.Id,
+	}
+}
+
+// handle answers a request, in a span that continues the trace of the
+// client. Errors are only returned when the connection is no longer
+// usable.
+func (c *connection) handle(ctx context.Context, msg message.Request) error {
+	ctx, span := tracing.Start(tracing.Extract(ctx, msg.Trace), "sockd."+string(msg.Command),
+		attribute.String("sockd.request.id", msg.Id))
+	defer span.End()
+
+	// these stream their own responses
+	switch msg.Command {
+	case message.CommandLogs:
+		return sendLogs(ctx, c, msg.Id, msg.Tenant, msg.Payload.(message.PayloadLogs))
+	case message.CommandEvents:
+		return sendEvents(ctx, c, msg.Id, msg.Tenant, msg.Payload.(message.PayloadEvents))
+	case message.CommandStats:
+		return sendStats(ctx, c, msg.Id, msg.Tenant, msg.Payload.(message.PayloadStats))
+	case message.CommandDrain:
+		return sendDrain(ctx, c, msg.Id, msg.Payload.(message.PayloadDrain))
+	}
+	response := handleRequest(ctx, msg)
+	if response.Error != nil {
+		span.SetStatus(codes.Error, response.Error.Error())
+	}
+	return c.reply(msg.Id, response)
+}
+
+// reply sends a response to the request with the given id. Responses
+// are written whole, so concurrent replies never interleave.
+func (c *connection) reply(id string, response message.Response) error {
+	response.Id = id
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	if err := c.encoder.Encode(&response); err != nil {
+		c.logger.Warn("failed to encode response", "request_id", id, "error", err)
+		return err
+	}
+	return nil
+}
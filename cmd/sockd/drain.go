@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"parkerdgabel/sockd/internal/manager"
+	"parkerdgabel/sockd/pkg/message"
+	"time"
+)
+
+// how often the progress of a drain is checked
+const drainPoll = 250 * time.Millisecond
+
+// waitDrained waits until no create or invocation is in flight, calling
+// progress with the status of the drain when it changes, and at least
+// every streamKeepAlive. It returns early with the error of progress, or
+// of ctx.
+func waitDrained(ctx context.Context, progress func(manager.DrainStatus) error) error {
+	ticker := time.NewTicker(drainPoll)
+	defer ticker.Stop()
+	var last manager.DrainStatus
+	var reported time.Time
+	for {
+		status := m.DrainStatus()
+		if reported.IsZero() || status != last || time.Since(reported) >= streamKeepAlive {
+			if err := progress(status); err != nil {
+				return err
+			}
+			last, reported = status, time.Now()
+		}
+		if status.InFlight == 0 {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func drainResponse(status manager.DrainStatus) message.Response {
+	return message.Response{
+		Success: true,
+		Message: fmt.Sprintf("Draining: %d in flight, %d containers", status.InFlight, status.Containers),
+		Payload: message.DrainResponse{
+			Draining:   status.Draining,
+			InFlight:   status.InFlight,
+			Containers: status.Containers,
+			Done:       status.InFlight == 0,
+		},
+	}
+}
+
+// sendDrain answers a drain request, streaming its progress until
+// nothing is in flight or ctx is cancelled if asked to wait. Errors are
+// only returned when the connection is no longer usable.
+func sendDrain(ctx context.Context, conn *connection, id string, payload message.PayloadDrain) error {
+	m.Drain()
+	if !payload.Wait {
+		return conn.reply(id, drainResponse(m.DrainStatus()))
+	}
+	err := waitDrained(ctx, func(status manager.DrainStatus) error {
+		return conn.reply(id, drainResponse(status))
+	})
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// shutdown drains the manager, waits up to timeout for the creates and
+// invocations in flight, or until a second signal, and tears everything
+// down
+func shutdown(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-sigChan:
+			logger.Warn("received a second shutdown signal, not waiting for requests in flight")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	err := waitDrained(ctx, func(status manager.DrainStatus) error {
+		if status.InFlight > 0 {
+			logger.Info("waiting for requests in flight", "in_flight", status.InFlight, "timeout", timeout)
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Warn("tearing down with requests still in flight", "in_flight", m.DrainStatus().InFlight, "error", err)
+	}
+	if err := m.Shutdown(); err != nil {
+		logger.Error("failed to tear down every container", "error", err)
+	}
+}
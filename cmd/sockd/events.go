@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"parkerdgabel/sockd/internal/manager"
+	"parkerdgabel/sockd/pkg/container"
+	"parkerdgabel/sockd/pkg/message"
+	"time"
+)
+
+func eventFilter(filters map[string][]string) (manager.EventFilter, error) {
+	var filter manager.EventFilter
+	for key, values := range filters {
+		switch key {
+		case "type":
+			for _, v := range values {
+				t, err := container.ParseEventType(v)
+				if err != nil {
+					return filter, message.NewError(message.ErrCodeBadRequest, "%v", err)
+				}
+				filter.Types = append(filter.Types, t)
+			}
+		case "container":
+			filter.Containers = append(filter.Containers, values...)
+		case "parent":
+			filter.Parents = append(filter.Parents, values...)
+		default:
+			return filter, message.NewError(message.ErrCodeBadRequest, "unknown event filter: %s", key)
+		}
+	}
+	return filter, nil
+}
+
+func events(events []manager.Event) []message.Event {
+	res := make([]message.Event, 0, len(events))
+	for _, e := range events {
+		res = append(res, message.Event{
+			Seq:         e.Seq,
+			Time:        e.Time,
+			Type:        e.Type.String(),
+			Tenant:      e.Tenant,
+			ContainerId: e.ContainerID,
+			ParentId:    e.ParentID,
+			Cgroup:      e.Cgroup,
+		})
+	}
+	return res
+}
+
+// sendEvents streams the events of a tenant matching a subscription
+// until ctx is cancelled. Errors are only returned when the connection is
+// no longer usable.
+func sendEvents(ctx context.Context, conn *connection, id, tenant string, payload message.PayloadEvents) error {
+	filter, err := eventFilter(payload.Filters)
+	if err != nil {
+		return conn.reply(id, errorResponse(err))
+	}
+	replay, sub, err := m.SubscribeEvents(tenant, filter, payload.Since)
+	if err != nil {
+		return conn.reply(id, errorResponse(err))
+	}
+	defer sub.Close()
+
+	response := message.Response{
+		Success: true,
+		Message: fmt.Sprintf("Subscribed to events, replaying %d", len(replay)),
+		Payload: message.EventsResponse{
+			Events: events(replay),
+		},
+	}
+	if err := conn.reply(id, response); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(streamKeepAlive)
+	defer ticker.Stop()
+	for {
+		batch := message.EventsResponse{}
+		select {
+		case e, ok := <-sub.C:
+			if !ok {
+				batch.Done = true
+				batch.Error = sub.Err().Error()
+				break
+			}
+			batch.Events = events([]manager.Event{e})
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+		response := message.Response{
+			Success: true,
+			Payload: batch,
+		}
+		if err := conn.reply(id, response); err != nil {
+			return err
+		}
+		if batch.Done {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"parkerdgabel/sockd/internal/auth"
+	"parkerdgabel/sockd/internal/config"
+	"parkerdgabel/sockd/internal/function"
+	"parkerdgabel/sockd/internal/manager"
+	"parkerdgabel/sockd/internal/metrics"
+	"parkerdgabel/sockd/internal/tracing"
+	"parkerdgabel/sockd/pkg/container"
+	"parkerdgabel/sockd/pkg/message"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+const runPrefix = "/run/"
+
+// gatewaySecurity secures the requests to the gateway. Its TLS
+// certificates and tokens change on reload, but whether the gateway
+// serves TLS at all is decided when it starts.
+var gatewaySecurity atomic.Pointer[security]
+
+// newGateway returns the HTTP front end that maps POST /run/<function>
+// to a leaf container of that function. The function may be qualified
+// with an alias or version, as in /run/resize:prod. It is a function of
+// the tenant the caller is bound to; callers that may invoke functions
+// in several tenants, or in all of them, name the tenant in the path,
+// as in /run/team-a/resize, or get the default one.
+func newGateway() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(runPrefix, handleRun)
+	return mux
+}
+
+// configureGateway secures the gateway as cfg says from now on
+func configureGateway(cfg config.Config) error {
+	sec, err := loadGatewaySecurity(cfg)
+	if err != nil {
+		return err
+	}
+	gatewaySecurity.Store(sec)
+	return nil
+}
+
+// loadGatewaySecurity loads how cfg secures the gateway. Callers of the
+// gateway are authenticated like those of the TCP listener, with a
+// bearer token or a TLS client certificate, so cfg must provide one of
+// them.
+func loadGatewaySecurity(cfg config.Config) (*security, error) {
+	sec, err := loadSecurity(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if sec.tokens == nil && cfg.TLS.ClientCAFile == "" {
+		return nil, errors.New("the HTTP gateway needs auth.token_file or tls.client_ca_file to authenticate callers")
+	}
+	if previous := gatewaySecurity.Load(); previous != nil && (previous.tls == nil) != (sec.tls == nil) {
+		return nil, errors.New("turning TLS on or off for the HTTP gateway requires a restart")
+	}
+	return sec, nil
+}
+
+func startGateway(cfg config.Config) (net.Listener, error) {
+	if err := configureGateway(cfg); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", cfg.HTTP)
+	if err != nil {
+		return nil, err
+	}
+	if gatewaySecurity.Load().tls != nil {
+		listener = tls.NewListener(listener, &tls.Config{
+			GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+				return gatewaySecurity.Load().tls, nil
+			},
+		})
+	}
+	go func() {
+		if err := http.Serve(listener, newGateway()); err != nil {
+			logger.Info("HTTP gateway stopped", "error", err)
+		}
+	}()
+	return listener, nil
+}
+
+// gatewayPrincipal authenticates the caller of the gateway by its TLS
+// client certificate and its bearer token, if the gateway takes tokens
+func gatewayPrincipal(r *http.Request) (auth.Principal, error) {
+	var principal auth.Principal
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		principal.Identity = r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	if tokens := gatewaySecurity.Load().tokens; tokens != nil {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		name, valid := tokens.Authenticate(token)
+		if !ok || !valid {
+			return principal, errors.New("missing or invalid token")
+		}
+		principal.Token = name
+	}
+	if principal.Identity == "" && principal.Token == "" {
+		return principal, errors.New("missing credentials")
+	}
+	return principal, nil
+}
+
+// gatewayTenant returns the tenant whose function principal runs. A
+// principal bound to a single tenant always runs the functions of that
+// tenant, whatever the path says; the others run those of the tenant in
+// the path, if they may.
+func gatewayTenant(principal auth.Principal, requested string) string {
+	tenants, all := policy.Load().Tenants(principal, message.CommandInvoke)
+	switch {
+	case !all && len(tenants) == 1:
+		return tenants[0]
+	case requested == "":
+		return manager.DefaultTenant
+	default:
+		return requested
+	}
+}
+
+func handleRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var tenant, name string
+	switch parts := strings.Split(strings.TrimPrefix(r.URL.Path, runPrefix), "/"); len(parts) {
+	case 1:
+		name = parts[0]
+	case 2:
+		if parts[0] != "" {
+			tenant, name = parts[0], parts[1]
+		}
+	}
+	if name == "" {
+		http.Error(w, "invalid function name", http.StatusNotFound)
+		return
+	}
+	principal, err := gatewayPrincipal(r)
+	if err != nil {
+		logger.Warn("rejected gateway request", "remote", r.RemoteAddr, "error", err)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	tenant = gatewayTenant(principal, tenant)
+	if !policy.Load().Allowed(principal, tenant, message.CommandInvoke) {
+		logger.Warn("denied gateway request", "tenant", tenant, "function", name, "principal", principal.String())
+		http.Error(w, fmt.Sprintf("%s may not invoke functions in tenant %s", principal, tenant), http.StatusForbidden)
+		return
+	}
+
+	// continue the trace of the caller, if any, and pass it on to the
+	// function
+	ctx := tracing.Propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracing.Start(ctx, "gateway.run", attribute.String("sockd.tenant", tenant), attribute.String("sockd.function", name))
+	defer span.End()
+	r = r.WithContext(ctx)
+
+	start := time.Now()
+	lease, err := m.AcquireContainer(ctx, tenant, name)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		logger.Error("failed to get container for function", "tenant", tenant, "function", name, "error", err)
+		status := http.StatusServiceUnavailable
+		if errors.Is(err, function.ErrFunctionNotFound) || errors.Is(err, function.ErrVersionNotFound) || errors.Is(err, manager.ErrTenantNotFound) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	defer m.ReleaseContainer(lease)
+	c := lease.Container
+	span.SetAttributes(
+		attribute.String("sockd.container.id", c.ID()),
+		attribute.String("sockd.function.version", lease.Version),
+		attribute.Bool("sockd.function.cold", lease.Cold),
+	)
+
+	kills := c.OOMKills()
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			// Host name is irrelevant as it is a local socket connection
+			req.URL.Scheme = "http"
+			req.URL.Host = "lambda"
+			req.Host = "lambda"
+			tracing.Propagator.Inject(req.Context(), propagation.HeaderCarrier(req.Header))
+		},
+		Transport:     c.Client().Transport,
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			if kills >= 0 && c.OOMKills() > kills {
+				err = fmt.Errorf("%w: %v", container.ErrOOMKilled, err)
+			}
+			logger.Error("failed to forward request to container", "function", lease.Function, "container_id", c.ID(), "error", err)
+			span.SetStatus(codes.Error, err.Error())
+			http.Error(w, err.Error(), http.StatusBadGateway)
+		},
+	}
+	proxy.ServeHTTP(w, r)
+	metrics.InvocationDuration.WithLabelValues(lease.Tenant, lease.Function).Observe(metrics.Since(start))
+	logger.Info("ran function", "tenant", lease.Tenant, "function", lease.Function, "version", lease.Version, "container_id", c.ID(), "cold", lease.Cold, "duration", time.Since(start))
+}
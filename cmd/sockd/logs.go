@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"parkerdgabel/sockd/internal/manager"
+	"parkerdgabel/sockd/pkg/container"
+	"parkerdgabel/sockd/pkg/message"
+	"time"
+)
+
+func logEntries(entries []container.LogEntry) []message.LogEntry {
+	res := make([]message.LogEntry, 0, len(entries))
+	for _, e := range entries {
+		res = append(res, message.LogEntry{Time: e.Time, Stream: e.Stream, Line: e.Line})
+	}
+	return res
+}
+
+// sendLogs answers a logs request, following the logs until ctx is
+// cancelled if asked to. Errors are only returned when the connection is
+// no longer usable.
+func sendLogs(ctx context.Context, conn *connection, id, tenant string, payload message.PayloadLogs) error {
+	c, ok := m.GetContainer(tenant, payload.Id)
+	if !ok {
+		return conn.reply(id, errorResponse(fmt.Errorf("%w: %s", manager.ErrContainerNotFound, payload.Id)))
+	}
+
+	// start following before reading the file so no line is missed
+	var follow <-chan container.LogEntry
+	if payload.Follow {
+		var cancel func()
+		follow, cancel = c.FollowLogs()
+		defer cancel()
+	}
+
+	entries, err := c.Logs(payload.Since, payload.Tail)
+	if err != nil {
+		return conn.reply(id, errorResponse(err))
+	}
+	response := message.Response{
+		Success: true,
+		Message: fmt.Sprintf("Got %d log lines for container: %s", len(entries), payload.Id),
+		Payload: message.LogsResponse{
+			Id:      payload.Id,
+			Entries: logEntries(entries),
+			Done:    !payload.Follow,
+		},
+	}
+	if err := conn.reply(id, response); err != nil {
+		return err
+	}
+	if !payload.Follow {
+		return nil
+	}
+
+	var last time.Time
+	if len(entries) > 0 {
+		last = entries[len(entries)-1].Time
+	}
+	ticker := time.NewTicker(streamKeepAlive)
+	defer ticker.Stop()
+	for {
+		logs := message.LogsResponse{Id: payload.Id}
+		select {
+		case entry, ok := <-follow:
+			if !ok {
+				logs.Done = true
+				break
+			}
+			// already sent with the contents of the file
+			if !entry.Time.After(last) {
+				continue
+			}
+			logs.Entries = logEntries([]container.LogEntry{entry})
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+		response := message.Response{
+			Success: true,
+			Payload: logs,
+		}
+		if err := conn.reply(id, response); err != nil {
+			return err
+		}
+		if logs.Done {
+			return nil
+		}
+	}
+}
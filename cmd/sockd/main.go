@@ -1,28 +1,38 @@
 package main
 
 import (
-	"encoding/gob"
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"os"
 	"os/signal"
+	"parkerdgabel/sockd/internal/config"
+	"parkerdgabel/sockd/internal/function"
+	"parkerdgabel/sockd/internal/logging"
 	"parkerdgabel/sockd/internal/manager"
+	"parkerdgabel/sockd/internal/tracing"
 	"parkerdgabel/sockd/pkg/container"
 	"parkerdgabel/sockd/pkg/message"
+	"parkerdgabel/sockd/pkg/zygote"
+	"sort"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
 var sigChan = make(chan os.Signal, 1)
-var m *manager.Manager = manager.NewManager()
+var hupChan = make(chan os.Signal, 1)
+var logger = logging.For(logging.Daemon)
 
-const socketPath = "/var/run/sockd.sock"
+// m is created once logging is set up, as it logs while starting
+var m *manager.Manager
 
 var cfgFile string
-var tcpAddr string
 
 var rootCmd = &cobra.Command{
 	Use:   "sockd",
@@ -34,8 +44,39 @@ var rootCmd = &cobra.Command{
 
 func init() {
 	cobra.OnInitialize(initConfig)
-	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.sockd.yaml)")
-	rootCmd.PersistentFlags().StringVar(&tcpAddr, "tcp", "", "TCP address to listen on (e.g., :8080)")
+	flags := rootCmd.PersistentFlags()
+	flags.StringVar(&cfgFile, "config", "", "config file (default is $HOME/.sockd.yaml)")
+	flags.String("socket", config.DefaultSocket, "Unix socket to listen on")
+	flags.String("tcp", "", "TCP address to listen on (e.g., :8080)")
+	flags.Bool("tcp-insecure", false, "serve the TCP address without TLS or tokens")
+	flags.String("tls-cert", "", "PEM certificate to serve the TCP address over TLS with")
+	flags.String("tls-key", "", "PEM key of the TLS certificate")
+	flags.String("tls-client-ca", "", "PEM CAs that must have signed the certificates of TCP clients")
+	flags.String("token-file", "", "file of the tokens TCP clients may authenticate with, one per line")
+	flags.String("http", "", "HTTP address for the function gateway (e.g., :8080)")
+	flags.String("metrics", "", "HTTP address for the Prometheus /metrics endpoint (e.g., :9090)")
+	flags.String("trace-endpoint", "", "OTLP/HTTP collector to export traces to (e.g., localhost:4318)")
+	flags.Bool("trace-insecure", false, "export traces to the collector over plain HTTP")
+	flags.String("trace-file", "", "file to append traces to as JSON")
+	// flags override the config file and environment
+	for key, flag := range map[string]string{
+		"socket":              "socket",
+		"tcp":                 "tcp",
+		"tcp_insecure":        "tcp-insecure",
+		"tls.cert_file":       "tls-cert",
+		"tls.key_file":        "tls-key",
+		"tls.client_ca_file":  "tls-client-ca",
+		"auth.token_file":     "token-file",
+		"http":                "http",
+		"metrics":             "metrics",
+		"trace.otlp_endpoint": "trace-endpoint",
+		"trace.otlp_insecure": "trace-insecure",
+		"trace.file":          "trace-file",
+	} {
+		cobra.CheckErr(viper.BindPFlag(key, flags.Lookup(flag)))
+	}
+
+	rootCmd.AddCommand(newConfigCmd())
 }
 
 func initConfig() {
@@ -49,340 +90,551 @@ func initConfig() {
 		viper.SetConfigName(".sockd")
 	}
 
-	viper.AutomaticEnv()
+	config.SetDefaults(viper.GetViper())
+	cobra.CheckErr(readConfig())
+}
 
-	if err := viper.ReadInConfig(); err == nil {
-		fmt.Println("Using config file:", viper.ConfigFileUsed())
-	}
+// fatal logs why the daemon cannot start and exits
+func fatal(msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
 }
 
 func startDaemon() {
-	listeners := []net.Listener{}
+	cfg, err := config.Load(viper.GetViper())
+	if err != nil {
+		fatal("failed to load config", "error", err)
+	}
+	if err := logging.Configure(os.Stderr, cfg.Log); err != nil {
+		fatal("failed to configure logging", "error", err)
+	}
+	// libraries that use the log package go through it too
+	slog.SetDefault(logger)
+	if file := viper.ConfigFileUsed(); file != "" {
+		logger.Info("using config file", "path", file)
+	}
+
+	m, err = manager.NewManager(cfg.Manager)
+	if err != nil {
+		fatal("failed to create manager", "error", err)
+	}
+
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Trace)
+	if err != nil {
+		fatal("failed to set up tracing", "error", err)
+	}
+	if err := configurePolicy(cfg); err != nil {
+		fatal("failed to load auth policy", "error", err)
+	}
+	socketPath := cfg.Socket
 
 	// Listen on Unix socket
 	unixListener, err := net.Listen("unix", socketPath)
 	if err != nil {
-		log.Fatalf("Failed to listen on %s: %v", socketPath, err)
+		fatal("failed to listen on Unix socket", "path", socketPath, "error", err)
+	}
+	if mode, _ := cfg.FileMode(); mode != 0 {
+		if err := os.Chmod(socketPath, mode); err != nil {
+			fatal("failed to set the mode of the Unix socket", "path", socketPath, "error", err)
+		}
+	}
+	go serve(unixListener, nil)
+	logger.Info("listening on Unix socket", "path", socketPath)
+
+	// Listen on TCP address if provided; it may change on reload
+	reloadMutex.Lock()
+	running = cfg
+	if err := configureTCP(cfg); err != nil {
+		fatal("failed to serve on TCP address", "addr", cfg.TCP, "error", err)
 	}
-	listeners = append(listeners, unixListener)
-	fmt.Printf("Listening on Unix socket %s\n", socketPath)
+	reloadMutex.Unlock()
 
-	// Listen on TCP address if provided
-	if tcpAddr != "" {
-		tcpListener, err := net.Listen("tcp", tcpAddr)
+	// Serve the HTTP function gateway if requested
+	var httpListener net.Listener
+	if cfg.HTTP != "" {
+		httpListener, err = startGateway(cfg)
 		if err != nil {
-			log.Fatalf("Failed to listen on TCP address %s: %v", tcpAddr, err)
+			fatal("failed to listen on HTTP address", "addr", cfg.HTTP, "error", err)
 		}
-		listeners = append(listeners, tcpListener)
-		fmt.Printf("Listening on TCP address %s\n", tcpAddr)
+		logger.Info("serving function gateway", "addr", cfg.HTTP)
+	}
+
+	// Serve metrics if requested
+	var metricsListener net.Listener
+	if cfg.Metrics != "" {
+		metricsListener, err = startMetrics(cfg.Metrics)
+		if err != nil {
+			fatal("failed to listen on metrics address", "addr", cfg.Metrics, "error", err)
+		}
+		logger.Info("serving metrics", "addr", cfg.Metrics, "path", "/metrics")
 	}
 
 	// Channel to listen for interrupt signals
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(hupChan, syscall.SIGHUP)
+
+	// Goroutine to reload the config on SIGHUP
+	go func() {
+		for range hupChan {
+			logger.Info("received SIGHUP, reloading config")
+			if _, err := reload(); err != nil {
+				logger.Error("failed to reload config", "error", err)
+			}
+		}
+	}()
 
 	// Goroutine to handle shutdown
 	go func() {
 		<-sigChan
-		log.Println("Received shutdown signal, closing listeners")
+		logger.Info("received shutdown signal, draining and closing listeners")
+		m.Drain()
 
 		// Close all listeners
-		for _, listener := range listeners {
-			if err := listener.Close(); err != nil {
-				log.Printf("Failed to close listener: %v", err)
+		if err := unixListener.Close(); err != nil {
+			logger.Warn("failed to close Unix listener", "error", err)
+		}
+		reloadMutex.Lock()
+		// moving to no address closes the TCP listener
+		(&tcpChange{}).commit()
+		reloadMutex.Unlock()
+		if httpListener != nil {
+			if err := httpListener.Close(); err != nil {
+				logger.Warn("failed to close HTTP listener", "error", err)
 			}
 		}
-
-		// Close the manager and destroy the cgroup pool
-		if err := m.Shutdown(); err != nil {
-			log.Printf("Failed to close manager: %v", err)
+		if metricsListener != nil {
+			if err := metricsListener.Close(); err != nil {
+				logger.Warn("failed to close metrics listener", "error", err)
+			}
 		}
 
+		// Let the requests in flight finish, then destroy the
+		// containers and cgroup pools
+		reloadMutex.Lock()
+		timeout := running.DrainTimeout
+		reloadMutex.Unlock()
+		shutdown(timeout)
+
 		// Delete the Unix socket file
 		if err := os.Remove(socketPath); err != nil {
-			log.Printf("Failed to remove Unix socket file: %v", err)
+			logger.Warn("failed to remove Unix socket file", "path", socketPath, "error", err)
 		}
 
+		// Export the spans still buffered
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := shutdownTracing(ctx); err != nil {
+			logger.Warn("failed to flush traces", "error", err)
+		}
+		cancel()
+
 		os.Exit(0)
 	}()
 
-	for _, listener := range listeners {
-		go func(l net.Listener) {
-			for {
-				conn, err := l.Accept()
-				if err != nil {
-					log.Printf("Failed to accept connection: %v", err)
-					continue
-				}
-				go handleConnection(conn)
-			}
-		}(listener)
-	}
-
 	// Block forever
 	select {}
 }
 
-func handleConnection(conn net.Conn) {
-	defer conn.Close()
-	// Handle the connection
-	// Create a new decoder and encoder
-	decoder := gob.NewDecoder(conn)
-	encoder := gob.NewEncoder(conn)
-
+// serve accepts connections to the control API until l is closed. They
+// are secured as sec says when they are accepted; a nil sec leaves them
+// as they are.
+func serve(l net.Listener, sec *atomic.Pointer[security]) {
 	for {
-		var msg message.Request
-		// Decode the incoming message
-		if err := decoder.Decode(&msg); err != nil {
-			log.Printf("Failed to decode message: %v", err)
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
 			return
 		}
+		if err != nil {
+			logger.Warn("failed to accept connection", "error", err)
+			continue
+		}
+		var s *security
+		if sec != nil {
+			s = sec.Load()
+		}
+		go handleConnection(conn, s)
+	}
+}
 
-		// Process the message (this is just an example)
-		log.Printf("Received command: %s, payload: %s", msg.Command, msg.Payload)
-		switch msg.Command {
-		case message.CommandCreate:
-			payload, ok := msg.Payload.(message.PayloadCreate)
-			if !ok {
-				log.Printf("Invalid payload type: %T", msg.Payload)
-				return
-			}
-			log.Printf("Creating container: %s", payload.Name)
-			c, err := createContainer(payload)
-			if err != nil {
-				log.Printf("Failed to create container: %v", err)
-				response := message.Response{
-					Success: false,
-					Message: err.Error(),
-				}
-				if err := encoder.Encode(&response); err != nil {
-					log.Printf("Failed to encode response: %v", err)
-					return
-				}
-			}
-			response := message.Response{
-				Success: true,
-				Message: fmt.Sprintf("Created container: %s", c.ID()),
-				Payload: message.CreateResponse{
-					Id: c.ID(),
-				},
-			}
-			if err := encoder.Encode(&response); err != nil {
-				log.Printf("Failed to encode response: %v", err)
-				return
-			}
-		case message.CommandDelete:
-			payload, ok := msg.Payload.(message.PayloadDelete)
-			if !ok {
-				log.Printf("Invalid payload type: %T", msg.Payload)
-				return
-			}
-			log.Printf("Deleting container: %s", payload.Id)
-			if err := m.DestroyContainer(payload.Id); err != nil {
-				log.Printf("Failed to delete container: %v", err)
-				response := message.Response{
-					Success: false,
-					Message: err.Error(),
-				}
-				if err := encoder.Encode(&response); err != nil {
-					log.Printf("Failed to encode response: %v", err)
-					return
-				}
-			}
-			response := message.Response{
-				Success: true,
-				Message: fmt.Sprintf("Deleted container: %s", payload.Id),
-			}
-			if err := encoder.Encode(&response); err != nil {
-				log.Printf("Failed to encode response: %v", err)
-				return
-			}
-		case message.CommandStart:
-			payload, ok := msg.Payload.(message.PayloadStart)
-			if !ok {
-				log.Printf("Invalid payload type: %T", msg.Payload)
-				return
-			}
-			log.Printf("Starting container: %s", payload.Id)
-			if err := startContainer(payload); err != nil {
-				log.Printf("Failed to start container: %v", err)
-				response := message.Response{
-					Success: false,
-					Message: err.Error(),
-				}
-				if err := encoder.Encode(&response); err != nil {
-					log.Printf("Failed to encode response: %v", err)
-					return
-				}
-			}
-			response := message.Response{
-				Success: true,
-				Message: fmt.Sprintf("Started container: %s", payload.Id),
-			}
-			if err := encoder.Encode(&response); err != nil {
-				log.Printf("Failed to encode response: %v", err)
-				return
-			}
-		case message.CommandStop:
-			payload, ok := msg.Payload.(message.PayloadStop)
-			if !ok {
-				log.Printf("Invalid payload type: %T", msg.Payload)
-				return
-			}
-			log.Printf("Stopping container: %s", payload.Id)
-			if err := m.StopContainer(payload.Id); err != nil {
-				log.Printf("Failed to stop container: %v", err)
-				response := message.Response{
-					Success: false,
-					Message: err.Error(),
-				}
-				if err := encoder.Encode(&response); err != nil {
-					log.Printf("Failed to encode response: %v", err)
-					return
-				}
-			}
-			response := message.Response{
-				Success: true,
-				Message: fmt.Sprintf("Stopped container: %s", payload.Id),
-			}
-			if err := encoder.Encode(&response); err != nil {
-				log.Printf("Failed to encode response: %v", err)
-				return
-			}
-		case message.CommandList:
-			log.Printf("Listing containers")
-			ids := m.ListContainers()
-			response := message.Response{
-				Success: true,
-				Message: fmt.Sprintf("Listed %d containers", len(ids)),
-				Payload: message.ListResponse{
-					Ids: ids,
-				},
-			}
-			log.Printf("Listed %d containers", len(ids))
-			if err := encoder.Encode(&response); err != nil {
-				log.Printf("Failed to encode response: %v", err)
-				return
-			}
-		case message.CommandInspect:
-			payload, ok := msg.Payload.(message.PayloadInspect)
-			if !ok {
-				log.Printf("Invalid payload type: %T", msg.Payload)
-				return
-			}
-			log.Printf("Inspecting container: %s", payload.Id)
-		case message.CommandLogs:
-			payload, ok := msg.Payload.(message.PayloadLogs)
-			if !ok {
-				log.Printf("Invalid payload type: %T", msg.Payload)
-				return
-			}
-			log.Printf("Getting logs for container: %s", payload.Id)
-		case message.CommandFork:
-			payload, ok := msg.Payload.(message.PayloadFork)
-			if !ok {
-				log.Printf("Invalid payload type: %T", msg.Payload)
-				return
-			}
-			log.Printf("Forking container: %s", payload.Id)
-			if err := m.ForkContainer(payload.Id); err != nil {
-				log.Printf("Failed to fork container: %v", err)
-				response := message.Response{
-					Success: false,
-					Message: err.Error(),
-				}
-				if err := encoder.Encode(&response); err != nil {
-					log.Printf("Failed to encode response: %v", err)
-					return
-				}
-			}
-			response := message.Response{
-				Success: true,
-				Message: fmt.Sprintf("Forked container: %s", payload.Id),
-			}
-			if err := encoder.Encode(&response); err != nil {
-				log.Printf("Failed to encode response: %v", err)
-				return
-			}
-		case message.CommandPause:
-			payload, ok := msg.Payload.(message.PayloadPause)
-			if !ok {
-				log.Printf("Invalid payload type: %T", msg.Payload)
-				return
-			}
-			log.Printf("Pausing container: %s", payload.Id)
-			if err := m.PauseContainer(payload.Id); err != nil {
-				log.Printf("Failed to pause container: %v", err)
-				response := message.Response{
-					Success: false,
-					Message: err.Error(),
-				}
-				if err := encoder.Encode(&response); err != nil {
-					log.Printf("Failed to encode response: %v", err)
-					return
-				}
-			}
-			response := message.Response{
-				Success: true,
-				Message: fmt.Sprintf("Paused container: %s", payload.Id),
-			}
-			if err := encoder.Encode(&response); err != nil {
-				log.Printf("Failed to encode response: %v", err)
-				return
-			}
-		case message.CommandUnpause:
-			payload, ok := msg.Payload.(message.PayloadUnpause)
-			if !ok {
-				log.Printf("Invalid payload type: %T", msg.Payload)
-				return
-			}
-			log.Printf("Unpausing container: %s", payload.Id)
-			if err := m.UnpauseContainer(payload.Id); err != nil {
-				log.Printf("Failed to unpause container: %v", err)
-				response := message.Response{
-					Success: false,
-					Message: err.Error(),
-				}
-				if err := encoder.Encode(&response); err != nil {
-					log.Printf("Failed to encode response: %v", err)
-					return
-				}
-			}
-			response := message.Response{
-				Success: true,
-				Message: fmt.Sprintf("Unpaused container: %s", payload.Id),
-			}
-			if err := encoder.Encode(&response); err != nil {
-				log.Printf("Failed to encode response: %v", err)
-				return
-			}
-		case message.CommandShutdown:
-			log.Println("Received shutdown command, closing connection")
-			sigChan <- syscall.SIGINT
-			return
-		case message.CommandCloseConnection:
-			log.Println("Received close connection command, closing connection")
-			return
-		default:
-			log.Printf("Unknown command: %s", msg.Command)
+func helloResponse(payload message.PayloadHello, version int) message.Response {
+	if version == 0 {
+		return errorResponse(message.NewError(message.ErrCodeUnsupportedVersion, "client speaks API versions %v, server speaks %v", payload.Versions, message.SupportedVersions))
+	}
+	logger.Debug("negotiated API version", "client", payload.Client, "version", version)
+	return message.Response{
+		Success: true,
+		Message: fmt.Sprintf("Using API version %d", version),
+		Payload: message.HelloResponse{
+			Version:  version,
+			Versions: message.SupportedVersions,
+		},
+	}
+}
+
+// errorCode maps the errors of the manager to protocol error codes
+func errorCode(err error) message.ErrorCode {
+	var protoErr *message.Error
+	switch {
+	case errors.As(err, &protoErr):
+		return protoErr.Code
+	case errors.Is(err, manager.ErrContainerNotFound),
+		errors.Is(err, manager.ErrTenantNotFound),
+		errors.Is(err, function.ErrFunctionNotFound),
+		errors.Is(err, function.ErrVersionNotFound),
+		errors.Is(err, function.ErrAliasNotFound):
+		return message.ErrCodeNotFound
+	case errors.Is(err, manager.ErrDraining),
+		errors.Is(err, zygote.ErrOutOfMemory):
+		return message.ErrCodeUnavailable
+	case errors.Is(err, zygote.ErrLimitExceedsPool),
+		errors.Is(err, container.ErrInvalidLimits):
+		return message.ErrCodeBadRequest
+	case errors.Is(err, container.ErrOOMKilled):
+		return message.ErrCodeOOMKilled
+	case errors.Is(err, container.ErrInvalidState),
+		errors.Is(err, function.ErrNoRollback):
+		return message.ErrCodeInvalidState
+	default:
+		return message.ErrCodeInternal
+	}
+}
+
+// tenantOf returns the tenant a request is for
+func tenantOf(msg message.Request) string {
+	if msg.Tenant == "" {
+		return manager.DefaultTenant
+	}
+	return msg.Tenant
+}
+
+func errorResponse(err error) message.Response {
+	var protoErr *message.Error
+	if !errors.As(err, &protoErr) {
+		protoErr = &message.Error{Code: errorCode(err), Message: err.Error()}
+	}
+	return message.Response{
+		Success: false,
+		Error:   protoErr,
+	}
+}
+
+// handleRequest runs a single command and returns its response.
+// Commands that can take long give up when ctx is cancelled.
+func handleRequest(ctx context.Context, msg message.Request) message.Response {
+	switch msg.Command {
+	case message.CommandCreate:
+		payload := msg.Payload.(message.PayloadCreate)
+		logger.Info("creating container", "name", payload.Name)
+		c, err := createContainer(ctx, msg.Tenant, payload)
+		if err != nil {
+			logger.Error("failed to create container", "name", payload.Name, "error", err)
+			return errorResponse(err)
+		}
+		return message.Response{
+			Success: true,
+			Message: fmt.Sprintf("Created container: %s", c.ID()),
+			Payload: message.CreateResponse{
+				Id: c.ID(),
+			},
+		}
+	case message.CommandDelete:
+		payload := msg.Payload.(message.PayloadDelete)
+		logger.Info("deleting container", "container_id", payload.Id)
+		if err := m.DestroyContainer(msg.Tenant, payload.Id); err != nil {
+			logger.Error("failed to delete container", "container_id", payload.Id, "error", err)
+			return errorResponse(err)
+		}
+		return message.Response{
+			Success: true,
+			Message: fmt.Sprintf("Deleted container: %s", payload.Id),
+		}
+	case message.CommandStart:
+		payload := msg.Payload.(message.PayloadStart)
+		logger.Info("starting container", "container_id", payload.Id)
+		if err := startContainer(msg.Tenant, payload); err != nil {
+			logger.Error("failed to start container", "container_id", payload.Id, "error", err)
+			return errorResponse(err)
+		}
+		return message.Response{
+			Success: true,
+			Message: fmt.Sprintf("Started container: %s", payload.Id),
+		}
+	case message.CommandStop:
+		payload := msg.Payload.(message.PayloadStop)
+		logger.Info("stopping container", "container_id", payload.Id)
+		if err := m.StopContainer(msg.Tenant, payload.Id); err != nil {
+			logger.Error("failed to stop container", "container_id", payload.Id, "error", err)
+			return errorResponse(err)
+		}
+		return message.Response{
+			Success: true,
+			Message: fmt.Sprintf("Stopped container: %s", payload.Id),
+		}
+	case message.CommandList:
+		logger.Debug("listing containers")
+		ids, err := m.ListContainers(msg.Tenant)
+		if err != nil {
+			return errorResponse(err)
+		}
+		logger.Debug("listed containers", "count", len(ids))
+		return message.Response{
+			Success: true,
+			Message: fmt.Sprintf("Listed %d containers", len(ids)),
+			Payload: message.ListResponse{
+				Ids: ids,
+			},
+		}
+	case message.CommandInspect:
+		payload := msg.Payload.(message.PayloadInspect)
+		logger.Debug("inspecting container", "container_id", payload.Id)
+		c, ok := m.GetContainer(msg.Tenant, payload.Id)
+		if !ok {
+			return errorResponse(fmt.Errorf("%w: %s", manager.ErrContainerNotFound, payload.Id))
+		}
+		return message.Response{
+			Success: true,
+			Message: fmt.Sprintf("Inspected container: %s", payload.Id),
+			Payload: inspectContainer(c),
+		}
+	case message.CommandFork:
+		payload := msg.Payload.(message.PayloadFork)
+		logger.Info("forking container", "container_id", payload.Id)
+		if err := m.ForkContainer(ctx, msg.Tenant, payload.Id); err != nil {
+			logger.Error("failed to fork container", "container_id", payload.Id, "error", err)
+			return errorResponse(err)
+		}
+		return message.Response{
+			Success: true,
+			Message: fmt.Sprintf("Forked container: %s", payload.Id),
+		}
+	case message.CommandPause:
+		payload := msg.Payload.(message.PayloadPause)
+		logger.Info("pausing container", "container_id", payload.Id)
+		if err := m.PauseContainer(msg.Tenant, payload.Id); err != nil {
+			logger.Error("failed to pause container", "container_id", payload.Id, "error", err)
+			return errorResponse(err)
+		}
+		return message.Response{
+			Success: true,
+			Message: fmt.Sprintf("Paused container: %s", payload.Id),
+		}
+	case message.CommandUnpause:
+		payload := msg.Payload.(message.PayloadUnpause)
+		logger.Info("unpausing container", "container_id", payload.Id)
+		if err := m.UnpauseContainer(msg.Tenant, payload.Id); err != nil {
+			logger.Error("failed to unpause container", "container_id", payload.Id, "error", err)
+			return errorResponse(err)
+		}
+		return message.Response{
+			Success: true,
+			Message: fmt.Sprintf("Unpaused container: %s", payload.Id),
+		}
+	case message.CommandInvoke:
+		payload := msg.Payload.(message.PayloadInvoke)
+		logger.Debug("invoking container", "container_id", payload.Id)
+		result, err := m.InvokeContainer(ctx, msg.Tenant, payload.Id, payload.Body, payload.ContentType)
+		if err != nil {
+			logger.Error("failed to invoke container", "container_id", payload.Id, "error", err)
+			return errorResponse(err)
+		}
+		return message.Response{
+			Success: true,
+			Message: fmt.Sprintf("Invoked container: %s", payload.Id),
+			Payload: message.InvokeResponse{
+				Id:         payload.Id,
+				StatusCode: result.StatusCode,
+				Body:       result.Body,
+				Duration:   result.Duration,
+			},
+		}
+	case message.CommandRegisterFunction:
+		payload := msg.Payload.(message.PayloadRegisterFunction)
+		logger.Info("registering function", "function", payload.Name)
+		fn, version, err := m.RegisterFunction(ctx, msg.Tenant, payload.Name, &payload.Meta)
+		if err != nil {
+			logger.Error("failed to register function", "function", payload.Name, "error", err)
+			return errorResponse(err)
+		}
+		return message.Response{
+			Success: true,
+			Message: fmt.Sprintf("Registered function: %s version %s", fn.Name, version.ID),
+			Payload: functionResponse(fn),
+		}
+	case message.CommandListFunctions:
+		logger.Debug("listing functions")
+		functions, err := m.ListFunctions(msg.Tenant)
+		if err != nil {
+			return errorResponse(err)
+		}
+		list := message.ListFunctionsResponse{
+			Functions: make([]message.FunctionResponse, 0, len(functions)),
+		}
+		for _, fn := range functions {
+			list.Functions = append(list.Functions, functionResponse(fn))
+		}
+		return message.Response{
+			Success: true,
+			Message: fmt.Sprintf("Listed %d functions", len(functions)),
+			Payload: list,
+		}
+	case message.CommandDescribeFunction:
+		payload := msg.Payload.(message.PayloadDescribeFunction)
+		logger.Debug("describing function", "function", payload.Name)
+		fn, ok := m.GetFunction(msg.Tenant, payload.Name)
+		if !ok {
+			return errorResponse(function.ErrFunctionNotFound)
+		}
+		return message.Response{
+			Success: true,
+			Message: fmt.Sprintf("Described function: %s", fn.Name),
+			Payload: functionResponse(fn),
+		}
+	case message.CommandDeleteFunction:
+		payload := msg.Payload.(message.PayloadDeleteFunction)
+		logger.Info("deleting function", "function", payload.Name)
+		if err := m.DeleteFunction(msg.Tenant, payload.Name); err != nil {
+			logger.Error("failed to delete function", "function", payload.Name, "error", err)
+			return errorResponse(err)
+		}
+		return message.Response{
+			Success: true,
+			Message: fmt.Sprintf("Deleted function: %s", payload.Name),
+		}
+	case message.CommandSetFunctionAlias:
+		payload := msg.Payload.(message.PayloadSetFunctionAlias)
+		logger.Info("setting function alias", "function", payload.Name, "alias", payload.Alias, "version", payload.Version)
+		fn, err := m.SetFunctionAlias(msg.Tenant, payload.Name, payload.Alias, payload.Version, payload.Canary, payload.CanaryWeight)
+		if err != nil {
+			logger.Error("failed to set function alias", "function", payload.Name, "alias", payload.Alias, "error", err)
+			return errorResponse(err)
+		}
+		return message.Response{
+			Success: true,
+			Message: fmt.Sprintf("Set alias %s of function %s", payload.Alias, payload.Name),
+			Payload: functionResponse(fn),
+		}
+	case message.CommandRollbackFunctionAlias:
+		payload := msg.Payload.(message.PayloadRollbackFunctionAlias)
+		logger.Info("rolling back function alias", "function", payload.Name, "alias", payload.Alias)
+		fn, err := m.RollbackFunctionAlias(msg.Tenant, payload.Name, payload.Alias)
+		if err != nil {
+			logger.Error("failed to roll back function alias", "function", payload.Name, "alias", payload.Alias, "error", err)
+			return errorResponse(err)
 		}
+		return message.Response{
+			Success: true,
+			Message: fmt.Sprintf("Rolled back alias %s of function %s", payload.Alias, payload.Name),
+			Payload: functionResponse(fn),
+		}
+	case message.CommandReload:
+		logger.Info("reloading config")
+		return reloadResponse()
+	case message.CommandResume:
+		logger.Info("resuming")
+		m.Resume()
+		return message.Response{
+			Success: true,
+			Message: "Resumed",
+		}
+	case message.CommandShutdown:
+		return message.Response{
+			Success: true,
+			Message: "Shutting down",
+		}
+	case message.CommandCloseConnection:
+		return message.Response{
+			Success: true,
+			Message: "Closing connection",
+		}
+	default:
+		logger.Warn("unknown command", "command", msg.Command)
+		return errorResponse(message.NewError(message.ErrCodeUnknownCommand, "unknown command: %s", msg.Command))
 	}
 }
 
-func createContainer(payload message.PayloadCreate) (*container.Container, error) {
-	c, err := m.CreateContainer(&payload.Meta, payload.Name)
+func createContainer(ctx context.Context, tenant string, payload message.PayloadCreate) (*container.Container, error) {
+	if payload.Function != "" {
+		return m.CreateFunctionContainer(ctx, tenant, payload.Function)
+	}
+	c, err := m.CreateContainer(ctx, tenant, &payload.Meta, payload.Name)
 	if err != nil {
 		return nil, err
 	}
 	return c, nil
 }
 
-func startContainer(payload message.PayloadStart) error {
-	if err := m.StartContainer(payload.Id); err != nil {
+func startContainer(tenant string, payload message.PayloadStart) error {
+	if err := m.StartContainer(tenant, payload.Id); err != nil {
 		return err
 	}
 	return nil
 }
 
+func inspectContainer(c *container.Container) message.InspectResponse {
+	res := message.InspectResponse{
+		Id:         c.ID(),
+		Tenant:     c.Meta().Tenant,
+		Status:     c.State().String(),
+		ChildIds:   c.ChildIDs(),
+		RootDir:    c.RootDir(),
+		CodeDir:    c.CodeDir(),
+		ScratchDir: c.ScratchDir(),
+		Meta:       *c.Meta(),
+		Created:    c.Created(),
+		Events:     make(map[string]time.Time),
+	}
+	if parent := c.Parent(); parent != nil {
+		res.ParentId = parent.ID()
+	}
+	for event, t := range c.Timestamps() {
+		res.Events[event.String()] = t
+	}
+	res.MemLimitMB, res.CPUPercent = c.Limits()
+	if cg := c.Cgroup(); cg != nil {
+		res.Cgroup = cg.Name()
+		// the cgroup is gone once the container is stopped
+		if usage, err := cg.MemUsageMB(); err == nil {
+			res.MemUsageMB = usage
+		}
+		if pids, err := cg.PIDs(); err == nil {
+			res.PIDs = pids
+		}
+	}
+	return res
+}
+
+func functionResponse(fn *function.Function) message.FunctionResponse {
+	res := message.FunctionResponse{
+		Name:       fn.Name,
+		Latest:     fn.Latest,
+		Versions:   make([]message.FunctionVersionResponse, 0, len(fn.Versions)),
+		Aliases:    make([]message.FunctionAliasResponse, 0, len(fn.Aliases)),
+		Registered: fn.Registered,
+	}
+	for _, v := range fn.Versions {
+		res.Versions = append(res.Versions, message.FunctionVersionResponse{
+			Id:      v.ID,
+			Meta:    v.Meta,
+			CodeDir: v.CodeDir,
+			Created: v.Created,
+		})
+	}
+	sort.Slice(res.Versions, func(i, j int) bool {
+		return res.Versions[i].Created.Before(res.Versions[j].Created)
+	})
+	for _, a := range fn.Aliases {
+		res.Aliases = append(res.Aliases, message.FunctionAliasResponse{
+			Name:         a.Name,
+			Version:      a.Version,
+			Canary:       a.Canary,
+			CanaryWeight: a.CanaryWeight,
+		})
+	}
+	sort.Slice(res.Aliases, func(i, j int) bool {
+		return res.Aliases[i].Name < res.Aliases[j].Name
+	})
+	return res
+}
+
 func main() {
 	cobra.CheckErr(rootCmd.Execute())
 }
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"parkerdgabel/sockd/internal/metrics"
+)
+
+// startMetrics serves the Prometheus metrics on /metrics
+func startMetrics(addr string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			logger.Info("metrics endpoint stopped", "error", err)
+		}
+	}()
+	return listener, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"parkerdgabel/sockd/internal/auth"
+	"parkerdgabel/sockd/internal/config"
+	"parkerdgabel/sockd/internal/logging"
+	"parkerdgabel/sockd/pkg/message"
+	"sync"
+	"sync/atomic"
+
+	"github.com/spf13/viper"
+)
+
+var (
+	// reloadMutex guards running and the TCP listener
+	reloadMutex sync.Mutex
+	// running is the config the daemon runs with. Keys that require a
+	// restart keep their value from startup.
+	running config.Config
+	// policy authorizes the commands of every connection
+	policy atomic.Pointer[auth.Policy]
+)
+
+// configurePolicy authorizes commands as cfg says from now on, on every
+// connection
+func configurePolicy(cfg config.Config) error {
+	p, err := loadPolicy(cfg)
+	if err != nil {
+		return err
+	}
+	policy.Store(p)
+	return nil
+}
+
+// loadPolicy returns the policy of cfg. It is nil if cfg binds no one.
+func loadPolicy(cfg config.Config) (*auth.Policy, error) {
+	p, err := auth.NewPolicy(cfg.Auth, uint32(os.Getuid()))
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		logger.Info("no auth bindings, every client may run every command")
+	}
+	return p, nil
+}
+
+// readConfig reads the config file, if there is one
+func readConfig() error {
+	err := viper.ReadInConfig()
+	// no config file is fine unless one was asked for
+	var notFound viper.ConfigFileNotFoundError
+	if err != nil && cfgFile == "" && errors.As(err, &notFound) {
+		return nil
+	}
+	return err
+}
+
+// reload re-reads the config and applies what it can without a restart:
+// log levels, the settings of the manager, and the TCP listener and
+// HTTP gateway, whose certificates and tokens are read again too. The
+// changes that need a restart are reported but left alone, so warm
+// Zygotes survive a reload. If any change fails, none is applied.
+func reload() (message.ReloadResponse, error) {
+	var res message.ReloadResponse
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	if err := readConfig(); err != nil {
+		return res, fmt.Errorf("failed to read config: %w", err)
+	}
+	cfg, err := config.Load(viper.GetViper())
+	if err != nil {
+		return res, err
+	}
+	for _, key := range config.Diff(running, cfg) {
+		if config.RequiresRestart(key) {
+			res.RestartRequired = append(res.RestartRequired, key)
+		} else {
+			res.Applied = append(res.Applied, key)
+		}
+	}
+
+	// everything that may fail is prepared before anything changes
+	p, err := loadPolicy(cfg)
+	if err != nil {
+		return res, err
+	}
+	var gateway *security
+	if running.HTTP != "" {
+		if gateway, err = loadGatewaySecurity(cfg); err != nil {
+			return res, err
+		}
+	}
+	tcp, err := prepareTCP(cfg)
+	if err != nil {
+		return res, err
+	}
+	// the manager applies all of its config or none of it
+	if err := m.Reconfigure(cfg.Manager); err != nil {
+		tcp.abort()
+		return res, err
+	}
+
+	tcp.commit()
+	policy.Store(p)
+	if gateway != nil {
+		gatewaySecurity.Store(gateway)
+	}
+	// config.Load checked the log levels, so this cannot fail
+	if err := logging.Configure(os.Stderr, cfg.Log); err != nil {
+		logger.Error("failed to configure logging", "error", err)
+	}
+
+	cfg.Socket = running.Socket
+	cfg.SocketMode = running.SocketMode
+	cfg.HTTP = running.HTTP
+	cfg.Metrics = running.Metrics
+	cfg.Trace = running.Trace
+	cfg.Manager.BaseDir = running.Manager.BaseDir
+	cfg.Manager.Cgroup.Parent = running.Manager.Cgroup.Parent
+	running = cfg
+
+	logger.Info("reloaded config", "applied", res.Applied)
+	if len(res.RestartRequired) > 0 {
+		logger.Warn("config changes take effect on restart", "keys", res.RestartRequired)
+	}
+	return res, nil
+}
+
+func reloadResponse() message.Response {
+	res, err := reload()
+	if err != nil {
+		logger.Error("failed to reload config", "error", err)
+		return errorResponse(err)
+	}
+	return message.Response{
+		Success: true,
+		Message: fmt.Sprintf("Reloaded config: %d changes applied, %d require a restart", len(res.Applied), len(res.RestartRequired)),
+		Payload: res,
+	}
+}
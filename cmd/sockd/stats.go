@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"parkerdgabel/sockd/pkg/message"
+	"time"
+)
+
+// the shortest interval stats are streamed at
+const minStatsInterval = 250 * time.Millisecond
+
+func statsResponse(tenant, id string) message.Response {
+	stats, err := m.Stats(tenant, id)
+	if err != nil {
+		return errorResponse(err)
+	}
+	res := message.StatsResponse{
+		Time:       time.Now(),
+		Containers: make([]message.ContainerStats, 0, len(stats)),
+	}
+	for _, s := range stats {
+		c := message.ContainerStats{
+			Id:     s.Container.ID(),
+			Status: s.Container.State().String(),
+			Zygote: s.Zygote,
+			Stats:  *s.Stats,
+		}
+		if parent := s.Container.Parent(); parent != nil {
+			c.ParentId = parent.ID()
+		}
+		if cg := s.Container.Cgroup(); cg != nil {
+			c.Cgroup = cg.Name()
+		}
+		res.Containers = append(res.Containers, c)
+	}
+	return message.Response{
+		Success: true,
+		Message: fmt.Sprintf("Got the stats of %d containers", len(res.Containers)),
+		Payload: res,
+	}
+}
+
+// sendStats answers a stats request, sending the stats again every
+// interval until ctx is cancelled if one is set. Errors are only
+// returned when the connection is no longer usable.
+func sendStats(ctx context.Context, conn *connection, id, tenant string, payload message.PayloadStats) error {
+	if payload.Interval > 0 && payload.Interval < minStatsInterval {
+		return conn.reply(id, errorResponse(message.NewError(message.ErrCodeBadRequest, "stats interval must be at least %v", minStatsInterval)))
+	}
+	response := statsResponse(tenant, payload.Id)
+	if err := conn.reply(id, response); err != nil {
+		return err
+	}
+	if payload.Interval <= 0 || !response.Success {
+		return nil
+	}
+
+	ticker := time.NewTicker(payload.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+		// a container that went away ends the stream with not_found
+		response := statsResponse(tenant, payload.Id)
+		if err := conn.reply(id, response); err != nil {
+			return err
+		}
+		if !response.Success {
+			return nil
+		}
+	}
+}
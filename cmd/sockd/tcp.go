@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"parkerdgabel/sockd/internal/auth"
+	"parkerdgabel/sockd/internal/config"
+	"sync/atomic"
+)
+
+// security is how the connections of a listener are secured
+type security struct {
+	// tls is nil for plain connections
+	tls *tls.Config
+	// tokens is nil when clients need none
+	tokens *auth.Tokens
+}
+
+var (
+	// tcpSecurity secures the connections accepted from now on
+	tcpSecurity atomic.Pointer[security]
+	// the TCP listener and its address, guarded by reloadMutex
+	tcpListener net.Listener
+	tcpAddr     string
+)
+
+func loadSecurity(cfg config.Config) (*security, error) {
+	tlsConfig, err := cfg.TLS.ServerConfig()
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := auth.LoadTokens(cfg.Auth.TokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tokens: %w", err)
+	}
+	return &security{tls: tlsConfig, tokens: tokens}, nil
+}
+
+// tcpChange is a move of the TCP listener prepared by prepareTCP. It
+// takes effect on commit, or is dropped on abort.
+type tcpChange struct {
+	addr string
+	// sec is nil when TCP is turned off
+	sec *security
+	// listener is nil when the address stays the same
+	listener net.Listener
+}
+
+// prepareTCP loads the security of the TCP listener of cfg and listens
+// on its address, if it is new, without serving it yet. The caller must
+// hold reloadMutex.
+func prepareTCP(cfg config.Config) (*tcpChange, error) {
+	change := &tcpChange{addr: cfg.TCP}
+	if cfg.TCP == "" {
+		return change, nil
+	}
+	sec, err := loadSecurity(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if sec.tls == nil && sec.tokens == nil && !cfg.TCPInsecure {
+		return nil, errors.New("serving the control API over TCP needs tls or auth.token_file, or tcp_insecure to let anyone who can reach it control sockd")
+	}
+	change.sec = sec
+	if cfg.TCP != tcpAddr {
+		if change.listener, err = net.Listen("tcp", cfg.TCP); err != nil {
+			return nil, fmt.Errorf("failed to listen on TCP address %s: %w", cfg.TCP, err)
+		}
+	}
+	return change, nil
+}
+
+// commit serves the control API on the new TCP address, if any, instead
+// of the current one. The caller must hold reloadMutex.
+func (c *tcpChange) commit() {
+	// connections must never be accepted before they can be secured
+	if c.sec != nil {
+		tcpSecurity.Store(c.sec)
+	}
+	if c.addr != tcpAddr {
+		if c.listener != nil {
+			go serve(c.listener, &tcpSecurity)
+			logger.Info("listening on TCP address", "addr", c.addr)
+		}
+		if tcpListener != nil {
+			logger.Info("closing TCP listener", "addr", tcpAddr)
+			if err := tcpListener.Close(); err != nil {
+				logger.Warn("failed to close TCP listener", "error", err)
+			}
+		}
+		tcpListener, tcpAddr = c.listener, c.addr
+	}
+	switch {
+	case c.sec == nil:
+	case c.sec.tls == nil && c.sec.tokens == nil:
+		logger.Warn("serving the control API over TCP without TLS or tokens, anyone who can reach it can control sockd", "addr", c.addr)
+	case c.sec.tls == nil:
+		logger.Warn("serving the control API over TCP without TLS, tokens are sent in plain text", "addr", c.addr)
+	}
+}
+
+// abort closes the listener of a change that is not committed
+func (c *tcpChange) abort() {
+	if c.listener != nil {
+		c.listener.Close()
+	}
+}
+
+// configureTCP serves the control API on the TCP address of cfg, secured
+// as cfg says, instead of the current address, if any. The caller must
+// hold reloadMutex.
+func configureTCP(cfg config.Config) error {
+	change, err := prepareTCP(cfg)
+	if err != nil {
+		return err
+	}
+	change.commit()
+	return nil
+}
@@ -0,0 +1,186 @@
+// Package auth secures the TCP listener of the control API: TLS,
+// optionally with client certificates, and bearer tokens sent in the
+// hello of each connection.
+package auth
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// TLSConfig is the tls section of the sockd config file
+type TLSConfig struct {
+	// CertFile and KeyFile are the PEM certificate and key of the
+	// server. TLS is off unless both are set.
+	CertFile string `mapstructure:"cert_file"`
+	KeyFile  string `mapstructure:"key_file"`
+	// ClientCAFile makes clients present a certificate signed by one of
+	// the PEM certificates it holds (mutual TLS)
+	ClientCAFile string `mapstructure:"client_ca_file"`
+}
+
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != ""
+}
+
+func (c TLSConfig) Validate() error {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return errors.New("tls cert_file and key_file must be set together")
+	}
+	if c.ClientCAFile != "" && !c.Enabled() {
+		return errors.New("tls client_ca_file needs cert_file and key_file")
+	}
+	return nil
+}
+
+// ServerConfig loads the certificates of c. It returns nil if TLS is off.
+func (c TLSConfig) ServerConfig() (*tls.Config, error) {
+	if !c.Enabled() {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if c.ClientCAFile != "" {
+		if config.ClientCAs, err = loadCertPool(c.ClientCAFile); err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// ClientConfig returns the TLS config of a client that trusts the CAs
+// in caFile (or the system roots if empty) and, if certFile is set,
+// presents that certificate
+func ClientConfig(caFile, certFile, keyFile, serverName string) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if caFile != "" {
+		var err error
+		if config.RootCAs, err = loadCertPool(caFile); err != nil {
+			return nil, err
+		}
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no PEM certificates in %s", path)
+	}
+	return pool, nil
+}
+
+// Config is the auth section of the sockd config file
+type Config struct {
+	// TokenFile holds the tokens TCP clients may authenticate with,
+	// one per line, each optionally preceded by a name and a space.
+	// Blank lines and lines starting with # are skipped.
+	TokenFile string `mapstructure:"token_file"`
+	// Roles adds roles to the built-in viewer, developer, operator and
+	// admin. Role names are lower case.
+	Roles map[string][]Permission `mapstructure:"roles"`
+	// Bindings grant roles to principals. Without any, everyone may run
+	// every command.
+	Bindings []Binding `mapstructure:"bindings"`
+}
+
+func (c Config) Validate() error {
+	for name, perms := range c.Roles {
+		for _, perm := range perms {
+			if !slices.Contains(permissions, perm) {
+				return fmt.Errorf("role %s: unknown permission %q", name, perm)
+			}
+		}
+	}
+	for i, b := range c.Bindings {
+		if _, ok := builtinRoles[b.Role]; !ok && c.Roles[b.Role] == nil {
+			return fmt.Errorf("binding %d: unknown role %q", i, b.Role)
+		}
+	}
+	return nil
+}
+
+// Tokens are the tokens accepted by the server, by name
+type Tokens struct {
+	names  []string
+	tokens [][]byte
+}
+
+// LoadTokens reads a token file. It returns nil if path is empty.
+func LoadTokens(path string) (*Tokens, error) {
+	if path == "" {
+		return nil, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	t := &Tokens{}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		name := fmt.Sprintf("token-%d", line)
+		fields := strings.Fields(text)
+		switch len(fields) {
+		case 1:
+		case 2:
+			name = fields[0]
+		default:
+			return nil, fmt.Errorf("%s:%d: want a token, or a name and a token", path, line)
+		}
+		t.names = append(t.names, name)
+		t.tokens = append(t.tokens, []byte(fields[len(fields)-1]))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(t.tokens) == 0 {
+		return nil, fmt.Errorf("no tokens in %s", path)
+	}
+	return t, nil
+}
+
+// Authenticate returns the name of token, or false if it is not one of
+// the tokens. It takes as long whichever token matches.
+func (t *Tokens) Authenticate(token string) (string, bool) {
+	name, found := "", 0
+	for i, want := range t.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), want) == 1 {
+			name, found = t.names[i], 1
+		}
+	}
+	return name, found == 1
+}
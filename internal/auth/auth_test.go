@@ -0,0 +1,51 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadTokens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens")
+	file := "# operators\nalice s3cret\n\nanonymous-token\n"
+	if err := os.WriteFile(path, []byte(file), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := LoadTokens(path)
+	if err != nil {
+		t.Fatalf("LoadTokens() error = %v", err)
+	}
+	for token, want := range map[string]string{"s3cret": "alice", "anonymous-token": "token-4"} {
+		if name, ok := tokens.Authenticate(token); !ok || name != want {
+			t.Errorf("Authenticate(%q) = %q, %v, want %q", token, name, ok, want)
+		}
+	}
+	for _, token := range []string{"", "alice", "s3cret "} {
+		if _, ok := tokens.Authenticate(token); ok {
+			t.Errorf("Authenticate(%q) succeeded", token)
+		}
+	}
+
+	if err := os.WriteFile(path, []byte("# nothing\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadTokens(path); err == nil {
+		t.Error("LoadTokens() accepted a file with no tokens")
+	}
+}
+
+func TestTLSConfigValidate(t *testing.T) {
+	for _, c := range []TLSConfig{
+		{CertFile: "cert.pem"},
+		{KeyFile: "key.pem"},
+		{ClientCAFile: "ca.pem"},
+	} {
+		if err := c.Validate(); err == nil {
+			t.Errorf("Validate(%+v) succeeded", c)
+		}
+	}
+	if err := (TLSConfig{CertFile: "cert.pem", KeyFile: "key.pem", ClientCAFile: "ca.pem"}).Validate(); err != nil {
+		t.Errorf("Validate() error = %v", err)
+	}
+}
@@ -0,0 +1,267 @@
+package auth
+
+import (
+	"fmt"
+	"net"
+	"os/user"
+	"parkerdgabel/sockd/pkg/message"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Permission is what a role allows
+type Permission string
+
+const (
+	// PermRead allows listing and inspecting, and reading logs and events
+	PermRead Permission = "read"
+	// PermInvoke allows invoking containers
+	PermInvoke Permission = "invoke"
+	// PermManage allows creating, changing and deleting containers and
+	// functions
+	PermManage Permission = "manage"
+	// PermAdmin allows shutting down and reloading the daemon
+	PermAdmin Permission = "admin"
+)
+
+var permissions = []Permission{PermRead, PermInvoke, PermManage, PermAdmin}
+
+// commandPermissions is the permission each command needs. Commands not
+// listed need PermAdmin.
+var commandPermissions = map[message.Command]Permission{
+	message.CommandList:                  PermRead,
+	message.CommandInspect:               PermRead,
+	message.CommandLogs:                  PermRead,
+	message.CommandEvents:                PermRead,
+	message.CommandStats:                 PermRead,
+	message.CommandListFunctions:         PermRead,
+	message.CommandDescribeFunction:      PermRead,
+	message.CommandInvoke:                PermInvoke,
+	message.CommandCreate:                PermManage,
+	message.CommandDelete:                PermManage,
+	message.CommandStart:                 PermManage,
+	message.CommandStop:                  PermManage,
+	message.CommandFork:                  PermManage,
+	message.CommandPause:                 PermManage,
+	message.CommandUnpause:               PermManage,
+	message.CommandRegisterFunction:      PermManage,
+	message.CommandDeleteFunction:        PermManage,
+	message.CommandSetFunctionAlias:      PermManage,
+	message.CommandRollbackFunctionAlias: PermManage,
+	message.CommandShutdown:              PermAdmin,
+	message.CommandReload:                PermAdmin,
+	message.CommandDrain:                 PermAdmin,
+	message.CommandResume:                PermAdmin,
+}
+
+// CommandPermission returns the permission needed to run cmd. Hello,
+// cancel and close_connection need none.
+func CommandPermission(cmd message.Command) (Permission, bool) {
+	switch cmd {
+	case message.CommandHello, message.CommandCancel, message.CommandCloseConnection:
+		return "", false
+	}
+	if perm, ok := commandPermissions[cmd]; ok {
+		return perm, true
+	}
+	return PermAdmin, true
+}
+
+// builtinRoles are the roles every policy has
+var builtinRoles = map[string][]Permission{
+	"viewer":    {PermRead},
+	"developer": {PermRead, PermInvoke},
+	"operator":  {PermRead, PermInvoke, PermManage},
+	"admin":     permissions,
+}
+
+// Binding grants a role to the principals it names
+type Binding struct {
+	Role string `mapstructure:"role"`
+	// Users and Groups are unix users and groups connecting on the unix
+	// socket, by name or by id
+	Users  []string `mapstructure:"users"`
+	Groups []string `mapstructure:"groups"`
+	// Identities are the common names of TLS client certificates
+	Identities []string `mapstructure:"identities"`
+	// Tokens are the names of tokens of the token file
+	Tokens []string `mapstructure:"tokens"`
+	// Tenants limits the role to requests for these tenants. Empty
+	// means every tenant. A limited binding never grants PermAdmin, as
+	// its commands are about the whole daemon.
+	Tenants []string `mapstructure:"tenants"`
+}
+
+// Principal is who is on the other end of a connection
+type Principal struct {
+	// Unix is set for peers on the unix socket, with their credentials
+	Unix   bool
+	UID    uint32
+	User   string
+	GIDs   []uint32
+	Groups []string
+	// Identity is the common name of the TLS client certificate
+	Identity string
+	// Token is the name of the token the client authenticated with
+	Token string
+}
+
+func (p Principal) String() string {
+	var parts []string
+	if p.Unix && p.User != "" {
+		parts = append(parts, fmt.Sprintf("uid=%d(%s)", p.UID, p.User))
+	} else if p.Unix {
+		parts = append(parts, fmt.Sprintf("uid=%d", p.UID))
+	}
+	if p.Identity != "" {
+		parts = append(parts, "identity="+p.Identity)
+	}
+	if p.Token != "" {
+		parts = append(parts, "token="+p.Token)
+	}
+	if len(parts) == 0 {
+		return "anonymous"
+	}
+	return strings.Join(parts, " ")
+}
+
+// PeerPrincipal returns the principal of the process on the other end of
+// a unix socket, from its SO_PEERCRED credentials. Its groups include the
+// supplementary groups of its user.
+func PeerPrincipal(conn *net.UnixConn) (Principal, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return Principal{}, err
+	}
+	var cred *unix.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	}); err != nil {
+		return Principal{}, err
+	}
+	if credErr != nil {
+		return Principal{}, fmt.Errorf("SO_PEERCRED: %w", credErr)
+	}
+
+	p := Principal{Unix: true, UID: cred.Uid, GIDs: []uint32{cred.Gid}}
+	// the names are best effort: the peer may have no passwd entry
+	if u, err := user.LookupId(strconv.Itoa(int(cred.Uid))); err == nil {
+		p.User = u.Username
+		if ids, err := u.GroupIds(); err == nil {
+			for _, id := range ids {
+				if gid, err := strconv.ParseUint(id, 10, 32); err == nil && !slices.Contains(p.GIDs, uint32(gid)) {
+					p.GIDs = append(p.GIDs, uint32(gid))
+				}
+			}
+		}
+	}
+	for _, gid := range p.GIDs {
+		if g, err := user.LookupGroupId(strconv.Itoa(int(gid))); err == nil {
+			p.Groups = append(p.Groups, g.Name)
+		}
+	}
+	return p, nil
+}
+
+// Policy decides which principals may run which commands
+type Policy struct {
+	roles    map[string][]Permission
+	bindings []Binding
+	// the uid of the daemon, which is always an admin, like root
+	self uint32
+}
+
+// NewPolicy returns the policy of cfg. Without bindings there is no
+// policy, and it returns nil: everyone may run every command.
+func NewPolicy(cfg Config, self uint32) (*Policy, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if len(cfg.Bindings) == 0 {
+		return nil, nil
+	}
+	p := &Policy{
+		roles:    make(map[string][]Permission),
+		bindings: cfg.Bindings,
+		self:     self,
+	}
+	for name, perms := range builtinRoles {
+		p.roles[name] = perms
+	}
+	for name, perms := range cfg.Roles {
+		p.roles[name] = perms
+	}
+	return p, nil
+}
+
+// Allowed reports whether principal may run cmd on the containers and
+// functions of tenant. A nil policy allows everything.
+func (p *Policy) Allowed(principal Principal, tenant string, cmd message.Command) bool {
+	perm, needed := CommandPermission(cmd)
+	if p == nil || !needed {
+		return true
+	}
+	if principal.Unix && (principal.UID == 0 || principal.UID == p.self) {
+		return true
+	}
+	for _, b := range p.bindings {
+		if len(b.Tenants) > 0 && (perm == PermAdmin || !slices.Contains(b.Tenants, tenant)) {
+			continue
+		}
+		if b.matches(principal) && slices.Contains(p.roles[b.Role], perm) {
+			return true
+		}
+	}
+	return false
+}
+
+// Tenants returns the tenants in which principal may run cmd, sorted.
+// It returns true instead if principal may run cmd in every tenant, as
+// everyone may with a nil policy.
+func (p *Policy) Tenants(principal Principal, cmd message.Command) ([]string, bool) {
+	perm, needed := CommandPermission(cmd)
+	if p == nil || !needed {
+		return nil, true
+	}
+	if principal.Unix && (principal.UID == 0 || principal.UID == p.self) {
+		return nil, true
+	}
+	var tenants []string
+	for _, b := range p.bindings {
+		if !b.matches(principal) || !slices.Contains(p.roles[b.Role], perm) {
+			continue
+		}
+		if len(b.Tenants) == 0 {
+			return nil, true
+		}
+		if perm != PermAdmin {
+			tenants = append(tenants, b.Tenants...)
+		}
+	}
+	slices.Sort(tenants)
+	return slices.Compact(tenants), false
+}
+
+func (b Binding) matches(p Principal) bool {
+	if p.Unix {
+		if (p.User != "" && slices.Contains(b.Users, p.User)) || slices.Contains(b.Users, strconv.Itoa(int(p.UID))) {
+			return true
+		}
+		for _, gid := range p.GIDs {
+			if slices.Contains(b.Groups, strconv.Itoa(int(gid))) {
+				return true
+			}
+		}
+		for _, group := range p.Groups {
+			if slices.Contains(b.Groups, group) {
+				return true
+			}
+		}
+	}
+	return (p.Identity != "" && slices.Contains(b.Identities, p.Identity)) ||
+		(p.Token != "" && slices.Contains(b.Tokens, p.Token))
+}
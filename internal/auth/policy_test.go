@@ -0,0 +1,135 @@
+package auth
+
+import (
+	"net"
+	"os"
+	"parkerdgabel/sockd/pkg/message"
+	"slices"
+	"testing"
+)
+
+func TestPolicyAllowed(t *testing.T) {
+	p, err := NewPolicy(Config{
+		Roles: map[string][]Permission{"deployer": {PermManage}},
+		Bindings: []Binding{
+			{Role: "developer", Groups: []string{"devs"}},
+			{Role: "deployer", Identities: []string{"ci"}},
+			{Role: "admin", Tokens: []string{"ops"}},
+			{Role: "admin", Tokens: []string{"team-a"}, Tenants: []string{"a"}},
+		},
+	}, 1000)
+	if err != nil {
+		t.Fatalf("NewPolicy() error = %v", err)
+	}
+
+	dev := Principal{Unix: true, UID: 1001, User: "dev", GIDs: []uint32{1001, 50}, Groups: []string{"dev", "devs"}}
+	ci := Principal{Identity: "ci"}
+	teamA := Principal{Token: "team-a"}
+	tests := []struct {
+		principal Principal
+		tenant    string
+		cmd       message.Command
+		want      bool
+	}{
+		{dev, "default", message.CommandList, true},
+		{dev, "a", message.CommandInvoke, true},
+		{dev, "default", message.CommandStop, false},
+		{dev, "default", message.CommandShutdown, false},
+		{dev, "default", message.CommandHello, true},
+		{ci, "default", message.CommandCreate, true},
+		{ci, "default", message.CommandList, false},
+		{Principal{Token: "ops"}, "default", message.CommandReload, true},
+		{teamA, "a", message.CommandDelete, true},
+		{teamA, "b", message.CommandList, false},
+		{teamA, "a", message.CommandReload, false},
+		{Principal{Unix: true, UID: 0}, "default", message.CommandShutdown, true},
+		{Principal{Unix: true, UID: 1000}, "default", message.CommandShutdown, true},
+		{Principal{}, "default", message.CommandList, false},
+		{dev, "default", "no_such_command", false},
+	}
+	for _, tt := range tests {
+		if got := p.Allowed(tt.principal, tt.tenant, tt.cmd); got != tt.want {
+			t.Errorf("Allowed(%v, %s, %s) = %v, want %v", tt.principal, tt.tenant, tt.cmd, got, tt.want)
+		}
+	}
+
+	var none *Policy
+	if !none.Allowed(Principal{}, "default", message.CommandShutdown) {
+		t.Error("a nil policy denied a command")
+	}
+}
+
+func TestPolicyTenants(t *testing.T) {
+	p, err := NewPolicy(Config{
+		Bindings: []Binding{
+			{Role: "developer", Tokens: []string{"dev"}},
+			{Role: "developer", Tokens: []string{"team-a", "team-ab"}, Tenants: []string{"a"}},
+			{Role: "operator", Tokens: []string{"team-ab"}, Tenants: []string{"b", "a"}},
+			{Role: "viewer", Tokens: []string{"audit"}, Tenants: []string{"c"}},
+		},
+	}, 1000)
+	if err != nil {
+		t.Fatalf("NewPolicy() error = %v", err)
+	}
+
+	tests := []struct {
+		principal Principal
+		tenants   []string
+		all       bool
+	}{
+		{Principal{Token: "dev"}, nil, true},
+		{Principal{Token: "team-a"}, []string{"a"}, false},
+		{Principal{Token: "team-ab"}, []string{"a", "b"}, false},
+		{Principal{Token: "audit"}, nil, false},
+		{Principal{Unix: true, UID: 0}, nil, true},
+	}
+	for _, tt := range tests {
+		tenants, all := p.Tenants(tt.principal, message.CommandInvoke)
+		if !slices.Equal(tenants, tt.tenants) || all != tt.all {
+			t.Errorf("Tenants(%v) = %v, %v, want %v, %v", tt.principal, tenants, all, tt.tenants, tt.all)
+		}
+	}
+
+	var none *Policy
+	if _, all := none.Tenants(Principal{}, message.CommandInvoke); !all {
+		t.Error("a nil policy limited the tenants")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	for _, c := range []Config{
+		{Bindings: []Binding{{Role: "root"}}},
+		{Roles: map[string][]Permission{"x": {"write"}}},
+	} {
+		if err := c.Validate(); err == nil {
+			t.Errorf("Validate(%+v) succeeded", c)
+		}
+	}
+}
+
+func TestPeerPrincipal(t *testing.T) {
+	path := t.TempDir() + "/sock"
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	p, err := PeerPrincipal(server.(*net.UnixConn))
+	if err != nil {
+		t.Fatalf("PeerPrincipal() error = %v", err)
+	}
+	if !p.Unix || p.UID != uint32(os.Getuid()) || p.GIDs[0] != uint32(os.Getgid()) {
+		t.Errorf("PeerPrincipal() = %+v, want uid %d gid %d", p, os.Getuid(), os.Getgid())
+	}
+}
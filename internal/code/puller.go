@@ -1,17 +1,24 @@
 package code
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
+	"parkerdgabel/sockd/internal/tracing"
 	"path/filepath"
 	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
-func PullCode(codeUrl string, outputDir string) error {
+func PullCode(ctx context.Context, codeUrl string, outputDir string) (err error) {
+	ctx, span := tracing.Start(ctx, "code.pull", attribute.String("sockd.code.url", codeUrl))
+	defer tracing.End(span, &err)
+
 	url, err := url.Parse(codeUrl)
 	if err != nil {
 		return fmt.Errorf("failed to parse url: %w", err)
@@ -19,7 +26,7 @@ func PullCode(codeUrl string, outputDir string) error {
 
 	switch url.Scheme {
 	case "http", "https":
-		req, err := http.NewRequest(http.MethodGet, codeUrl, nil)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, codeUrl, nil)
 		if err != nil {
 			return fmt.Errorf("failed to create request: %w", err)
 		}
@@ -39,6 +46,7 @@ func PullCode(codeUrl string, outputDir string) error {
 		if err != nil {
 			return fmt.Errorf("failed to create file: %w", err)
 		}
+		defer os.Remove(file.Name())
 		defer file.Close()
 
 		_, err = io.Copy(file, resp.Body)
@@ -47,7 +55,7 @@ func PullCode(codeUrl string, outputDir string) error {
 		}
 
 		// unpack the tarball
-		cmd := exec.Command("tar", "-xzf", file.Name(), "-C", outputDir)
+		cmd := exec.CommandContext(ctx, "tar", "-xzf", file.Name(), "-C", outputDir)
 		if err := cmd.Run(); err != nil {
 			return fmt.Errorf("failed to unpack tarball: %w", err)
 		}
@@ -64,7 +72,7 @@ func PullCode(codeUrl string, outputDir string) error {
 		// Check if the file is a tarball by its extension
 		if strings.HasSuffix(url.Path, ".tar.gz") || strings.HasSuffix(url.Path, ".tgz") {
 			// unpack the tarball
-			cmd := exec.Command("tar", "-xzf", url.Path, "-C", outputDir)
+			cmd := exec.CommandContext(ctx, "tar", "-xzf", url.Path, "-C", outputDir)
 			if err := cmd.Run(); err != nil {
 				return fmt.Errorf("failed to unpack tarball: %w", err)
 			}
@@ -91,21 +99,21 @@ func PullCode(codeUrl string, outputDir string) error {
 		return nil
 	case "git":
 		// Clone the git repository
-		cmd := exec.Command("git", "clone", codeUrl, outputDir)
+		cmd := exec.CommandContext(ctx, "git", "clone", codeUrl, outputDir)
 		if err := cmd.Run(); err != nil {
 			return fmt.Errorf("failed to clone git repository: %w", err)
 		}
 		return nil
 	case "s3":
 		// Download the file from S3
-		cmd := exec.Command("aws", "s3", "cp", codeUrl, outputDir)
+		cmd := exec.CommandContext(ctx, "aws", "s3", "cp", codeUrl, outputDir)
 		if err := cmd.Run(); err != nil {
 			return fmt.Errorf("failed to download file from S3: %w", err)
 		}
 		// Check if the file is a tarball by its extension
 		if strings.HasSuffix(url.Path, ".tar.gz") || strings.HasSuffix(url.Path, ".tgz") {
 			// unpack the tarball
-			cmd := exec.Command("tar", "-xzf", url.Path, "-C", outputDir)
+			cmd := exec.CommandContext(ctx, "tar", "-xzf", url.Path, "-C", outputDir)
 			if err := cmd.Run(); err != nil {
 				return fmt.Errorf("failed to unpack tarball: %w", err)
 			}
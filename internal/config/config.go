@@ -0,0 +1,204 @@
+// Package config is the configuration of the sockd daemon: its schema,
+// defaults and validation. Values come, by increasing precedence, from
+// the defaults, the config file, SOCKD_* environment variables and
+// flags, all through viper.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"parkerdgabel/sockd/internal/auth"
+	"parkerdgabel/sockd/internal/logging"
+	"parkerdgabel/sockd/internal/manager"
+	"parkerdgabel/sockd/internal/tracing"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix prefixes the environment variables that override the config
+// file. Keys are upper-cased with dots replaced by underscores, as in
+// SOCKD_ZYGOTE_MEM_POOL_MB.
+const EnvPrefix = "SOCKD"
+
+// DefaultSocket is the Unix socket of the control API unless configured
+// otherwise
+const DefaultSocket = "/var/run/sockd.sock"
+
+// DefaultDrainTimeout is the DrainTimeout unless configured otherwise
+const DefaultDrainTimeout = 30 * time.Second
+
+type Config struct {
+	// Socket is the path of the Unix socket of the control API
+	Socket string `mapstructure:"socket"`
+	// SocketMode is the octal mode of the socket, e.g. 0666 to let
+	// every local user connect and leave it to the auth bindings what
+	// they may do. Empty leaves the mode from the umask.
+	SocketMode string `mapstructure:"socket_mode"`
+	// TCP is an address to also serve the control API on
+	TCP string `mapstructure:"tcp"`
+	// TCPInsecure lets the TCP listener serve without TLS or tokens,
+	// so that anyone who can reach it controls the daemon
+	TCPInsecure bool `mapstructure:"tcp_insecure"`
+	// TLS and Auth secure the TCP listener
+	TLS  auth.TLSConfig `mapstructure:"tls"`
+	Auth auth.Config    `mapstructure:"auth"`
+	// HTTP is an address to serve the function gateway on
+	HTTP string `mapstructure:"http"`
+	// Metrics is an address to serve Prometheus metrics on, at /metrics
+	Metrics string `mapstructure:"metrics"`
+	// DrainTimeout is how long a shutdown waits for the creates and
+	// invocations in flight before tearing the containers down
+	DrainTimeout time.Duration  `mapstructure:"drain_timeout"`
+	Log          logging.Config `mapstructure:"log"`
+	Trace        tracing.Config `mapstructure:"trace"`
+	Manager      manager.Config `mapstructure:",squash"`
+}
+
+// Default returns the config of a daemon with no config file
+func Default() Config {
+	return Config{
+		Socket:       DefaultSocket,
+		DrainTimeout: DefaultDrainTimeout,
+		Log:          logging.DefaultConfig(),
+		Manager:      manager.DefaultConfig(),
+	}
+}
+
+func (c Config) Validate() error {
+	var err error
+	if c.Socket == "" {
+		err = errors.New("socket must not be empty")
+	}
+	if _, modeErr := c.FileMode(); modeErr != nil {
+		err = errors.Join(err, modeErr)
+	}
+	if c.DrainTimeout < 0 {
+		err = errors.Join(err, fmt.Errorf("drain_timeout must not be negative, not %v", c.DrainTimeout))
+	}
+	return errors.Join(err, c.TLS.Validate(), c.Auth.Validate(), c.Log.Validate(), c.Manager.Validate())
+}
+
+// FileMode parses SocketMode. It returns 0 if it is empty.
+func (c Config) FileMode() (os.FileMode, error) {
+	if c.SocketMode == "" {
+		return 0, nil
+	}
+	mode, err := strconv.ParseUint(c.SocketMode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("socket_mode must be an octal mode such as 0660, not %q", c.SocketMode)
+	}
+	return os.FileMode(mode), nil
+}
+
+// SetDefaults registers every key with its default value in v, and lets
+// the SOCKD_* environment variables override them
+func SetDefaults(v *viper.Viper) {
+	for key, value := range flatten("", toMap(reflect.ValueOf(Default()))) {
+		// an empty map default would hide the keys set below it
+		if rv := reflect.ValueOf(value); rv.Kind() == reflect.Map && rv.Len() == 0 {
+			continue
+		}
+		v.SetDefault(key, value)
+	}
+	v.SetEnvPrefix(EnvPrefix)
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.AutomaticEnv()
+}
+
+// Load decodes and validates the config held by v
+func Load(v *viper.Viper) (Config, error) {
+	var c Config
+	if err := v.Unmarshal(&c); err != nil {
+		return c, fmt.Errorf("invalid config: %w", err)
+	}
+	if err := c.Validate(); err != nil {
+		return c, fmt.Errorf("invalid config: %w", err)
+	}
+	return c, nil
+}
+
+// WriteDefaults writes the default config as YAML, in the format of the
+// config file
+func WriteDefaults(w io.Writer) error {
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(toMap(reflect.ValueOf(Default()))); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+// Diff returns the keys whose value differs between two configs, sorted
+func Diff(old, new Config) []string {
+	before := flatten("", toMap(reflect.ValueOf(old)))
+	after := flatten("", toMap(reflect.ValueOf(new)))
+	var keys []string
+	for key, value := range after {
+		// a nil map or slice is the same as an empty one
+		if fmt.Sprint(value) != fmt.Sprint(before[key]) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// RequiresRestart reports whether a change to key only takes effect
+// when the daemon is restarted. Every other key is applied by a reload.
+func RequiresRestart(key string) bool {
+	switch key {
+	case "socket", "socket_mode", "http", "metrics", "base_dir", "cgroup.parent":
+		return true
+	}
+	return strings.HasPrefix(key, "trace.")
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// toMap turns a config struct into nested maps keyed as in the config
+// file, following the mapstructure tags
+func toMap(v reflect.Value) map[string]any {
+	m := make(map[string]any)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name, opts, _ := strings.Cut(t.Field(i).Tag.Get("mapstructure"), ",")
+		field := v.Field(i)
+		switch {
+		case opts == "squash":
+			for key, value := range toMap(field) {
+				m[key] = value
+			}
+		case field.Kind() == reflect.Struct:
+			m[name] = toMap(field)
+		case field.Type() == durationType:
+			// as written in the config file
+			m[name] = field.Interface().(time.Duration).String()
+		default:
+			m[name] = field.Interface()
+		}
+	}
+	return m
+}
+
+// flatten turns nested maps into dotted viper keys
+func flatten(prefix string, m map[string]any) map[string]any {
+	flat := make(map[string]any)
+	for key, value := range m {
+		if nested, ok := value.(map[string]any); ok {
+			for k, v := range flatten(prefix+key+".", nested) {
+				flat[k] = v
+			}
+			continue
+		}
+		flat[prefix+key] = value
+	}
+	return flat
+}
@@ -0,0 +1,119 @@
+package config
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func load(t *testing.T, file string) (Config, error) {
+	t.Helper()
+	v := viper.New()
+	SetDefaults(v)
+	v.SetConfigType("yaml")
+	if err := v.ReadConfig(strings.NewReader(file)); err != nil {
+		t.Fatalf("ReadConfig() error = %v", err)
+	}
+	return Load(v)
+}
+
+func TestLoadDefaults(t *testing.T) {
+	c, err := load(t, "")
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if !reflect.DeepEqual(c, Default()) {
+		t.Errorf("Load() = %+v, want %+v", c, Default())
+	}
+}
+
+func TestLoadOverrides(t *testing.T) {
+	t.Setenv("SOCKD_CONTAINER_CLIENT_TIMEOUT", "10s")
+	c, err := load(t, `
+zygote:
+  mem_pool_mb: 512
+container:
+  client_timeout: 5s
+log:
+  levels:
+    cgroup: debug
+auth:
+  bindings:
+    - role: developer
+      groups: [devs]
+`)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if c.Manager.Zygote.MemPoolMB != 512 {
+		t.Errorf("MemPoolMB = %d, want 512 from the file", c.Manager.Zygote.MemPoolMB)
+	}
+	if c.Manager.Zygote.ConcurrentEvictions != Default().Manager.Zygote.ConcurrentEvictions {
+		t.Errorf("ConcurrentEvictions = %d, want the default", c.Manager.Zygote.ConcurrentEvictions)
+	}
+	if c.Manager.Container.ClientTimeout != 10*time.Second {
+		t.Errorf("ClientTimeout = %v, want 10s from the environment", c.Manager.Container.ClientTimeout)
+	}
+	if len(c.Auth.Bindings) != 1 || c.Auth.Bindings[0].Groups[0] != "devs" {
+		t.Errorf("Auth.Bindings = %+v, want the developer binding", c.Auth.Bindings)
+	}
+	if c.Log.Levels["cgroup"] != "debug" {
+		t.Errorf("Log.Levels = %v, want cgroup: debug", c.Log.Levels)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	if _, err := load(t, "cgroup:\n  reserve: 0\n"); err == nil {
+		t.Error("Load() accepted a reserve of 0")
+	}
+	if _, err := load(t, "drain_timeout: -1s\n"); err == nil {
+		t.Error("Load() accepted a negative drain_timeout")
+	}
+	if _, err := load(t, "socket_mode: rw\n"); err == nil {
+		t.Error("Load() accepted a socket_mode that is not octal")
+	}
+	if _, err := load(t, "image:\n  nameservers: [dns.example.com]\n"); err == nil {
+		t.Error("Load() accepted a nameserver that is not an IP")
+	}
+}
+
+func TestWriteDefaults(t *testing.T) {
+	var out bytes.Buffer
+	if err := WriteDefaults(&out); err != nil {
+		t.Fatalf("WriteDefaults() error = %v", err)
+	}
+	c, err := load(t, out.String())
+	if err != nil {
+		t.Fatalf("Load() of the defaults error = %v", err)
+	}
+	// an empty list is written as [] and read back as an empty slice
+	if keys := Diff(Default(), c); len(keys) != 0 {
+		t.Errorf("defaults did not round trip: %v differ", keys)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	if keys := Diff(Default(), Default()); len(keys) != 0 {
+		t.Errorf("Diff() of equal configs = %v", keys)
+	}
+
+	c := Default()
+	c.TCP = ":8080"
+	c.Log.Levels = map[string]string{}
+	c.Manager.Zygote.MemPoolMB = 512
+	c.Trace.File = "/tmp/traces.json"
+	keys := Diff(Default(), c)
+	want := []string{"tcp", "trace.file", "zygote.mem_pool_mb"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Fatalf("Diff() = %v, want %v", keys, want)
+	}
+	for _, key := range keys {
+		if got := RequiresRestart(key); got != (key == "trace.file") {
+			t.Errorf("RequiresRestart(%q) = %v", key, got)
+		}
+	}
+}
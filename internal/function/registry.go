@@ -0,0 +1,397 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"parkerdgabel/sockd/internal/code"
+	"parkerdgabel/sockd/internal/logging"
+	"parkerdgabel/sockd/internal/storage"
+	"parkerdgabel/sockd/pkg/container"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrFunctionNotFound = errors.New("function not found")
+	ErrVersionNotFound  = errors.New("version not found")
+	ErrAliasNotFound    = errors.New("alias not found")
+	ErrNoRollback       = errors.New("alias has no previous version")
+)
+
+var logger = logging.For(logging.Function)
+
+// qualifierSep separates a function name from an alias or version in
+// an invocation target, as in "resize:prod"
+const qualifierSep = ":"
+
+// validFunctionName matches the names functions can be registered
+// under. The name ends up in the path of the code dir of the function,
+// so it must not contain a path separator.
+var validFunctionName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]{0,63}$`)
+
+// Alias is a movable name for a version of a function. When Canary is
+// set, CanaryWeight percent of the traffic goes to it instead.
+type Alias struct {
+	Name         string
+	Version      string
+	Canary       string
+	CanaryWeight int
+	// versions the alias pointed at before, most recent last
+	history []string
+}
+
+// Function is a named piece of code together with everything needed to
+// build containers that run it
+type Function struct {
+	Name       string
+	Versions   map[string]*Version
+	Aliases    map[string]*Alias
+	Latest     string
+	Registered time.Time
+}
+
+// Live returns the IDs of the versions that invocations can still be
+// routed to: the latest version and every alias target
+func (fn *Function) Live() map[string]bool {
+	live := map[string]bool{fn.Latest: true}
+	for _, alias := range fn.Aliases {
+		live[alias.Version] = true
+		if alias.Canary != "" {
+			live[alias.Canary] = true
+		}
+	}
+	return live
+}
+
+func (fn *Function) clone() *Function {
+	c := *fn
+	c.Versions = make(map[string]*Version, len(fn.Versions))
+	for id, v := range fn.Versions {
+		c.Versions[id] = v
+	}
+	c.Aliases = make(map[string]*Alias, len(fn.Aliases))
+	for name, a := range fn.Aliases {
+		alias := *a
+		alias.history = append([]string(nil), a.history...)
+		c.Aliases[name] = &alias
+	}
+	return &c
+}
+
+// Registry keeps track of the functions registered in a tenant. The
+// code of each version is pulled and unpacked once, when it is
+// registered, and shared by every container created for that version.
+// The functions are kept in the state store, if any, so they survive a
+// restart along with their code.
+type Registry struct {
+	codeDirs  *storage.DirMaker
+	state     *storage.StateStore
+	tenant    string
+	mutex     sync.Mutex
+	functions map[string]*Function
+	// function names whose code is being pulled
+	pending map[string]bool
+}
+
+// NewRegistry returns the registry of a tenant, with the functions the
+// state store kept for it
+func NewRegistry(codeDirs *storage.DirMaker, state *storage.StateStore, tenant string) *Registry {
+	r := &Registry{
+		codeDirs:  codeDirs,
+		state:     state,
+		tenant:    tenant,
+		functions: make(map[string]*Function),
+		pending:   make(map[string]bool),
+	}
+	if state != nil {
+		r.load()
+	}
+	return r
+}
+
+// load restores the functions kept in the state store. Functions whose
+// code is gone are dropped.
+func (r *Registry) load() {
+	for _, rec := range r.state.Functions(r.tenant) {
+		fn := functionFromRecord(rec)
+		if missing := fn.missingCode(); missing != "" {
+			logger.Warn("not recovering function, its code is gone", "tenant", r.tenant, "function", fn.Name, "path", missing)
+			if err := r.state.DeleteFunction(r.tenant, fn.Name); err != nil {
+				logger.Error("failed to save function state", "tenant", r.tenant, "function", fn.Name, "error", err)
+			}
+			continue
+		}
+		r.functions[fn.Name] = fn
+		logger.Info("recovered function", "tenant", r.tenant, "function", fn.Name, "versions", len(fn.Versions))
+	}
+}
+
+// save keeps a function in the state store. Callers must hold mutex.
+func (r *Registry) save(fn *Function) {
+	if r.state == nil {
+		return
+	}
+	if err := r.state.PutFunction(fn.record(r.tenant)); err != nil {
+		logger.Error("failed to save function state", "tenant", r.tenant, "function", fn.Name, "error", err)
+	}
+}
+
+// CodeDirs returns the code dirs of every version of every function
+func (r *Registry) CodeDirs() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var dirs []string
+	for _, fn := range r.functions {
+		for _, v := range fn.Versions {
+			dirs = append(dirs, v.CodeDir)
+		}
+	}
+	return dirs
+}
+
+// Register publishes the code at meta.CodeUrl as the latest version of
+// a function, creating the function if needed. Registering code and
+// Meta identical to an existing version makes that version the latest
+// again instead of creating a new one.
+func (r *Registry) Register(ctx context.Context, name string, meta *container.Meta) (*Function, *Version, error) {
+	if !validFunctionName.MatchString(name) {
+		return nil, nil, fmt.Errorf("invalid function name: %q", name)
+	}
+	if meta.Runtime == "" {
+		return nil, nil, fmt.Errorf("runtime is required")
+	}
+	if meta.BaseImageName == "" {
+		return nil, nil, fmt.Errorf("base image name is required")
+	}
+	if meta.CodeUrl == "" {
+		return nil, nil, fmt.Errorf("code url is required")
+	}
+	if err := meta.ValidateLimits(); err != nil {
+		return nil, nil, err
+	}
+
+	r.mutex.Lock()
+	if r.pending[name] {
+		r.mutex.Unlock()
+		return nil, nil, fmt.Errorf("function %s is already being registered", name)
+	}
+	r.pending[name] = true
+	r.mutex.Unlock()
+	defer func() {
+		r.mutex.Lock()
+		delete(r.pending, name)
+		r.mutex.Unlock()
+	}()
+
+	codeDir, err := r.codeDirs.Make("fn-" + name)
+	if err != nil {
+		return nil, nil, err
+	}
+	removeCodeDir := func() {
+		if err := os.RemoveAll(codeDir); err != nil {
+			logger.Warn("failed to remove code dir", "path", codeDir, "error", err)
+		}
+	}
+	if err := code.PullCode(ctx, meta.CodeUrl, codeDir); err != nil {
+		removeCodeDir()
+		return nil, nil, err
+	}
+	id, err := hashVersion(codeDir, meta)
+	if err != nil {
+		removeCodeDir()
+		return nil, nil, err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	fn, ok := r.functions[name]
+	if !ok {
+		fn = &Function{
+			Name:       name,
+			Versions:   make(map[string]*Version),
+			Aliases:    make(map[string]*Alias),
+			Registered: time.Now(),
+		}
+		r.functions[name] = fn
+	}
+	version, ok := fn.Versions[id]
+	if ok {
+		removeCodeDir()
+		logger.Info("function version already registered", "function", name, "version", id)
+	} else {
+		version = &Version{
+			ID:      id,
+			Meta:    *meta,
+			CodeDir: codeDir,
+			Created: time.Now(),
+		}
+		fn.Versions[id] = version
+		logger.Info("registered function", "function", name, "version", id, "path", codeDir)
+	}
+	fn.Latest = id
+	r.save(fn)
+	return fn.clone(), version, nil
+}
+
+func (r *Registry) Get(name string) (*Function, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	fn, ok := r.functions[name]
+	if !ok {
+		return nil, false
+	}
+	return fn.clone(), true
+}
+
+// HasVersion reports whether a version of a function is still
+// registered. It may be invoked by its ID even when no alias points to
+// it.
+func (r *Registry) HasVersion(name, id string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	fn, ok := r.functions[name]
+	return ok && fn.Versions[id] != nil
+}
+
+// Resolve picks the version that should serve an invocation target of
+// the form name[:qualifier]. The qualifier may be an alias or a version
+// ID; without one the latest version is used.
+func (r *Registry) Resolve(target string) (*Function, *Version, error) {
+	name, qualifier, _ := strings.Cut(target, qualifierSep)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	fn, ok := r.functions[name]
+	if !ok {
+		return nil, nil, ErrFunctionNotFound
+	}
+
+	id := fn.Latest
+	if qualifier != "" {
+		if alias, ok := fn.Aliases[qualifier]; ok {
+			id = alias.pick()
+		} else {
+			id = qualifier
+		}
+	}
+	version, ok := fn.Versions[id]
+	if !ok {
+		return nil, nil, ErrVersionNotFound
+	}
+	return fn.clone(), version, nil
+}
+
+func (a *Alias) pick() string {
+	if a.Canary != "" && rand.Intn(100) < a.CanaryWeight {
+		return a.Canary
+	}
+	return a.Version
+}
+
+// SetAlias points an alias at a version, optionally sending
+// canaryWeight percent of its traffic to a second version
+func (r *Registry) SetAlias(name, alias, version, canary string, canaryWeight int) (*Function, error) {
+	if alias == "" || strings.Contains(alias, qualifierSep) {
+		return nil, fmt.Errorf("invalid alias name: %q", alias)
+	}
+	if canaryWeight < 0 || canaryWeight > 100 {
+		return nil, fmt.Errorf("canary weight must be between 0 and 100")
+	}
+	if canary == "" && canaryWeight != 0 {
+		return nil, fmt.Errorf("canary weight requires a canary version")
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	fn, ok := r.functions[name]
+	if !ok {
+		return nil, ErrFunctionNotFound
+	}
+	if _, ok := fn.Versions[alias]; ok {
+		return nil, fmt.Errorf("alias name %s shadows a version", alias)
+	}
+	if _, ok := fn.Versions[version]; !ok {
+		return nil, ErrVersionNotFound
+	}
+	if _, ok := fn.Versions[canary]; canary != "" && !ok {
+		return nil, ErrVersionNotFound
+	}
+
+	a, ok := fn.Aliases[alias]
+	if !ok {
+		a = &Alias{Name: alias}
+		fn.Aliases[alias] = a
+	} else if a.Version != version {
+		a.history = append(a.history, a.Version)
+	}
+	a.Version = version
+	a.Canary = canary
+	a.CanaryWeight = canaryWeight
+	logger.Info("set function alias", "function", name, "alias", alias, "version", version, "canary", canary, "canary_weight", canaryWeight)
+	r.save(fn)
+	return fn.clone(), nil
+}
+
+// RollbackAlias moves an alias back to the version it pointed at
+// before its last move, dropping any canary
+func (r *Registry) RollbackAlias(name, alias string) (*Function, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	fn, ok := r.functions[name]
+	if !ok {
+		return nil, ErrFunctionNotFound
+	}
+	a, ok := fn.Aliases[alias]
+	if !ok {
+		return nil, ErrAliasNotFound
+	}
+	if len(a.history) == 0 {
+		return nil, ErrNoRollback
+	}
+	a.Version = a.history[len(a.history)-1]
+	a.history = a.history[:len(a.history)-1]
+	a.Canary = ""
+	a.CanaryWeight = 0
+	logger.Info("rolled back function alias", "function", name, "alias", alias, "version", a.Version)
+	r.save(fn)
+	return fn.clone(), nil
+}
+
+// List returns the registered functions sorted by name
+func (r *Registry) List() []*Function {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	functions := make([]*Function, 0, len(r.functions))
+	for _, fn := range r.functions {
+		functions = append(functions, fn.clone())
+	}
+	sort.Slice(functions, func(i, j int) bool {
+		return functions[i].Name < functions[j].Name
+	})
+	return functions
+}
+
+// Delete removes a function from the registry and returns it. The code
+// of its versions is left to the caller, as containers may still run it.
+func (r *Registry) Delete(name string) (*Function, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	fn, ok := r.functions[name]
+	if !ok {
+		return nil, ErrFunctionNotFound
+	}
+	delete(r.functions, name)
+	if r.state != nil {
+		if err := r.state.DeleteFunction(r.tenant, name); err != nil {
+			logger.Error("failed to save function state", "tenant", r.tenant, "function", name, "error", err)
+		}
+	}
+	logger.Info("deleted function", "function", name)
+	return fn, nil
+}
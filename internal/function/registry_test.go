@@ -0,0 +1,234 @@
+package function
+
+import (
+	"context"
+	"os"
+	"parkerdgabel/sockd/internal/storage"
+	"parkerdgabel/sockd/pkg/container"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestRegistry(t *testing.T, versions ...string) *Registry {
+	t.Helper()
+	r := NewRegistry(nil, nil, "")
+	fn := &Function{
+		Name:       "fn",
+		Versions:   make(map[string]*Version),
+		Aliases:    make(map[string]*Alias),
+		Registered: time.Now(),
+	}
+	for _, id := range versions {
+		fn.Versions[id] = &Version{ID: id, Created: time.Now()}
+		fn.Latest = id
+	}
+	r.functions[fn.Name] = fn
+	return r
+}
+
+func TestHashVersion(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "f.py"), []byte("def f(event): return event"), 0644); err != nil {
+		t.Fatalf("failed to write code: %v", err)
+	}
+	meta := &container.Meta{Runtime: container.Python, CodeUrl: "file:///a/f.py"}
+
+	first, err := hashVersion(dir, meta)
+	if err != nil {
+		t.Fatalf("hashVersion() error = %v", err)
+	}
+	if len(first) != versionIDLen {
+		t.Errorf("hashVersion() = %q, want %d characters", first, versionIDLen)
+	}
+
+	moved := *meta
+	moved.CodeUrl = "file:///b/f.py"
+	if id, _ := hashVersion(dir, &moved); id != first {
+		t.Errorf("hashVersion() changed with the code url: %s != %s", id, first)
+	}
+
+	limited := *meta
+	limited.MemLimitMB = 128
+	if id, _ := hashVersion(dir, &limited); id == first {
+		t.Errorf("hashVersion() did not change with the meta")
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "f.py"), []byte("def f(event): return None"), 0644); err != nil {
+		t.Fatalf("failed to write code: %v", err)
+	}
+	if id, _ := hashVersion(dir, meta); id == first {
+		t.Errorf("hashVersion() did not change with the code")
+	}
+}
+
+func TestRegistry_Resolve(t *testing.T) {
+	r := newTestRegistry(t, "v1", "v2")
+	if _, err := r.SetAlias("fn", "prod", "v1", "", 0); err != nil {
+		t.Fatalf("SetAlias() error = %v", err)
+	}
+
+	tests := []struct {
+		target  string
+		version string
+		err     error
+	}{
+		{target: "fn", version: "v2"},
+		{target: "fn:prod", version: "v1"},
+		{target: "fn:v2", version: "v2"},
+		{target: "fn:v3", err: ErrVersionNotFound},
+		{target: "other", err: ErrFunctionNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			_, v, err := r.Resolve(tt.target)
+			if err != tt.err {
+				t.Fatalf("Resolve() error = %v, want %v", err, tt.err)
+			}
+			if err == nil && v.ID != tt.version {
+				t.Errorf("Resolve() = %s, want %s", v.ID, tt.version)
+			}
+		})
+	}
+}
+
+func TestRegistry_HasVersion(t *testing.T) {
+	r := newTestRegistry(t, "v1", "v2", "v3")
+	if _, err := r.SetAlias("fn", "prod", "v2", "", 0); err != nil {
+		t.Fatalf("SetAlias() error = %v", err)
+	}
+	tests := []struct {
+		name, version string
+		want          bool
+	}{
+		{name: "fn", version: "v1", want: true}, // invoked by its ID only
+		{name: "fn", version: "v2", want: true},
+		{name: "fn", version: "v3", want: true},
+		{name: "fn", version: "v4"},
+		{name: "other", version: "v1"},
+	}
+	for _, tt := range tests {
+		if got := r.HasVersion(tt.name, tt.version); got != tt.want {
+			t.Errorf("HasVersion(%s, %s) = %v, want %v", tt.name, tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestRegistry_Canary(t *testing.T) {
+	r := newTestRegistry(t, "v1", "v2")
+	if _, err := r.SetAlias("fn", "prod", "v1", "v2", 100); err != nil {
+		t.Fatalf("SetAlias() error = %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, v, _ := r.Resolve("fn:prod"); v.ID != "v2" {
+			t.Fatalf("Resolve() = %s, want all traffic on the canary", v.ID)
+		}
+	}
+
+	if _, err := r.SetAlias("fn", "prod", "v1", "v2", 0); err != nil {
+		t.Fatalf("SetAlias() error = %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, v, _ := r.Resolve("fn:prod"); v.ID != "v1" {
+			t.Fatalf("Resolve() = %s, want no traffic on the canary", v.ID)
+		}
+	}
+
+	if _, err := r.SetAlias("fn", "prod", "v1", "v3", 10); err != ErrVersionNotFound {
+		t.Errorf("SetAlias() error = %v, want %v", err, ErrVersionNotFound)
+	}
+	if _, err := r.SetAlias("fn", "prod", "v1", "v2", 101); err == nil {
+		t.Errorf("SetAlias() accepted a weight above 100")
+	}
+}
+
+func TestRegistry_RollbackAlias(t *testing.T) {
+	r := newTestRegistry(t, "v1", "v2", "v3")
+	if _, err := r.RollbackAlias("fn", "prod"); err != ErrAliasNotFound {
+		t.Fatalf("RollbackAlias() error = %v, want %v", err, ErrAliasNotFound)
+	}
+	for _, v := range []string{"v1", "v2", "v3"} {
+		if _, err := r.SetAlias("fn", "prod", v, "", 0); err != nil {
+			t.Fatalf("SetAlias() error = %v", err)
+		}
+	}
+
+	for _, want := range []string{"v2", "v1"} {
+		fn, err := r.RollbackAlias("fn", "prod")
+		if err != nil {
+			t.Fatalf("RollbackAlias() error = %v", err)
+		}
+		if got := fn.Aliases["prod"].Version; got != want {
+			t.Errorf("RollbackAlias() = %s, want %s", got, want)
+		}
+		if !fn.Live()[want] {
+			t.Errorf("Live() does not contain %s", want)
+		}
+	}
+	if _, err := r.RollbackAlias("fn", "prod"); err != ErrNoRollback {
+		t.Errorf("RollbackAlias() error = %v, want %v", err, ErrNoRollback)
+	}
+}
+
+func TestRegistry_RegisterInvalidName(t *testing.T) {
+	r := NewRegistry(nil, nil, "")
+	meta := &container.Meta{Runtime: container.Python, BaseImageName: "python", CodeUrl: "file:///f.py"}
+	for _, name := range []string{"", "fn:prod", "a/b", "../fn", ".", "-fn", "fn\x00"} {
+		if _, _, err := r.Register(context.Background(), name, meta); err == nil {
+			t.Errorf("Register(%q) error = nil, want an error", name)
+		}
+	}
+}
+
+func TestRegistry_Persist(t *testing.T) {
+	state, err := storage.NewStateStore(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatalf("NewStateStore() error = %v", err)
+	}
+	r := NewRegistry(nil, state, "a")
+	fn := &Function{
+		Name:       "fn",
+		Versions:   make(map[string]*Version),
+		Aliases:    make(map[string]*Alias),
+		Registered: time.Now(),
+	}
+	for _, id := range []string{"v1", "v2"} {
+		fn.Versions[id] = &Version{ID: id, CodeDir: t.TempDir(), Created: time.Now()}
+		fn.Latest = id
+	}
+	r.functions[fn.Name] = fn
+	gone := &Function{Name: "gone", Versions: map[string]*Version{"v1": {ID: "v1", CodeDir: filepath.Join(t.TempDir(), "missing")}}}
+	r.functions[gone.Name] = gone
+	r.save(gone)
+	if _, err := r.SetAlias("fn", "prod", "v1", "", 0); err != nil {
+		t.Fatalf("SetAlias() error = %v", err)
+	}
+	if _, err := r.SetAlias("fn", "prod", "v2", "", 0); err != nil {
+		t.Fatalf("SetAlias() error = %v", err)
+	}
+
+	// as after a restart
+	r = NewRegistry(nil, state, "a")
+	if _, ok := r.Get("gone"); ok {
+		t.Error("recovered a function whose code is gone")
+	}
+	if _, version, err := r.Resolve("fn:prod"); err != nil || version.ID != "v2" {
+		t.Fatalf("Resolve(fn:prod) = %v, %v, want v2", version, err)
+	}
+	if _, err := r.RollbackAlias("fn", "prod"); err != nil {
+		t.Errorf("RollbackAlias() error = %v, want the history to be kept", err)
+	}
+	if len(r.CodeDirs()) != 2 {
+		t.Errorf("CodeDirs() = %v, want the dirs of both versions", r.CodeDirs())
+	}
+	if fns := NewRegistry(nil, state, "b").List(); len(fns) != 0 {
+		t.Errorf("another tenant got functions %v", fns)
+	}
+
+	if _, err := r.Delete("fn"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if fns := NewRegistry(nil, state, "a").List(); len(fns) != 0 {
+		t.Errorf("List() after Delete() = %v", fns)
+	}
+}
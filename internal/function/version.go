@@ -0,0 +1,140 @@
+package function
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"parkerdgabel/sockd/internal/storage"
+	"parkerdgabel/sockd/pkg/container"
+	"path/filepath"
+	"time"
+)
+
+// length of the hex version IDs derived from the content hash
+const versionIDLen = 12
+
+// Version is an immutable snapshot of the code and Meta of a function
+type Version struct {
+	ID      string
+	Meta    container.Meta
+	CodeDir string
+	Created time.Time
+}
+
+// hashVersion derives a version ID from the files in codeDir and the
+// Meta they run with. The code location is left out, so the same code
+// pulled from two places is the same version.
+func hashVersion(codeDir string, meta *container.Meta) (string, error) {
+	h := sha256.New()
+
+	m := *meta
+	m.CodeUrl = ""
+	metaBytes, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	h.Write(metaBytes)
+
+	err = filepath.WalkDir(codeDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(codeDir, path)
+		if err != nil {
+			return err
+		}
+		// git metadata changes on every clone
+		if d.IsDir() && d.Name() == ".git" {
+			return fs.SkipDir
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%s\x00%o\x00", rel, info.Mode())
+		switch {
+		case info.Mode().IsRegular():
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if _, err := io.Copy(h, f); err != nil {
+				return err
+			}
+		case info.Mode()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			h.Write([]byte(target))
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to hash code dir: %w", err)
+	}
+
+	return hex.EncodeToString(h.Sum(nil))[:versionIDLen], nil
+}
+
+// record returns the state store record of a function of tenant
+func (fn *Function) record(tenant string) storage.FunctionRecord {
+	rec := storage.FunctionRecord{
+		Tenant:     tenant,
+		Name:       fn.Name,
+		Latest:     fn.Latest,
+		Registered: fn.Registered,
+	}
+	for _, v := range fn.Versions {
+		rec.Versions = append(rec.Versions, storage.VersionRecord{ID: v.ID, Meta: v.Meta, CodeDir: v.CodeDir, Created: v.Created})
+	}
+	for _, a := range fn.Aliases {
+		rec.Aliases = append(rec.Aliases, storage.AliasRecord{
+			Name:         a.Name,
+			Version:      a.Version,
+			Canary:       a.Canary,
+			CanaryWeight: a.CanaryWeight,
+			History:      a.history,
+		})
+	}
+	return rec
+}
+
+func functionFromRecord(rec storage.FunctionRecord) *Function {
+	fn := &Function{
+		Name:       rec.Name,
+		Versions:   make(map[string]*Version, len(rec.Versions)),
+		Aliases:    make(map[string]*Alias, len(rec.Aliases)),
+		Latest:     rec.Latest,
+		Registered: rec.Registered,
+	}
+	for _, v := range rec.Versions {
+		fn.Versions[v.ID] = &Version{ID: v.ID, Meta: v.Meta, CodeDir: v.CodeDir, Created: v.Created}
+	}
+	for _, a := range rec.Aliases {
+		fn.Aliases[a.Name] = &Alias{
+			Name:         a.Name,
+			Version:      a.Version,
+			Canary:       a.Canary,
+			CanaryWeight: a.CanaryWeight,
+			history:      a.History,
+		}
+	}
+	return fn
+}
+
+// missingCode returns the code dir of a version of fn that no longer
+// exists, if any
+func (fn *Function) missingCode() string {
+	for _, v := range fn.Versions {
+		if _, err := os.Stat(v.CodeDir); err != nil {
+			return v.CodeDir
+		}
+	}
+	return ""
+}
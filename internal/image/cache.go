@@ -5,20 +5,28 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"strings"
+	"sync/atomic"
 
+	"parkerdgabel/sockd/internal/logging"
 	strg "parkerdgabel/sockd/internal/storage"
+	"parkerdgabel/sockd/internal/tracing"
 
 	"github.com/containers/buildah"
 	"github.com/containers/buildah/define"
 	"github.com/containers/buildah/imagebuildah"
 	"github.com/containers/storage"
 	"github.com/containers/storage/pkg/unshare"
+	"go.opentelemetry.io/otel/attribute"
 )
 
+var logger = logging.For(logging.Image)
+
 type ImageCacheError struct {
 	image string
 	err   error
@@ -28,21 +36,57 @@ func (e *ImageCacheError) Error() string {
 	return "ImageCache error: " + e.image + ": " + e.err.Error()
 }
 
+// Config holds the settings of the images built by the ImageCache
+type Config struct {
+	// Nameservers are written to the resolv.conf of every image, as
+	// base images do not come with a usable one
+	Nameservers []string `mapstructure:"nameservers"`
+}
+
+// DefaultConfig returns the Config used unless configured otherwise
+func DefaultConfig() Config {
+	return Config{
+		Nameservers: []string{"8.8.8.8"},
+	}
+}
+
+func (c Config) Validate() error {
+	if len(c.Nameservers) == 0 {
+		return errors.New("image nameservers must not be empty")
+	}
+	for _, ns := range c.Nameservers {
+		if net.ParseIP(ns) == nil {
+			return fmt.Errorf("image nameserver %q is not an IP address", ns)
+		}
+	}
+	return nil
+}
+
 type ImageCache struct {
+	// the config of the images built from now on
+	config    atomic.Pointer[Config]
 	imageDirs *strg.DirMaker
 	images    map[string]string
 }
 
-func NewImageCache() *ImageCache {
-	dirs, err := strg.NewDirMaker("images", strg.STORE_PRIVATE)
+func NewImageCache(baseDir string, config Config) *ImageCache {
+	dirs, err := strg.NewDirMaker(baseDir, "images", strg.STORE_PRIVATE)
 	if err != nil {
-		fmt.Printf("failed to create image cache: %q", err)
+		logger.Error("failed to create image cache", "error", err)
 		return nil
 	}
-	return &ImageCache{
+	ic := &ImageCache{
 		imageDirs: dirs,
 		images:    make(map[string]string),
 	}
+	ic.config.Store(&config)
+	return ic
+}
+
+// Configure sets the config of the images built from now on. Images
+// already built are kept as they are.
+func (ic *ImageCache) Configure(config Config) {
+	ic.config.Store(&config)
 }
 
 func (ic *ImageCache) GetImage(name string) (string, bool) {
@@ -58,7 +102,10 @@ func (ic *ImageCache) DeleteImage(name string) {
 	delete(ic.images, name)
 }
 
-func (ic *ImageCache) BuildImage(config *ContainerfileConfig) error {
+func (ic *ImageCache) BuildImage(ctx context.Context, config *ContainerfileConfig) (err error) {
+	ctx, span := tracing.Start(ctx, "image.build", attribute.String("sockd.image.key", config.Key()))
+	defer tracing.End(span, &err)
+
 	if buildah.InitReexec() {
 		return &ImageCacheError{config.Key(), errors.New("failed to initialize reexec")}
 	}
@@ -76,7 +123,7 @@ func (ic *ImageCache) BuildImage(config *ContainerfileConfig) error {
 	defer func() {
 		if _, err := buildStore.Shutdown(false); err != nil {
 			if !errors.Is(err, storage.ErrLayerUsedByContainer) {
-				fmt.Printf("failed to shutdown storage: %q", err)
+				logger.Warn("failed to shut down build storage", "image", config.Key(), "error", err)
 			}
 		}
 	}()
@@ -98,20 +145,25 @@ func (ic *ImageCache) BuildImage(config *ContainerfileConfig) error {
 	fmt.Fprintf(f, "%s", content)
 	f.Close()
 
-	outputDir := ic.imageDirs.Make(config.Key())
+	outputDir, err := ic.imageDirs.Make(config.Key())
+	if err != nil {
+		return &ImageCacheError{config.Key(), err}
+	}
+	log := logger.With("image", config.Key(), "path", outputDir)
+	log.Info("building image")
 
 	buildOptions := define.BuildOptions{
 		ContextDirectory: d,
 		BuildOutput:      outputDir,
 	}
 
-	_, _, err = imagebuildah.BuildDockerfiles(context.TODO(), buildStore, buildOptions, containerfile)
+	_, _, err = imagebuildah.BuildDockerfiles(ctx, buildStore, buildOptions, containerfile)
 	if err != nil {
 		return &ImageCacheError{config.Key(), err}
 	}
 
 	// PART 2: various files/dirs on top of the extracted image
-	fmt.Printf("\tCreate handler/host/packages/resolve.conf over base image.\n")
+	log.Debug("creating handler, host, packages and resolv.conf over base image")
 	if err := os.Mkdir(path.Join(outputDir, "handler"), 0700); err != nil {
 		return err
 	}
@@ -125,14 +177,17 @@ func (ic *ImageCache) BuildImage(config *ContainerfileConfig) error {
 	}
 
 	// need this because Docker containers don't have a dns server in /etc/resolv.conf
-	// TODO: make it a config option
+	var resolvConf strings.Builder
+	for _, ns := range ic.config.Load().Nameservers {
+		fmt.Fprintf(&resolvConf, "nameserver %s\n", ns)
+	}
 	dnsPath := filepath.Join(outputDir, "etc", "resolv.conf")
-	if err := ioutil.WriteFile(dnsPath, []byte("nameserver 8.8.8.8\n"), 0644); err != nil {
+	if err := ioutil.WriteFile(dnsPath, []byte(resolvConf.String()), 0644); err != nil {
 		return err
 	}
 
 	// PART 3: make /dev/* devices
-	fmt.Printf("\tCreate /dev/(null,random,urandom) over base image.\n")
+	log.Debug("creating /dev/null, /dev/random and /dev/urandom over base image")
 	path := filepath.Join(outputDir, "dev", "null")
 	if err := exec.Command("mknod", "-m", "0644", path, "c", "1", "3").Run(); err != nil {
 		return err
@@ -0,0 +1,209 @@
+// Package logging holds the structured loggers of sockd. Every subsystem
+// logs through its own logger, whose level is set on its own, and all of
+// them write through the one handler installed by Configure.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// The subsystems of sockd, each with its own logger
+const (
+	Daemon    = "sockd"
+	Manager   = "manager"
+	Container = "container"
+	Cgroup    = "cgroup"
+	Zygote    = "zygote"
+	Image     = "image"
+	Storage   = "storage"
+	Function  = "function"
+)
+
+// Subsystems lists the subsystems whose level may be configured
+var Subsystems = []string{Daemon, Manager, Container, Cgroup, Zygote, Image, Storage, Function}
+
+// Config is the log section of the sockd config file
+type Config struct {
+	// Format is json (the default) or text
+	Format string `mapstructure:"format"`
+	// Level is the level of the subsystems not in Levels: debug, info
+	// (the default), warn or error
+	Level string `mapstructure:"level"`
+	// Levels overrides Level for some subsystems
+	Levels map[string]string `mapstructure:"levels"`
+}
+
+// output is the handler every logger ends up writing to
+type output struct {
+	slog.Handler
+}
+
+var (
+	current atomic.Pointer[output]
+
+	mutex        sync.Mutex
+	defaultLevel slog.LevelVar
+	levels       = make(map[string]*slog.LevelVar)
+)
+
+func init() {
+	current.Store(&output{newHandler(os.Stderr, "text")})
+}
+
+func newHandler(w io.Writer, format string) slog.Handler {
+	// levels are checked by each subsystem logger
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+	if format == "text" {
+		return slog.NewTextHandler(w, opts)
+	}
+	return slog.NewJSONHandler(w, opts)
+}
+
+// DefaultConfig returns the Config used unless configured otherwise
+func DefaultConfig() Config {
+	return Config{
+		Format: "json",
+		Level:  "info",
+	}
+}
+
+func (c Config) Validate() error {
+	_, _, err := c.levels()
+	return err
+}
+
+// levels parses the level of each subsystem
+func (c Config) levels() (slog.Level, map[string]slog.Level, error) {
+	switch c.Format {
+	case "", "json", "text":
+	default:
+		return 0, nil, fmt.Errorf("unknown log format %q", c.Format)
+	}
+	level, err := parseLevel(c.Level)
+	if err != nil {
+		return 0, nil, err
+	}
+	overrides := make(map[string]slog.Level, len(c.Levels))
+	for name, text := range c.Levels {
+		if !slices.Contains(Subsystems, name) {
+			return 0, nil, fmt.Errorf("unknown log subsystem %q", name)
+		}
+		if overrides[name], err = parseLevel(text); err != nil {
+			return 0, nil, err
+		}
+	}
+	return level, overrides, nil
+}
+
+// Configure makes every logger, including those already handed out,
+// write to w in the format and at the levels of cfg
+func Configure(w io.Writer, cfg Config) error {
+	level, overrides, err := cfg.levels()
+	if err != nil {
+		return err
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	current.Store(&output{newHandler(w, cfg.Format)})
+	defaultLevel.Set(level)
+	for _, name := range Subsystems {
+		levelOf(name)
+	}
+	for name, v := range levels {
+		l, ok := overrides[name]
+		if !ok {
+			l = level
+		}
+		v.Set(l)
+	}
+	return nil
+}
+
+func parseLevel(text string) (slog.Level, error) {
+	var level slog.Level
+	if text == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := level.UnmarshalText([]byte(text)); err != nil {
+		return level, fmt.Errorf("invalid log level %q", text)
+	}
+	return level, nil
+}
+
+// levelOf returns the level of a subsystem. The caller must hold the
+// mutex.
+func levelOf(subsystem string) *slog.LevelVar {
+	level, ok := levels[subsystem]
+	if !ok {
+		level = new(slog.LevelVar)
+		level.Set(defaultLevel.Level())
+		levels[subsystem] = level
+	}
+	return level
+}
+
+// For returns the logger of a subsystem. Its records carry the
+// subsystem name.
+func For(subsystem string) *slog.Logger {
+	mutex.Lock()
+	level := levelOf(subsystem)
+	mutex.Unlock()
+	h := &handler{level: level}
+	return slog.New(h).With("subsystem", subsystem)
+}
+
+// handler filters records by the level of its subsystem and passes them
+// on to the current output, with the attributes and groups it was given
+type handler struct {
+	level *slog.LevelVar
+	with  []func(slog.Handler) slog.Handler
+	// the output with the attributes and groups applied, rebuilt when
+	// the output changes
+	cache atomic.Pointer[resolved]
+}
+
+type resolved struct {
+	out     *output
+	handler slog.Handler
+}
+
+func (h *handler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	return h.resolve().Handle(ctx, r)
+}
+
+func (h *handler) resolve() slog.Handler {
+	out := current.Load()
+	if r := h.cache.Load(); r != nil && r.out == out {
+		return r.handler
+	}
+	var next slog.Handler = out.Handler
+	for _, with := range h.with {
+		next = with(next)
+	}
+	h.cache.Store(&resolved{out: out, handler: next})
+	return next
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.extend(func(next slog.Handler) slog.Handler { return next.WithAttrs(attrs) })
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return h.extend(func(next slog.Handler) slog.Handler { return next.WithGroup(name) })
+}
+
+func (h *handler) extend(with func(slog.Handler) slog.Handler) slog.Handler {
+	return &handler{level: h.level, with: append(slices.Clip(h.with), with)}
+}
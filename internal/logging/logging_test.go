@@ -0,0 +1,55 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestConfigureLevels(t *testing.T) {
+	// loggers handed out before Configure follow it too
+	cgroup := For(Cgroup).With("pool", "p")
+	manager := For(Manager)
+
+	var out bytes.Buffer
+	err := Configure(&out, Config{Level: "warn", Levels: map[string]string{Cgroup: "debug"}})
+	if err != nil {
+		t.Fatalf("Configure() error = %v", err)
+	}
+	defer Configure(os.Stderr, Config{Format: "text"})
+
+	cgroup.Debug("created", "cgroup", "cg-1")
+	manager.Info("dropped")
+	manager.Warn("kept")
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d records, want 2:\n%s", len(lines), out.String())
+	}
+	var record map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatalf("record is not JSON: %v", err)
+	}
+	for key, want := range map[string]string{"msg": "created", "subsystem": Cgroup, "pool": "p", "cgroup": "cg-1"} {
+		if record[key] != want {
+			t.Errorf("record[%q] = %v, want %q", key, record[key], want)
+		}
+	}
+	if !strings.Contains(lines[1], `"msg":"kept"`) {
+		t.Errorf("second record = %s, want the warning", lines[1])
+	}
+}
+
+func TestConfigureInvalid(t *testing.T) {
+	for _, cfg := range []Config{
+		{Format: "xml"},
+		{Level: "loud"},
+		{Levels: map[string]string{"nope": "info"}},
+	} {
+		if err := Configure(os.Stderr, cfg); err == nil {
+			t.Errorf("Configure(%+v) succeeded", cfg)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"parkerdgabel/sockd/pkg/container"
+	"sort"
+)
+
+// ErrDraining is returned for creates and invocations asked for while
+// the manager drains
+var ErrDraining = errors.New("draining, not accepting new containers or invocations")
+
+// DrainStatus is the progress of a drain
+type DrainStatus struct {
+	Draining bool
+	// InFlight is how many creates and invocations are still running
+	InFlight int
+	// Containers is how many containers are still managed
+	Containers int
+}
+
+// begin counts a create or invocation as in flight until end is called.
+// It fails once the manager drains.
+func (m *Manager) begin() error {
+	// counted before checking, so a drain that sees none in flight
+	// never misses one that is starting
+	m.inFlight.Add(1)
+	if m.draining.Load() {
+		m.end()
+		return ErrDraining
+	}
+	return nil
+}
+
+func (m *Manager) end() {
+	m.inFlight.Add(-1)
+}
+
+// Drain makes the manager refuse new creates and invocations. Those in
+// flight run to completion; DrainStatus tells when they are done.
+func (m *Manager) Drain() {
+	if !m.draining.Swap(true) {
+		logger.Info("draining", "in_flight", m.inFlight.Load())
+	}
+}
+
+// Resume accepts creates and invocations again after Drain
+func (m *Manager) Resume() {
+	if m.draining.Swap(false) {
+		logger.Info("resumed")
+	}
+}
+
+func (m *Manager) DrainStatus() DrainStatus {
+	m.mapMutex.Lock()
+	defer m.mapMutex.Unlock()
+	return DrainStatus{
+		Draining:   m.draining.Load(),
+		InFlight:   int(m.inFlight.Load()),
+		Containers: len(m.containers),
+	}
+}
+
+// Shutdown drains the manager, stops the evictors and tears everything
+// down: the containers, children before their parents, then the Zygotes
+// of every tenant and last the cgroup pools. It carries on past failures and returns them
+// all. Invocations still in flight fail.
+func (m *Manager) Shutdown() error {
+	m.Drain()
+	// nothing is evicted while the containers are torn down
+	m.configMutex.Lock()
+	for _, t := range m.tenants {
+		for key, evictor := range t.evictors {
+			evictor.Stop()
+			delete(t.evictors, key)
+		}
+	}
+	m.configMutex.Unlock()
+
+	m.mapMutex.Lock()
+	containers := make([]*container.Container, 0, len(m.containers))
+	for _, c := range m.containers {
+		containers = append(containers, c)
+	}
+	m.mapMutex.Unlock()
+	sort.SliceStable(containers, func(i, j int) bool {
+		return depth(containers[i]) > depth(containers[j])
+	})
+
+	var errs []error
+	for _, c := range containers {
+		if err := c.Destroy(); err != nil {
+			errs = append(errs, fmt.Errorf("container %s: %w", c.ID(), err))
+		}
+		m.mapMutex.Lock()
+		delete(m.containers, c.ID())
+		m.removeIdle(c.ID())
+		m.mapMutex.Unlock()
+	}
+
+	m.configMutex.Lock()
+	defer m.configMutex.Unlock()
+	for _, t := range m.tenants {
+		for key, provider := range t.zygoteProviders {
+			if err := provider.Destroy(); err != nil {
+				errs = append(errs, fmt.Errorf("zygotes of %s in tenant %s: %w", key, t.name, err))
+			}
+		}
+	}
+	for _, t := range m.tenants {
+		if err := t.cgroupPool.Destroy(); err != nil {
+			errs = append(errs, fmt.Errorf("cgroup pool %s: %w", t.cgroupPool.Name, err))
+		}
+	}
+	if err := m.ppPool.Destroy(); err != nil {
+		errs = append(errs, fmt.Errorf("cgroup pool %s: %w", m.ppPool.Name, err))
+	}
+	return errors.Join(errs...)
+}
+
+// depth is how many ancestors a container has
+func depth(c *container.Container) int {
+	n := 0
+	for parent := c.Parent(); parent != nil; parent = parent.Parent() {
+		n++
+	}
+	return n
+}
@@ -0,0 +1,29 @@
+package manager
+
+import (
+	"errors"
+	"parkerdgabel/sockd/pkg/container"
+	"testing"
+)
+
+func TestDrain(t *testing.T) {
+	m := &Manager{containers: make(map[string]*container.Container)}
+	if err := m.begin(); err != nil {
+		t.Fatalf("begin() error = %v", err)
+	}
+	m.Drain()
+	if err := m.begin(); !errors.Is(err, ErrDraining) {
+		t.Fatalf("begin() while draining error = %v, want ErrDraining", err)
+	}
+	if status := m.DrainStatus(); !status.Draining || status.InFlight != 1 {
+		t.Errorf("DrainStatus() = %+v, want draining with 1 in flight", status)
+	}
+	m.end()
+	if status := m.DrainStatus(); status.InFlight != 0 {
+		t.Errorf("DrainStatus() = %+v, want none in flight", status)
+	}
+	m.Resume()
+	if err := m.begin(); err != nil {
+		t.Errorf("begin() after Resume error = %v", err)
+	}
+}
@@ -0,0 +1,192 @@
+package manager
+
+import (
+	"errors"
+	"parkerdgabel/sockd/pkg/container"
+	"sync"
+	"time"
+)
+
+const (
+	// how many past events are kept for late subscribers
+	eventHistory = 1024
+	// how many events a subscriber may fall behind before it is dropped
+	subscriberBuffer = 256
+)
+
+// ErrEventsLagged ends a subscription that did not keep up with the events
+var ErrEventsLagged = errors.New("subscriber fell behind")
+
+// Event is a lifecycle event of a container
+type Event struct {
+	Seq         uint64
+	Time        time.Time
+	Type        container.ContainerEventType
+	Tenant      string
+	ContainerID string
+	ParentID    string
+	// Cgroup is the cgroup the container had last, as stopped
+	// containers have none
+	Cgroup string
+}
+
+// EventFilter selects events. An empty field matches everything,
+// otherwise an event must match one of its values.
+type EventFilter struct {
+	Types      []container.ContainerEventType
+	Tenants    []string
+	Containers []string
+	Parents    []string
+}
+
+func (f *EventFilter) Match(e Event) bool {
+	return matchAny(f.Types, e.Type) && matchAny(f.Tenants, e.Tenant) && matchAny(f.Containers, e.ContainerID) && matchAny(f.Parents, e.ParentID)
+}
+
+func matchAny[T comparable](values []T, v T) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// EventSubscription receives the events matching its filter on C, which
+// is closed when the subscription ends
+type EventSubscription struct {
+	C <-chan Event
+
+	c      chan Event
+	filter EventFilter
+	events *eventLog
+	err    error
+}
+
+// Err returns why C was closed: ErrEventsLagged, or nil after Close
+func (s *EventSubscription) Err() error {
+	s.events.mutex.Lock()
+	defer s.events.mutex.Unlock()
+	return s.err
+}
+
+func (s *EventSubscription) Close() {
+	s.events.mutex.Lock()
+	defer s.events.mutex.Unlock()
+	s.events.remove(s, nil)
+}
+
+// eventLog numbers the events of all containers, keeps the latest ones
+// and hands them to subscribers
+type eventLog struct {
+	mutex       sync.Mutex
+	seq         uint64
+	history     []Event
+	subscribers map[*EventSubscription]struct{}
+	// the last cgroup of each live container
+	cgroups map[string]string
+}
+
+func newEventLog() *eventLog {
+	return &eventLog{
+		subscribers: make(map[*EventSubscription]struct{}),
+		cgroups:     make(map[string]string),
+	}
+}
+
+// publish is a ContainerEventHandler. It never blocks, as it is called
+// in the middle of lifecycle operations: subscribers that are too slow
+// are dropped.
+func (m *Manager) publish(event container.ContainerEventType, c *container.Container) {
+	e := Event{
+		Time:        time.Now(),
+		Type:        event,
+		Tenant:      tenantOf(c),
+		ContainerID: c.ID(),
+	}
+	if parent := c.Parent(); parent != nil {
+		e.ParentID = parent.ID()
+	}
+	var cgroup string
+	if cg := c.Cgroup(); cg != nil {
+		cgroup = cg.Name()
+	}
+	m.events.publish(e, cgroup)
+}
+
+// SubscribeEvents returns the buffered events of a tenant matching
+// filter at or after since (none if since is zero), and a subscription
+// to the ones that follow them
+func (m *Manager) SubscribeEvents(tenant string, filter EventFilter, since time.Time) ([]Event, *EventSubscription, error) {
+	t, err := m.tenant(tenant)
+	if err != nil {
+		return nil, nil, err
+	}
+	filter.Tenants = []string{t.name}
+	replay, sub := m.events.subscribe(filter, since)
+	return replay, sub, nil
+}
+
+// publish numbers an event and hands it to the subscribers. cgroup is
+// the current cgroup of the container, if it has one.
+func (l *eventLog) publish(e Event, cgroup string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if cgroup != "" {
+		l.cgroups[e.ContainerID] = cgroup
+	}
+	e.Cgroup = l.cgroups[e.ContainerID]
+	if e.Type == container.ContainerDestroy {
+		delete(l.cgroups, e.ContainerID)
+	}
+
+	l.seq++
+	e.Seq = l.seq
+	if len(l.history) == eventHistory {
+		l.history = l.history[1:]
+	}
+	l.history = append(l.history, e)
+
+	for s := range l.subscribers {
+		if !s.filter.Match(e) {
+			continue
+		}
+		select {
+		case s.c <- e:
+		default:
+			l.remove(s, ErrEventsLagged)
+		}
+	}
+}
+
+func (l *eventLog) subscribe(filter EventFilter, since time.Time) ([]Event, *EventSubscription) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var replay []Event
+	if !since.IsZero() {
+		for _, e := range l.history {
+			if !e.Time.Before(since) && filter.Match(e) {
+				replay = append(replay, e)
+			}
+		}
+	}
+
+	c := make(chan Event, subscriberBuffer)
+	s := &EventSubscription{C: c, c: c, filter: filter, events: l}
+	l.subscribers[s] = struct{}{}
+	return replay, s
+}
+
+// remove ends a subscription. The caller must hold the mutex.
+func (l *eventLog) remove(s *EventSubscription, err error) {
+	if _, ok := l.subscribers[s]; !ok {
+		return
+	}
+	delete(l.subscribers, s)
+	s.err = err
+	close(s.c)
+}
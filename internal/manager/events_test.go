@@ -0,0 +1,46 @@
+package manager
+
+import (
+	"errors"
+	"parkerdgabel/sockd/pkg/container"
+	"testing"
+	"time"
+)
+
+func TestEventLogReplayAndFilter(t *testing.T) {
+	l := newEventLog()
+	start := time.Now()
+	l.publish(Event{Time: start, Type: container.ContainerStart, ContainerID: "a"}, "cg-1")
+	l.publish(Event{Time: start, Type: container.ContainerFork, ContainerID: "a"}, "cg-1")
+	l.publish(Event{Time: start, Type: container.ContainerStop, ContainerID: "a"}, "")
+
+	filter := EventFilter{Types: []container.ContainerEventType{container.ContainerFork, container.ContainerStop}}
+	replay, sub := l.subscribe(filter, start)
+	defer sub.Close()
+	if len(replay) != 2 || replay[0].Seq != 2 || replay[1].Seq != 3 {
+		t.Fatalf("replayed %+v, want the fork and stop events", replay)
+	}
+	// stopped containers have no cgroup, so the last one is reported
+	if replay[1].Cgroup != "cg-1" {
+		t.Errorf("stop event has cgroup %q, want cg-1", replay[1].Cgroup)
+	}
+
+	l.publish(Event{Time: time.Now(), Type: container.ContainerStart, ContainerID: "b"}, "cg-2")
+	l.publish(Event{Time: time.Now(), Type: container.ContainerFork, ContainerID: "b"}, "cg-2")
+	if e := <-sub.C; e.Type != container.ContainerFork || e.ContainerID != "b" {
+		t.Errorf("got %+v, want the fork of b", e)
+	}
+}
+
+func TestEventLogDropsSlowSubscriber(t *testing.T) {
+	l := newEventLog()
+	_, sub := l.subscribe(EventFilter{}, time.Time{})
+	for i := 0; i <= subscriberBuffer; i++ {
+		l.publish(Event{Time: time.Now(), Type: container.ContainerPause, ContainerID: "a"}, "")
+	}
+	for range sub.C {
+	}
+	if !errors.Is(sub.Err(), ErrEventsLagged) {
+		t.Fatalf("subscription ended with %v, want ErrEventsLagged", sub.Err())
+	}
+}
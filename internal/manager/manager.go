@@ -1,89 +1,240 @@
 package manager
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"parkerdgabel/sockd/internal/code"
+	"parkerdgabel/sockd/internal/function"
 	"parkerdgabel/sockd/internal/image"
+	"parkerdgabel/sockd/internal/logging"
+	"parkerdgabel/sockd/internal/metrics"
 	"parkerdgabel/sockd/internal/storage"
+	"parkerdgabel/sockd/internal/tracing"
 	"parkerdgabel/sockd/pkg/cgroup"
 	"parkerdgabel/sockd/pkg/container"
 	"parkerdgabel/sockd/pkg/zygote"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
+var ErrContainerNotFound = errors.New("container not found")
+
+var logger = logging.For(logging.Manager)
+
+// Config holds the settings of the manager and of everything it creates
+type Config struct {
+	// BaseDir is where the state and the dirs of containers are kept
+	BaseDir   string            `mapstructure:"base_dir"`
+	Cgroup    cgroup.PoolConfig `mapstructure:"cgroup"`
+	Zygote    zygote.Config     `mapstructure:"zygote"`
+	Container container.Config  `mapstructure:"container"`
+	Image     image.Config      `mapstructure:"image"`
+	// Tenants holds the quotas of each tenant. The default tenant may be
+	// listed to give it quotas too.
+	Tenants map[string]TenantConfig `mapstructure:"tenants"`
+}
+
+// DefaultConfig returns the Config used unless configured otherwise
+func DefaultConfig() Config {
+	return Config{
+		BaseDir:   storage.DefaultBaseDir,
+		Cgroup:    cgroup.DefaultPoolConfig(),
+		Zygote:    zygote.DefaultConfig(),
+		Container: container.DefaultConfig(),
+		Image:     image.DefaultConfig(),
+	}
+}
+
+func (c Config) Validate() error {
+	if !filepath.IsAbs(c.BaseDir) {
+		return fmt.Errorf("base_dir must be an absolute path, not %q", c.BaseDir)
+	}
+	err := errors.Join(c.Cgroup.Validate(), c.Zygote.Validate(), c.Container.Validate(), c.Image.Validate())
+	for name, tenant := range c.Tenants {
+		if !validTenantName.MatchString(name) {
+			err = errors.Join(err, fmt.Errorf("invalid tenant name %q: it must be lowercase letters, digits and dashes", name))
+		}
+		if tenantErr := tenant.Validate(); tenantErr != nil {
+			err = errors.Join(err, fmt.Errorf("tenant %s: %w", name, tenantErr))
+		}
+	}
+	return err
+}
+
 type Manager struct {
-	rootDirs        *storage.DirMaker
-	scratchDirs     *storage.DirMaker
-	codeDirs        *storage.DirMaker
-	imageCache      *image.ImageCache
-	cgroupPool      *cgroup.Pool
-	ppPool          *cgroup.Pool
-	mapMutex        sync.Mutex
-	containers      map[string]*container.Container
-	zygoteProviders map[string]zygote.Provider
+	// configMutex guards config and tenants
+	configMutex sync.Mutex
+	config      Config
+	tenants     map[string]*tenant
+	rootDirs    *storage.DirMaker
+	scratchDirs *storage.DirMaker
+	codeDirs    *storage.DirMaker
+	imageCache  *image.ImageCache
+	ppPool      *cgroup.Pool
+	mapMutex    sync.Mutex
+	containers  map[string]*container.Container
+	warm        map[string]*warmPool
+	// code dirs of deleted functions that containers still run
+	staleCode map[string]bool
+	state     *storage.StateStore
+	events    *eventLog
+	// creates and invocations are refused while draining
+	draining atomic.Bool
+	inFlight atomic.Int64
 }
 
-func NewManager() *Manager {
-	rootDirs, err := storage.NewDirMaker("root", storage.STORE_PRIVATE)
+func NewManager(config Config) (*Manager, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	state, err := storage.NewStateStore(storage.StateFile(config.BaseDir))
 	if err != nil {
-		return nil
+		return nil, fmt.Errorf("failed to load state: %w", err)
 	}
-	scratchDirs, err := storage.NewDirMaker("scratch", storage.STORE_PRIVATE)
+	rootDirs, err := storage.NewDirMaker(config.BaseDir, "root", storage.STORE_PRIVATE)
 	if err != nil {
-		return nil
+		return nil, err
 	}
-
-	codeDirs, err := storage.NewDirMaker("code", storage.STORE_PRIVATE)
+	scratchDirs, err := storage.NewDirMaker(config.BaseDir, "scratch", storage.STORE_PRIVATE)
 	if err != nil {
-		return nil
+		return nil, err
 	}
 
-	pool, err := cgroup.NewPool("sockd")
+	codeDirs, err := storage.NewDirMaker(config.BaseDir, "code", storage.STORE_PRIVATE)
 	if err != nil {
-		return nil
+		return nil, err
 	}
-	ppPool, err := cgroup.NewPool("sockd_pp")
+
+	ppPool, err := cgroup.NewPool("sockd_pp", config.Cgroup)
 	if err != nil {
-		return nil
+		return nil, err
 	}
-	zygoteProviders := make(map[string]zygote.Provider)
-	return &Manager{
-		rootDirs:        rootDirs,
-		scratchDirs:     scratchDirs,
-		codeDirs:        codeDirs,
-		cgroupPool:      pool,
-		ppPool:          ppPool,
-		imageCache:      image.NewImageCache(),
-		containers:      make(map[string]*container.Container),
-		mapMutex:        sync.Mutex{},
-		zygoteProviders: zygoteProviders,
+	metrics.RegisterCgroupPool(ppPool.Name, ppPool)
+	m := &Manager{
+		config:      config,
+		tenants:     make(map[string]*tenant),
+		rootDirs:    rootDirs,
+		scratchDirs: scratchDirs,
+		codeDirs:    codeDirs,
+		ppPool:      ppPool,
+		imageCache:  image.NewImageCache(config.BaseDir, config.Image),
+		containers:  make(map[string]*container.Container),
+		mapMutex:    sync.Mutex{},
+		warm:        make(map[string]*warmPool),
+		staleCode:   make(map[string]bool),
+		state:       state,
+		events:      newEventLog(),
+	}
+	for _, name := range tenantNames(config) {
+		if _, err := m.addTenant(name, config.Tenants[name], config.Cgroup); err != nil {
+			return nil, fmt.Errorf("tenant %s: %w", name, err)
+		}
 	}
+	m.recover()
+	return m, nil
 }
 
-func (m *Manager) GetContainer(id string) (*container.Container, bool) {
+// GetContainer returns a container of a tenant. Containers of other
+// tenants are not found.
+func (m *Manager) GetContainer(tenant, id string) (*container.Container, bool) {
 	m.mapMutex.Lock()
 	defer m.mapMutex.Unlock()
 	container, ok := m.containers[id]
-	return container, ok
+	if !ok || tenantOf(container) != orDefault(tenant) {
+		return nil, false
+	}
+	return container, true
 }
 
 func (m *Manager) SetContainer(name string, container *container.Container) {
 	m.mapMutex.Lock()
-	defer m.mapMutex.Unlock()
 	m.containers[name] = container
+	m.mapMutex.Unlock()
+	err := m.state.Update(container.ID(), func(rec *storage.ContainerRecord) {
+		fillRecord(rec, container)
+		rec.Managed = true
+	})
+	if err != nil {
+		logger.Error("failed to save container state", "container_id", container.ID(), "error", err)
+	}
+}
+
+func (m *Manager) CreateContainer(ctx context.Context, tenant string, meta *container.Meta, name string) (*container.Container, error) {
+	if err := m.begin(); err != nil {
+		return nil, err
+	}
+	defer m.end()
+	t, err := m.tenant(tenant)
+	if err != nil {
+		return nil, err
+	}
+	if meta.CodeUrl == "" {
+		return nil, fmt.Errorf("code url not found")
+	}
+	if err := meta.ValidateLimits(); err != nil {
+		return nil, err
+	}
+	codeDir, err := m.codeDirs.Make(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := code.PullCode(ctx, meta.CodeUrl, codeDir); err != nil {
+		return nil, err
+	}
+	meta.Tenant = t.name
+	return m.createContainer(ctx, t, meta, codeDir)
+}
+
+// CreateFunctionContainer creates a leaf container for a registered
+// function, reusing the code that was pulled when the version was
+// registered. The target is the function name, optionally followed by
+// an alias or version as in "name:prod".
+func (m *Manager) CreateFunctionContainer(ctx context.Context, tenant, target string) (*container.Container, error) {
+	if err := m.begin(); err != nil {
+		return nil, err
+	}
+	defer m.end()
+	t, err := m.tenant(tenant)
+	if err != nil {
+		return nil, err
+	}
+	_, version, err := t.functions.Resolve(target)
+	if err != nil {
+		return nil, err
+	}
+	return m.createVersionContainer(ctx, t, version)
+}
+
+func (m *Manager) createVersionContainer(ctx context.Context, t *tenant, version *function.Version) (*container.Container, error) {
+	meta := version.Meta
+	return m.createContainer(ctx, t, meta.MakeLeaf(), version.CodeDir)
 }
 
-func (m *Manager) CreateContainer(meta *container.Meta, name string) (*container.Container, error) {
+func (m *Manager) createContainer(ctx context.Context, t *tenant, meta *container.Meta, codeDir string) (_ *container.Container, err error) {
 	config := &image.ContainerfileConfig{
 		BaseImageName:    meta.BaseImageName,
 		BaseImageVersion: meta.BaseImageVersion,
 		Runtime:          meta.Runtime,
 	}
+	ctx, span := tracing.Start(ctx, "manager.create_container",
+		attribute.String("sockd.tenant", t.name),
+		attribute.String("sockd.image.key", config.Key()),
+		attribute.StringSlice("sockd.packages", meta.Installs))
+	defer tracing.End(span, &err)
+
 	dir, found := m.imageCache.GetImage(config.Key())
 	if !found {
-		if err := m.imageCache.BuildImage(config); err != nil {
+		start := time.Now()
+		err := m.imageCache.BuildImage(ctx, config)
+		metrics.ImageBuilds.WithLabelValues(metrics.Result(err)).Inc()
+		metrics.ImageBuildDuration.Observe(metrics.Since(start))
+		if err != nil {
 			return nil, err
 		}
 		dir, found = m.imageCache.GetImage(config.Key())
@@ -91,27 +242,11 @@ func (m *Manager) CreateContainer(meta *container.Meta, name string) (*container
 			return nil, fmt.Errorf("failed to build image")
 		}
 	}
-	if meta.CodeUrl == "" {
-		return nil, fmt.Errorf("code url not found")
-	}
-
-	if err := code.PullCode(meta.CodeUrl, m.codeDirs.Make(name)); err != nil {
+	provider, err := m.zygoteProvider(t, config.Key(), meta, dir)
+	if err != nil {
 		return nil, err
 	}
-	provider, found := m.zygoteProviders[config.Key()]
-	if !found {
-		ppCgroup, err := m.ppPool.RetrieveCgroup(time.Duration(1) * time.Second)
-		if err != nil {
-			return nil, err
-		}
-		pullerInstaller, err := container.NewPackagePullerInstaller(meta, dir, m.rootDirs.Make("pp-"+config.Key()), ppCgroup)
-		if err != nil {
-			return nil, err
-		}
-		provider = zygote.NewProvider(m.rootDirs, m.codeDirs, m.scratchDirs, dir, m.cgroupPool, pullerInstaller)
-		m.zygoteProviders[config.Key()] = provider
-	}
-	c, err := provider.ProvideZygote(name, meta)
+	c, err := provider.ProvideZygote(ctx, codeDir, meta)
 	if err != nil {
 		return nil, err
 	}
@@ -128,7 +263,7 @@ func (m *Manager) CreateContainer(meta *container.Meta, name string) (*container
 	// 	return nil, fmt.Errorf("parent container not found")
 	// }
 
-	// if err := m.installPackages(meta, dir); err != nil {
+	// if err := m.installPackages(ctx, meta, dir); err != nil {
 	// 	return nil, err
 	// }
 
@@ -137,23 +272,117 @@ func (m *Manager) CreateContainer(meta *container.Meta, name string) (*container
 	// 	return nil, err
 	// }
 
+	span.SetAttributes(attribute.String("sockd.container.id", c.ID()))
 	m.SetContainer(c.ID(), c)
+	metrics.ContainersCreated.WithLabelValues(string(meta.Runtime)).Inc()
 	return c, nil
 }
 
-func (m *Manager) installPackages(meta *container.Meta, baseImageDir string) error {
+// zygoteProvider returns the Zygote provider of an image for a tenant,
+// creating it on first use
+func (m *Manager) zygoteProvider(t *tenant, key string, meta *container.Meta, dir string) (zygote.Provider, error) {
+	m.configMutex.Lock()
+	defer m.configMutex.Unlock()
+	if provider, found := t.zygoteProviders[key]; found {
+		return provider, nil
+	}
+	ppCgroup, err := m.ppPool.RetrieveCgroup(time.Duration(1) * time.Second)
+	if err != nil {
+		return nil, err
+	}
+	ppRootDir, err := m.rootDirs.Make("pp-" + key)
+	if err != nil {
+		ppCgroup.Release()
+		return nil, err
+	}
+	pullerInstaller, err := container.NewPackagePullerInstaller(meta, dir, ppRootDir, ppCgroup, m.config.Container)
+	if err != nil {
+		ppCgroup.Release()
+		if err := os.RemoveAll(ppRootDir); err != nil {
+			logger.Warn("failed to remove dir", "path", ppRootDir, "error", err)
+		}
+		return nil, err
+	}
+	config := t.zygoteConfig(m.config.Zygote)
+	provider := zygote.NewProvider(config, m.config.Container, m.rootDirs, m.codeDirs, m.scratchDirs, dir, t.cgroupPool, countingPullerInstaller{pullerInstaller}, m.persist, m.publish, m.count, m.collectCode, m.forget)
+	evictor := zygote.NewEvictor(provider, config, m.config.Container)
+	provider.AddListener(evictor.Event)
+	t.zygoteProviders[key] = provider
+	t.evictors[key] = evictor
+	for _, claim := range t.claims[key] {
+		claim.take(provider.MemPool())
+	}
+	delete(t.claims, key)
+	metrics.RegisterMemPool(t.name, key, provider.MemPool())
+	return provider, nil
+}
+
+// currentConfig returns the config the manager runs with
+func (m *Manager) currentConfig() Config {
+	m.configMutex.Lock()
+	defer m.configMutex.Unlock()
+	return m.config
+}
+
+// Reconfigure applies a new config without a restart: the cgroup pools
+// are resized, the memory pool of every Zygote provider too, its
+// evictor gets the new eviction thresholds, tenants
+// are added or get their new quotas, and new containers and images get
+// the new settings. Warm Zygotes are kept. The base dir cannot change
+// while running, so it is left as it is.
+func (m *Manager) Reconfigure(config Config) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	m.configMutex.Lock()
+	defer m.configMutex.Unlock()
+	config.BaseDir = m.config.BaseDir
+
+	// the tenants go first, as they are all that may fail once config
+	// is valid, and nothing else has changed if they do
+	if err := m.configureTenants(config); err != nil {
+		return err
+	}
+	if err := m.ppPool.Configure(config.Cgroup); err != nil {
+		return err
+	}
+	for _, t := range m.tenants {
+		if err := t.cgroupPool.Configure(config.Cgroup); err != nil {
+			return err
+		}
+	}
+	for _, t := range m.tenants {
+		zygoteConfig := t.zygoteConfig(config.Zygote)
+		for key, provider := range t.zygoteProviders {
+			provider.Configure(zygoteConfig, config.Container)
+			// the evictors are gone once the manager shuts down
+			if evictor, ok := t.evictors[key]; ok {
+				evictor.Configure(zygoteConfig, config.Container)
+			}
+		}
+	}
+	m.imageCache.Configure(config.Image)
+	m.config = config
+	logger.Info("manager reconfigured")
+	return nil
+}
+
+func (m *Manager) installPackages(ctx context.Context, meta *container.Meta, baseImageDir string) error {
 	for _, pkg := range meta.Installs {
-		ppRootDir := m.rootDirs.Make("pp-" + pkg)
+		ppRootDir, err := m.rootDirs.Make("pp-" + pkg)
+		if err != nil {
+			return err
+		}
 		cgroup, err := m.ppPool.RetrieveCgroup(time.Duration(1) * time.Second)
 		defer cgroup.Release()
 		if err != nil {
 			return err
 		}
-		puller, err := container.NewPackagePullerInstaller(meta, baseImageDir, ppRootDir, cgroup)
+		puller, err := container.NewPackagePullerInstaller(meta, baseImageDir, ppRootDir, cgroup, m.currentConfig().Container)
 		if err != nil {
 			return err
 		}
-		if _, err := puller.PullPackage(pkg); err != nil {
+		if _, err := puller.PullPackage(ctx, pkg); err != nil {
 			return err
 		}
 		if err := os.RemoveAll(ppRootDir); err != nil {
@@ -163,28 +392,35 @@ func (m *Manager) installPackages(meta *container.Meta, baseImageDir string) err
 	return nil
 }
 
-func (m *Manager) StartContainer(id string) error {
-	container, ok := m.GetContainer(id)
+func (m *Manager) StartContainer(tenant, id string) error {
+	container, ok := m.GetContainer(tenant, id)
 	if !ok {
-		return fmt.Errorf("container not found")
+		return fmt.Errorf("%w: %s", ErrContainerNotFound, id)
 	}
 	return container.Start()
 }
 
-func (m *Manager) ListContainers() []string {
+// ListContainers returns the ids of the containers of a tenant
+func (m *Manager) ListContainers(tenant string) ([]string, error) {
+	t, err := m.tenant(tenant)
+	if err != nil {
+		return nil, err
+	}
 	m.mapMutex.Lock()
 	defer m.mapMutex.Unlock()
 	containers := make([]string, 0, len(m.containers))
-	for k := range m.containers {
-		containers = append(containers, k)
+	for k, c := range m.containers {
+		if tenantOf(c) == t.name {
+			containers = append(containers, k)
+		}
 	}
-	return containers
+	return containers, nil
 }
 
-func (m *Manager) DestroyContainer(id string) error {
-	container, ok := m.GetContainer(id)
+func (m *Manager) DestroyContainer(tenant, id string) error {
+	container, ok := m.GetContainer(tenant, id)
 	if !ok {
-		return fmt.Errorf("container not found")
+		return fmt.Errorf("%w: %s", ErrContainerNotFound, id)
 	}
 	if err := container.Destroy(); err != nil {
 		return err
@@ -192,64 +428,70 @@ func (m *Manager) DestroyContainer(id string) error {
 	m.mapMutex.Lock()
 	defer m.mapMutex.Unlock()
 	delete(m.containers, id)
+	m.removeIdle(id)
 	return nil
 }
 
-func (m *Manager) ForkContainer(id string) error {
-	container, ok := m.GetContainer(id)
+// forget drops a container destroyed behind the back of the manager, as
+// the evictor does, so it is never handed out again
+func (m *Manager) forget(event container.ContainerEventType, c *container.Container) {
+	if event != container.ContainerDestroy {
+		return
+	}
+	m.mapMutex.Lock()
+	defer m.mapMutex.Unlock()
+	delete(m.containers, c.ID())
+	m.removeIdle(c.ID())
+}
+
+func (m *Manager) ForkContainer(ctx context.Context, tenant, id string) error {
+	container, ok := m.GetContainer(tenant, id)
 	if !ok {
-		return fmt.Errorf("container not found")
+		return fmt.Errorf("%w: %s", ErrContainerNotFound, id)
 	}
-	dstContainer, err := m.CreateContainer(container.Meta(), "forked")
+	dstContainer, err := m.CreateContainer(ctx, tenant, container.Meta(), "forked")
 	if err != nil {
 		return err
 	}
-	if err := container.Fork(dstContainer); err != nil {
+	if err := container.Fork(ctx, dstContainer); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func (m *Manager) StopContainer(id string) error {
-	container, ok := m.GetContainer(id)
+func (m *Manager) StopContainer(tenant, id string) error {
+	container, ok := m.GetContainer(tenant, id)
 	if !ok {
-		return fmt.Errorf("container not found")
+		return fmt.Errorf("%w: %s", ErrContainerNotFound, id)
 	}
 	return container.Stop()
 }
 
-func (m *Manager) PauseContainer(id string) error {
-	container, ok := m.GetContainer(id)
+func (m *Manager) PauseContainer(tenant, id string) error {
+	container, ok := m.GetContainer(tenant, id)
 	if !ok {
-		return fmt.Errorf("container not found")
+		return fmt.Errorf("%w: %s", ErrContainerNotFound, id)
 	}
 	return container.Pause()
 }
 
-func (m *Manager) UnpauseContainer(id string) error {
-	container, ok := m.GetContainer(id)
+func (m *Manager) UnpauseContainer(tenant, id string) error {
+	container, ok := m.GetContainer(tenant, id)
 	if !ok {
-		return fmt.Errorf("container not found")
+		return fmt.Errorf("%w: %s", ErrContainerNotFound, id)
 	}
 	return container.Unpause()
 }
 
-func (m *Manager) Shutdown() error {
-	m.mapMutex.Lock()
-	defer m.mapMutex.Unlock()
-	for _, container := range m.containers {
-		if err := container.Destroy(); err != nil {
-			return err
-		}
-	}
-	if err := m.cgroupPool.Destroy(); err != nil {
-		return err
+func (m *Manager) InvokeContainer(ctx context.Context, tenant, id string, body []byte, contentType string) (*container.InvokeResult, error) {
+	if err := m.begin(); err != nil {
+		return nil, err
 	}
-
-	if err := m.ppPool.Destroy(); err != nil {
-		return err
+	defer m.end()
+	container, ok := m.GetContainer(tenant, id)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrContainerNotFound, id)
 	}
-
-	return nil
+	return container.Invoke(ctx, body, contentType)
 }
@@ -0,0 +1,26 @@
+package manager
+
+import (
+	"context"
+	"parkerdgabel/sockd/internal/metrics"
+	"parkerdgabel/sockd/pkg/container"
+	"time"
+)
+
+// count is a ContainerEventHandler that feeds the event metrics
+func (m *Manager) count(event container.ContainerEventType, c *container.Container) {
+	metrics.ContainerEvents.WithLabelValues(event.String()).Inc()
+}
+
+// countingPullerInstaller times the packages pulled for the import cache
+type countingPullerInstaller struct {
+	container.PackagePullerInstaller
+}
+
+func (p countingPullerInstaller) PullPackage(ctx context.Context, pkg string) (*container.Package, error) {
+	start := time.Now()
+	pa, err := p.PackagePullerInstaller.PullPackage(ctx, pkg)
+	metrics.PackageInstalls.WithLabelValues(metrics.Result(err)).Inc()
+	metrics.PackageInstallDuration.Observe(metrics.Since(start))
+	return pa, err
+}
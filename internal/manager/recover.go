@@ -0,0 +1,264 @@
+package manager
+
+import (
+	"fmt"
+	"os"
+	"parkerdgabel/sockd/internal/image"
+	"parkerdgabel/sockd/internal/storage"
+	"parkerdgabel/sockd/pkg/cgroup"
+	"parkerdgabel/sockd/pkg/container"
+	"parkerdgabel/sockd/pkg/zygote"
+	"sync"
+	"syscall"
+)
+
+// persist keeps the record of a container in the state store up to date
+// with the events that matter to recovery: a stopped container gave its
+// cgroup back, and a destroyed one is gone. The store is rewritten on
+// every save, so the other events are left out; recovery tells a paused
+// container from a running one by its cgroup.
+func (m *Manager) persist(event container.ContainerEventType, c *container.Container) {
+	// Zygotes are never adopted
+	if c.Meta().IsZygote() {
+		return
+	}
+	var err error
+	switch event {
+	case container.ContainerStop:
+		err = m.state.Update(c.ID(), func(rec *storage.ContainerRecord) {
+			fillRecord(rec, c)
+		})
+	case container.ContainerDestroy:
+		err = m.state.Delete(c.ID())
+	default:
+		return
+	}
+	if err != nil {
+		logger.Error("failed to save container state", "container_id", c.ID(), "error", err)
+	}
+}
+
+func fillRecord(rec *storage.ContainerRecord, c *container.Container) {
+	rec.State = c.State().String()
+	rec.Zygote = c.Meta().IsZygote()
+	rec.RootDir = c.RootDir()
+	rec.CodeDir = c.CodeDir()
+	rec.ScratchDir = c.ScratchDir()
+	rec.Meta = *c.Meta()
+	rec.Created = c.Created()
+	if parent := c.Parent(); parent != nil {
+		rec.ParentID = parent.ID()
+	}
+	// a stopped container gave its cgroup back to the pool
+	rec.Pool, rec.Cgroup = "", ""
+	if cg := c.Cgroup(); cg != nil {
+		rec.Pool = cg.PoolName()
+		rec.Cgroup = cg.Name()
+	}
+}
+
+// recover re-adopts the containers handed out by a daemon that did not
+// shut down cleanly, if their processes are still alive, and claims
+// their memory limits in the memory pools of their images, keeps the code
+// of the functions registered with it, and cleans up everything else it
+// left behind: cgroups, mounts and dirs
+func (m *Manager) recover() {
+	keepCgroups := make(map[string]bool)
+	keepDirs := make(map[string]bool)
+	adopted := make(map[string]bool)
+	for _, rec := range m.state.Records() {
+		// the import cache is rebuilt on demand, so Zygotes are
+		// never adopted, but their children may be
+		if !rec.Managed || rec.Zygote {
+			continue
+		}
+		c, err := m.restore(rec)
+		if err != nil {
+			logger.Warn("not recovering container", "container_id", rec.ID, "error", err)
+			continue
+		}
+		logger.Info("recovered container", "container_id", c.ID(), "state", c.State().String())
+		m.containers[c.ID()] = c
+		adopted[c.ID()] = true
+		keepCgroups[rec.Pool+"/"+rec.Cgroup] = true
+		keepDirs[rec.RootDir] = true
+		keepDirs[rec.ScratchDir] = true
+		keepDirs[rec.CodeDir] = true
+	}
+	if err := m.state.Reset(adopted); err != nil {
+		logger.Error("failed to save state", "error", err)
+	}
+
+	// the registries kept their functions, and the code of those is
+	// kept too. Functions of tenants that are gone are dropped.
+	for _, t := range m.tenants {
+		for _, dir := range t.functions.CodeDirs() {
+			keepDirs[dir] = true
+		}
+	}
+	for _, tenant := range m.state.FunctionTenants() {
+		if _, ok := m.tenants[tenant]; ok {
+			continue
+		}
+		for _, rec := range m.state.Functions(tenant) {
+			logger.Warn("not recovering function, its tenant is gone", "tenant", tenant, "function", rec.Name)
+			if err := m.state.DeleteFunction(tenant, rec.Name); err != nil {
+				logger.Error("failed to save state", "error", err)
+			}
+		}
+	}
+
+	pools := []*cgroup.Pool{m.ppPool}
+	for _, t := range m.tenants {
+		pools = append(pools, t.cgroupPool)
+	}
+	for _, pool := range pools {
+		for _, name := range pool.Stale() {
+			if keepCgroups[pool.Name+"/"+name] {
+				continue
+			}
+			if err := killCgroup(pool, name); err != nil {
+				logger.Warn("failed to remove stale cgroup", "pool", pool.Name, "cgroup", name, "error", err)
+			}
+		}
+	}
+
+	for _, dirs := range []*storage.DirMaker{m.rootDirs, m.scratchDirs, m.codeDirs} {
+		if err := cleanDirs(dirs, keepDirs); err != nil {
+			logger.Warn("failed to clean up", "path", dirs.Prefix(), "error", err)
+		}
+	}
+}
+
+func (m *Manager) restore(rec storage.ContainerRecord) (*container.Container, error) {
+	if rec.Cgroup == "" {
+		return nil, fmt.Errorf("container was %s", rec.State)
+	}
+	t, err := m.tenant(rec.Meta.Tenant)
+	if err != nil {
+		return nil, err
+	}
+	if rec.Pool != t.cgroupPool.Name {
+		return nil, fmt.Errorf("cgroup %s/%s is not in pool %s", rec.Pool, rec.Cgroup, t.cgroupPool.Name)
+	}
+	cg, err := t.cgroupPool.Adopt(rec.Cgroup)
+	if err != nil {
+		return nil, err
+	}
+	meta := rec.Meta
+	meta.Tenant = t.name
+	config := m.currentConfig().Container
+	memLimitMB, _ := config.Limits(&meta)
+	claim := &memClaim{mb: memLimitMB}
+	c, err := container.Restore(rec.ID, rec.RootDir, rec.CodeDir, rec.ScratchDir, cg, meta.MakeLeaf(), rec.Created, config, []container.ContainerEventHandler{m.persist, m.publish, m.count, m.collectCode, claim.release})
+	if err != nil {
+		return nil, err
+	}
+	key := (&image.ContainerfileConfig{
+		BaseImageName:    meta.BaseImageName,
+		BaseImageVersion: meta.BaseImageVersion,
+		Runtime:          meta.Runtime,
+	}).Key()
+	m.configMutex.Lock()
+	t.claims[key] = append(t.claims[key], claim)
+	m.configMutex.Unlock()
+	return c, nil
+}
+
+// memClaim holds the memory limit of a recovered container in the
+// memory pool of its image until it stops. The pool comes with the
+// Zygote provider of the image, which is only created on first use, so
+// the memory is claimed then, if the container is still running.
+type memClaim struct {
+	mutex    sync.Mutex
+	mb       int
+	pool     *zygote.MemPool
+	released bool
+}
+
+// take claims the memory in pool, as the container runs already
+func (claim *memClaim) take(pool *zygote.MemPool) {
+	claim.mutex.Lock()
+	defer claim.mutex.Unlock()
+	if claim.released || claim.pool != nil {
+		return
+	}
+	claim.pool = pool
+	pool.Claim(claim.mb)
+}
+
+// release gives the memory back once the container is stopped or
+// destroyed
+func (claim *memClaim) release(event container.ContainerEventType, c *container.Container) {
+	if event != container.ContainerStop && event != container.ContainerDestroy {
+		return
+	}
+	claim.mutex.Lock()
+	defer claim.mutex.Unlock()
+	if claim.released {
+		return
+	}
+	claim.released = true
+	if claim.pool != nil {
+		claim.pool.Return(claim.mb)
+	}
+}
+
+func killCgroup(pool *cgroup.Pool, name string) error {
+	cg, err := pool.Adopt(name)
+	if err != nil {
+		return err
+	}
+	logger.Info("killing stale cgroup", "pool", pool.Name, "cgroup", name)
+	if err := cg.KillAllProcs(); err != nil {
+		return err
+	}
+	return cg.Destroy()
+}
+
+// unmount and remove every dir under dirs that is not in keep
+func cleanDirs(dirs *storage.DirMaker, keep map[string]bool) error {
+	mounts, err := storage.MountsUnder(dirs.Prefix())
+	if err != nil {
+		return err
+	}
+	for _, mount := range mounts {
+		if mount == dirs.Prefix() || isKept(mount, keep) {
+			continue
+		}
+		logger.Info("unmounting stale mount", "path", mount)
+		if err := syscall.Unmount(mount, syscall.MNT_DETACH); err != nil {
+			logger.Warn("failed to unmount", "path", mount, "error", err)
+		}
+	}
+
+	entries, err := dirs.Entries()
+	if err != nil {
+		return err
+	}
+	for _, dir := range entries {
+		if keep[dir] {
+			continue
+		}
+		// removing a dir that still has the base image mounted
+		// would delete the image
+		if mounts, err := storage.MountsUnder(dir); err != nil || len(mounts) > 0 {
+			logger.Warn("not removing dir, it is still mounted", "path", dir)
+			continue
+		}
+		logger.Info("removing stale dir", "path", dir)
+		if err := os.RemoveAll(dir); err != nil {
+			logger.Warn("failed to remove dir", "path", dir, "error", err)
+		}
+	}
+	return nil
+}
+
+func isKept(path string, keep map[string]bool) bool {
+	for dir := range keep {
+		if storage.IsUnder(path, dir) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,40 @@
+package manager
+
+import (
+	"parkerdgabel/sockd/pkg/container"
+	"parkerdgabel/sockd/pkg/zygote"
+	"testing"
+	"time"
+)
+
+// waitAvailable waits for the monitoring copy of the free memory of pool
+// to catch up with the requests sent to it
+func waitAvailable(t *testing.T, pool *zygote.MemPool, want int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for pool.AvailableMB() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("available = %d MB, want %d", pool.AvailableMB(), want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMemClaim(t *testing.T) {
+	pool := zygote.NewMemPool("test", 100)
+
+	running := &memClaim{mb: 30}
+	running.take(pool)
+	running.take(pool)
+	waitAvailable(t, pool, 70)
+	running.release(container.ContainerPause, nil)
+	running.release(container.ContainerStop, nil)
+	running.release(container.ContainerDestroy, nil)
+	waitAvailable(t, pool, 100)
+
+	// a container stopped before its provider was created claims nothing
+	stopped := &memClaim{mb: 30}
+	stopped.release(container.ContainerDestroy, nil)
+	stopped.take(pool)
+	waitAvailable(t, pool, 100)
+}
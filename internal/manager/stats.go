@@ -0,0 +1,75 @@
+package manager
+
+import (
+	"fmt"
+	"parkerdgabel/sockd/pkg/cgroup"
+	"parkerdgabel/sockd/pkg/container"
+)
+
+// ContainerStats is the resource usage of a container
+type ContainerStats struct {
+	Container *container.Container
+	// Zygote is set for the Zygotes containers are forked from
+	Zygote bool
+	Stats  *cgroup.Stats
+}
+
+// Stats returns the resource usage of the containers of a tenant, its
+// Zygotes and the children of both included, or only of the one with id
+// if it is set. Containers without a cgroup, such as stopped ones, are
+// left out.
+func (m *Manager) Stats(tenant, id string) ([]ContainerStats, error) {
+	t, err := m.tenant(tenant)
+	if err != nil {
+		return nil, err
+	}
+
+	m.configMutex.Lock()
+	var zygotes []*container.Container
+	for _, provider := range t.zygoteProviders {
+		zygotes = append(zygotes, provider.Zygotes()...)
+	}
+	m.configMutex.Unlock()
+	m.mapMutex.Lock()
+	containers := make([]*container.Container, 0, len(m.containers))
+	for _, c := range m.containers {
+		if tenantOf(c) == t.name {
+			containers = append(containers, c)
+		}
+	}
+	m.mapMutex.Unlock()
+
+	isZygote := make(map[string]bool, len(zygotes))
+	for _, c := range zygotes {
+		isZygote[c.ID()] = true
+	}
+	var stats []ContainerStats
+	seen := make(map[string]bool)
+	var add func(c *container.Container)
+	add = func(c *container.Container) {
+		if seen[c.ID()] {
+			return
+		}
+		seen[c.ID()] = true
+		if cg := c.Cgroup(); cg != nil && (id == "" || c.ID() == id) {
+			if s, err := cg.Stats(); err == nil {
+				stats = append(stats, ContainerStats{Container: c, Zygote: isZygote[c.ID()], Stats: s})
+			} else {
+				logger.Debug("failed to read container stats", "container_id", c.ID(), "error", err)
+			}
+		}
+		for _, child := range c.Children() {
+			add(child)
+		}
+	}
+	for _, c := range zygotes {
+		add(c)
+	}
+	for _, c := range containers {
+		add(c)
+	}
+	if id != "" && len(stats) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrContainerNotFound, id)
+	}
+	return stats, nil
+}
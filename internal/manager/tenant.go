@@ -0,0 +1,224 @@
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"parkerdgabel/sockd/internal/function"
+	"parkerdgabel/sockd/internal/metrics"
+	"parkerdgabel/sockd/pkg/cgroup"
+	"parkerdgabel/sockd/pkg/container"
+	"parkerdgabel/sockd/pkg/zygote"
+	"regexp"
+	"sort"
+)
+
+// DefaultTenant owns the containers and functions of requests that name
+// no tenant. It always exists.
+const DefaultTenant = "default"
+
+var ErrTenantNotFound = errors.New("tenant not found")
+
+var validTenantName = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// TenantConfig holds the quotas of a tenant. Zero means no limit.
+type TenantConfig struct {
+	// MemLimitMB, CPUPercent and PidsMax cap all the containers of the
+	// tenant together, through its parent cgroup
+	MemLimitMB int   `mapstructure:"mem_limit_mb"`
+	CPUPercent int   `mapstructure:"cpu_percent"`
+	PidsMax    int64 `mapstructure:"pids_max"`
+	// MemPoolMB is the memory of the containers of the tenant for each
+	// base image, instead of zygote.mem_pool_mb. Each of these pools has
+	// its own evictor, which only sees the containers of the tenant and
+	// the memory pressure of its cgroup pool, so they are only evicted
+	// to make room for the tenant itself.
+	MemPoolMB int `mapstructure:"mem_pool_mb"`
+}
+
+func (c TenantConfig) Validate() error {
+	if c.MemLimitMB < 0 || c.CPUPercent < 0 || c.PidsMax < 0 || c.MemPoolMB < 0 {
+		return errors.New("tenant quotas must not be negative")
+	}
+	if c.MemPoolMB == 1 {
+		return errors.New("tenant mem_pool_mb must be at least 2")
+	}
+	return nil
+}
+
+func (c TenantConfig) limits() cgroup.Limits {
+	return cgroup.Limits{MemLimitMB: c.MemLimitMB, CPUPercent: c.CPUPercent, PidsMax: c.PidsMax}
+}
+
+// tenant is a namespace of containers and functions with its own cgroup
+// pool, whose parent cgroup enforces the quotas of the tenant, and its
+// own Zygotes
+type tenant struct {
+	name       string
+	config     TenantConfig
+	cgroupPool *cgroup.Pool
+	functions  *function.Registry
+	// Zygote providers by image key, and the evictors that free their
+	// memory pools, guarded by the configMutex of the manager
+	zygoteProviders map[string]zygote.Provider
+	evictors        map[string]*zygote.Evictor
+	// memory claims of recovered containers by image key, waiting for
+	// the provider of their image, guarded by the configMutex too
+	claims map[string][]*memClaim
+}
+
+// tenantPoolName returns the name of the cgroup pool of a tenant. The
+// default tenant has the pool of sockd before there were tenants.
+func tenantPoolName(name string) string {
+	if name == DefaultTenant {
+		return "sockd"
+	}
+	return "sockd-" + name
+}
+
+// orDefault returns the name of a tenant, the empty name being the
+// default tenant
+func orDefault(name string) string {
+	if name == "" {
+		return DefaultTenant
+	}
+	return name
+}
+
+// tenantOf returns the tenant of a container. Containers created before
+// there were tenants belong to the default one.
+func tenantOf(c *container.Container) string {
+	return orDefault(c.Meta().Tenant)
+}
+
+// addTenant creates a tenant and its cgroup pool. The caller must hold
+// configMutex, or be creating the manager.
+func (m *Manager) addTenant(name string, config TenantConfig, poolConfig cgroup.PoolConfig) (*tenant, error) {
+	t, err := m.newTenant(name, config, poolConfig)
+	if err != nil {
+		return nil, err
+	}
+	m.insertTenant(t)
+	return t, nil
+}
+
+// newTenant creates a tenant and its cgroup pool, without adding it to
+// the manager
+func (m *Manager) newTenant(name string, config TenantConfig, poolConfig cgroup.PoolConfig) (*tenant, error) {
+	pool, err := cgroup.NewPool(tenantPoolName(name), poolConfig)
+	if err != nil {
+		return nil, err
+	}
+	if err := pool.SetLimits(config.limits()); err != nil {
+		pool.Destroy()
+		return nil, err
+	}
+	return &tenant{
+		name:            name,
+		config:          config,
+		cgroupPool:      pool,
+		functions:       function.NewRegistry(m.codeDirs, m.state, name),
+		zygoteProviders: make(map[string]zygote.Provider),
+		evictors:        make(map[string]*zygote.Evictor),
+		claims:          make(map[string][]*memClaim),
+	}, nil
+}
+
+// insertTenant adds a tenant created by newTenant to the manager
+func (m *Manager) insertTenant(t *tenant) {
+	metrics.RegisterCgroupPool(t.cgroupPool.Name, t.cgroupPool)
+	m.tenants[t.name] = t
+	logger.Info("added tenant", "tenant", t.name)
+}
+
+// configureTenants adds the tenants of config that are new and applies
+// the quotas of those that exist. Tenants no longer in config are kept,
+// along with their containers, until the daemon restarts. Either every
+// tenant is configured or none is. The caller must hold configMutex.
+func (m *Manager) configureTenants(config Config) error {
+	var added []*tenant
+	var changed []*tenant
+	rollback := func() {
+		for _, t := range added {
+			if err := t.cgroupPool.Destroy(); err != nil {
+				logger.Warn("failed to destroy the cgroup pool of a tenant", "tenant", t.name, "error", err)
+			}
+		}
+		for _, t := range changed {
+			if err := t.cgroupPool.SetLimits(t.config.limits()); err != nil {
+				logger.Warn("failed to restore tenant quotas", "tenant", t.name, "error", err)
+			}
+		}
+	}
+	for _, name := range tenantNames(config) {
+		tc := config.Tenants[name]
+		t, ok := m.tenants[name]
+		if !ok {
+			created, err := m.newTenant(name, tc, config.Cgroup)
+			if err != nil {
+				rollback()
+				return fmt.Errorf("tenant %s: %w", name, err)
+			}
+			added = append(added, created)
+			continue
+		}
+		changed = append(changed, t)
+		if err := t.cgroupPool.SetLimits(tc.limits()); err != nil {
+			rollback()
+			return fmt.Errorf("tenant %s: %w", name, err)
+		}
+	}
+	for _, t := range changed {
+		t.config = config.Tenants[t.name]
+	}
+	for _, t := range added {
+		m.insertTenant(t)
+	}
+	return nil
+}
+
+// tenantNames returns the tenants of config, the default one included,
+// sorted
+func tenantNames(config Config) []string {
+	names := []string{DefaultTenant}
+	for name := range config.Tenants {
+		if name != DefaultTenant {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names[1:])
+	return names
+}
+
+// tenant returns a tenant by name, the empty name being the default
+// tenant
+func (m *Manager) tenant(name string) (*tenant, error) {
+	name = orDefault(name)
+	m.configMutex.Lock()
+	defer m.configMutex.Unlock()
+	t, ok := m.tenants[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrTenantNotFound, name)
+	}
+	return t, nil
+}
+
+// Tenants returns the names of the tenants, sorted
+func (m *Manager) Tenants() []string {
+	m.configMutex.Lock()
+	defer m.configMutex.Unlock()
+	names := make([]string, 0, len(m.tenants))
+	for name := range m.tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// zygoteConfig returns config with the memory pool of the tenant. The
+// caller must hold configMutex.
+func (t *tenant) zygoteConfig(config zygote.Config) zygote.Config {
+	if t.config.MemPoolMB > 0 {
+		config.MemPoolMB = t.config.MemPoolMB
+	}
+	return config
+}
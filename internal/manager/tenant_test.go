@@ -0,0 +1,34 @@
+package manager
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestConfigValidateTenants(t *testing.T) {
+	c := DefaultConfig()
+	c.Tenants = map[string]TenantConfig{"team-a": {MemLimitMB: 1024, PidsMax: 512}}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+	for name, tenant := range map[string]TenantConfig{
+		"Team-A": {},
+		"team-":  {},
+		"team-b": {CPUPercent: -1},
+		"team-c": {MemPoolMB: 1},
+	} {
+		c.Tenants = map[string]TenantConfig{name: tenant}
+		if err := c.Validate(); err == nil {
+			t.Errorf("Validate() accepted tenant %q %+v", name, tenant)
+		}
+	}
+}
+
+func TestTenantNames(t *testing.T) {
+	c := DefaultConfig()
+	c.Tenants = map[string]TenantConfig{"b": {}, DefaultTenant: {MemPoolMB: 64}, "a": {}}
+	want := []string{DefaultTenant, "a", "b"}
+	if got := tenantNames(c); !reflect.DeepEqual(got, want) {
+		t.Errorf("tenantNames() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,280 @@
+package manager
+
+import (
+	"context"
+	"os"
+	"parkerdgabel/sockd/internal/function"
+	"parkerdgabel/sockd/internal/metrics"
+	"parkerdgabel/sockd/pkg/container"
+)
+
+// warmPool holds the leaf containers of one version of a function that
+// are paused and waiting for a request
+type warmPool struct {
+	tenant   string
+	function string
+	version  string
+	idle     []*container.Container
+}
+
+func warmKey(tenant, name, version string) string {
+	return tenant + "/" + name + "@" + version
+}
+
+// Lease is a running container handed out to serve a single request.
+// It must be given back with ReleaseContainer.
+type Lease struct {
+	Container *container.Container
+	Tenant    string
+	Function  string
+	Version   string
+	// Cold is true when the container was created for this request
+	Cold bool
+}
+
+func (m *Manager) RegisterFunction(ctx context.Context, tenant, name string, meta *container.Meta) (*function.Function, *function.Version, error) {
+	t, err := m.tenant(tenant)
+	if err != nil {
+		return nil, nil, err
+	}
+	meta.Tenant = t.name
+	return t.functions.Register(ctx, name, meta)
+}
+
+// GetFunction returns a function of a tenant. Functions of other
+// tenants, or of tenants that do not exist, are not found.
+func (m *Manager) GetFunction(tenant, name string) (*function.Function, bool) {
+	t, err := m.tenant(tenant)
+	if err != nil {
+		return nil, false
+	}
+	return t.functions.Get(name)
+}
+
+func (m *Manager) ListFunctions(tenant string) ([]*function.Function, error) {
+	t, err := m.tenant(tenant)
+	if err != nil {
+		return nil, err
+	}
+	return t.functions.List(), nil
+}
+
+// SetFunctionAlias moves an alias and drains the paused containers of
+// versions that can no longer be invoked
+func (m *Manager) SetFunctionAlias(tenant, name, alias, version, canary string, canaryWeight int) (*function.Function, error) {
+	t, err := m.tenant(tenant)
+	if err != nil {
+		return nil, err
+	}
+	fn, err := t.functions.SetAlias(name, alias, version, canary, canaryWeight)
+	if err != nil {
+		return nil, err
+	}
+	m.drainVersions(t.name, fn.Name, fn.Live())
+	return fn, nil
+}
+
+// RollbackFunctionAlias moves an alias back to its previous version
+// and drains the paused containers of versions that can no longer be
+// invoked
+func (m *Manager) RollbackFunctionAlias(tenant, name, alias string) (*function.Function, error) {
+	t, err := m.tenant(tenant)
+	if err != nil {
+		return nil, err
+	}
+	fn, err := t.functions.RollbackAlias(name, alias)
+	if err != nil {
+		return nil, err
+	}
+	m.drainVersions(t.name, fn.Name, fn.Live())
+	return fn, nil
+}
+
+// DeleteFunction unregisters a function, destroys its idle containers
+// and removes its code. Containers serving a request are destroyed when
+// they are released; the code they run is removed once every container
+// running it is destroyed.
+func (m *Manager) DeleteFunction(tenant, name string) error {
+	t, err := m.tenant(tenant)
+	if err != nil {
+		return err
+	}
+	fn, err := t.functions.Delete(name)
+	if err != nil {
+		return err
+	}
+	m.drainVersions(t.name, name, nil)
+	for _, version := range fn.Versions {
+		m.removeCode(version.CodeDir, nil)
+	}
+	return nil
+}
+
+// removeCode removes the code dir of a deleted version of a function,
+// unless a container other than destroyed still runs it. It is removed
+// when that container is destroyed instead (see collectCode).
+func (m *Manager) removeCode(dir string, destroyed *container.Container) {
+	m.mapMutex.Lock()
+	for _, c := range m.containers {
+		if c != destroyed && c.CodeDir() == dir && c.State() != container.StateDestroyed {
+			logger.Info("keeping code dir until its containers are destroyed", "path", dir, "container_id", c.ID())
+			m.staleCode[dir] = true
+			m.mapMutex.Unlock()
+			return
+		}
+	}
+	delete(m.staleCode, dir)
+	m.mapMutex.Unlock()
+
+	logger.Info("removing code dir", "path", dir)
+	if err := os.RemoveAll(dir); err != nil {
+		logger.Warn("failed to remove code dir", "path", dir, "error", err)
+	}
+}
+
+// collectCode removes the code of a deleted function once the last
+// container running it is destroyed
+func (m *Manager) collectCode(event container.ContainerEventType, c *container.Container) {
+	if event != container.ContainerDestroy {
+		return
+	}
+	m.mapMutex.Lock()
+	stale := m.staleCode[c.CodeDir()]
+	m.mapMutex.Unlock()
+	if stale {
+		m.removeCode(c.CodeDir(), c)
+	}
+}
+
+// destroy the idle containers of every version of a function of a
+// tenant that is not in live
+func (m *Manager) drainVersions(tenant, name string, live map[string]bool) {
+	drained := []*container.Container{}
+	m.mapMutex.Lock()
+	for key, pool := range m.warm {
+		if pool.tenant != tenant || pool.function != name || live[pool.version] {
+			continue
+		}
+		drained = append(drained, pool.idle...)
+		delete(m.warm, key)
+	}
+	m.mapMutex.Unlock()
+
+	for _, c := range drained {
+		logger.Info("draining container", "container_id", c.ID(), "tenant", tenant, "function", name)
+		if err := m.DestroyContainer(tenant, c.ID()); err != nil {
+			logger.Error("failed to destroy container", "container_id", c.ID(), "error", err)
+		}
+	}
+}
+
+// AcquireContainer returns a running container for an invocation
+// target of a tenant (see CreateFunctionContainer). Paused containers
+// of the resolved version left behind by earlier requests are reused;
+// a new container is only created when none are idle. The lease counts
+// as an invocation in flight until it is released.
+func (m *Manager) AcquireContainer(ctx context.Context, tenant, target string) (_ *Lease, err error) {
+	if err := m.begin(); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			m.end()
+		}
+	}()
+	t, err := m.tenant(tenant)
+	if err != nil {
+		return nil, err
+	}
+	fn, version, err := t.functions.Resolve(target)
+	if err != nil {
+		return nil, err
+	}
+	lease := &Lease{Tenant: t.name, Function: fn.Name, Version: version.ID}
+	key := warmKey(t.name, fn.Name, version.ID)
+	for {
+		m.mapMutex.Lock()
+		pool, ok := m.warm[key]
+		if !ok || len(pool.idle) == 0 {
+			m.mapMutex.Unlock()
+			break
+		}
+		c := pool.idle[len(pool.idle)-1]
+		pool.idle = pool.idle[:len(pool.idle)-1]
+		m.mapMutex.Unlock()
+
+		if err := c.Acquire(); err != nil {
+			logger.Warn("failed to unpause idle container, discarding it", "container_id", c.ID(), "error", err)
+			if err := m.DestroyContainer(t.name, c.ID()); err != nil {
+				logger.Error("failed to destroy container", "container_id", c.ID(), "error", err)
+			}
+			continue
+		}
+		lease.Container = c
+		metrics.FunctionStarts.WithLabelValues(t.name, fn.Name, "warm").Inc()
+		return lease, nil
+	}
+
+	c, err := m.createVersionContainer(ctx, t, version)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Acquire(); err != nil {
+		if err := m.DestroyContainer(t.name, c.ID()); err != nil {
+			logger.Error("failed to destroy container", "container_id", c.ID(), "error", err)
+		}
+		return nil, err
+	}
+	lease.Container = c
+	lease.Cold = true
+	metrics.FunctionStarts.WithLabelValues(t.name, fn.Name, "cold").Inc()
+	return lease, nil
+}
+
+// ReleaseContainer pauses the container of a lease, once no other
+// request uses it, and keeps it around for the next request to the same
+// version. Containers of deleted versions are destroyed instead; those
+// of versions no alias points to any more are kept until drainVersions
+// destroys them.
+func (m *Manager) ReleaseContainer(lease *Lease) {
+	defer m.end()
+	c := lease.Container
+	t, err := m.tenant(lease.Tenant)
+	deleted := err != nil || !t.functions.HasVersion(lease.Function, lease.Version)
+	if err := c.Release(!deleted); err != nil {
+		logger.Warn("failed to pause container, destroying it", "container_id", c.ID(), "error", err)
+		deleted = true
+	}
+	if deleted {
+		if err := m.DestroyContainer(lease.Tenant, c.ID()); err != nil {
+			logger.Error("failed to destroy container", "container_id", c.ID(), "error", err)
+		}
+		return
+	}
+	m.mapMutex.Lock()
+	defer m.mapMutex.Unlock()
+	if _, ok := m.containers[c.ID()]; !ok {
+		// destroyed while it was in use
+		return
+	}
+	key := warmKey(lease.Tenant, lease.Function, lease.Version)
+	pool, ok := m.warm[key]
+	if !ok {
+		pool = &warmPool{tenant: lease.Tenant, function: lease.Function, version: lease.Version}
+		m.warm[key] = pool
+	}
+	pool.idle = append(pool.idle, c)
+}
+
+// forget a destroyed container so it is never handed out again.
+// Callers must hold mapMutex.
+func (m *Manager) removeIdle(id string) {
+	for _, pool := range m.warm {
+		for i, c := range pool.idle {
+			if c.ID() == id {
+				pool.idle = append(pool.idle[:i], pool.idle[i+1:]...)
+				break
+			}
+		}
+	}
+}
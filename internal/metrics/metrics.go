@@ -0,0 +1,185 @@
+// Package metrics holds the Prometheus metrics of sockd. They are
+// registered with Registry, which the daemon serves on /metrics when
+// asked to.
+package metrics
+
+import (
+	"net/http"
+	"parkerdgabel/sockd/pkg/cgroup"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "sockd"
+
+// Registry holds every sockd metric, plus the Go runtime and process
+// ones
+var Registry = prometheus.NewRegistry()
+
+var factory = promauto.With(Registry)
+
+var (
+	ContainersCreated = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "containers_created_total",
+		Help:      "Leaf containers created, by runtime.",
+	}, []string{"runtime"})
+
+	ContainerEvents = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "container_events_total",
+		Help:      "Events of all containers, Zygotes included, by type (start, fork, pause, unpause, stop, destroy, child_exit, oom, oom_kill, memory_high, memory_max, pressure).",
+	}, []string{"type"})
+
+	Evictions = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "evictions_total",
+		Help:      "Containers destroyed by the evictor to free memory.",
+	})
+
+	FunctionStarts = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "function_starts_total",
+		Help:      "Containers handed out for function requests, by tenant, function and whether the container was created for the request (cold) or reused (warm).",
+	}, []string{"tenant", "function", "start"})
+
+	InvocationDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "function_invocation_duration_seconds",
+		Help:      "Time to serve a function request through the gateway, including getting a container, by tenant and function.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 16),
+	}, []string{"tenant", "function"})
+
+	ImageBuilds = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "image_builds_total",
+		Help:      "Base image builds, by result (ok or error).",
+	}, []string{"result"})
+
+	ImageBuildDuration = factory.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "image_build_duration_seconds",
+		Help:      "Time to build a base image.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 10),
+	})
+
+	PackageInstalls = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "package_installs_total",
+		Help:      "Packages pulled and installed for the import cache, by result (ok or error).",
+	}, []string{"result"})
+
+	PackageInstallDuration = factory.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "package_install_duration_seconds",
+		Help:      "Time to pull and install a package for the import cache.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 14),
+	})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// Handler serves the metrics in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// Result is the value of the result label for err
+func Result(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+// Since is the time elapsed since start, in seconds
+func Since(start time.Time) float64 {
+	return time.Since(start).Seconds()
+}
+
+// CgroupPool is implemented by *cgroup.Pool
+type CgroupPool interface {
+	Stats() cgroup.PoolStats
+}
+
+// MemPool is implemented by *zygote.MemPool
+type MemPool interface {
+	AvailableMB() int
+	TotalMB() int
+	Waiting() int
+}
+
+// RegisterCgroupPool exports the queue depths and counters of a cgroup
+// pool
+func RegisterCgroupPool(name string, pool CgroupPool) {
+	labels := prometheus.Labels{"pool": name}
+	factory.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Name:        "cgroup_pool_ready",
+		Help:        "Cgroups created and waiting to be handed out.",
+		ConstLabels: labels,
+	}, func() float64 { return float64(pool.Stats().Ready) })
+	factory.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Name:        "cgroup_pool_recycled",
+		Help:        "Released cgroups waiting to be cleaned up for reuse.",
+		ConstLabels: labels,
+	}, func() float64 { return float64(pool.Stats().Recycled) })
+	factory.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Name:        "cgroup_pool_in_use",
+		Help:        "Cgroups handed out to containers.",
+		ConstLabels: labels,
+	}, func() float64 { return float64(pool.Stats().InUse) })
+	factory.NewCounterFunc(prometheus.CounterOpts{
+		Namespace:   namespace,
+		Name:        "cgroup_pool_created_total",
+		Help:        "Cgroups created by the pool.",
+		ConstLabels: labels,
+	}, func() float64 { return float64(pool.Stats().Created) })
+	factory.NewCounterFunc(prometheus.CounterOpts{
+		Namespace:   namespace,
+		Name:        "cgroup_pool_destroyed_total",
+		Help:        "Cgroups of the pool destroyed.",
+		ConstLabels: labels,
+	}, func() float64 { return float64(pool.Stats().Destroyed) })
+	factory.NewCounterFunc(prometheus.CounterOpts{
+		Namespace:   namespace,
+		Name:        "cgroup_pool_create_failures_total",
+		Help:        "Failed attempts of the pool to create a cgroup.",
+		ConstLabels: labels,
+	}, func() float64 { return float64(pool.Stats().Failed) })
+}
+
+// RegisterMemPool exports the state of the memory pool of the Zygotes
+// of a tenant built on an image
+func RegisterMemPool(tenant, image string, mem MemPool) {
+	labels := prometheus.Labels{"tenant": tenant, "image": image}
+	factory.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Name:        "mem_pool_available_mb",
+		Help:        "Memory of the Zygote memory pool not handed out, in MB.",
+		ConstLabels: labels,
+	}, func() float64 { return float64(mem.AvailableMB()) })
+	factory.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Name:        "mem_pool_total_mb",
+		Help:        "Memory managed by the Zygote memory pool, in MB.",
+		ConstLabels: labels,
+	}, func() float64 { return float64(mem.TotalMB()) })
+	factory.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Name:        "mem_pool_waiting_requests",
+		Help:        "Requests waiting for memory from the Zygote memory pool.",
+		ConstLabels: labels,
+	}, func() float64 { return float64(mem.Waiting()) })
+}
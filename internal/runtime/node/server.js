@@ -96,12 +96,16 @@ function forkServer() {
             const fds = buffer.readUInt32LE(0);
             const rootFd = fds[0];
             const memCgroupFd = fds[1];
+            const stdoutFd = fds[2];
+            const stderrFd = fds[3];
 
             const pid = forkProcess();
 
             if (pid) {
                 fs.closeSync(rootFd);
                 fs.closeSync(memCgroupFd);
+                fs.closeSync(stdoutFd);
+                fs.closeSync(stderrFd);
 
                 process.wait(pid, 0);
                 client.write(Buffer.from([pid]));
@@ -117,6 +121,12 @@ function forkServer() {
                 fs.writeSync(memCgroupFd, Buffer.from(process.pid.toString()));
                 fs.closeSync(memCgroupFd);
 
+                // stdout and stderr of the new container, captured by sockd
+                const stdout = fs.createWriteStream(null, { fd: stdoutFd });
+                const stderr = fs.createWriteStream(null, { fd: stderrFd });
+                process.stdout.write = stdout.write.bind(stdout);
+                process.stderr.write = stderr.write.bind(stderr);
+
                 startContainer();
                 process.exit(1);
             }
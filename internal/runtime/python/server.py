@@ -109,8 +109,8 @@ def fork_server():
 
     while True:
         client, _info = file_sock.accept()
-        _, fds, _, _ = socket.recv_fds(client, 8, 2)
-        root_fd, mem_cgroup_fd = fds
+        _, fds, _, _ = socket.recv_fds(client, 8, 4)
+        root_fd, mem_cgroup_fd, stdout_fd, stderr_fd = fds
 
         pid = os.fork()
 
@@ -118,6 +118,8 @@ def fork_server():
             # parent
             os.close(root_fd)
             os.close(mem_cgroup_fd)
+            os.close(stdout_fd)
+            os.close(stderr_fd)
 
             # the child opens the new ol.sock, forks the grandchild
             # (which will actually do the serving), then exits.  Thus,
@@ -144,6 +146,12 @@ def fork_server():
             os.write(mem_cgroup_fd, str(os.getpid()).encode('utf-8'))
             os.close(mem_cgroup_fd)
 
+            # stdout and stderr of the new container, captured by sockd
+            os.dup2(stdout_fd, 1)
+            os.dup2(stderr_fd, 2)
+            os.close(stdout_fd)
+            os.close(stderr_fd)
+
             # child
             start_container()
             os._exit(1) # only reachable if program unnexpectedly returns
@@ -107,8 +107,8 @@ def fork_server
 
   loop do
     client, _info = file_sock.accept
-    _, fds, _, _ = Socket.recv_io(client, 8, 2)
-    root_fd, mem_cgroup_fd = fds
+    _, fds, _, _ = Socket.recv_io(client, 8, 4)
+    root_fd, mem_cgroup_fd, stdout_fd, stderr_fd = fds
 
     pid = fork_process
 
@@ -116,6 +116,8 @@ def fork_server
       # parent
       IO.new(root_fd).close
       IO.new(mem_cgroup_fd).close
+      IO.new(stdout_fd).close
+      IO.new(stderr_fd).close
 
       # the child opens the new ol.sock, forks the grandchild
       # (which will actually do the serving), then exits.  Thus,
@@ -141,6 +143,10 @@ def fork_server
       IO.new(mem_cgroup_fd).write(Process.pid.to_s)
       IO.new(mem_cgroup_fd).close
 
+      # stdout and stderr of the new container, captured by sockd
+      $stdout.reopen(IO.new(stdout_fd))
+      $stderr.reopen(IO.new(stderr_fd))
+
       # child
       start_container
       exit(1) # only reachable if program unexpectedly returns
@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const mountInfoPath = "/proc/self/mountinfo"
+
+// unescape the octal escapes (\040 for space etc.) the kernel uses in
+// mountinfo paths
+func unescapeMountPath(path string) string {
+	if !strings.Contains(path, `\`) {
+		return path
+	}
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			var c byte
+			valid := true
+			for _, d := range path[i+1 : i+4] {
+				if d < '0' || d > '7' {
+					valid = false
+					break
+				}
+				c = c*8 + byte(d-'0')
+			}
+			if valid {
+				b.WriteByte(c)
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
+
+func parseMountPoints(info string) []string {
+	mounts := []string{}
+	scanner := bufio.NewScanner(strings.NewReader(info))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		mounts = append(mounts, unescapeMountPath(fields[4]))
+	}
+	return mounts
+}
+
+// MountsUnder returns the mount points at or below dir, deepest first,
+// which is the order they can be unmounted in
+func MountsUnder(dir string) ([]string, error) {
+	info, err := os.ReadFile(mountInfoPath)
+	if err != nil {
+		return nil, err
+	}
+	dir = filepath.Clean(dir)
+	mounts := []string{}
+	for _, mount := range parseMountPoints(string(info)) {
+		if IsUnder(mount, dir) {
+			mounts = append(mounts, mount)
+		}
+	}
+	sort.Slice(mounts, func(i, j int) bool {
+		return strings.Count(mounts[i], "/") > strings.Count(mounts[j], "/")
+	})
+	return mounts, nil
+}
+
+// IsMountPoint reports whether something is mounted at path
+func IsMountPoint(path string) (bool, error) {
+	path = filepath.Clean(path)
+	mounts, err := MountsUnder(path)
+	if err != nil {
+		return false, err
+	}
+	for _, mount := range mounts {
+		if mount == path {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// IsUnder reports whether path is dir or inside it
+func IsUnder(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
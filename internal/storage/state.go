@@ -0,0 +1,261 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"parkerdgabel/sockd/pkg/container"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// StateFile is where the daemon keeps track of the containers it runs
+// and the functions registered with it, so it can recover them after a
+// restart
+func StateFile(baseDir string) string {
+	return filepath.Join(baseDir, "state.json")
+}
+
+// ContainerRecord is what is needed to find the processes, cgroup and
+// mounts of a container again after the daemon restarts
+type ContainerRecord struct {
+	ID string `json:"id"`
+	// ParentID is the Zygote the container was forked from; together
+	// they form the zygote tree
+	ParentID string `json:"parent_id,omitempty"`
+	// Zygote is true for containers of the import cache
+	Zygote bool `json:"zygote"`
+	// Managed is true for containers handed out to clients
+	Managed bool `json:"managed"`
+	// State is the state of the container when it was created or
+	// stopped; pauses are not saved
+	State string `json:"state"`
+	// Pool and Cgroup name the cgroup at /sys/fs/cgroup/<Pool>/<Cgroup>
+	Pool   string `json:"pool"`
+	Cgroup string `json:"cgroup"`
+	// RootDir is a bind mount of the base image, with the code and
+	// scratch dirs mounted below it
+	RootDir    string         `json:"root_dir"`
+	CodeDir    string         `json:"code_dir"`
+	ScratchDir string         `json:"scratch_dir"`
+	Meta       container.Meta `json:"meta"`
+	Created    time.Time      `json:"created"`
+}
+
+// FunctionRecord is a function registered in a tenant. The code of its
+// versions stays in their code dirs across restarts.
+type FunctionRecord struct {
+	Tenant     string          `json:"tenant"`
+	Name       string          `json:"name"`
+	Versions   []VersionRecord `json:"versions"`
+	Aliases    []AliasRecord   `json:"aliases,omitempty"`
+	Latest     string          `json:"latest"`
+	Registered time.Time       `json:"registered"`
+}
+
+type VersionRecord struct {
+	ID      string         `json:"id"`
+	Meta    container.Meta `json:"meta"`
+	CodeDir string         `json:"code_dir"`
+	Created time.Time      `json:"created"`
+}
+
+type AliasRecord struct {
+	Name         string `json:"name"`
+	Version      string `json:"version"`
+	Canary       string `json:"canary,omitempty"`
+	CanaryWeight int    `json:"canary_weight,omitempty"`
+	// History is the versions the alias pointed at before, most recent
+	// last
+	History []string `json:"history,omitempty"`
+}
+
+// stateFile is the layout of the state file. Files written before
+// functions were kept in it hold the array of containers alone.
+type stateFile struct {
+	Containers []*ContainerRecord `json:"containers"`
+	Functions  []*FunctionRecord  `json:"functions,omitempty"`
+}
+
+// StateStore is a JSON file of ContainerRecords and FunctionRecords,
+// rewritten on every change
+type StateStore struct {
+	path    string
+	mutex   sync.Mutex
+	records map[string]*ContainerRecord
+	// functions by tenant and name, as in "default/resize"
+	functions map[string]*FunctionRecord
+}
+
+// NewStateStore opens the store at path, loading the records left
+// behind by an earlier run
+func NewStateStore(path string) (*StateStore, error) {
+	s := &StateStore{
+		path:      path,
+		records:   make(map[string]*ContainerRecord),
+		functions: make(map[string]*FunctionRecord),
+	}
+	raw, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var file stateFile
+	if bytes.HasPrefix(bytes.TrimSpace(raw), []byte("[")) {
+		err = json.Unmarshal(raw, &file.Containers)
+	} else {
+		err = json.Unmarshal(raw, &file)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, rec := range file.Containers {
+		s.records[rec.ID] = rec
+	}
+	for _, rec := range file.Functions {
+		s.functions[functionKey(rec.Tenant, rec.Name)] = rec
+	}
+	return s, nil
+}
+
+func functionKey(tenant, name string) string {
+	return tenant + "/" + name
+}
+
+// Records returns a copy of every record, sorted by creation time so
+// parents come before their children
+func (s *StateStore) Records() []ContainerRecord {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	records := make([]ContainerRecord, 0, len(s.records))
+	for _, rec := range s.records {
+		records = append(records, *rec)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Created.Before(records[j].Created)
+	})
+	return records
+}
+
+// Update applies fn to the record of id, creating it if needed, and
+// saves the store
+func (s *StateStore) Update(id string, fn func(rec *ContainerRecord)) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	rec, ok := s.records[id]
+	if !ok {
+		rec = &ContainerRecord{ID: id}
+		s.records[id] = rec
+	}
+	fn(rec)
+	return s.save()
+}
+
+// Delete removes the record of id and saves the store
+func (s *StateStore) Delete(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.records[id]; !ok {
+		return nil
+	}
+	delete(s.records, id)
+	return s.save()
+}
+
+// Reset removes every container record except those of keep and saves
+// the store
+func (s *StateStore) Reset(keep map[string]bool) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for id := range s.records {
+		if !keep[id] {
+			delete(s.records, id)
+		}
+	}
+	return s.save()
+}
+
+// Functions returns a copy of the records of the functions of a tenant,
+// sorted by name
+func (s *StateStore) Functions(tenant string) []FunctionRecord {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var records []FunctionRecord
+	for _, rec := range s.functions {
+		if rec.Tenant == tenant {
+			records = append(records, *rec)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Name < records[j].Name
+	})
+	return records
+}
+
+// FunctionTenants returns the tenants that have functions in the store,
+// sorted
+func (s *StateStore) FunctionTenants() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	seen := make(map[string]bool)
+	var tenants []string
+	for _, rec := range s.functions {
+		if !seen[rec.Tenant] {
+			seen[rec.Tenant] = true
+			tenants = append(tenants, rec.Tenant)
+		}
+	}
+	sort.Strings(tenants)
+	return tenants
+}
+
+// PutFunction replaces the record of a function and saves the store
+func (s *StateStore) PutFunction(rec FunctionRecord) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.functions[functionKey(rec.Tenant, rec.Name)] = &rec
+	return s.save()
+}
+
+// DeleteFunction removes the record of a function and saves the store
+func (s *StateStore) DeleteFunction(tenant, name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	key := functionKey(tenant, name)
+	if _, ok := s.functions[key]; !ok {
+		return nil
+	}
+	delete(s.functions, key)
+	return s.save()
+}
+
+// write to a temp file and rename it, so a crash never leaves a
+// truncated store behind. Callers must hold mutex.
+func (s *StateStore) save() error {
+	file := stateFile{
+		Containers: make([]*ContainerRecord, 0, len(s.records)),
+		Functions:  make([]*FunctionRecord, 0, len(s.functions)),
+	}
+	for _, rec := range s.records {
+		file.Containers = append(file.Containers, rec)
+	}
+	for _, rec := range s.functions {
+		file.Functions = append(file.Functions, rec)
+	}
+	raw, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStateStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	s, err := NewStateStore(path)
+	if err != nil {
+		t.Fatalf("NewStateStore() error = %v", err)
+	}
+	now := time.Now()
+	for i, id := range []string{"zygote", "leaf", "other"} {
+		err := s.Update(id, func(rec *ContainerRecord) {
+			rec.Created = now.Add(time.Duration(i) * time.Second)
+			rec.Zygote = id == "zygote"
+		})
+		if err != nil {
+			t.Fatalf("Update() error = %v", err)
+		}
+	}
+	if err := s.Update("leaf", func(rec *ContainerRecord) { rec.ParentID = "zygote" }); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	if err := s.Delete("other"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+
+	// as after a restart
+	s, err = NewStateStore(path)
+	if err != nil {
+		t.Fatalf("NewStateStore() error = %v", err)
+	}
+	records := s.Records()
+	if len(records) != 2 || records[0].ID != "zygote" || !records[0].Zygote || records[1].ParentID != "zygote" {
+		t.Errorf("Records() = %+v", records)
+	}
+
+	if err := s.Reset(map[string]bool{"leaf": true}); err != nil {
+		t.Fatalf("Reset() error = %v", err)
+	}
+	if records := s.Records(); len(records) != 1 || records[0].ID != "leaf" {
+		t.Errorf("Records() after Reset() = %+v", records)
+	}
+}
+
+func TestStateStoreFunctions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	s, err := NewStateStore(path)
+	if err != nil {
+		t.Fatalf("NewStateStore() error = %v", err)
+	}
+	for _, rec := range []FunctionRecord{
+		{Tenant: "default", Name: "resize", Latest: "v1"},
+		{Tenant: "default", Name: "crop", Latest: "v1"},
+		{Tenant: "a", Name: "resize", Latest: "v2", Aliases: []AliasRecord{{Name: "prod", Version: "v2", History: []string{"v1"}}}},
+	} {
+		if err := s.PutFunction(rec); err != nil {
+			t.Fatalf("PutFunction() error = %v", err)
+		}
+	}
+	if err := s.DeleteFunction("default", "crop"); err != nil {
+		t.Fatalf("DeleteFunction() error = %v", err)
+	}
+	if err := s.Update("leaf", func(rec *ContainerRecord) {}); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+
+	// as after a restart
+	s, err = NewStateStore(path)
+	if err != nil {
+		t.Fatalf("NewStateStore() error = %v", err)
+	}
+	if tenants := s.FunctionTenants(); !reflect.DeepEqual(tenants, []string{"a", "default"}) {
+		t.Errorf("FunctionTenants() = %v", tenants)
+	}
+	if fns := s.Functions("default"); len(fns) != 1 || fns[0].Name != "resize" {
+		t.Errorf("Functions(default) = %+v", fns)
+	}
+	if fns := s.Functions("a"); len(fns) != 1 || fns[0].Aliases[0].History[0] != "v1" {
+		t.Errorf("Functions(a) = %+v", fns)
+	}
+	if records := s.Records(); len(records) != 1 {
+		t.Errorf("Records() = %+v", records)
+	}
+}
+
+func TestStateStoreContainersOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err := os.WriteFile(path, []byte(`[{"id": "leaf", "managed": true}]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewStateStore(path)
+	if err != nil {
+		t.Fatalf("NewStateStore() error = %v", err)
+	}
+	if records := s.Records(); len(records) != 1 || records[0].ID != "leaf" || !records[0].Managed {
+		t.Errorf("Records() = %+v", records)
+	}
+}
+
+func TestParseMountPoints(t *testing.T) {
+	info := `23 28 0:22 / /proc rw,relatime - proc proc rw
+101 28 0:45 / /var/lib/sockd/root rw,relatime shared:1 - tmpfs none rw
+102 101 8:1 /images/python /var/lib/sockd/root/1001-with\040space ro,relatime - ext4 /dev/sda1 rw
+`
+	want := []string{"/proc", "/var/lib/sockd/root", "/var/lib/sockd/root/1001-with space"}
+	if got := parseMountPoints(info); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseMountPoints() = %v, want %v", got, want)
+	}
+}
@@ -2,14 +2,18 @@ package storage
 
 import (
 	"fmt"
-	"log"
 	"os"
+	"parkerdgabel/sockd/internal/logging"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync/atomic"
 	"syscall"
 )
 
-const baseDir = "/var/lib/sockd"
+// DefaultBaseDir is where sockd keeps its state and dirs unless
+// configured otherwise
+const DefaultBaseDir = "/var/lib/sockd"
 
 type StoreMode int
 
@@ -26,23 +30,42 @@ var SHARED uintptr = uintptr(syscall.MS_SHARED)
 
 var nextDirId int64 = 1000
 
+var logger = logging.For(logging.Storage)
+
 type DirMaker struct {
 	prefix string
 	mode   StoreMode
 }
 
-func NewDirMaker(system string, mode StoreMode) (*DirMaker, error) {
+// NewDirMaker makes dirs under <baseDir>/<system>. Dirs left behind by
+// an earlier run are kept (see Entries), so they can be recovered or
+// removed, and new dirs never collide with them.
+func NewDirMaker(baseDir, system string, mode StoreMode) (*DirMaker, error) {
 	prefix := filepath.Join(baseDir, system)
-	log.Printf("Storage dir at %s", prefix)
-	if err := os.RemoveAll(prefix); err != nil {
+	logger.Debug("storage dir", "path", prefix)
+	if err := os.MkdirAll(prefix, 0777); err != nil {
 		return nil, err
 	}
 
-	if err := os.MkdirAll(prefix, 0777); err != nil {
+	entries, err := os.ReadDir(prefix)
+	if err != nil {
 		return nil, err
 	}
+	for _, entry := range entries {
+		id, _, _ := strings.Cut(entry.Name(), "-")
+		if n, err := strconv.ParseInt(id, 10, 64); err == nil && n > atomic.LoadInt64(&nextDirId) {
+			atomic.StoreInt64(&nextDirId, n)
+		}
+	}
 
-	if mode == STORE_MEMORY {
+	// still mounted if the last run did not clean up
+	mounted, err := IsMountPoint(prefix)
+	if err != nil {
+		return nil, err
+	}
+	if mounted && mode != STORE_REGULAR {
+		logger.Info("reusing mount", "path", prefix)
+	} else if mode == STORE_MEMORY {
 		// TODO: configure mem size?
 		if err := syscall.Mount("none", prefix, "tmpfs", 0, "size=64m"); err != nil {
 			return nil, err
@@ -63,6 +86,24 @@ func NewDirMaker(system string, mode StoreMode) (*DirMaker, error) {
 	}, nil
 }
 
+// Prefix returns the dir all dirs of this DirMaker are made in
+func (dm *DirMaker) Prefix() string {
+	return dm.prefix
+}
+
+// Entries returns the paths of the dirs currently under the prefix
+func (dm *DirMaker) Entries() ([]string, error) {
+	entries, err := os.ReadDir(dm.prefix)
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		paths = append(paths, filepath.Join(dm.prefix, entry.Name()))
+	}
+	return paths, nil
+}
+
 func (dm *DirMaker) Get(suffix string) string {
 	if suffix != "" {
 		suffix = "-" + suffix
@@ -71,12 +112,17 @@ func (dm *DirMaker) Get(suffix string) string {
 	return filepath.Join(dm.prefix, id) + suffix
 }
 
-func (dm *DirMaker) Make(suffix string) string {
+// Make creates a new dir whose name ends with suffix. The suffix may
+// come from a client, so it must not contain a path separator.
+func (dm *DirMaker) Make(suffix string) (string, error) {
+	if strings.ContainsRune(suffix, filepath.Separator) {
+		return "", fmt.Errorf("invalid dir suffix: %q", suffix)
+	}
 	dir := dm.Get(suffix)
 	if err := os.Mkdir(dir, 0777); err != nil {
-		panic(err)
+		return "", err
 	}
-	return dir
+	return dir, nil
 }
 
 func (dm *DirMaker) Cleanup() error {
@@ -0,0 +1,130 @@
+// Package tracing sets up OpenTelemetry tracing for sockd and holds the
+// helpers used to trace its stages. Until Setup installs an exporter,
+// spans cost next to nothing and go nowhere.
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "parkerdgabel/sockd"
+
+// Propagator carries trace context across sockd requests and the
+// gateway, as W3C traceparent and tracestate
+var Propagator = propagation.TraceContext{}
+
+// Config says where spans are exported. Both exporters may be used at
+// once; with neither, tracing is off.
+type Config struct {
+	// OTLPEndpoint is the host:port of an OTLP/HTTP collector
+	OTLPEndpoint string `mapstructure:"otlp_endpoint"`
+	// OTLPInsecure sends to the collector over plain HTTP
+	OTLPInsecure bool `mapstructure:"otlp_insecure"`
+	// File is a path to append spans to, one JSON object each
+	File string `mapstructure:"file"`
+}
+
+// Setup installs the tracer provider described by cfg. The returned
+// function flushes the spans not exported yet and must be called
+// before exiting.
+func Setup(ctx context.Context, cfg Config) (func(context.Context) error, error) {
+	var exporters []sdktrace.SpanExporter
+	if cfg.OTLPEndpoint != "" {
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.OTLPEndpoint)}
+		if cfg.OTLPInsecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err := otlptracehttp.New(ctx, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+		}
+		exporters = append(exporters, exporter)
+	}
+	var file *os.File
+	if cfg.File != "" {
+		var err error
+		file, err = os.OpenFile(cfg.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open trace file: %w", err)
+		}
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(file))
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to create file exporter: %w", err)
+		}
+		exporters = append(exporters, exporter)
+	}
+	if len(exporters) == 0 {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", "sockd"),
+	))
+	if err != nil {
+		return nil, err
+	}
+	opts := []sdktrace.TracerProviderOption{sdktrace.WithResource(res)}
+	for _, exporter := range exporters {
+		opts = append(opts, sdktrace.WithBatcher(exporter))
+	}
+	provider := sdktrace.NewTracerProvider(opts...)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(Propagator)
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if file != nil {
+			err = errors.Join(err, file.Close())
+		}
+		return err
+	}, nil
+}
+
+// Start starts a span named after a stage of sockd
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End ends a span, marking it failed if err is not nil. It is meant to
+// be deferred with a pointer to the named error result of the traced
+// function.
+func End(span trace.Span, err *error) {
+	if err != nil && *err != nil {
+		span.RecordError(*err)
+		span.SetStatus(codes.Error, (*err).Error())
+	}
+	span.End()
+}
+
+// Extract returns ctx with the trace context found in carrier, if any
+func Extract(ctx context.Context, carrier map[string]string) context.Context {
+	if len(carrier) == 0 {
+		return ctx
+	}
+	return Propagator.Extract(ctx, propagation.MapCarrier(carrier))
+}
+
+// Inject returns the trace context of ctx to send along with a request,
+// or nil if ctx is not being traced
+func Inject(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	Propagator.Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return carrier
+}
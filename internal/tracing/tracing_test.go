@@ -0,0 +1,29 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestInjectExtract(t *testing.T) {
+	if carrier := Inject(context.Background()); carrier != nil {
+		t.Fatalf("Inject without a span returned %v", carrier)
+	}
+
+	parent := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1},
+		SpanID:     trace.SpanID{2},
+		TraceFlags: trace.FlagsSampled,
+	})
+	carrier := Inject(trace.ContextWithSpanContext(context.Background(), parent))
+	if carrier["traceparent"] == "" {
+		t.Fatalf("Inject returned no traceparent: %v", carrier)
+	}
+
+	got := trace.SpanContextFromContext(Extract(context.Background(), carrier))
+	if got.TraceID() != parent.TraceID() || got.SpanID() != parent.SpanID() || !got.IsRemote() {
+		t.Errorf("Extract returned %v, want remote %v", got, parent)
+	}
+}
@@ -2,14 +2,17 @@ package cgroup
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
+	"parkerdgabel/sockd/internal/logging"
 	"strconv"
 	"strings"
 	"syscall"
 	"time"
 )
 
+var logger = logging.For(logging.Cgroup)
+
 type CgroupError struct {
 	resource string
 	err      error
@@ -19,16 +22,27 @@ func (e *CgroupError) Error() string {
 	return fmt.Sprintf("Cgroup error: %s: %v", e.resource, e.err)
 }
 
+func (e *CgroupError) Unwrap() error {
+	return e.err
+}
+
 type Cgroup struct {
 	name       string
 	pool       *Pool
 	memLimitMB int
+	cpuPercent int
+	// what to write back to the resources changed by the setters of
+	// resources.go, by resource and device, when the cgroup is recycled
+	resets map[[2]string]string
+	logger *slog.Logger
 }
 
-func (cg *Cgroup) printf(format string, args ...any) {
-	msg := fmt.Sprintf(format, args...)
-	log.Printf("%s [CGROUP %s: %s]", strings.TrimRight(msg, "\n"), cg.pool.Name, cg.name)
-
+func newCgroup(pool *Pool, name string) *Cgroup {
+	return &Cgroup{
+		name:   name,
+		pool:   pool,
+		logger: pool.logger.With("cgroup", name),
+	}
 }
 
 // ResourcePath returns the path to a specific resource in this cgroup
@@ -41,6 +55,11 @@ func (cg *Cgroup) Name() string {
 	return cg.name
 }
 
+// PoolName returns the name of the pool the cgroup belongs to
+func (cg *Cgroup) PoolName() string {
+	return cg.pool.Name
+}
+
 // SetMemoryLimit sets the memory limit for the cgroup
 func (cg *Cgroup) SetMemoryLimit(mb int) {
 	cg.memLimitMB = mb
@@ -59,15 +78,15 @@ func (cg *Cgroup) Release() error {
 		if retries == 1 {
 			return &CgroupError{resource: "cgroup.procs", err: fmt.Errorf("cgroup not empty")}
 		}
-		cg.printf("cgroup Rmdir failed, trying again in 5ms")
+		cg.logger.Debug("cgroup not empty, trying again in 5ms")
 		time.Sleep(5 * time.Millisecond)
 	}
 
 	select {
 	case cg.pool.recycled <- cg:
-		cg.printf("release and recycle")
+		cg.logger.Debug("released and recycled")
 	default:
-		cg.printf("release and destroy")
+		cg.logger.Debug("released and destroyed")
 		if err := cg.Destroy(); err != nil {
 			return &CgroupError{resource: "cgroup.procs", err: err}
 		}
@@ -79,19 +98,21 @@ func (cg *Cgroup) Release() error {
 // Destroy this cgroup
 func (cg *Cgroup) Destroy() error {
 	gpath := cg.GroupPath()
-	cg.printf("Destroying cgroup with path \"%s\"", gpath)
+	cg.logger.Debug("destroying cgroup", "path", gpath)
 
 	for retries := 100; retries > 0; retries-- {
 		if err := syscall.Rmdir(gpath); err != nil {
 			if retries == 1 {
 				return &CgroupError{resource: gpath, err: err}
 			}
-			cg.printf("cgroup Rmdir failed, trying again in 5ms")
+			cg.logger.Debug("cgroup rmdir failed, trying again in 5ms", "error", err)
 			time.Sleep(5 * time.Millisecond)
 		} else {
 			break
 		}
 	}
+	cg.pool.live.Add(-1)
+	cg.pool.destroyed.Add(1)
 	return nil
 }
 
@@ -201,14 +222,24 @@ func (cg *Cgroup) setFreezeState(state int64) error {
 
 // get mem usage in MB
 func (cg *Cgroup) GetMemUsageMB() int {
-	usage, err := cg.ReadInt("memory.current")
+	mb, err := cg.MemUsageMB()
 	if err != nil {
 		panic(err)
 	}
+	return mb
+}
+
+// MemUsageMB is like GetMemUsageMB, but returns read errors instead of
+// panicking
+func (cg *Cgroup) MemUsageMB() (int, error) {
+	usage, err := cg.ReadInt("memory.current")
+	if err != nil {
+		return 0, err
+	}
 
 	// round up to nearest MB
 	mb := int64(1024 * 1024)
-	return int((usage + mb - 1) / mb)
+	return int((usage + mb - 1) / mb), nil
 }
 
 // get mem limit in MB
@@ -252,16 +283,25 @@ func (cg *Cgroup) SetMemLimitMB(mb int) error {
 	return nil
 }
 
-// percent of a core
+// percent of a core, 0 for no limit
 func (cg *Cgroup) SetCPUPercent(percent int) error {
 	period := 100000 // 100 ms
-	quota := period * percent / 100
-	if err := cg.WriteString("cpu.max", fmt.Sprintf("%d %d", quota, period)); err != nil {
+	quota := "max"
+	if percent > 0 {
+		quota = strconv.Itoa(period * percent / 100)
+	}
+	if err := cg.WriteString("cpu.max", fmt.Sprintf("%s %d", quota, period)); err != nil {
 		return &CgroupError{resource: "cpu.max", err: err}
 	}
+	cg.cpuPercent = percent
 	return nil
 }
 
+// get the CPU limit in percent of a core (0 if unlimited)
+func (cg *Cgroup) CPUPercent() int {
+	return cg.cpuPercent
+}
+
 // Freeze processes in the cgroup
 func (cg *Cgroup) Pause() error {
 	return cg.setFreezeState(1)
@@ -272,6 +312,15 @@ func (cg *Cgroup) Unpause() error {
 	return cg.setFreezeState(0)
 }
 
+// Paused reports whether processes in the cgroup are frozen
+func (cg *Cgroup) Paused() (bool, error) {
+	state, err := cg.ReadInt("cgroup.freeze")
+	if err != nil {
+		return false, err
+	}
+	return state == 1, nil
+}
+
 // Get the IDs of all processes running in this cgroup
 func (cg *Cgroup) PIDs() ([]string, error) {
 	procsPath := cg.ResourcePath("cgroup.procs")
@@ -3,7 +3,7 @@ package cgroup
 import "testing"
 
 func Test_CgroupGroupPath(t *testing.T) {
-	pool, err := NewPool("test-pool")
+	pool, err := NewPool("test-pool", DefaultPoolConfig())
 	if err != nil {
 		t.Fatalf("NewPool() error = %v", err)
 	}
@@ -16,7 +16,7 @@ func Test_CgroupGroupPath(t *testing.T) {
 		{
 			name:     "test-pool",
 			cgroup:   &Cgroup{pool: pool, name: "test"},
-			expected: "/sys/fs/cgroup/cgroup-test-pool/test",
+			expected: "/sys/fs/cgroup/test-pool/test",
 		},
 	}
 	for _, tt := range tests {
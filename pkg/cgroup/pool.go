@@ -1,11 +1,18 @@
 package cgroup
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"io/fs"
+	"log/slog"
 	"os"
 	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -19,48 +26,182 @@ func (e *CgroupPoolError) Error() string {
 	return "CgroupPool error: " + e.resource + ": " + e.err.Error()
 }
 
-// if there are fewer than CGROUP_RESERVE available, more will be created.
-// If there are more than 2*CGROUP_RESERVE available, they'll be released.
 const (
-	CGROUP_RESERVE = 16
 	SubTreeControl = "cgroup.subtree_control"
 	Controller     = "cgroup.controller"
 	CgroupPath     = "/sys/fs/cgroup"
 	Controllers    = "+pids +io +memory +cpu"
+	// the cpuset controller is only enabled where the parent of the pool
+	// makes it available
+	CpusetController = "+cpuset"
+)
+
+// PoolConfig sizes a Pool and sets the limits its cgroups start with
+type PoolConfig struct {
+	// Parent is the cgroup the pools are created in, made along with the
+	// cgroups above it if missing. Changing it takes a restart.
+	Parent string `mapstructure:"parent"`
+	// Reserve is how many cgroups are kept ready to be handed out. If
+	// there are fewer available, more will be created.
+	Reserve int `mapstructure:"reserve"`
+	// Max is how many cgroups may be kept ready, recycled ones included.
+	// Those released beyond it are destroyed. 0 means twice the reserve.
+	Max int `mapstructure:"max"`
+	// ShrinkAfter is how long the pool must go without handing out a
+	// cgroup before it destroys those ready beyond the reserve. 0 keeps
+	// them.
+	ShrinkAfter time.Duration `mapstructure:"shrink_after"`
+	// PidsMax is the pids.max of every cgroup
+	PidsMax int64 `mapstructure:"pids_max"`
+}
+
+// DefaultPoolConfig returns the PoolConfig used unless configured
+// otherwise
+func DefaultPoolConfig() PoolConfig {
+	return PoolConfig{
+		Parent:      CgroupPath,
+		Reserve:     16,
+		Max:         32,
+		ShrinkAfter: time.Minute,
+		PidsMax:     10,
+	}
+}
+
+func (c PoolConfig) Validate() error {
+	if c.Parent != "" && !path.IsAbs(c.Parent) {
+		return fmt.Errorf("cgroup parent must be an absolute path, not %q", c.Parent)
+	}
+	if c.Reserve < 1 {
+		return fmt.Errorf("cgroup reserve must be at least 1, not %d", c.Reserve)
+	}
+	if c.Max != 0 && c.Max < c.Reserve {
+		return fmt.Errorf("cgroup max must be 0 or at least the reserve of %d, not %d", c.Reserve, c.Max)
+	}
+	if c.ShrinkAfter < 0 {
+		return fmt.Errorf("cgroup shrink_after must not be negative, not %s", c.ShrinkAfter)
+	}
+	if c.PidsMax < 1 {
+		return fmt.Errorf("cgroup pids_max must be at least 1, not %d", c.PidsMax)
+	}
+	return nil
+}
+
+// max returns how many cgroups the pool may keep ready
+func (c PoolConfig) max() int {
+	if c.Max == 0 {
+		return 2 * c.Reserve
+	}
+	return c.Max
+}
+
+// PoolStats tell how many cgroups a pool holds and how creating them
+// went
+type PoolStats struct {
+	// Ready is how many cgroups wait to be handed out
+	Ready int `json:"ready"`
+	// Recycled is how many released cgroups wait to be cleaned up
+	Recycled int `json:"recycled"`
+	// InUse is how many cgroups are handed out, adopted ones included
+	InUse int `json:"in_use"`
+	// Created, Destroyed and Failed count the cgroups created, destroyed
+	// and failed to be created since the pool was
+	Created   int64 `json:"created"`
+	Destroyed int64 `json:"destroyed"`
+	Failed    int64 `json:"failed"`
+}
+
+const (
+	// how long cgTask waits before creating a cgroup again after it
+	// failed to, doubling on each failure in a row
+	minBackoff = 100 * time.Millisecond
+	maxBackoff = 10 * time.Second
+	// how often cgTask checks whether to shrink the pool
+	shrinkInterval = 10 * time.Second
 )
 
 type Pool struct {
-	Name     string
-	ready    chan *Cgroup
-	recycled chan *Cgroup
-	quit     chan chan bool
-	nextID   int
+	Name string
+	// the cgroup the pool is in
+	parent string
+	// config is owned by cgTask once the pool is created
+	config    PoolConfig
+	ready     chan *Cgroup
+	recycled  chan *Cgroup
+	configure chan PoolConfig
+	quit      chan chan bool
+	nextID    int
+	// how many cgroups cgTask holds ready
+	queued atomic.Int64
+	// a copy of config.PidsMax, for the cgroups handed out
+	pidsMax atomic.Int64
+	// how many cgroups of the pool exist, and the counters of PoolStats
+	live      atomic.Int64
+	created   atomic.Int64
+	destroyed atomic.Int64
+	failed    atomic.Int64
+	// the error of the last attempt to create a cgroup, nil if it
+	// succeeded
+	errMutex  sync.Mutex
+	createErr error
+	// cgroups found in the pool when it was created
+	stale  []string
+	logger *slog.Logger
 }
 
-// NewPool creates a new Cgroup pool
-func NewPool(name string) (*Pool, error) {
-	wd, err := os.Getwd()
-	if err != nil {
-		return nil, fmt.Errorf("Getwd: %s", err)
+// NewPool creates a new Cgroup pool, named name, in the parent cgroup of
+// config
+func NewPool(name string, config PoolConfig) (*Pool, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	parent := config.Parent
+	if parent == "" {
+		parent = CgroupPath
 	}
 	pool := &Pool{
-		Name:     path.Base(wd) + "-" + name,
-		ready:    make(chan *Cgroup, CGROUP_RESERVE),
-		recycled: make(chan *Cgroup, CGROUP_RESERVE),
-		quit:     make(chan chan bool),
-		nextID:   0,
+		Name:      name,
+		parent:    parent,
+		config:    config,
+		ready:     make(chan *Cgroup),
+		recycled:  make(chan *Cgroup, config.Reserve),
+		configure: make(chan PoolConfig),
+		quit:      make(chan chan bool),
+		nextID:    0,
+	}
+	pool.logger = logger.With("pool", pool.Name)
+	pool.pidsMax.Store(config.PidsMax)
+
+	if err := makeParent(parent); err != nil {
+		return nil, &CgroupPoolError{"parent", err}
 	}
 
-	// create cgroup
+	// create cgroup, or reuse the one a crashed daemon left behind
 	groupPath := pool.GroupPath()
-	pool.printf("create %s", groupPath)
-	if err := syscall.Mkdir(groupPath, 0700); err != nil {
+	pool.logger.Info("creating cgroup pool", "path", groupPath)
+	if err := syscall.Mkdir(groupPath, 0700); err == syscall.EEXIST {
+		pool.logger.Info("reusing existing cgroup pool", "path", groupPath)
+		entries, err := os.ReadDir(groupPath)
+		if err != nil {
+			return nil, &CgroupPoolError{"ReadDir", err}
+		}
+		// never hand out the name of a leftover cgroup
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				continue
+			}
+			name := entry.Name()
+			pool.stale = append(pool.stale, name)
+			var id int
+			if _, err := fmt.Sscanf(name, "cg-%d", &id); err == nil && id > pool.nextID {
+				pool.nextID = id
+			}
+		}
+	} else if err != nil {
 		return nil, &CgroupPoolError{"Mkdir", err}
 	}
 
 	// Make controllers available to child groups
-	rpath := fmt.Sprintf("%s/%s", groupPath, SubTreeControl)
-	if err := os.WriteFile(rpath, []byte(Controllers), os.ModeAppend); err != nil {
+	if err := enableControllers(groupPath); err != nil {
 		return nil, &CgroupPoolError{"WriteFile", err}
 	}
 	go pool.cgTask()
@@ -68,74 +209,170 @@ func NewPool(name string) (*Pool, error) {
 	return pool, nil
 }
 
-// NewCgroup creates a new CGroup in the pool
+// makeParent creates dir and the cgroups between it and the cgroup2
+// mount, making the controllers available down to dir. A dir outside
+// the mount must already exist.
+func makeParent(dir string) error {
+	rel, err := filepath.Rel(CgroupPath, dir)
+	if err != nil || rel == "." {
+		return err
+	}
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		_, err := os.Stat(dir)
+		return err
+	}
+	current := CgroupPath
+	for _, name := range strings.Split(rel, "/") {
+		current = path.Join(current, name)
+		if err := syscall.Mkdir(current, 0700); err != nil && err != syscall.EEXIST {
+			return fmt.Errorf("mkdir %s: %w", current, err)
+		}
+		if err := enableControllers(current); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// enableControllers makes the controllers of a cgroup available to its
+// children
+func enableControllers(dir string) error {
+	rpath := path.Join(dir, SubTreeControl)
+	if err := os.WriteFile(rpath, []byte(Controllers), os.ModeAppend); err != nil {
+		return err
+	}
+	if err := os.WriteFile(rpath, []byte(CpusetController), os.ModeAppend); err != nil {
+		logger.Warn("cpuset controller not available, containers cannot be pinned to CPUs", "path", dir, "error", err)
+	}
+	return nil
+}
+
+// NewCgroup creates a new CGroup in the pool, with the pids.max of the
+// pool and without swap
 func (pool *Pool) NewCgroup() (*Cgroup, error) {
 	pool.nextID++
 
-	cg := &Cgroup{
-		name: fmt.Sprintf("cg-%d", pool.nextID),
-		pool: pool,
-	}
+	cg := newCgroup(pool, fmt.Sprintf("cg-%d", pool.nextID))
 
 	groupPath := cg.GroupPath()
 	if err := syscall.Mkdir(groupPath, 0700); err != nil {
 		return nil, &CgroupError{"Mkdir", err}
 	}
+	pool.live.Add(1)
+	pool.created.Add(1)
+
+	err := cg.WriteInt("pids.max", pool.pidsMax.Load())
+	// swap is not accounted for on every kernel
+	if swapErr := cg.WriteInt("memory.swap.max", 0); err == nil && !errors.Is(swapErr, fs.ErrNotExist) {
+		err = swapErr
+	}
+	if err != nil {
+		if err := cg.Destroy(); err != nil {
+			cg.logger.Warn("failed to destroy cgroup that could not be set up", "error", err)
+		}
+		return nil, err
+	}
 
-	cg.printf("created")
+	cg.logger.Debug("created cgroup")
+	return cg, nil
+}
+
+// Stale returns the names of the cgroups an earlier run left in the
+// pool. They are not handed out; see Adopt.
+func (pool *Pool) Stale() []string {
+	return pool.stale
+}
+
+// Adopt returns an existing cgroup of the pool that is not managed by
+// it, e.g. one left behind by an earlier run
+func (pool *Pool) Adopt(name string) (*Cgroup, error) {
+	cg := newCgroup(pool, name)
+	if _, err := os.Stat(cg.GroupPath()); err != nil {
+		return nil, &CgroupError{resource: name, err: err}
+	}
+	// a limit of "max" is left at 0 (unlimited)
+	if limit, err := cg.TryReadInt("memory.max"); err == nil {
+		cg.memLimitMB = int(limit / (1024 * 1024))
+	}
+	pool.live.Add(1)
 	return cg, nil
 }
 
 func (pool *Pool) cgTask() {
 	// we'll be sent this as part of the quit request
 	var done chan bool
+	// the cgroups ready to be handed out, oldest first
+	var queue []*Cgroup
+	// ready to receive from while cgroups may be created right away
+	now := make(chan time.Time)
+	close(now)
+	// set while waiting to create cgroups again after a failure
+	var retry <-chan time.Time
+	var backoff time.Duration
+	lastOut := time.Now()
+	shrink := time.NewTicker(shrinkInterval)
+	defer shrink.Stop()
 
 	// loop until we get the quit message
-	pool.printf("start creating/serving CGs")
+	pool.logger.Debug("creating and serving cgroups")
 Loop:
 	for {
-		var cg *Cgroup
-
-		// get a new or recycled cgroup.  Settings may be initialized
-		// in one of three places, the first two of which are here:
-		//
-		// 1. upon fresh creation (things that never change, such as max procs)
-		// 2. after it's been recycled (we need to clean things up that change during use)
-		// 3. some things (e.g., memory limits) need to be done in either case, and may
-		//    depend on the needs of the Container; this happens in pool.GetCg (which is
-		//    fed by this function)
-		select {
-		case cg = <-pool.recycled:
-			// restore cgroup to clean state
-			// FIXME not possible in CG2?
-			// cg.WriteInt("memory.failcnt", 0)
-			if err := cg.Unpause(); err != nil {
-				cg.printf("Unpause failed: %s", err)
+		var out chan *Cgroup
+		var head *Cgroup
+		if len(queue) > 0 {
+			out = pool.ready
+			head = queue[0]
+		}
+		// serve what is ready, but keep filling the queue
+		var create <-chan time.Time
+		if len(queue) < pool.config.Reserve {
+			create = retry
+			if retry == nil {
+				create = now
 			}
-		default:
-			cg, _ = pool.NewCgroup()
-			// TODO: set up Config for max procs, memory limits, etc.
-			cg.WriteInt("pids.max", int64(10))
-			cg.WriteInt("memory.swap.max", int64(0))
 		}
 
-		// add cgroup to ready queue
 		select {
-		case pool.ready <- cg:
+		case out <- head:
+			queue = queue[1:]
+			lastOut = time.Now()
+		case cg := <-pool.recycled:
+			queue = pool.recycle(queue, cg)
+		case <-create:
+			retry = nil
+			cg, err := pool.NewCgroup()
+			pool.setCreateErr(err)
+			if err != nil {
+				pool.failed.Add(1)
+				backoff = min(max(2*backoff, minBackoff), maxBackoff)
+				pool.logger.Error("failed to create cgroup", "error", err, "retry_in", backoff)
+				retry = time.After(backoff)
+				break
+			}
+			backoff = 0
+			queue = append(queue, cg)
+		case <-shrink.C:
+			if pool.config.ShrinkAfter > 0 && time.Since(lastOut) >= pool.config.ShrinkAfter {
+				queue = pool.release(queue, pool.config.Reserve)
+			}
+		case config := <-pool.configure:
+			queue = pool.resize(queue, config)
 		case done = <-pool.quit:
-			pool.printf("received shutdown request")
-			cg.Destroy()
 			break Loop
 		}
+		pool.queued.Store(int64(len(queue)))
 	}
+	pool.logger.Debug("received shutdown request")
 
 	// empty queues, freeing all cgroups
-	pool.printf("empty queues and release CGs")
+	pool.logger.Debug("emptying queues and releasing cgroups")
+	for _, cg := range queue {
+		cg.Destroy()
+	}
+	pool.queued.Store(0)
 Empty:
 	for {
 		select {
-		case cg := <-pool.ready:
-			cg.Destroy()
 		case cg := <-pool.recycled:
 			cg.Destroy()
 		default:
@@ -146,12 +383,93 @@ Empty:
 	done <- true
 }
 
-// RetrieveCg retrieves a Cgroup from the pool with a timeout
+// recycle cleans up a released cgroup and queues it to be handed out
+// again, unless the pool already holds its max or it cannot be cleaned
+// up. Settings may be initialized in one of three places:
+//
+//  1. upon fresh creation (things that never change, such as max procs)
+//  2. after it's been recycled (we need to clean things up that change during use)
+//  3. some things (e.g., memory limits) need to be done in either case, and may
+//     depend on the needs of the Container; this happens when the cgroup is
+//     handed out
+func (pool *Pool) recycle(queue []*Cgroup, cg *Cgroup) []*Cgroup {
+	if len(queue) >= pool.config.max() {
+		pool.destroy([]*Cgroup{cg})
+		return queue
+	}
+	// restore cgroup to clean state
+	// FIXME not possible in CG2?
+	// cg.WriteInt("memory.failcnt", 0)
+	if err := errors.Join(cg.Unpause(), cg.reset()); err != nil {
+		cg.logger.Warn("failed to reset recycled cgroup, destroying it", "error", err)
+		pool.destroy([]*Cgroup{cg})
+		return queue
+	}
+	return append(queue, cg)
+}
+
+// release destroys the cgroups queued beyond keep
+func (pool *Pool) release(queue []*Cgroup, keep int) []*Cgroup {
+	if len(queue) <= keep {
+		return queue
+	}
+	pool.logger.Debug("releasing surplus cgroups", "surplus", len(queue)-keep)
+	pool.destroy(queue[keep:])
+	return slices.Clip(queue[:keep])
+}
+
+// destroy destroys cgroups in the background, as destroying may retry
+// for a while and cgroups must keep flowing
+func (pool *Pool) destroy(cgroups []*Cgroup) {
+	go func() {
+		for _, cg := range cgroups {
+			if err := cg.Destroy(); err != nil {
+				cg.logger.Warn("failed to destroy surplus cgroup", "error", err)
+			}
+		}
+	}()
+}
+
+// resize applies a new config to the pool, releasing the cgroups queued
+// beyond the new reserve. The parent of the pool never changes.
+func (pool *Pool) resize(queue []*Cgroup, config PoolConfig) []*Cgroup {
+	pool.logger.Info("reconfiguring cgroup pool", "reserve", config.Reserve, "max", config.max(), "shrink_after", config.ShrinkAfter, "pids_max", config.PidsMax)
+	config.Parent = pool.config.Parent
+	pool.config = config
+	pool.pidsMax.Store(config.PidsMax)
+	return pool.release(queue, config.Reserve)
+}
+
+func (pool *Pool) setCreateErr(err error) {
+	pool.errMutex.Lock()
+	defer pool.errMutex.Unlock()
+	pool.createErr = err
+}
+
+// Configure changes the sizes and limits of the pool, but not its
+// parent. Cgroups already handed out keep their limits; those queued
+// are released if there are more than the new reserve.
+func (pool *Pool) Configure(config PoolConfig) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	pool.configure <- config
+	return nil
+}
+
+// RetrieveCg retrieves a Cgroup from the pool with a timeout. If the pool
+// fails to create cgroups, the timeout error wraps why.
 func (pool *Pool) RetrieveCgroup(timeout time.Duration) (*Cgroup, error) {
 	select {
 	case cg := <-pool.ready:
 		return cg, nil
 	case <-time.After(timeout):
+		pool.errMutex.Lock()
+		err := pool.createErr
+		pool.errMutex.Unlock()
+		if err != nil {
+			return nil, &CgroupPoolError{"timeout", fmt.Errorf("timeout waiting for cgroup: %w", err)}
+		}
 		return nil, &CgroupPoolError{"timeout", fmt.Errorf("timeout waiting for cgroup")}
 	}
 }
@@ -165,14 +483,14 @@ func (pool *Pool) Destroy() error {
 
 	// Destroy cgroup for this entire pool
 	gpath := pool.GroupPath()
-	pool.printf("Destroying cgroup pool with path \"%s\"", gpath)
+	pool.logger.Info("destroying cgroup pool", "path", gpath)
 	for i := 100; i >= 0; i-- {
 		if err := syscall.Rmdir(gpath); err != nil {
 			if i == 0 {
 				return &CgroupPoolError{resource: gpath, err: err}
 			}
 
-			pool.printf("cgroup pool Rmdir failed, trying again in 5ms")
+			pool.logger.Debug("cgroup pool rmdir failed, trying again in 5ms", "error", err)
 			time.Sleep(5 * time.Millisecond)
 		} else {
 			break
@@ -181,14 +499,52 @@ func (pool *Pool) Destroy() error {
 	return nil
 }
 
-// add ID to each log message so we know which logs correspond to
-// which containers
-func (pool *Pool) printf(format string, args ...any) {
-	msg := fmt.Sprintf(format, args...)
-	log.Printf("%s [CGROUP POOL %s]", strings.TrimRight(msg, "\n"), pool.Name)
+// Limits caps the cgroups of a pool together. Zero means no limit.
+type Limits struct {
+	MemLimitMB int
+	CPUPercent int
+	PidsMax    int64
+}
+
+// SetLimits sets the limits of the pool cgroup, which every cgroup of
+// the pool is below
+func (pool *Pool) SetLimits(limits Limits) error {
+	mem, cpu, pids := "max", "max 100000", "max"
+	if limits.MemLimitMB > 0 {
+		mem = strconv.FormatInt(int64(limits.MemLimitMB)*1024*1024, 10)
+	}
+	if limits.CPUPercent > 0 {
+		period := 100000 // 100 ms
+		cpu = fmt.Sprintf("%d %d", period*limits.CPUPercent/100, period)
+	}
+	if limits.PidsMax > 0 {
+		pids = strconv.FormatInt(limits.PidsMax, 10)
+	}
+	for resource, value := range map[string]string{"memory.max": mem, "cpu.max": cpu, "pids.max": pids} {
+		if err := os.WriteFile(path.Join(pool.GroupPath(), resource), []byte(value), os.ModeAppend); err != nil {
+			return &CgroupPoolError{resource, err}
+		}
+	}
+	pool.logger.Info("set cgroup pool limits", "mem_limit_mb", limits.MemLimitMB, "cpu_percent", limits.CPUPercent, "pids_max", limits.PidsMax)
+	return nil
+}
+
+// Stats returns how many cgroups the pool holds, and how many it
+// created, destroyed and failed to create
+func (pool *Pool) Stats() PoolStats {
+	stats := PoolStats{
+		Ready:     int(pool.queued.Load()),
+		Recycled:  len(pool.recycled),
+		Created:   pool.created.Load(),
+		Destroyed: pool.destroyed.Load(),
+		Failed:    pool.failed.Load(),
+	}
+	// the counts are read one by one, so they may not add up
+	stats.InUse = max(int(pool.live.Load())-stats.Ready-stats.Recycled, 0)
+	return stats
 }
 
 // GroupPath returns the path to the Cgroup pool
 func (pool *Pool) GroupPath() string {
-	return fmt.Sprintf("/sys/fs/cgroup/%s", pool.Name)
+	return path.Join(pool.parent, pool.Name)
 }
@@ -1,8 +1,8 @@
 package cgroup
 
 import (
-	"log"
 	"os"
+	"parkerdgabel/sockd/internal/logging"
 	"path"
 	"strings"
 	"testing"
@@ -20,7 +20,7 @@ func TestPool_NewPool(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			pool, err := NewPool("test-pool")
+			pool, err := NewPool("test-pool", DefaultPoolConfig())
 			if err != nil {
 				t.Errorf("NewPool() error = %v", err)
 			}
@@ -30,7 +30,7 @@ func TestPool_NewPool(t *testing.T) {
 }
 
 func TestPool_Destroy(t *testing.T) {
-	pool, err := NewPool("test-pool")
+	pool, err := NewPool("test-pool", DefaultPoolConfig())
 
 	if err != nil {
 		t.Fatalf("NewPool() error = %v", err)
@@ -46,21 +46,21 @@ func TestPool_Destroy(t *testing.T) {
 }
 
 func TestPool_GroupPath(t *testing.T) {
-	pool, err := NewPool("test-pool")
+	pool, err := NewPool("test-pool", DefaultPoolConfig())
 
 	if err != nil {
 		t.Fatalf("NewPool() error = %v", err)
 	}
 	defer pool.Destroy()
 
-	expectedPath := path.Join(CgroupPath, "cgroup-test-pool")
+	expectedPath := path.Join(CgroupPath, "test-pool")
 	if pool.GroupPath() != expectedPath {
 		t.Errorf("GroupPath() = %v, want %v", pool.GroupPath(), expectedPath)
 	}
 }
 
 func TestPool_RetrieveCgroup(t *testing.T) {
-	pool, err := NewPool("test-pool")
+	pool, err := NewPool("test-pool", DefaultPoolConfig())
 	if err != nil {
 		t.Fatalf("NewPool() error = %v", err)
 	}
@@ -78,21 +78,88 @@ func TestPool_RetrieveCgroup(t *testing.T) {
 	cgroup.Release()
 }
 
-func TestPool_printf(t *testing.T) {
-	pool, err := NewPool("test-pool")
+func TestPool_logger(t *testing.T) {
+	// Redirect log output for testing
+	var logOutput strings.Builder
+	if err := logging.Configure(&logOutput, logging.Config{}); err != nil {
+		t.Fatalf("Configure() error = %v", err)
+	}
+	defer logging.Configure(os.Stderr, logging.Config{Format: "text"})
+
+	pool, err := NewPool("test-pool", DefaultPoolConfig())
 	if err != nil {
 		t.Fatalf("NewPool() error = %v", err)
 	}
 	defer pool.Destroy()
 
-	// Redirect log output for testing
-	var logOutput strings.Builder
-	log.SetOutput(&logOutput)
-	defer log.SetOutput(os.Stderr)
+	pool.logger.Info("test message", "n", 1)
+
+	for _, want := range []string{`"msg":"test message"`, `"subsystem":"cgroup"`, `"pool":"` + pool.Name + `"`} {
+		if !strings.Contains(logOutput.String(), want) {
+			t.Errorf("logger did not log %s", want)
+		}
+	}
+}
+
+func TestPool_Configure(t *testing.T) {
+	pool, err := NewPool("test-pool", DefaultPoolConfig())
+	if err != nil {
+		t.Fatalf("NewPool() error = %v", err)
+	}
+	defer pool.Destroy()
+
+	if err := pool.Configure(PoolConfig{Reserve: 0, PidsMax: 10}); err == nil {
+		t.Errorf("Configure() accepted a reserve of 0")
+	}
+	if err := pool.Configure(PoolConfig{Reserve: 2, PidsMax: 10}); err != nil {
+		t.Fatalf("Configure() error = %v", err)
+	}
+	for i := 0; i < 100 && pool.Stats().Ready != 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if pool.Stats().Ready != 2 {
+		t.Errorf("Stats().Ready = %d, want the new reserve of 2", pool.Stats().Ready)
+	}
+}
 
-	pool.printf("test message %d", 1)
+func TestPoolConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  PoolConfig
+		wantErr bool
+	}{
+		{name: "default", config: DefaultPoolConfig()},
+		{name: "no parent", config: PoolConfig{Reserve: 2, PidsMax: 10}},
+		{name: "relative parent", config: PoolConfig{Parent: "sockd", Reserve: 2, PidsMax: 10}, wantErr: true},
+		{name: "max below reserve", config: PoolConfig{Reserve: 4, Max: 2, PidsMax: 10}, wantErr: true},
+		{name: "negative shrink_after", config: PoolConfig{Reserve: 2, ShrinkAfter: -time.Second, PidsMax: 10}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
 
-	if !strings.Contains(logOutput.String(), "test message 1") {
-		t.Errorf("printf() did not log the expected message")
+func TestPool_Stats(t *testing.T) {
+	pool, err := NewPool("test-pool", PoolConfig{Reserve: 2, PidsMax: 10})
+	if err != nil {
+		t.Fatalf("NewPool() error = %v", err)
+	}
+	defer pool.Destroy()
+
+	cg, err := pool.RetrieveCgroup(time.Second)
+	if err != nil {
+		t.Fatalf("RetrieveCgroup() error = %v", err)
+	}
+	for i := 0; i < 100 && pool.Stats().Ready != 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	stats := pool.Stats()
+	if stats.InUse != 1 || stats.Ready != 2 || stats.Created < 3 {
+		t.Errorf("Stats() = %+v, want 1 in use and 2 ready", stats)
 	}
+	cg.Release()
 }
@@ -0,0 +1,121 @@
+package cgroup
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// MemoryEvents counts what happened when a cgroup ran into its memory
+// limits, from memory.events
+type MemoryEvents struct {
+	// Low is how often memory under memory.low was reclaimed
+	Low int64 `json:"low"`
+	// High is how often the cgroup was throttled above memory.high
+	High int64 `json:"high"`
+	// Max is how often the cgroup hit memory.max
+	Max int64 `json:"max"`
+	// OOM is how often the OOM killer was invoked in the cgroup
+	OOM int64 `json:"oom"`
+	// OOMKill is how many processes of the cgroup the OOM killer killed
+	OOMKill int64 `json:"oom_kill"`
+}
+
+// MemoryEvents reads the memory.events of the cgroup
+func (cg *Cgroup) MemoryEvents() (*MemoryEvents, error) {
+	events, err := cg.readKV("memory.events")
+	if err != nil {
+		return nil, err
+	}
+	return &MemoryEvents{
+		Low:     events["low"],
+		High:    events["high"],
+		Max:     events["max"],
+		OOM:     events["oom"],
+		OOMKill: events["oom_kill"],
+	}, nil
+}
+
+// Pressure is the pressure stall information (PSI) of a resource: the
+// share of time, in percent, some or all of the tasks of a cgroup were
+// stalled waiting for it, averaged over 10s, 60s and 300s
+type Pressure struct {
+	Some PressureAverages `json:"some"`
+	Full PressureAverages `json:"full"`
+}
+
+type PressureAverages struct {
+	Avg10  float64 `json:"avg10"`
+	Avg60  float64 `json:"avg60"`
+	Avg300 float64 `json:"avg300"`
+	// Total is the total stall time in microseconds
+	Total int64 `json:"total"`
+}
+
+// MemoryPressure reads the memory.pressure of the cgroup
+func (cg *Cgroup) MemoryPressure() (*Pressure, error) {
+	return readPressure(cg.ResourcePath("memory.pressure"))
+}
+
+// CPUPressure reads the cpu.pressure of the cgroup
+func (cg *Cgroup) CPUPressure() (*Pressure, error) {
+	return readPressure(cg.ResourcePath("cpu.pressure"))
+}
+
+// MemoryPressure reads the memory.pressure of the pool cgroup, which
+// covers every cgroup of the pool
+func (pool *Pool) MemoryPressure() (*Pressure, error) {
+	return readPressure(path.Join(pool.GroupPath(), "memory.pressure"))
+}
+
+// readPressure parses a PSI file, whose lines look like
+//
+//	some avg10=0.00 avg60=0.00 avg300=0.00 total=0
+func readPressure(file string) (*Pressure, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, &CgroupError{resource: path.Base(file), err: err}
+	}
+	defer f.Close()
+	var p Pressure
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		var averages *PressureAverages
+		switch fields[0] {
+		case "some":
+			averages = &p.Some
+		case "full":
+			averages = &p.Full
+		default:
+			continue
+		}
+		for _, field := range fields[1:] {
+			key, value, _ := strings.Cut(field, "=")
+			var err error
+			switch key {
+			case "avg10":
+				averages.Avg10, err = strconv.ParseFloat(value, 64)
+			case "avg60":
+				averages.Avg60, err = strconv.ParseFloat(value, 64)
+			case "avg300":
+				averages.Avg300, err = strconv.ParseFloat(value, 64)
+			case "total":
+				averages.Total, err = strconv.ParseInt(value, 10, 64)
+			}
+			if err != nil {
+				return nil, &CgroupError{resource: path.Base(file), err: fmt.Errorf("%s: %w", field, err)}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, &CgroupError{resource: path.Base(file), err: err}
+	}
+	return &p, nil
+}
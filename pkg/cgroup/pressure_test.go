@@ -0,0 +1,33 @@
+package cgroup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadPressure(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "memory.pressure")
+	content := "some avg10=12.50 avg60=3.00 avg300=0.75 total=123456\nfull avg10=1.25 avg60=0.00 avg300=0.00 total=789\n"
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readPressure(file)
+	if err != nil {
+		t.Fatalf("readPressure() error = %v", err)
+	}
+	want := Pressure{
+		Some: PressureAverages{Avg10: 12.5, Avg60: 3, Avg300: 0.75, Total: 123456},
+		Full: PressureAverages{Avg10: 1.25, Total: 789},
+	}
+	if *got != want {
+		t.Errorf("readPressure() = %+v, want %+v", *got, want)
+	}
+
+	if err := os.WriteFile(file, []byte("some avg10=high\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readPressure(file); err == nil {
+		t.Error("readPressure() of a malformed file succeeded")
+	}
+}
@@ -0,0 +1,359 @@
+package cgroup
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// IOMax limits the IO of a cgroup on one device, in bytes and
+// operations per second. Zero means no limit.
+type IOMax struct {
+	// Device is a device number, as in "8:0", or the path of a device
+	// node, as in "/dev/sda"
+	Device    string `json:"device"`
+	ReadBPS   int64  `json:"rbps,omitempty"`
+	WriteBPS  int64  `json:"wbps,omitempty"`
+	ReadIOPS  int64  `json:"riops,omitempty"`
+	WriteIOPS int64  `json:"wiops,omitempty"`
+}
+
+// IOWeight is the share of a device a cgroup gets when it is contended,
+// from 1 to 10000, 100 being the default
+type IOWeight struct {
+	Device string `json:"device"`
+	Weight int    `json:"weight"`
+}
+
+var deviceNumber = regexp.MustCompile(`^\d+:\d+$`)
+
+// ParseIOMax parses an io.max line, as in "8:0 rbps=1048576 wiops=100".
+// Keys left out, or set to max, are not limited.
+func ParseIOMax(s string) (IOMax, error) {
+	fields := strings.Fields(s)
+	if len(fields) < 2 {
+		return IOMax{}, fmt.Errorf("io max %q must be a device followed by key=value limits", s)
+	}
+	limit := IOMax{Device: fields[0]}
+	for _, field := range fields[1:] {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return IOMax{}, fmt.Errorf("io max %q: %q is not key=value", s, field)
+		}
+		var n int64
+		if value != "max" {
+			var err error
+			if n, err = strconv.ParseInt(value, 10, 64); err != nil || n < 1 {
+				return IOMax{}, fmt.Errorf("io max %q: %s must be a positive number or max", s, key)
+			}
+		}
+		switch key {
+		case "rbps":
+			limit.ReadBPS = n
+		case "wbps":
+			limit.WriteBPS = n
+		case "riops":
+			limit.ReadIOPS = n
+		case "wiops":
+			limit.WriteIOPS = n
+		default:
+			return IOMax{}, fmt.Errorf("io max %q: unknown key %q", s, key)
+		}
+	}
+	return limit, nil
+}
+
+// String formats the limit as a line of io.max
+func (m IOMax) String() string {
+	return fmt.Sprintf("%s rbps=%s wbps=%s riops=%s wiops=%s", m.Device,
+		orMax(m.ReadBPS), orMax(m.WriteBPS), orMax(m.ReadIOPS), orMax(m.WriteIOPS))
+}
+
+// ParseIOWeight parses an io.weight line, as in "8:0 200"
+func ParseIOWeight(s string) (IOWeight, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return IOWeight{}, fmt.Errorf("io weight %q must be a device followed by a weight", s)
+	}
+	weight, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return IOWeight{}, fmt.Errorf("io weight %q: %v", s, err)
+	}
+	w := IOWeight{Device: fields[0], Weight: weight}
+	if err := w.Validate(); err != nil {
+		return IOWeight{}, err
+	}
+	return w, nil
+}
+
+// String formats the weight as a line of io.weight
+func (w IOWeight) String() string {
+	return fmt.Sprintf("%s %d", w.Device, w.Weight)
+}
+
+func (w IOWeight) Validate() error {
+	if w.Weight < 1 || w.Weight > 10000 {
+		return fmt.Errorf("io weight of %s must be between 1 and 10000, not %d", w.Device, w.Weight)
+	}
+	return nil
+}
+
+func orMax(n int64) string {
+	if n <= 0 {
+		return "max"
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+// resolveDevice returns the number of a device given by number or by the
+// path of its node
+func resolveDevice(device string) (string, error) {
+	if deviceNumber.MatchString(device) {
+		return device, nil
+	}
+	var st unix.Stat_t
+	if err := unix.Stat(device, &st); err != nil {
+		return "", fmt.Errorf("device %s: %w", device, err)
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFBLK {
+		return "", fmt.Errorf("device %s is not a block device", device)
+	}
+	return fmt.Sprintf("%d:%d", unix.Major(st.Rdev), unix.Minor(st.Rdev)), nil
+}
+
+// write writes value to resource, and remembers to write reset to it
+// when the cgroup is recycled. Devices of io.max and io.weight are reset
+// one by one.
+func (cg *Cgroup) write(resource, device, value, reset string) error {
+	if err := cg.WriteString(resource, value); err != nil {
+		return err
+	}
+	if cg.resets == nil {
+		cg.resets = make(map[[2]string]string)
+	}
+	cg.resets[[2]string{resource, device}] = reset
+	return nil
+}
+
+// reset gives a recycled cgroup the limits of a new one of its pool
+// back, undoing what the setters wrote. Resources the kernel lacks,
+// such as memory.swap.max without swap accounting, are skipped.
+func (cg *Cgroup) reset() error {
+	defaults := map[string]string{
+		"memory.max":      "max",
+		"memory.high":     "max",
+		"memory.low":      "0",
+		"memory.swap.max": "0",
+		"cpu.max":         "max 100000",
+		"cpu.weight":      "100",
+		"pids.max":        strconv.FormatInt(cg.pool.pidsMax.Load(), 10),
+	}
+	var errs []error
+	for resource, value := range defaults {
+		if err := cg.WriteString(resource, value); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	// cpusets and the limits of devices
+	for key, value := range cg.resets {
+		if _, ok := defaults[key[0]]; ok {
+			continue
+		}
+		if err := cg.WriteString(key[0], value); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	cg.resets = nil
+	cg.memLimitMB, cg.cpuPercent = 0, 0
+	return errors.Join(errs...)
+}
+
+// readMax reads a resource holding a number or max, the latter as -1
+func (cg *Cgroup) readMax(resource string) (int64, error) {
+	raw, err := os.ReadFile(cg.ResourcePath(resource))
+	if err != nil {
+		return 0, &CgroupError{resource: resource, err: err}
+	}
+	value := strings.TrimSpace(string(raw))
+	if value == "max" {
+		return -1, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, &CgroupError{resource: resource, err: err}
+	}
+	return n, nil
+}
+
+func (cg *Cgroup) readString(resource string) (string, error) {
+	raw, err := os.ReadFile(cg.ResourcePath(resource))
+	if err != nil {
+		return "", &CgroupError{resource: resource, err: err}
+	}
+	return strings.TrimSpace(string(raw)), nil
+}
+
+// SetPidsMax limits how many processes the cgroup may hold, 0 for no
+// limit. Recycled cgroups get the pids_max of their pool back.
+func (cg *Cgroup) SetPidsMax(n int64) error {
+	return cg.write("pids.max", "", orMax(n), strconv.FormatInt(cg.pool.pidsMax.Load(), 10))
+}
+
+// PidsMax returns the process limit of the cgroup, -1 for none
+func (cg *Cgroup) PidsMax() (int64, error) {
+	return cg.readMax("pids.max")
+}
+
+// SetCPUWeight sets the share of the CPU the cgroup gets when it is
+// contended, from 1 to 10000, 100 being the default
+func (cg *Cgroup) SetCPUWeight(weight int) error {
+	if weight < 1 || weight > 10000 {
+		return &CgroupError{resource: "cpu.weight", err: fmt.Errorf("weight must be between 1 and 10000, not %d", weight)}
+	}
+	return cg.write("cpu.weight", "", strconv.Itoa(weight), "100")
+}
+
+func (cg *Cgroup) CPUWeight() (int, error) {
+	weight, err := cg.readMax("cpu.weight")
+	return int(weight), err
+}
+
+// SetCpusetCPUs pins the cgroup to a list of CPUs, as in "0-3,6". The
+// empty list gives the cgroup the CPUs of its pool.
+func (cg *Cgroup) SetCpusetCPUs(cpus string) error {
+	return cg.write("cpuset.cpus", "", cpus+"\n", "\n")
+}
+
+// CpusetCPUs returns the CPUs the cgroup is pinned to, empty if it is not
+func (cg *Cgroup) CpusetCPUs() (string, error) {
+	return cg.readString("cpuset.cpus")
+}
+
+// SetCpusetMems pins the cgroup to a list of memory nodes, as in "0".
+// The empty list gives the cgroup the nodes of its pool.
+func (cg *Cgroup) SetCpusetMems(mems string) error {
+	return cg.write("cpuset.mems", "", mems+"\n", "\n")
+}
+
+// CpusetMems returns the memory nodes the cgroup is pinned to, empty if
+// it is not
+func (cg *Cgroup) CpusetMems() (string, error) {
+	return cg.readString("cpuset.mems")
+}
+
+// SetIOMax limits the IO of the cgroup on a device
+func (cg *Cgroup) SetIOMax(limit IOMax) error {
+	device, err := resolveDevice(limit.Device)
+	if err != nil {
+		return &CgroupError{resource: "io.max", err: err}
+	}
+	limit.Device = device
+	return cg.write("io.max", device, limit.String(), IOMax{Device: device}.String())
+}
+
+// IOMax returns the IO limits of the cgroup, by device number
+func (cg *Cgroup) IOMax() ([]IOMax, error) {
+	raw, err := cg.readString("io.max")
+	if err != nil {
+		return nil, err
+	}
+	var limits []IOMax
+	for _, line := range strings.Split(raw, "\n") {
+		if line == "" {
+			continue
+		}
+		limit, err := ParseIOMax(line)
+		if err != nil {
+			return nil, &CgroupError{resource: "io.max", err: err}
+		}
+		limits = append(limits, limit)
+	}
+	return limits, nil
+}
+
+// SetIOWeight sets the share of a device the cgroup gets when it is
+// contended
+func (cg *Cgroup) SetIOWeight(weight IOWeight) error {
+	if err := weight.Validate(); err != nil {
+		return &CgroupError{resource: "io.weight", err: err}
+	}
+	device, err := resolveDevice(weight.Device)
+	if err != nil {
+		return &CgroupError{resource: "io.weight", err: err}
+	}
+	weight.Device = device
+	return cg.write("io.weight", device, weight.String(), device+" default")
+}
+
+// IOWeight returns the IO weights of the cgroup by device number. The
+// weight of the devices not listed is returned with an empty device.
+func (cg *Cgroup) IOWeight() ([]IOWeight, error) {
+	raw, err := cg.readString("io.weight")
+	if err != nil {
+		return nil, err
+	}
+	var weights []IOWeight
+	for _, line := range strings.Split(raw, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		weight, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, &CgroupError{resource: "io.weight", err: err}
+		}
+		device := fields[0]
+		if device == "default" {
+			device = ""
+		}
+		weights = append(weights, IOWeight{Device: device, Weight: weight})
+	}
+	return weights, nil
+}
+
+// SetMemHighMB sets the memory above which the processes of the cgroup
+// are throttled and reclaimed from, 0 for none
+func (cg *Cgroup) SetMemHighMB(mb int) error {
+	return cg.write("memory.high", "", orMax(int64(mb)*1024*1024), "max")
+}
+
+// MemHighMB returns the memory.high of the cgroup in MB, -1 for none
+func (cg *Cgroup) MemHighMB() (int, error) {
+	return cg.readMB("memory.high")
+}
+
+// SetMemLowMB sets the memory of the cgroup that is only reclaimed when
+// no unprotected memory is left
+func (cg *Cgroup) SetMemLowMB(mb int) error {
+	return cg.write("memory.low", "", strconv.FormatInt(int64(mb)*1024*1024, 10), "0")
+}
+
+func (cg *Cgroup) MemLowMB() (int, error) {
+	return cg.readMB("memory.low")
+}
+
+// SetMemSwapMaxMB sets how much the cgroup may swap. Cgroups of a pool
+// start without swap.
+func (cg *Cgroup) SetMemSwapMaxMB(mb int) error {
+	return cg.write("memory.swap.max", "", strconv.FormatInt(int64(mb)*1024*1024, 10), "0")
+}
+
+// MemSwapMaxMB returns the memory.swap.max of the cgroup in MB, -1 for
+// no limit
+func (cg *Cgroup) MemSwapMaxMB() (int, error) {
+	return cg.readMB("memory.swap.max")
+}
+
+func (cg *Cgroup) readMB(resource string) (int, error) {
+	n, err := cg.readMax(resource)
+	if err != nil || n < 0 {
+		return int(n), err
+	}
+	return int(n / (1024 * 1024)), nil
+}
@@ -0,0 +1,57 @@
+package cgroup
+
+import "testing"
+
+func TestParseIOMax(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    IOMax
+		wantErr bool
+	}{
+		{in: "8:0 rbps=1048576 wiops=100", want: IOMax{Device: "8:0", ReadBPS: 1048576, WriteIOPS: 100}},
+		{in: "8:16 rbps=max wbps=2 riops=max wiops=max", want: IOMax{Device: "8:16", WriteBPS: 2}},
+		{in: "/dev/sda wbps=10", want: IOMax{Device: "/dev/sda", WriteBPS: 10}},
+		{in: "8:0", wantErr: true},
+		{in: "8:0 rbps", wantErr: true},
+		{in: "8:0 rbps=-1", wantErr: true},
+		{in: "8:0 bps=1", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseIOMax(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseIOMax(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseIOMax(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+
+	limit := IOMax{Device: "8:0", ReadBPS: 1048576}
+	if got, want := limit.String(), "8:0 rbps=1048576 wbps=max riops=max wiops=max"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+	if got, err := ParseIOMax(limit.String()); err != nil || got != limit {
+		t.Errorf("ParseIOMax(String()) = %+v, %v, want %+v", got, err, limit)
+	}
+}
+
+func TestParseIOWeight(t *testing.T) {
+	if got, err := ParseIOWeight("8:0 200"); err != nil || got != (IOWeight{Device: "8:0", Weight: 200}) {
+		t.Errorf("ParseIOWeight() = %+v, %v", got, err)
+	}
+	for _, in := range []string{"8:0", "8:0 heavy", "8:0 0", "8:0 10001"} {
+		if _, err := ParseIOWeight(in); err == nil {
+			t.Errorf("ParseIOWeight(%q) succeeded, want an error", in)
+		}
+	}
+}
+
+func TestResolveDevice(t *testing.T) {
+	if got, err := resolveDevice("8:0"); err != nil || got != "8:0" {
+		t.Errorf("resolveDevice(8:0) = %q, %v", got, err)
+	}
+	if _, err := resolveDevice("/dev/null"); err == nil {
+		t.Error("resolveDevice accepted /dev/null, which is not a block device")
+	}
+}
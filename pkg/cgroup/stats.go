@@ -0,0 +1,188 @@
+package cgroup
+
+import (
+	"bufio"
+	"errors"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Stats is the resource usage of a cgroup. Counters the kernel does not
+// keep, such as memory.peak before Linux 5.19, are left at zero.
+type Stats struct {
+	Memory MemoryStats `json:"memory"`
+	CPU    CPUStats    `json:"cpu"`
+	IO     []IOStats   `json:"io,omitempty"`
+	Pids   PidsStats   `json:"pids"`
+}
+
+// MemoryStats come from memory.current, memory.peak and memory.stat
+type MemoryStats struct {
+	CurrentBytes int64 `json:"current_bytes"`
+	PeakBytes    int64 `json:"peak_bytes"`
+	LimitBytes   int64 `json:"limit_bytes"` // 0 for no limit
+	AnonBytes    int64 `json:"anon_bytes"`
+	FileBytes    int64 `json:"file_bytes"`
+	KernelBytes  int64 `json:"kernel_bytes"`
+	ShmemBytes   int64 `json:"shmem_bytes"`
+	SockBytes    int64 `json:"sock_bytes"`
+	PgFault      int64 `json:"pgfault"`
+	PgMajFault   int64 `json:"pgmajfault"`
+}
+
+// CPUStats come from cpu.stat
+type CPUStats struct {
+	UsageUsec     int64 `json:"usage_usec"`
+	UserUsec      int64 `json:"user_usec"`
+	SystemUsec    int64 `json:"system_usec"`
+	NrPeriods     int64 `json:"nr_periods"`
+	NrThrottled   int64 `json:"nr_throttled"`
+	ThrottledUsec int64 `json:"throttled_usec"`
+}
+
+// IOStats are the IO of a cgroup on one device, from io.stat
+type IOStats struct {
+	Device     string `json:"device"`
+	ReadBytes  int64  `json:"rbytes"`
+	WriteBytes int64  `json:"wbytes"`
+	ReadIOs    int64  `json:"rios"`
+	WriteIOs   int64  `json:"wios"`
+}
+
+// PidsStats come from pids.current and pids.max
+type PidsStats struct {
+	Current int64 `json:"current"`
+	Max     int64 `json:"max"` // 0 for no limit
+}
+
+// Stats reads the resource usage of the cgroup. Only a cgroup that is
+// gone, or that lacks memory.current or cpu.stat, is an error.
+func (cg *Cgroup) Stats() (*Stats, error) {
+	var s Stats
+	var err error
+	if s.Memory.CurrentBytes, err = cg.ReadInt("memory.current"); err != nil {
+		return nil, err
+	}
+	cpu, err := cg.readKV("cpu.stat")
+	if err != nil {
+		return nil, err
+	}
+	s.CPU = CPUStats{
+		UsageUsec:     cpu["usage_usec"],
+		UserUsec:      cpu["user_usec"],
+		SystemUsec:    cpu["system_usec"],
+		NrPeriods:     cpu["nr_periods"],
+		NrThrottled:   cpu["nr_throttled"],
+		ThrottledUsec: cpu["throttled_usec"],
+	}
+
+	var errs []error
+	optional := func(err error) {
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	if peak, err := cg.TryReadInt("memory.peak"); err == nil {
+		s.Memory.PeakBytes = peak
+	} else {
+		optional(err)
+	}
+	if limit, err := cg.readMax("memory.max"); err == nil && limit > 0 {
+		s.Memory.LimitBytes = limit
+	} else {
+		optional(err)
+	}
+	if mem, err := cg.readKV("memory.stat"); err == nil {
+		s.Memory.AnonBytes = mem["anon"]
+		s.Memory.FileBytes = mem["file"]
+		s.Memory.KernelBytes = mem["kernel"]
+		s.Memory.ShmemBytes = mem["shmem"]
+		s.Memory.SockBytes = mem["sock"]
+		s.Memory.PgFault = mem["pgfault"]
+		s.Memory.PgMajFault = mem["pgmajfault"]
+	} else {
+		optional(err)
+	}
+	if io, err := cg.ioStats(); err == nil {
+		s.IO = io
+	} else {
+		optional(err)
+	}
+	if current, err := cg.TryReadInt("pids.current"); err == nil {
+		s.Pids.Current = current
+	} else {
+		optional(err)
+	}
+	if max, err := cg.readMax("pids.max"); err == nil && max > 0 {
+		s.Pids.Max = max
+	} else {
+		optional(err)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// readKV reads a flat keyed file such as cpu.stat, one "key value" per
+// line
+func (cg *Cgroup) readKV(resource string) (map[string]int64, error) {
+	f, err := os.Open(cg.ResourcePath(resource))
+	if err != nil {
+		return nil, &CgroupError{resource: resource, err: err}
+	}
+	defer f.Close()
+	values := make(map[string]int64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			continue
+		}
+		if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+			values[key] = n
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, &CgroupError{resource: resource, err: err}
+	}
+	return values, nil
+}
+
+// ioStats reads io.stat, whose lines are a device followed by key=value
+// counters, as in "8:0 rbytes=1 wbytes=2 rios=3 wios=4 dbytes=0 dios=0"
+func (cg *Cgroup) ioStats() ([]IOStats, error) {
+	raw, err := cg.readString("io.stat")
+	if err != nil {
+		return nil, err
+	}
+	var stats []IOStats
+	for _, line := range strings.Split(raw, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		s := IOStats{Device: fields[0]}
+		for _, field := range fields[1:] {
+			key, value, _ := strings.Cut(field, "=")
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				continue
+			}
+			switch key {
+			case "rbytes":
+				s.ReadBytes = n
+			case "wbytes":
+				s.WriteBytes = n
+			case "rios":
+				s.ReadIOs = n
+			case "wios":
+				s.WriteIOs = n
+			}
+		}
+		stats = append(stats, s)
+	}
+	return stats, nil
+}
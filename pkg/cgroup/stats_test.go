@@ -0,0 +1,174 @@
+package cgroup
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// fixtureCgroup returns a cgroup whose resource files are files, in a
+// temporary directory instead of the cgroup filesystem
+func fixtureCgroup(t *testing.T, files map[string]string) *Cgroup {
+	t.Helper()
+	cg := &Cgroup{pool: &Pool{Name: "pool", parent: t.TempDir()}, name: "cg"}
+	if err := os.MkdirAll(cg.GroupPath(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(cg.GroupPath(), name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return cg
+}
+
+func TestCgroupStats(t *testing.T) {
+	required := map[string]string{
+		"memory.current": "4096\n",
+		"cpu.stat":       "usage_usec 300\nuser_usec 200\nsystem_usec 100\n",
+	}
+	with := func(files map[string]string) map[string]string {
+		all := map[string]string{}
+		for _, m := range []map[string]string{required, files} {
+			for name, content := range m {
+				all[name] = content
+			}
+		}
+		return all
+	}
+	minimal := Stats{
+		Memory: MemoryStats{CurrentBytes: 4096},
+		CPU:    CPUStats{UsageUsec: 300, UserUsec: 200, SystemUsec: 100},
+	}
+
+	tests := []struct {
+		name    string
+		files   map[string]string
+		want    Stats
+		wantErr bool
+	}{
+		{
+			name:  "only required files",
+			files: required,
+			want:  minimal,
+		},
+		{
+			name: "every file",
+			files: map[string]string{
+				"memory.current": "4096\n",
+				"memory.peak":    "8192\n",
+				"memory.max":     "1048576\n",
+				"memory.stat":    "anon 1024\nfile 2048\nkernel 512\nshmem 256\nsock 128\npgfault 7\npgmajfault 1\nactive_anon 0\n",
+				"cpu.stat":       "usage_usec 300\nuser_usec 200\nsystem_usec 100\nnr_periods 10\nnr_throttled 2\nthrottled_usec 50\n",
+				"io.stat":        "8:0 rbytes=1 wbytes=2 rios=3 wios=4 dbytes=0 dios=0\n",
+				"pids.current":   "3\n",
+				"pids.max":       "64\n",
+			},
+			want: Stats{
+				Memory: MemoryStats{
+					CurrentBytes: 4096, PeakBytes: 8192, LimitBytes: 1048576,
+					AnonBytes: 1024, FileBytes: 2048, KernelBytes: 512, ShmemBytes: 256, SockBytes: 128,
+					PgFault: 7, PgMajFault: 1,
+				},
+				CPU:  CPUStats{UsageUsec: 300, UserUsec: 200, SystemUsec: 100, NrPeriods: 10, NrThrottled: 2, ThrottledUsec: 50},
+				IO:   []IOStats{{Device: "8:0", ReadBytes: 1, WriteBytes: 2, ReadIOs: 3, WriteIOs: 4}},
+				Pids: PidsStats{Current: 3, Max: 64},
+			},
+		},
+		{
+			name:  "no limits",
+			files: with(map[string]string{"memory.max": "max\n", "pids.max": "max\n"}),
+			want:  minimal,
+		},
+		{
+			name:    "no memory.current",
+			files:   map[string]string{"cpu.stat": required["cpu.stat"]},
+			wantErr: true,
+		},
+		{
+			name:    "no cpu.stat",
+			files:   map[string]string{"memory.current": required["memory.current"]},
+			wantErr: true,
+		},
+		{
+			name:    "malformed memory.current",
+			files:   with(map[string]string{"memory.current": "lots\n"}),
+			wantErr: true,
+		},
+		{
+			name:    "malformed optional file",
+			files:   with(map[string]string{"pids.max": "many\n"}),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := fixtureCgroup(t, tt.files).Stats()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Stats() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("Stats() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCgroupReadKV(t *testing.T) {
+	tests := []struct {
+		content string
+		want    map[string]int64
+	}{
+		{content: "", want: map[string]int64{}},
+		{content: "usage_usec 300\nuser_usec 200\n", want: map[string]int64{"usage_usec": 300, "user_usec": 200}},
+		{content: "usage_usec 300", want: map[string]int64{"usage_usec": 300}},
+		{content: "usage_usec\nuser_usec two\nsystem_usec 100\n", want: map[string]int64{"system_usec": 100}},
+	}
+	for _, tt := range tests {
+		got, err := fixtureCgroup(t, map[string]string{"cpu.stat": tt.content}).readKV("cpu.stat")
+		if err != nil {
+			t.Errorf("readKV(%q) error = %v", tt.content, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("readKV(%q) = %v, want %v", tt.content, got, tt.want)
+		}
+	}
+
+	if _, err := fixtureCgroup(t, nil).readKV("cpu.stat"); err == nil {
+		t.Error("readKV() of a missing file succeeded")
+	}
+}
+
+func TestCgroupIOStats(t *testing.T) {
+	tests := []struct {
+		content string
+		want    []IOStats
+	}{
+		{content: "", want: nil},
+		{
+			content: "8:0 rbytes=1 wbytes=2 rios=3 wios=4 dbytes=0 dios=0\n8:16 rbytes=10 wbytes=20 rios=30 wios=40\n",
+			want: []IOStats{
+				{Device: "8:0", ReadBytes: 1, WriteBytes: 2, ReadIOs: 3, WriteIOs: 4},
+				{Device: "8:16", ReadBytes: 10, WriteBytes: 20, ReadIOs: 30, WriteIOs: 40},
+			},
+		},
+		{content: "8:0 rbytes=1 wbytes=many rios\n", want: []IOStats{{Device: "8:0", ReadBytes: 1}}},
+		{content: "8:0\n", want: nil},
+	}
+	for _, tt := range tests {
+		got, err := fixtureCgroup(t, map[string]string{"io.stat": tt.content}).ioStats()
+		if err != nil {
+			t.Errorf("ioStats(%q) error = %v", tt.content, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ioStats(%q) = %+v, want %+v", tt.content, got, tt.want)
+		}
+	}
+
+	if _, err := fixtureCgroup(t, nil).ioStats(); err == nil {
+		t.Error("ioStats() of a missing file succeeded")
+	}
+}
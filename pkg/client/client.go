@@ -1,27 +1,63 @@
 package client
 
 import (
-	"encoding/gob"
+	"context"
+	"encoding/json"
+	"fmt"
 	"net"
+	"parkerdgabel/sockd/internal/tracing"
 	"parkerdgabel/sockd/pkg/container"
 	"parkerdgabel/sockd/pkg/message"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// how many responses of a stream are buffered before the reader waits
+// for the caller to take them
+const streamBuffer = 64
+
+// Client is a connection to sockd. It is safe for concurrent use: every
+// request gets its own id, so many can be in flight at once and their
+// responses are matched up as they arrive.
 type Client struct {
-	conn    net.Conn
-	encoder *gob.Encoder
-	decoder *gob.Decoder
+	conn net.Conn
+
+	writeMutex sync.Mutex
+	encoder    *json.Encoder
+
+	nextId  atomic.Uint64
+	mutex   sync.Mutex
+	pending map[string]*call
+	closed  chan struct{}
+	err     error
+
+	handshakeMutex sync.Mutex
+	version        int
+	token          string
+	tenant         string
+}
+
+// call is a request waiting for its responses
+type call struct {
+	id        string
+	responses chan *message.Response
+	done      chan struct{}
 }
 
 type Option func(*Client)
 
 func NewClient(opts ...Option) *Client {
-	c := &Client{}
+	c := &Client{
+		pending: make(map[string]*call),
+		closed:  make(chan struct{}),
+	}
 	for _, opt := range opts {
 		opt(c)
 	}
-	c.encoder = gob.NewEncoder(c.conn)
-	c.decoder = gob.NewDecoder(c.conn)
+	c.encoder = json.NewEncoder(c.conn)
+	go c.read()
 	return c
 }
 
@@ -31,143 +67,404 @@ func WithConn(conn net.Conn) Option {
 	}
 }
 
+// WithToken authenticates the client with a token in the hello
+func WithToken(token string) Option {
+	return func(c *Client) {
+		c.token = token
+	}
+}
+
+// WithTenant makes every request of the client about the containers and
+// functions of a tenant, instead of the default one
+func WithTenant(tenant string) Option {
+	return func(c *Client) {
+		c.tenant = tenant
+	}
+}
+
+// Close asks the server to close the connection, which it does once the
+// requests in flight have been answered, and closes it
 func (c *Client) Close() error {
-	_, _ = c.CloseConnection()
+	_ = c.CloseConnection(context.Background())
 	return c.conn.Close()
 }
 
-func (c *Client) Send(msg *message.Request) error {
-	return c.encoder.Encode(msg)
+// read hands every response to the call waiting for it until the
+// connection breaks
+func (c *Client) read() {
+	decoder := json.NewDecoder(c.conn)
+	for {
+		var payload json.RawMessage
+		res := &message.Response{Payload: &payload}
+		if err := decoder.Decode(res); err != nil {
+			c.fail(fmt.Errorf("connection closed: %w", err))
+			return
+		}
+		c.mutex.Lock()
+		cl, ok := c.pending[res.Id]
+		c.mutex.Unlock()
+		// the caller gave up on the request
+		if !ok {
+			continue
+		}
+		select {
+		case cl.responses <- res:
+		case <-cl.done:
+		}
+	}
+}
+
+func (c *Client) fail(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.err = err
+	close(c.closed)
 }
 
-func (c *Client) Receive(msg *message.Response) error {
-	return c.decoder.Decode(msg)
+// Version agrees on an API version with the server, the first time it
+// succeeds, and returns it. Every command does this implicitly.
+func (c *Client) Version(ctx context.Context) (int, error) {
+	c.handshakeMutex.Lock()
+	defer c.handshakeMutex.Unlock()
+	if c.version != 0 {
+		return c.version, nil
+	}
+	hello := &message.HelloResponse{}
+	if err := c.do(ctx, message.CommandHello, message.PayloadHello{Versions: message.SupportedVersions, Client: "sockd-go", Token: c.token}, hello); err != nil {
+		return 0, err
+	}
+	c.version = hello.Version
+	return c.version, nil
 }
 
-func (c *Client) SendReceive(req *message.Request, res *message.Response) error {
-	if err := c.Send(req); err != nil {
+// call sends a request and decodes the payload of the response into
+// out (if not nil). Failed requests return a *message.Error; if ctx
+// ends first the request is cancelled and ctx.Err() returned.
+func (c *Client) call(ctx context.Context, cmd message.Command, payload any, out any) error {
+	if _, err := c.Version(ctx); err != nil {
 		return err
 	}
-	return c.Receive(res)
+	return c.do(ctx, cmd, payload, out)
 }
 
-// Command methods
-func (c *Client) Create(meta container.Meta, name string) (*message.Response, error) {
-	req := &message.Request{
-		Command: message.CommandCreate,
-		Payload: message.PayloadCreate{Meta: meta, Name: name},
+func (c *Client) do(ctx context.Context, cmd message.Command, payload any, out any) error {
+	cl, err := c.send(ctx, cmd, payload, 1)
+	if err != nil {
+		return err
 	}
-	res := &message.Response{}
-	err := c.SendReceive(req, res)
-	return res, err
+	defer c.finish(cl)
+	return c.receive(ctx, cl, out)
 }
 
-func (c *Client) Delete(id string) (*message.Response, error) {
-	req := &message.Request{
-		Command: message.CommandDelete,
-		Payload: message.PayloadDelete{Id: id},
+// send writes a request with a new id and registers the call that
+// receives its responses. The trace context of ctx goes along with it.
+func (c *Client) send(ctx context.Context, cmd message.Command, payload any, buffer int) (*call, error) {
+	trace := tracing.Inject(ctx)
+	cl := &call{
+		id:        strconv.FormatUint(c.nextId.Add(1), 10),
+		responses: make(chan *message.Response, buffer),
+		done:      make(chan struct{}),
 	}
-	res := &message.Response{}
-	err := c.SendReceive(req, res)
-	return res, err
+	c.mutex.Lock()
+	if c.err != nil {
+		c.mutex.Unlock()
+		return nil, c.err
+	}
+	c.pending[cl.id] = cl
+	c.mutex.Unlock()
+
+	c.writeMutex.Lock()
+	err := c.encoder.Encode(&message.Request{Id: cl.id, Command: cmd, Payload: payload, Tenant: c.tenant, Trace: trace})
+	c.writeMutex.Unlock()
+	if err != nil {
+		c.finish(cl)
+		return nil, err
+	}
+	return cl, nil
 }
 
-func (c *Client) Start(id string) (*message.Response, error) {
-	req := &message.Request{
-		Command: message.CommandStart,
-		Payload: message.PayloadStart{Id: id},
+// finish stops delivering responses to a call
+func (c *Client) finish(cl *call) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, ok := c.pending[cl.id]; ok {
+		delete(c.pending, cl.id)
+		close(cl.done)
 	}
-	res := &message.Response{}
-	err := c.SendReceive(req, res)
-	return res, err
 }
 
-func (c *Client) Stop(id string) (*message.Response, error) {
-	req := &message.Request{
-		Command: message.CommandStop,
-		Payload: message.PayloadStop{Id: id},
+// cancel tells the server to stop working on a request. Its answer is
+// not waited for.
+func (c *Client) cancel(cl *call) {
+	c.finish(cl)
+	if cancel, err := c.send(context.Background(), message.CommandCancel, message.PayloadCancel{Id: cl.id}, 1); err == nil {
+		c.finish(cancel)
 	}
-	res := &message.Response{}
-	err := c.SendReceive(req, res)
-	return res, err
 }
 
-func (c *Client) List() (*message.Response, error) {
-	req := &message.Request{
-		Command: message.CommandList,
-		Payload: message.PayloadList{},
+// receive waits for the next response to a call and decodes its
+// payload into out (if not nil)
+func (c *Client) receive(ctx context.Context, cl *call, out any) error {
+	var res *message.Response
+	select {
+	case res = <-cl.responses:
+	case <-ctx.Done():
+		c.cancel(cl)
+		return ctx.Err()
+	case <-c.closed:
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		return c.err
 	}
-	res := &message.Response{}
-	err := c.SendReceive(req, res)
+	if !res.Success {
+		if res.Error == nil {
+			return message.NewError(message.ErrCodeInternal, "%s", res.Message)
+		}
+		return res.Error
+	}
+	if payload, ok := res.Payload.(*json.RawMessage); ok && out != nil && len(*payload) > 0 {
+		return json.Unmarshal(*payload, out)
+	}
+	return nil
+}
+
+// Command methods
+func (c *Client) Create(ctx context.Context, meta container.Meta, name string) (*message.CreateResponse, error) {
+	res := &message.CreateResponse{}
+	err := c.call(ctx, message.CommandCreate, message.PayloadCreate{Meta: meta, Name: name}, res)
 	return res, err
 }
 
-func (c *Client) Inspect(id string) (*message.Response, error) {
-	req := &message.Request{
-		Command: message.CommandInspect,
-		Payload: message.PayloadInspect{Id: id},
-	}
-	res := &message.Response{}
-	err := c.SendReceive(req, res)
+func (c *Client) Delete(ctx context.Context, id string) error {
+	return c.call(ctx, message.CommandDelete, message.PayloadDelete{Id: id}, nil)
+}
+
+func (c *Client) Start(ctx context.Context, id string) error {
+	return c.call(ctx, message.CommandStart, message.PayloadStart{Id: id}, nil)
+}
+
+func (c *Client) Stop(ctx context.Context, id string) error {
+	return c.call(ctx, message.CommandStop, message.PayloadStop{Id: id}, nil)
+}
+
+func (c *Client) List(ctx context.Context) (*message.ListResponse, error) {
+	res := &message.ListResponse{}
+	err := c.call(ctx, message.CommandList, message.PayloadList{}, res)
 	return res, err
 }
 
-func (c *Client) Logs(id string) (*message.Response, error) {
-	req := &message.Request{
-		Command: message.CommandLogs,
-		Payload: message.PayloadLogs{Id: id},
-	}
-	res := &message.Response{}
-	err := c.SendReceive(req, res)
+func (c *Client) Inspect(ctx context.Context, id string) (*message.InspectResponse, error) {
+	res := &message.InspectResponse{}
+	err := c.call(ctx, message.CommandInspect, message.PayloadInspect{Id: id}, res)
 	return res, err
 }
 
-func (c *Client) Fork(id string) (*message.Response, error) {
-	req := &message.Request{
-		Command: message.CommandFork,
-		Payload: message.PayloadFork{Id: id},
-	}
-	res := &message.Response{}
-	err := c.SendReceive(req, res)
+func (c *Client) Logs(ctx context.Context, id string, since time.Time, tail int) (*message.LogsResponse, error) {
+	res := &message.LogsResponse{}
+	err := c.call(ctx, message.CommandLogs, message.PayloadLogs{Id: id, Since: since, Tail: tail}, res)
 	return res, err
 }
 
-func (c *Client) Pause(id string) (*message.Response, error) {
-	req := &message.Request{
-		Command: message.CommandPause,
-		Payload: message.PayloadPause{Id: id},
+// FollowLogs streams the logs of a container, calling fn for every batch
+// of lines, until the container goes away, ctx ends or fn returns an
+// error
+func (c *Client) FollowLogs(ctx context.Context, id string, since time.Time, tail int, fn func(entries []message.LogEntry) error) error {
+	if _, err := c.Version(ctx); err != nil {
+		return err
+	}
+	cl, err := c.send(ctx, message.CommandLogs, message.PayloadLogs{Id: id, Follow: true, Since: since, Tail: tail}, streamBuffer)
+	if err != nil {
+		return err
+	}
+	for {
+		logs := &message.LogsResponse{}
+		if err := c.receive(ctx, cl, logs); err != nil {
+			c.finish(cl)
+			return err
+		}
+		if logs.Done {
+			c.finish(cl)
+		}
+		if len(logs.Entries) > 0 {
+			if err := fn(logs.Entries); err != nil {
+				c.cancel(cl)
+				return err
+			}
+		}
+		if logs.Done {
+			if logs.Error != "" {
+				return fmt.Errorf("%s", logs.Error)
+			}
+			return nil
+		}
 	}
-	res := &message.Response{}
-	err := c.SendReceive(req, res)
-	return res, err
 }
 
-func (c *Client) Unpause(id string) (*message.Response, error) {
-	req := &message.Request{
-		Command: message.CommandUnpause,
-		Payload: message.PayloadUnpause{Id: id},
+// Events streams the lifecycle events of containers that match filters
+// (see message.PayloadEvents), starting with the buffered ones since
+// since (if set), calling fn for every batch until ctx ends or fn
+// returns an error
+func (c *Client) Events(ctx context.Context, filters map[string][]string, since time.Time, fn func(events []message.Event) error) error {
+	if _, err := c.Version(ctx); err != nil {
+		return err
+	}
+	cl, err := c.send(ctx, message.CommandEvents, message.PayloadEvents{Filters: filters, Since: since}, streamBuffer)
+	if err != nil {
+		return err
+	}
+	for {
+		events := &message.EventsResponse{}
+		if err := c.receive(ctx, cl, events); err != nil {
+			c.finish(cl)
+			return err
+		}
+		if events.Done {
+			c.finish(cl)
+			return fmt.Errorf("%s", events.Error)
+		}
+		if len(events.Events) > 0 {
+			if err := fn(events.Events); err != nil {
+				c.cancel(cl)
+				return err
+			}
+		}
 	}
-	res := &message.Response{}
-	err := c.SendReceive(req, res)
-	return res, err
 }
 
-func (c *Client) Shutdown() (*message.Response, error) {
-	req := &message.Request{
-		Command: message.CommandShutdown,
-		Payload: nil,
+// Stats calls fn with the resource usage of the containers, Zygotes
+// included, or only of the container with id if it is set. With an
+// interval, it keeps calling fn every interval until ctx is cancelled or
+// fn returns an error; otherwise it calls fn once.
+func (c *Client) Stats(ctx context.Context, id string, interval time.Duration, fn func(*message.StatsResponse) error) error {
+	if _, err := c.Version(ctx); err != nil {
+		return err
+	}
+	cl, err := c.send(ctx, message.CommandStats, message.PayloadStats{Id: id, Interval: interval}, streamBuffer)
+	if err != nil {
+		return err
+	}
+	for {
+		stats := &message.StatsResponse{}
+		if err := c.receive(ctx, cl, stats); err != nil {
+			c.finish(cl)
+			return err
+		}
+		if interval <= 0 {
+			c.finish(cl)
+		}
+		if err := fn(stats); err != nil {
+			c.cancel(cl)
+			return err
+		}
+		if interval <= 0 {
+			return nil
+		}
 	}
-	res := &message.Response{}
-	err := c.SendReceive(req, res)
+}
+
+func (c *Client) Fork(ctx context.Context, id string) error {
+	return c.call(ctx, message.CommandFork, message.PayloadFork{Id: id}, nil)
+}
+
+func (c *Client) Pause(ctx context.Context, id string) error {
+	return c.call(ctx, message.CommandPause, message.PayloadPause{Id: id}, nil)
+}
+
+func (c *Client) Unpause(ctx context.Context, id string) error {
+	return c.call(ctx, message.CommandUnpause, message.PayloadUnpause{Id: id}, nil)
+}
+
+func (c *Client) Invoke(ctx context.Context, id string, body []byte, contentType string) (*message.InvokeResponse, error) {
+	res := &message.InvokeResponse{}
+	err := c.call(ctx, message.CommandInvoke, message.PayloadInvoke{Id: id, Body: body, ContentType: contentType}, res)
 	return res, err
 }
 
-func (c *Client) CloseConnection() (*message.Response, error) {
-	req := &message.Request{
-		Command: message.CommandCloseConnection,
-		Payload: nil,
-	}
-	res := &message.Response{}
-	err := c.SendReceive(req, res)
+func (c *Client) CreateFromFunction(ctx context.Context, function string, name string) (*message.CreateResponse, error) {
+	res := &message.CreateResponse{}
+	err := c.call(ctx, message.CommandCreate, message.PayloadCreate{Function: function, Name: name}, res)
+	return res, err
+}
+
+func (c *Client) RegisterFunction(ctx context.Context, name string, meta container.Meta) (*message.FunctionResponse, error) {
+	res := &message.FunctionResponse{}
+	err := c.call(ctx, message.CommandRegisterFunction, message.PayloadRegisterFunction{Name: name, Meta: meta}, res)
+	return res, err
+}
+
+func (c *Client) ListFunctions(ctx context.Context) (*message.ListFunctionsResponse, error) {
+	res := &message.ListFunctionsResponse{}
+	err := c.call(ctx, message.CommandListFunctions, message.PayloadListFunctions{}, res)
+	return res, err
+}
+
+func (c *Client) DescribeFunction(ctx context.Context, name string) (*message.FunctionResponse, error) {
+	res := &message.FunctionResponse{}
+	err := c.call(ctx, message.CommandDescribeFunction, message.PayloadDescribeFunction{Name: name}, res)
 	return res, err
 }
+
+func (c *Client) SetFunctionAlias(ctx context.Context, name, alias, version, canary string, canaryWeight int) (*message.FunctionResponse, error) {
+	res := &message.FunctionResponse{}
+	err := c.call(ctx, message.CommandSetFunctionAlias, message.PayloadSetFunctionAlias{Name: name, Alias: alias, Version: version, Canary: canary, CanaryWeight: canaryWeight}, res)
+	return res, err
+}
+
+func (c *Client) RollbackFunctionAlias(ctx context.Context, name, alias string) (*message.FunctionResponse, error) {
+	res := &message.FunctionResponse{}
+	err := c.call(ctx, message.CommandRollbackFunctionAlias, message.PayloadRollbackFunctionAlias{Name: name, Alias: alias}, res)
+	return res, err
+}
+
+func (c *Client) DeleteFunction(ctx context.Context, name string) error {
+	return c.call(ctx, message.CommandDeleteFunction, message.PayloadDeleteFunction{Name: name}, nil)
+}
+
+func (c *Client) Reload(ctx context.Context) (*message.ReloadResponse, error) {
+	res := &message.ReloadResponse{}
+	err := c.call(ctx, message.CommandReload, message.PayloadReload{}, res)
+	return res, err
+}
+
+// Drain makes the server refuse new creates and invocations. With wait,
+// fn is called with the progress of the drain until nothing is in
+// flight; otherwise it is called once.
+func (c *Client) Drain(ctx context.Context, wait bool, fn func(*message.DrainResponse) error) error {
+	if _, err := c.Version(ctx); err != nil {
+		return err
+	}
+	cl, err := c.send(ctx, message.CommandDrain, message.PayloadDrain{Wait: wait}, streamBuffer)
+	if err != nil {
+		return err
+	}
+	for {
+		drain := &message.DrainResponse{}
+		if err := c.receive(ctx, cl, drain); err != nil {
+			c.finish(cl)
+			return err
+		}
+		if !wait || drain.Done {
+			c.finish(cl)
+		}
+		if err := fn(drain); err != nil {
+			c.cancel(cl)
+			return err
+		}
+		if !wait || drain.Done {
+			return nil
+		}
+	}
+}
+
+// Resume ends a drain
+func (c *Client) Resume(ctx context.Context) error {
+	return c.call(ctx, message.CommandResume, message.PayloadResume{}, nil)
+}
+
+func (c *Client) Shutdown(ctx context.Context) error {
+	return c.call(ctx, message.CommandShutdown, message.PayloadShutdown{}, nil)
+}
+
+func (c *Client) CloseConnection(ctx context.Context) error {
+	return c.call(ctx, message.CommandCloseConnection, message.PayloadCloseConnection{}, nil)
+}
@@ -0,0 +1,100 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"parkerdgabel/sockd/pkg/message"
+	"testing"
+	"time"
+)
+
+// fakeServer answers the handshake, then hands every other request to
+// the test
+func fakeServer(conn net.Conn) (<-chan message.Request, *json.Encoder) {
+	requests := make(chan message.Request)
+	encoder := json.NewEncoder(conn)
+	go func() {
+		decoder := json.NewDecoder(conn)
+		for {
+			var req message.Request
+			if err := decoder.Decode(&req); err != nil {
+				close(requests)
+				return
+			}
+			if req.Command == message.CommandHello {
+				encoder.Encode(&message.Response{Id: req.Id, Success: true, Payload: message.HelloResponse{Version: message.APIVersion}})
+				continue
+			}
+			requests <- req
+		}
+	}()
+	return requests, encoder
+}
+
+func TestClientOutOfOrderResponses(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	c := NewClient(WithConn(clientConn))
+	requests, encoder := fakeServer(serverConn)
+
+	ctx := context.Background()
+	type result struct {
+		res *message.InspectResponse
+		err error
+	}
+	results := make(map[string]chan result)
+	for _, id := range []string{"a", "b"} {
+		ch := make(chan result, 1)
+		results[id] = ch
+		go func(id string) {
+			res, err := c.Inspect(ctx, id)
+			ch <- result{res, err}
+		}(id)
+	}
+
+	pending := make(map[string]string)
+	for range results {
+		req := <-requests
+		pending[req.Payload.(message.PayloadInspect).Id] = req.Id
+	}
+	// answer in the opposite order of the requests
+	for _, id := range []string{"b", "a"} {
+		encoder.Encode(&message.Response{Id: pending[id], Success: true, Payload: message.InspectResponse{Id: id}})
+		r := <-results[id]
+		if r.err != nil {
+			t.Fatalf("Inspect(%s): %v", id, r.err)
+		}
+		if r.res.Id != id {
+			t.Errorf("Inspect(%s) got the response for %s", id, r.res.Id)
+		}
+	}
+}
+
+func TestClientCancel(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	c := NewClient(WithConn(clientConn))
+	requests, _ := fakeServer(serverConn)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		errs <- c.Start(ctx, "a")
+	}()
+	start := <-requests
+	cancel()
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Fatalf("Start returned %v, want context.Canceled", err)
+	}
+
+	select {
+	case req := <-requests:
+		if req.Command != message.CommandCancel || req.Payload.(message.PayloadCancel).Id != start.Id {
+			t.Fatalf("got %s request, want cancel of %s", req.Command, start.Id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("request was not cancelled on the server")
+	}
+}
@@ -30,7 +30,7 @@ func sendFDs(sock int, fds []int) error {
 }
 
 // sendRootFD connects to a Unix domain socket and sends file descriptors.
-func sendRootFD(sockPath string, chrootFD, memFD int) (int, error) {
+func sendRootFD(sockPath string, fds []int) (int, error) {
 	sock, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
 	if err != nil {
 		return -1, fmt.Errorf("socket creation failed: %v", err)
@@ -42,8 +42,6 @@ func sendRootFD(sockPath string, chrootFD, memFD int) (int, error) {
 		return -1, fmt.Errorf("connect failed: %v", err)
 	}
 
-	fmt.Printf("send chrootFD=%d\n", chrootFD)
-	fds := []int{chrootFD, memFD}
 	if err := sendFDs(sock, fds); err != nil {
 		return -1, err
 	}
@@ -56,10 +54,13 @@ func sendRootFD(sockPath string, chrootFD, memFD int) (int, error) {
 	return status, nil
 }
 
-// forkRequest sends the namespace file descriptors for the targetPid process
-// and the passed package list to a lambda server listening on the Unix socket at sockPath.
-func (c *Container) forkRequest(rootDir *os.File, memCG *os.File) error {
-	status, err := sendRootFD(c.commsSock(), int(rootDir.Fd()), int(memCG.Fd()))
+// forkRequest sends the root dir and cgroup of the new container, along with
+// the pipes for its stdout and stderr, to a lambda server listening on the
+// Unix socket at sockPath.
+func (c *Container) forkRequest(rootDir, memCG, stdout, stderr *os.File) error {
+	fds := []int{int(rootDir.Fd()), int(memCG.Fd()), int(stdout.Fd()), int(stderr.Fd())}
+	c.logger.Debug("sending chroot fd", "fd", fds[0])
+	status, err := sendRootFD(c.commsSock(), fds)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,106 @@
+package container
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"parkerdgabel/sockd/internal/tracing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// InvokeResult is what the handler of a container returned for a
+// single invocation
+type InvokeResult struct {
+	StatusCode int
+	Body       []byte
+	Duration   time.Duration
+}
+
+// Acquire marks the start of a use of the container, such as an
+// invocation, unpausing it if it is paused. Every Acquire must be
+// followed by a Release.
+func (c *Container) Acquire() error {
+	c.useMutex.Lock()
+	defer c.useMutex.Unlock()
+	switch state := c.State(); state {
+	case StateRunning:
+	case StatePaused:
+		if err := c.Unpause(); err != nil {
+			return err
+		}
+		c.repause = true
+	default:
+		return &StateError{container: c.id, op: "use", state: state}
+	}
+	c.uses++
+	return nil
+}
+
+// Release marks the end of a use of the container. When the last use
+// ends, the container is paused again if a use unpaused it, or if pause
+// is set by any of the uses.
+func (c *Container) Release(pause bool) error {
+	c.useMutex.Lock()
+	defer c.useMutex.Unlock()
+	c.uses--
+	c.repause = c.repause || pause
+	if c.uses > 0 || !c.repause {
+		return nil
+	}
+	c.repause = false
+	return c.Pause()
+}
+
+// Invoke POSTs body to the handler listening on the comms.sock of the
+// container. A paused container is unpaused for the duration of the
+// request and paused again once no other request is using it.
+// Cancelling ctx abandons the request.
+func (c *Container) Invoke(ctx context.Context, body []byte, contentType string) (_ *InvokeResult, err error) {
+	ctx, span := tracing.Start(ctx, "container.invoke", attribute.String("sockd.container.id", c.id))
+	defer tracing.End(span, &err)
+
+	if err := c.Acquire(); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := c.Release(false); err != nil {
+			c.logger.Warn("failed to pause after invoke", "error", err)
+		}
+	}()
+
+	if contentType == "" {
+		contentType = "application/json"
+	}
+
+	// Host name is irrelevant as it is a local socket connection
+	url := fmt.Sprintf("http://lambda/run/%s", c.id)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, &ContainerError{container: c.id, err: err}
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	start := time.Now()
+	kills := c.OOMKills()
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, c.oomError(kills, fmt.Errorf("failed to invoke handler: %v", err))
+	}
+	defer res.Body.Close()
+
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, c.oomError(kills, fmt.Errorf("failed to read handler response: %v", err))
+	}
+	result := &InvokeResult{
+		StatusCode: res.StatusCode,
+		Body:       resBody,
+		Duration:   time.Since(start),
+	}
+	c.logger.Debug("invoked handler", "status", result.StatusCode, "duration", result.Duration)
+	return result, nil
+}
@@ -0,0 +1,200 @@
+package container
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+
+	// name of the log file in the scratch dir of each container
+	logFileName = "container.log"
+	// lines longer than this are split into entries of this many bytes
+	maxLogLineBytes = 64 * 1024
+	// entries buffered per follower before new ones are dropped
+	followBuffer = 256
+)
+
+// LogEntry is a single line written by a container
+type LogEntry struct {
+	Time   time.Time `json:"time"`
+	Stream string    `json:"stream"`
+	Line   string    `json:"line"`
+}
+
+// containerLogs captures the stdout and stderr of the processes of a
+// container through pipes, timestamps each line and appends it to a
+// log file, handing it to followers as well
+type containerLogs struct {
+	path      string
+	mutex     sync.Mutex
+	file      *os.File
+	encoder   *json.Encoder
+	followers map[chan LogEntry]struct{}
+}
+
+func newContainerLogs(path string) (*containerLogs, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &containerLogs{
+		path:      path,
+		file:      file,
+		encoder:   json.NewEncoder(file),
+		followers: make(map[chan LogEntry]struct{}),
+	}, nil
+}
+
+// pipe returns the write end of a pipe whose output is captured as the
+// given stream. The caller hands it to a process and closes its own
+// copy afterwards.
+func (l *containerLogs) pipe(stream string) (*os.File, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	go l.capture(stream, r)
+	return w, nil
+}
+
+// capture appends the lines read from r until every process closed its
+// write end. It must keep reading: a process writing to a pipe nobody
+// reads gets EPIPE.
+func (l *containerLogs) capture(stream string, r *os.File) {
+	defer r.Close()
+	reader := bufio.NewReaderSize(r, maxLogLineBytes)
+	for {
+		// the rest of a line too long for the buffer comes on the
+		// next calls
+		line, _, err := reader.ReadLine()
+		if err != nil {
+			if err != io.EOF {
+				logger.Warn("failed to read container output", "path", l.path, "stream", stream, "error", err)
+			}
+			return
+		}
+		l.append(LogEntry{Time: time.Now(), Stream: stream, Line: string(line)})
+	}
+}
+
+func (l *containerLogs) append(entry LogEntry) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.file == nil {
+		return
+	}
+	if err := l.encoder.Encode(&entry); err != nil {
+		logger.Warn("failed to write log entry", "path", l.path, "error", err)
+	}
+	for follower := range l.followers {
+		select {
+		case follower <- entry:
+		default:
+			// never block the container on a slow follower
+		}
+	}
+}
+
+// read returns the entries written at or after since (if not zero),
+// limited to the last tail entries (if tail > 0)
+func (l *containerLogs) read(since time.Time, tail int) ([]LogEntry, error) {
+	f, err := os.Open(l.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := []LogEntry{}
+	// escaping may make an entry several times as long as its line, so
+	// entries are read whole, however long
+	reader := bufio.NewReader(f)
+	for {
+		raw, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(raw) == 0 {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		var entry LogEntry
+		if err := json.Unmarshal(raw, &entry); err != nil {
+			return nil, fmt.Errorf("corrupt log file %s: %v", l.path, err)
+		}
+		if !since.IsZero() && entry.Time.Before(since) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if tail > 0 && len(entries) > tail {
+		entries = entries[len(entries)-tail:]
+	}
+	return entries, nil
+}
+
+// follow returns a channel receiving every entry appended from now on.
+// The channel is closed by the returned cancel function, or when the
+// logs are closed.
+func (l *containerLogs) follow() (<-chan LogEntry, func()) {
+	ch := make(chan LogEntry, followBuffer)
+	l.mutex.Lock()
+	if l.file == nil {
+		close(ch)
+	} else {
+		l.followers[ch] = struct{}{}
+	}
+	l.mutex.Unlock()
+
+	cancel := func() {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		if _, ok := l.followers[ch]; ok {
+			delete(l.followers, ch)
+			close(ch)
+		}
+	}
+	return ch, cancel
+}
+
+func (l *containerLogs) close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	for follower := range l.followers {
+		close(follower)
+	}
+	l.followers = make(map[chan LogEntry]struct{})
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// Logs returns the lines the container wrote at or after since (if not
+// zero), limited to the last tail lines (if tail > 0)
+func (c *Container) Logs(since time.Time, tail int) ([]LogEntry, error) {
+	entries, err := c.logs.read(since, tail)
+	if err != nil {
+		return nil, &ContainerError{container: c.id, err: err}
+	}
+	return entries, nil
+}
+
+// FollowLogs streams the lines the container writes from now on until
+// cancel is called or the container is destroyed
+func (c *Container) FollowLogs() (entries <-chan LogEntry, cancel func()) {
+	return c.logs.follow()
+}
+
+// LogPath returns the path of the log file of the container
+func (c *Container) LogPath() string {
+	return c.logs.path
+}
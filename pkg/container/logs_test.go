@@ -0,0 +1,94 @@
+package container
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestContainerLogs(t *testing.T) {
+	logs, err := newContainerLogs(filepath.Join(t.TempDir(), logFileName))
+	if err != nil {
+		t.Fatalf("newContainerLogs() error = %v", err)
+	}
+	follow, cancel := logs.follow()
+	defer cancel()
+
+	start := time.Now()
+	for i, line := range []string{"one", "two", "three"} {
+		stream := StreamStdout
+		if i == 1 {
+			stream = StreamStderr
+		}
+		logs.append(LogEntry{Time: start.Add(time.Duration(i) * time.Second), Stream: stream, Line: line})
+	}
+
+	entries, err := logs.read(time.Time{}, 0)
+	if err != nil {
+		t.Fatalf("read() error = %v", err)
+	}
+	if len(entries) != 3 || entries[1].Stream != StreamStderr || entries[2].Line != "three" {
+		t.Errorf("read() = %v", entries)
+	}
+	if entries, _ := logs.read(time.Time{}, 2); len(entries) != 2 || entries[0].Line != "two" {
+		t.Errorf("read() with tail = %v", entries)
+	}
+	if entries, _ := logs.read(start.Add(2*time.Second), 0); len(entries) != 1 || entries[0].Line != "three" {
+		t.Errorf("read() with since = %v", entries)
+	}
+
+	if e := <-follow; e.Line != "one" {
+		t.Errorf("follow() = %v, want first line", e)
+	}
+	if err := logs.close(); err != nil {
+		t.Fatalf("close() error = %v", err)
+	}
+	for range follow {
+	}
+}
+
+func TestContainerLogsLongLine(t *testing.T) {
+	logs, err := newContainerLogs(filepath.Join(t.TempDir(), logFileName))
+	if err != nil {
+		t.Fatalf("newContainerLogs() error = %v", err)
+	}
+	defer logs.close()
+	w, err := logs.pipe(StreamStdout)
+	if err != nil {
+		t.Fatalf("pipe() error = %v", err)
+	}
+
+	// control characters are escaped in the log file, making its
+	// entries much longer than the line
+	long := strings.Repeat("\x01", 2*maxLogLineBytes+10)
+	if _, err := w.WriteString(long + "\nafter\n"); err != nil {
+		t.Fatalf("write of a long line error = %v", err)
+	}
+	// the pipe is still read after the long line
+	if _, err := w.WriteString("last\n"); err != nil {
+		t.Fatalf("write after a long line error = %v", err)
+	}
+	w.Close()
+
+	want := []string{long[:maxLogLineBytes], long[:maxLogLineBytes], long[:10], "after", "last"}
+	deadline := time.Now().Add(time.Second)
+	for {
+		entries, err := logs.read(time.Time{}, 0)
+		if err != nil {
+			t.Fatalf("read() error = %v", err)
+		}
+		if len(entries) == len(want) {
+			for i, entry := range entries {
+				if entry.Line != want[i] {
+					t.Errorf("entry %d has %d bytes, want %d", i, len(entry.Line), len(want[i]))
+				}
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("read() returned %d entries, want %d", len(entries), len(want))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
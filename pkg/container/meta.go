@@ -1,5 +1,12 @@
 package container
 
+import (
+	"errors"
+	"fmt"
+	"parkerdgabel/sockd/pkg/cgroup"
+	"regexp"
+)
+
 type Runtime string // Runtime is the container runtime to use
 
 const (
@@ -11,16 +18,68 @@ const (
 )
 
 type Meta struct {
-	ParentID         string
-	Installs         []string
-	Imports          []string
-	Runtime          Runtime
-	MemLimitMB       int
-	CPUPercent       int
-	BaseImageName    string
-	BaseImageVersion string
-	CodeUrl          string
-	isLeaf           bool
+	ParentID         string   `json:"parent_id,omitempty"`
+	Installs         []string `json:"installs,omitempty"`
+	Imports          []string `json:"imports,omitempty"`
+	Runtime          Runtime  `json:"runtime"`
+	MemLimitMB       int      `json:"mem_limit_mb,omitempty"`
+	CPUPercent       int      `json:"cpu_percent,omitempty"`
+	BaseImageName    string   `json:"base_image_name"`
+	BaseImageVersion string   `json:"base_image_version,omitempty"`
+	CodeUrl          string   `json:"code_url,omitempty"`
+	Tenant           string   `json:"tenant,omitempty"` // set by the manager
+	// the other cgroup controls of the container; zero values leave the
+	// defaults of the kernel or of the cgroup pool
+	PidsMax      int64             `json:"pids_max,omitempty"`
+	CPUWeight    int               `json:"cpu_weight,omitempty"`
+	CPUs         string            `json:"cpus,omitempty"`
+	Mems         string            `json:"mems,omitempty"`
+	MemHighMB    int               `json:"mem_high_mb,omitempty"`
+	MemLowMB     int               `json:"mem_low_mb,omitempty"`
+	MemSwapMaxMB int               `json:"mem_swap_max_mb,omitempty"`
+	IOMax        []cgroup.IOMax    `json:"io_max,omitempty"`
+	IOWeight     []cgroup.IOWeight `json:"io_weight,omitempty"`
+	isLeaf       bool
+}
+
+// ErrInvalidLimits is wrapped by the errors of ValidateLimits
+var ErrInvalidLimits = errors.New("invalid container limits")
+
+var cpuList = regexp.MustCompile(`^\d+(-\d+)?(,\d+(-\d+)?)*$`)
+
+// ValidateLimits checks the limits of m before they are written to a
+// cgroup
+func (m *Meta) ValidateLimits() error {
+	var errs []error
+	if m.MemLimitMB < 0 || m.CPUPercent < 0 || m.PidsMax < 0 || m.MemHighMB < 0 || m.MemLowMB < 0 || m.MemSwapMaxMB < 0 {
+		errs = append(errs, errors.New("limits must not be negative"))
+	}
+	if m.CPUWeight != 0 && (m.CPUWeight < 1 || m.CPUWeight > 10000) {
+		errs = append(errs, fmt.Errorf("cpu weight must be between 1 and 10000, not %d", m.CPUWeight))
+	}
+	if m.CPUs != "" && !cpuList.MatchString(m.CPUs) {
+		errs = append(errs, fmt.Errorf("cpus %q is not a list of CPUs such as 0-3,6", m.CPUs))
+	}
+	if m.Mems != "" && !cpuList.MatchString(m.Mems) {
+		errs = append(errs, fmt.Errorf("mems %q is not a list of memory nodes such as 0", m.Mems))
+	}
+	if m.MemLimitMB > 0 && (m.MemHighMB > m.MemLimitMB || m.MemLowMB > m.MemLimitMB) {
+		errs = append(errs, errors.New("mem high and mem low must not exceed the mem limit"))
+	}
+	for _, limit := range m.IOMax {
+		if limit.Device == "" || limit.ReadBPS < 0 || limit.WriteBPS < 0 || limit.ReadIOPS < 0 || limit.WriteIOPS < 0 {
+			errs = append(errs, fmt.Errorf("io max %q needs a device and no negative limits", limit.String()))
+		}
+	}
+	for _, weight := range m.IOWeight {
+		if err := weight.Validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidLimits, err)
+	}
+	return nil
 }
 
 func (m *Meta) IsZygote() bool {
@@ -31,3 +90,8 @@ func (m *Meta) MakeZygote() *Meta {
 	m.isLeaf = false
 	return m
 }
+
+func (m *Meta) MakeLeaf() *Meta {
+	m.isLeaf = true
+	return m
+}
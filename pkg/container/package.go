@@ -2,11 +2,12 @@ package container
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
-	"log"
 	"net/http"
 	"os"
+	"parkerdgabel/sockd/internal/tracing"
 	"parkerdgabel/sockd/pkg/cgroup"
 	"parkerdgabel/sockd/pkg/container/embedded"
 	"path/filepath"
@@ -15,6 +16,7 @@ import (
 	"sync/atomic"
 
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 var ErrUnsupportedRuntime = errors.New("unsupported runtime")
@@ -38,7 +40,7 @@ type PackageMeta struct {
 }
 
 type PackagePuller interface {
-	PullPackage(pkg string) (*Package, error)
+	PullPackage(ctx context.Context, pkg string) (*Package, error)
 }
 
 type PackageInstaller interface {
@@ -50,7 +52,7 @@ type PackagePullerInstaller interface {
 	PackageInstaller
 }
 
-func NewPackagePullerInstaller(meta *Meta, baseImageDir string, rootDir string, cgroup *cgroup.Cgroup) (PackagePullerInstaller, error) {
+func NewPackagePullerInstaller(meta *Meta, baseImageDir string, rootDir string, cgroup *cgroup.Cgroup, config Config) (PackagePullerInstaller, error) {
 	switch meta.Runtime {
 	case Python:
 		m := &Meta{
@@ -72,6 +74,7 @@ func NewPackagePullerInstaller(meta *Meta, baseImageDir string, rootDir string,
 			containerMeta: m,
 			packageDir:    packageDir,
 			cgroup:        cgroup,
+			config:        config,
 		}, nil
 	default:
 		return nil, ErrUnsupportedRuntime
@@ -88,6 +91,7 @@ type PyPiPullerInstaller struct {
 	baseImageDir  string
 	packageDir    string
 	cgroup        *cgroup.Cgroup
+	config        Config
 }
 
 func (p *PyPiPullerInstaller) InstallPackages(pkgs []string) ([]string, error) {
@@ -98,7 +102,7 @@ func (p *PyPiPullerInstaller) NormalizePackage(pkg string) string {
 	return strings.ReplaceAll(strings.ToLower(pkg), "_", "-")
 }
 
-func (p *PyPiPullerInstaller) PullPackage(pkg string) (*Package, error) {
+func (p *PyPiPullerInstaller) PullPackage(ctx context.Context, pkg string) (*Package, error) {
 	pkg = p.NormalizePackage(pkg)
 	tmp, _ := p.packages.LoadOrStore(pkg, &Package{Name: pkg})
 	pa := tmp.(*Package)
@@ -111,7 +115,10 @@ func (p *PyPiPullerInstaller) PullPackage(pkg string) (*Package, error) {
 	pa.installMutex.Lock()
 	defer pa.installMutex.Unlock()
 	if pa.installed == 0 {
-		if err := p.sandboxInstall(pa); err != nil {
+		ctx, span := tracing.Start(ctx, "package.install", attribute.String("sockd.package", pkg))
+		err := p.sandboxInstall(ctx, pa)
+		tracing.End(span, &err)
+		if err != nil {
 			return pa, err
 		}
 
@@ -123,16 +130,16 @@ func (p *PyPiPullerInstaller) PullPackage(pkg string) (*Package, error) {
 	return pa, nil
 }
 
-func (p *PyPiPullerInstaller) sandboxInstall(pa *Package) error {
+func (p *PyPiPullerInstaller) sandboxInstall(ctx context.Context, pa *Package) error {
 	// install the package
 	scratchDir := filepath.Join(p.packageDir, pa.Name)
-	log.Printf("pip install using scratchDir='%v'", scratchDir)
+	log := logger.With("package", pa.Name, "path", scratchDir)
 	alreadyInstalled := false
 	if _, err := os.Stat(scratchDir); err == nil {
-		log.Printf("Package %v already installed", pa.Name)
+		log.Debug("package already installed")
 		alreadyInstalled = true
 	} else {
-		log.Printf("run pip install %s from a new Sandbox to %s on host", pa.Name, scratchDir)
+		log.Info("installing package from a new container")
 		if err := os.Mkdir(scratchDir, 0700); err != nil {
 			return err
 		}
@@ -150,7 +157,7 @@ func (p *PyPiPullerInstaller) sandboxInstall(pa *Package) error {
 		return err
 	}
 
-	container, err := NewContainer(nil, p.baseImageDir, uuid.New().String(), p.rootDir, p.pipLambdaDir, scratchDir, p.cgroup, p.containerMeta, nil)
+	container, err := NewContainer(ctx, nil, p.baseImageDir, uuid.New().String(), p.rootDir, p.pipLambdaDir, scratchDir, p.cgroup, p.containerMeta, p.config, nil)
 	if err != nil {
 		return err
 	}
@@ -170,7 +177,7 @@ func (p *PyPiPullerInstaller) sandboxInstall(pa *Package) error {
 		return err
 	}
 	// Host name is irrelevant as it is a local socket connection
-	req, err := http.NewRequest("POST", "http://lambda/run/pip-lambda", bytes.NewBuffer(pkgReqBytes))
+	req, err := http.NewRequestWithContext(ctx, "POST", "http://lambda/run/pip-lambda", bytes.NewBuffer(pkgReqBytes))
 	if err != nil {
 		return err
 	}
@@ -183,7 +190,7 @@ func (p *PyPiPullerInstaller) sandboxInstall(pa *Package) error {
 	defer res.Body.Close()
 
 	if res.StatusCode != http.StatusOK {
-		log.Printf("Failed to install package %s: %v", pa.Name, res.Status)
+		log.Error("failed to install package", "status", res.Status)
 		return err
 	}
 
@@ -0,0 +1,62 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"parkerdgabel/sockd/pkg/cgroup"
+	"path/filepath"
+	"time"
+)
+
+// Restore re-adopts a container whose processes outlived the daemon that
+// created it. The container is running or paused, depending on its
+// cgroup. Its output can no longer be captured, as the pipes went away
+// with the old daemon, but the log file keeps what was written before.
+func Restore(id, rootDir, codeDir, scratchDir string, cgroup *cgroup.Cgroup, meta *Meta, created time.Time, config Config, listeners []ContainerEventHandler) (*Container, error) {
+	pids, err := cgroup.PIDs()
+	if err != nil {
+		return nil, &ContainerError{container: id, err: err}
+	}
+	if len(pids) == 0 {
+		return nil, &ContainerError{container: id, err: fmt.Errorf("no processes left in cgroup %s", cgroup.Name())}
+	}
+	paused, err := cgroup.Paused()
+	if err != nil {
+		return nil, &ContainerError{container: id, err: err}
+	}
+	state := StateRunning
+	if paused {
+		state = StatePaused
+	}
+
+	c := &Container{
+		config:        config,
+		id:            id,
+		rootDir:       rootDir,
+		codeDir:       codeDir,
+		scratchDir:    scratchDir,
+		cgroup:        cgroup,
+		meta:          meta,
+		children:      make(map[string]*Container),
+		cgRefCount:    1,
+		eventHandlers: listeners,
+		state:         state,
+		created:       created,
+		timestamps:    make(map[ContainerEventType]time.Time),
+		logger:        logger.With("container_id", id),
+	}
+	if _, err := os.Stat(c.commsSock()); err != nil {
+		return nil, &ContainerError{container: id, err: err}
+	}
+	logs, err := newContainerLogs(filepath.Join(scratchDir, logFileName))
+	if err != nil {
+		return nil, &ContainerError{container: id, err: err}
+	}
+	c.logs = logs
+	if err := c.StartClient(); err != nil {
+		return nil, err
+	}
+	c.startWatch()
+	c.logger.Info("restored container", "state", state.String())
+	return c, nil
+}
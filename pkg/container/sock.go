@@ -1,24 +1,32 @@
 package container
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"parkerdgabel/sockd/internal/bootstrap"
+	"parkerdgabel/sockd/internal/logging"
+	"parkerdgabel/sockd/internal/tracing"
 	"parkerdgabel/sockd/pkg/cgroup"
 	"path/filepath"
+	"sort"
 	"strconv"
-	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/sys/unix"
 )
 
+var logger = logging.For(logging.Container)
+
 type ContainerEventType int
 
 const (
@@ -29,6 +37,13 @@ const (
 	ContainerDestroy
 	ContainerFork
 	ContainerChildExit
+	// the events below report the resource usage of a container, not a
+	// change of its lifecycle; see Config.WatchInterval
+	ContainerOOM
+	ContainerOOMKill
+	ContainerMemoryHigh
+	ContainerMemoryMax
+	ContainerPressure
 )
 
 type ContainerEventHandler func(event ContainerEventType, container *Container)
@@ -46,6 +61,69 @@ func (e *ContainerError) Error() string {
 	return "Container error: " + e.container + ": " + e.err.Error()
 }
 
+func (e *ContainerError) Unwrap() error {
+	return e.err
+}
+
+// Config holds the settings shared by all containers
+type Config struct {
+	// ClientTimeout bounds each request to the server in a container
+	ClientTimeout time.Duration `mapstructure:"client_timeout"`
+	// MemLimitMB and CPUPercent limit the containers whose Meta sets no
+	// limits of their own. A CPUPercent of 0 means no CPU limit.
+	MemLimitMB int `mapstructure:"mem_limit_mb"`
+	CPUPercent int `mapstructure:"cpu_percent"`
+	// WatchInterval is how often the memory events and pressure of a
+	// running container are checked, 0 to never check them
+	WatchInterval time.Duration `mapstructure:"watch_interval"`
+	// PressureThreshold is the share of time, in percent over the last
+	// 10s, the tasks of a container may stall on memory or CPU before a
+	// pressure event is sent
+	PressureThreshold float64 `mapstructure:"pressure_threshold"`
+}
+
+// DefaultConfig returns the Config used unless configured otherwise
+func DefaultConfig() Config {
+	return Config{
+		ClientTimeout:     3 * time.Second,
+		MemLimitMB:        128,
+		WatchInterval:     time.Second,
+		PressureThreshold: 10,
+	}
+}
+
+func (c Config) Validate() error {
+	if c.ClientTimeout <= 0 {
+		return fmt.Errorf("container client_timeout must be positive, not %v", c.ClientTimeout)
+	}
+	if c.MemLimitMB < 1 {
+		return fmt.Errorf("container mem_limit_mb must be at least 1, not %d", c.MemLimitMB)
+	}
+	if c.CPUPercent < 0 {
+		return fmt.Errorf("container cpu_percent must not be negative, not %d", c.CPUPercent)
+	}
+	if c.WatchInterval < 0 {
+		return fmt.Errorf("container watch_interval must not be negative, not %v", c.WatchInterval)
+	}
+	if c.PressureThreshold < 0 || c.PressureThreshold > 100 {
+		return fmt.Errorf("container pressure_threshold must be between 0 and 100, not %v", c.PressureThreshold)
+	}
+	return nil
+}
+
+// Limits returns the memory limit in MB and the CPU limit in percent of
+// a core of a container with meta, falling back to those of c
+func (c Config) Limits(meta *Meta) (memLimitMB, cpuPercent int) {
+	memLimitMB, cpuPercent = meta.MemLimitMB, meta.CPUPercent
+	if memLimitMB <= 0 {
+		memLimitMB = c.MemLimitMB
+	}
+	if cpuPercent <= 0 {
+		cpuPercent = c.CPUPercent
+	}
+	return memLimitMB, cpuPercent
+}
+
 var BIND uintptr = uintptr(syscall.MS_BIND)
 var BIND_RO uintptr = uintptr(syscall.MS_BIND | syscall.MS_RDONLY | syscall.MS_REMOUNT)
 var PRIVATE uintptr = uintptr(syscall.MS_PRIVATE)
@@ -53,6 +131,7 @@ var SHARED uintptr = uintptr(syscall.MS_SHARED)
 var UNSHARE uintptr = uintptr(unix.CLONE_NEWUTS | unix.CLONE_NEWPID | unix.CLONE_NEWIPC)
 
 type Container struct {
+	config     Config
 	id         string
 	rootDir    string
 	codeDir    string
@@ -65,14 +144,38 @@ type Container struct {
 	// until all descendants are dead, because they share the
 	// pages of this Container, but this is the only container
 	// charged)
-	cgRefCount    int32
-	parent        *Container
+	cgRefCount int32
+	parent     *Container
+	// guards children, which the children change as they exit
+	childMutex    sync.Mutex
 	children      map[string]*Container
 	eventHandlers []ContainerEventHandler
-}
-
-func NewContainer(parent *Container, baseImageDir, id, rootDir, codeDir, scratchDir string, cgroup *cgroup.Cgroup, meta *Meta, listeners []ContainerEventHandler) (*Container, error) {
+	logs          *containerLogs
+	logger        *slog.Logger
+
+	// held for the whole of a lifecycle operation (Start, Pause,
+	// Unpause, Stop, Destroy, Fork), so they never interleave
+	opMutex sync.Mutex
+	// guards state, timestamps and cgroup for readers
+	stateMutex sync.Mutex
+	state      State
+	created    time.Time
+	// when each kind of event last happened
+	timestamps map[ContainerEventType]time.Time
+	// closed to stop watching the cgroup, guarded by opMutex
+	unwatch chan struct{}
+
+	// guards uses and repause (see Acquire)
+	useMutex sync.Mutex
+	// how many invocations and leases are using the container
+	uses int
+	// whether to pause the container when the last use ends
+	repause bool
+}
+
+func NewContainer(ctx context.Context, parent *Container, baseImageDir, id, rootDir, codeDir, scratchDir string, cgroup *cgroup.Cgroup, meta *Meta, config Config, listeners []ContainerEventHandler) (*Container, error) {
 	c := &Container{
+		config:        config,
 		id:            id,
 		rootDir:       rootDir,
 		codeDir:       codeDir,
@@ -83,32 +186,49 @@ func NewContainer(parent *Container, baseImageDir, id, rootDir, codeDir, scratch
 		children:      make(map[string]*Container),
 		cgRefCount:    1,
 		eventHandlers: listeners,
+		state:         StateCreated,
+		created:       time.Now(),
+		timestamps:    make(map[ContainerEventType]time.Time),
+		logger:        logger.With("container_id", id),
+	}
+	logs, err := newContainerLogs(filepath.Join(scratchDir, logFileName))
+	if err != nil {
+		c.logger.Error("failed to create log file", "error", err)
+		return nil, &ContainerError{container: id, err: err}
+	}
+	c.logs = logs
+	if err := c.setLimits(); err != nil {
+		c.logger.Error("failed to set limits", "error", err)
+		return nil, err
 	}
 	if err := c.populateRoot(baseImageDir); err != nil {
-		log.Printf("failed to populate root: %v", err)
+		c.logger.Error("failed to populate root", "error", err)
 		return nil, err
 	}
 	if err := c.bootstrapCode(); err != nil {
-		log.Printf("failed to bootstrap code: %v", err)
+		c.logger.Error("failed to bootstrap code", "error", err)
 		return nil, err
 	}
 	if parent != nil {
-		if err := parent.Fork(c); err != nil {
-			log.Printf("failed to fork: %v", err)
+		if err := parent.Fork(ctx, c); err != nil {
+			c.logger.Error("failed to fork", "parent_id", parent.ID(), "error", err)
 			return nil, err
 		}
 		c.parent = parent
+		c.opMutex.Lock()
+		c.transition(StateRunning)
+		c.notifyListeners(ContainerStart)
+		c.opMutex.Unlock()
 	} else {
 		if err := c.setCommand(); err != nil {
-			log.Printf("failed to set command: %v", err)
+			c.logger.Error("failed to set command", "error", err)
 			return nil, err
 		}
 	}
 	if err := c.StartClient(); err != nil {
-		log.Printf("failed to start client: %v", err)
+		c.logger.Error("failed to start client", "error", err)
 		return nil, err
 	}
-	c.notifyListeners(ContainerStart)
 	return c, nil
 }
 
@@ -128,7 +248,10 @@ func (c *Container) ScratchDir() string {
 	return c.scratchDir
 }
 
+// Cgroup returns the cgroup of the container, or nil once it is stopped
 func (c *Container) Cgroup() *cgroup.Cgroup {
+	c.stateMutex.Lock()
+	defer c.stateMutex.Unlock()
 	return c.cgroup
 }
 
@@ -140,17 +263,40 @@ func (c *Container) Parent() *Container {
 	return c.parent
 }
 
+// Children returns a copy of the containers forked from this one, by ID
 func (c *Container) Children() map[string]*Container {
-	return c.children
+	c.childMutex.Lock()
+	defer c.childMutex.Unlock()
+	children := make(map[string]*Container, len(c.children))
+	for id, child := range c.children {
+		children[id] = child
+	}
+	return children
+}
+
+// ChildIDs returns the IDs of the containers forked from this one
+func (c *Container) ChildIDs() []string {
+	c.childMutex.Lock()
+	defer c.childMutex.Unlock()
+	ids := make([]string, 0, len(c.children))
+	for id := range c.children {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
 }
 
 func (c *Container) AddChild(child *Container) {
+	c.childMutex.Lock()
 	c.children[child.ID()] = child
+	c.childMutex.Unlock()
 	child.parent = c
 }
 
 func (c *Container) RemoveChild(child *Container) {
+	c.childMutex.Lock()
 	delete(c.children, child.ID())
+	c.childMutex.Unlock()
 	child.parent = nil
 }
 
@@ -159,14 +305,14 @@ func (c *Container) StartClient() error {
 	if len(sockPath) > 108 {
 		return &ContainerError{container: c.id, err: fmt.Errorf("socket path length cannot exceed 108 characters (try moving cluster closer to the root directory")}
 	}
-	c.printf("starting client with socket path: %s", sockPath)
+	c.logger.Debug("starting client", "socket", sockPath)
 	dial := func(proto, addr string) (net.Conn, error) {
 		return net.Dial("unix", sockPath)
 	}
 
 	c.client = &http.Client{
 		Transport: &http.Transport{Dial: dial},
-		Timeout:   time.Second * time.Duration(3), // TODO make this configurable
+		Timeout:   c.config.ClientTimeout,
 	}
 	return nil
 }
@@ -176,14 +322,59 @@ func (c *Container) StopClient() {
 }
 
 func (c *Container) Destroy() error {
-	if err := c.cgroup.Pause(); err != nil {
-		return &ContainerError{container: c.id, err: err}
+	c.opMutex.Lock()
+	defer c.opMutex.Unlock()
+	if err := c.checkState("destroy", StateCreated, StateRunning, StatePaused, StateStopped); err != nil {
+		return err
+	}
+	return c.destroy()
+}
+
+// DestroyIfPaused destroys the container unless it is no longer paused,
+// which lets an idle container be evicted without interrupting a request
+// that unpaused it in the meantime. It reports whether it destroyed it.
+func (c *Container) DestroyIfPaused() (bool, error) {
+	c.opMutex.Lock()
+	defer c.opMutex.Unlock()
+	if c.State() != StatePaused {
+		return false, nil
 	}
+	return true, c.destroy()
+}
+
+// destroy destroys the container. Callers must hold opMutex.
+func (c *Container) destroy() error {
+	// a stopped container has already given its cgroup back
+	if c.cgroup != nil {
+		if err := c.cgroup.Pause(); err != nil {
+			return &ContainerError{container: c.id, err: err}
+		}
+	}
+	c.transition(StateDestroyed)
 	c.notifyListeners(ContainerDestroy)
 	return c.decCgRefCount()
 }
 
 func (c *Container) Start() error {
+	c.opMutex.Lock()
+	if err := c.checkState("start", StateCreated); err != nil {
+		c.opMutex.Unlock()
+		return err
+	}
+	if err := c.startCommand(); err != nil {
+		c.opMutex.Unlock()
+		return err
+	}
+	c.transition(StateRunning)
+	c.notifyListeners(ContainerStart)
+	c.opMutex.Unlock()
+	return c.cmd.Wait() // Command passed in is expected to fork and exec
+}
+
+func (c *Container) startCommand() error {
+	if c.cmd.SysProcAttr == nil {
+		c.cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
 	c.cmd.SysProcAttr.Chroot = c.rootDir
 	// c.cmd.SysProcAttr.Cloneflags = UNSHARE
 	path := c.cgroup.CgroupProcsPath()
@@ -193,14 +384,32 @@ func (c *Container) Start() error {
 	}
 	c.cmd.ExtraFiles = []*os.File{os.NewFile(uintptr(fd), path)}
 	c.cmd.Env = []string{} // for security, DO NOT expose host env to guest
+	// pass the pipes as files, so Wait does not wait for every
+	// descendant of the command to close them
+	stdout, err := c.logs.pipe(StreamStdout)
+	if err != nil {
+		return &ContainerError{container: c.id, err: fmt.Errorf("failed to create stdout pipe: %v", err)}
+	}
+	defer stdout.Close()
+	stderr, err := c.logs.pipe(StreamStderr)
+	if err != nil {
+		return &ContainerError{container: c.id, err: fmt.Errorf("failed to create stderr pipe: %v", err)}
+	}
+	defer stderr.Close()
+	c.cmd.Stdout = stdout
+	c.cmd.Stderr = stderr
 	if err := c.cmd.Start(); err != nil {
 		return &ContainerError{container: c.id, err: fmt.Errorf("failed to start container: %v", err)}
 	}
-	c.notifyListeners(ContainerStart)
-	return c.cmd.Wait() // Command passed in is expected to fork and exec
+	return nil
 }
 
 func (c *Container) Pause() error {
+	c.opMutex.Lock()
+	defer c.opMutex.Unlock()
+	if err := c.checkState("pause", StateRunning); err != nil {
+		return err
+	}
 	if err := c.cgroup.Pause(); err != nil {
 		return &ContainerError{container: c.id, err: err}
 	}
@@ -212,13 +421,20 @@ func (c *Container) Pause() error {
 		}
 	}
 	c.client.CloseIdleConnections()
+	c.transition(StatePaused)
 	c.notifyListeners(ContainerPause)
 	return nil
 }
 
 func (c *Container) Unpause() error {
+	c.opMutex.Lock()
+	defer c.opMutex.Unlock()
+	if err := c.checkState("unpause", StatePaused); err != nil {
+		return err
+	}
+	// give back the memory taken away by Pause
 	oldLimit := c.cgroup.MemLimitMB()
-	newLimit := c.cgroup.GetMemUsageMB() - 1
+	newLimit, _ := c.Limits()
 	if newLimit > oldLimit {
 		if err := c.cgroup.SetMemLimitMB(newLimit); err != nil {
 			return &ContainerError{container: c.id, err: err}
@@ -227,6 +443,7 @@ func (c *Container) Unpause() error {
 	if err := c.cgroup.Unpause(); err != nil {
 		return &ContainerError{container: c.id, err: err}
 	}
+	c.transition(StateRunning)
 	c.notifyListeners(ContainerUnpause)
 	return nil
 }
@@ -235,7 +452,30 @@ func (c *Container) commsSock() string {
 	return fmt.Sprintf("%s/comms.sock", c.scratchDir)
 }
 
+// Stop kills the processes of the container and gives its cgroup back
+// to the pool. Only Destroy is allowed afterwards.
 func (c *Container) Stop() error {
+	c.opMutex.Lock()
+	defer c.opMutex.Unlock()
+	if err := c.checkState("stop", StateRunning, StatePaused); err != nil {
+		return err
+	}
+	prev := c.State()
+	c.transition(StateStopping)
+	if err := c.stopProcs(); err != nil {
+		// nothing was given up, so the stop can be retried
+		c.transition(prev)
+		return err
+	}
+	c.stateMutex.Lock()
+	c.cgroup = nil
+	c.stateMutex.Unlock()
+	c.transition(StateStopped)
+	c.notifyListeners(ContainerStop)
+	return nil
+}
+
+func (c *Container) stopProcs() error {
 	if err := c.cgroup.Pause(); err != nil {
 		return &ContainerError{container: c.id, err: err}
 	}
@@ -245,7 +485,6 @@ func (c *Container) Stop() error {
 	if err := c.cgroup.Release(); err != nil {
 		return &ContainerError{container: c.id, err: err}
 	}
-	c.notifyListeners(ContainerStop)
 	return nil
 }
 
@@ -253,15 +492,80 @@ func (c *Container) Meta() *Meta {
 	return c.meta
 }
 
+// Limits returns the memory limit in MB and the CPU limit in percent of
+// a core of the container. While it is paused, its cgroup is held to the
+// memory it uses instead.
+func (c *Container) Limits() (memLimitMB, cpuPercent int) {
+	return c.config.Limits(c.meta)
+}
+
+// setLimits applies the limits of the container to its cgroup, which may
+// still have those of the container that had it before
+func (c *Container) setLimits() error {
+	memLimitMB, cpuPercent := c.Limits()
+	if err := c.cgroup.SetMemLimitMB(memLimitMB); err != nil {
+		return &ContainerError{container: c.id, err: err}
+	}
+	if err := c.cgroup.SetCPUPercent(cpuPercent); err != nil {
+		return &ContainerError{container: c.id, err: err}
+	}
+	m := c.meta
+	var errs []error
+	if m.PidsMax > 0 {
+		errs = append(errs, c.cgroup.SetPidsMax(m.PidsMax))
+	}
+	if m.CPUWeight > 0 {
+		errs = append(errs, c.cgroup.SetCPUWeight(m.CPUWeight))
+	}
+	if m.CPUs != "" {
+		errs = append(errs, c.cgroup.SetCpusetCPUs(m.CPUs))
+	}
+	if m.Mems != "" {
+		errs = append(errs, c.cgroup.SetCpusetMems(m.Mems))
+	}
+	if m.MemHighMB > 0 {
+		errs = append(errs, c.cgroup.SetMemHighMB(m.MemHighMB))
+	}
+	if m.MemLowMB > 0 {
+		errs = append(errs, c.cgroup.SetMemLowMB(m.MemLowMB))
+	}
+	if m.MemSwapMaxMB > 0 {
+		errs = append(errs, c.cgroup.SetMemSwapMaxMB(m.MemSwapMaxMB))
+	}
+	for _, limit := range m.IOMax {
+		errs = append(errs, c.cgroup.SetIOMax(limit))
+	}
+	for _, weight := range m.IOWeight {
+		errs = append(errs, c.cgroup.SetIOWeight(weight))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return &ContainerError{container: c.id, err: err}
+	}
+	return nil
+}
+
 // fork a new process from the Zygote in container, relocate it to be the server in dst
-func (c *Container) Fork(dst *Container) error {
+func (c *Container) Fork(ctx context.Context, dst *Container) (err error) {
+	ctx, span := tracing.Start(ctx, "container.fork",
+		attribute.String("sockd.container.parent_id", c.id),
+		attribute.String("sockd.container.id", dst.ID()))
+	defer tracing.End(span, &err)
+
+	c.opMutex.Lock()
+	defer c.opMutex.Unlock()
+	// a paused Zygote could not answer the fork request
+	if err := c.checkState("fork from", StateRunning); err != nil {
+		return err
+	}
 	spareMB := c.cgroup.MemLimitMB() - c.cgroup.GetMemUsageMB()
 	if spareMB < 3 {
 		return fmt.Errorf("only %vMB of spare memory in parent, rejecting fork request (need at least 3MB)", spareMB)
 	}
 
 	// increment reference count before we start any processes
+	c.childMutex.Lock()
 	c.children[dst.ID()] = dst
+	c.childMutex.Unlock()
 	newCount := atomic.AddInt32(&c.cgRefCount, 1)
 
 	if newCount == 0 {
@@ -286,7 +590,20 @@ func (c *Container) Fork(dst *Container) error {
 	}
 	defer cgProcs.Close()
 
-	err = c.forkRequest(root, cgProcs)
+	// the child gets its own stdout and stderr instead of the ones
+	// of the Zygote
+	stdout, err := dst.logs.pipe(StreamStdout)
+	if err != nil {
+		return &ContainerError{container: c.id, err: err}
+	}
+	defer stdout.Close()
+	stderr, err := dst.logs.pipe(StreamStderr)
+	if err != nil {
+		return &ContainerError{container: c.id, err: err}
+	}
+	defer stderr.Close()
+
+	err = c.forkRequest(root, cgProcs, stdout, stderr)
 	if err != nil {
 		return &ContainerError{container: c.id, err: err}
 	}
@@ -297,14 +614,17 @@ func (c *Container) Fork(dst *Container) error {
 	// spawned (TODO: better way to do this?  This lets a forking
 	// process potentially kill our cache entry, which isn't
 	// great).
-
+	_, migrate := tracing.Start(ctx, "container.migrate_pids")
+	defer migrate.End()
+	passes, moved := 0, 0
 	for {
+		passes++
 		currPids, err := c.cgroup.PIDs()
 		if err != nil {
 			return &ContainerError{container: c.id, err: err}
 		}
 
-		moved := 0
+		movedNow := 0
 
 		for _, pid := range currPids {
 			isOrig := false
@@ -315,18 +635,20 @@ func (c *Container) Fork(dst *Container) error {
 				}
 			}
 			if !isOrig {
-				c.printf("move PID %v from CG %v to CG %v\n", pid, c.cgroup.Name(), dst.cgroup.Name())
+				c.logger.Debug("moving forked process", "pid", pid, "cgroup", c.cgroup.Name(), "child_id", dst.id, "child_cgroup", dst.cgroup.Name())
 				if err = dst.cgroup.AddPid(pid); err != nil {
 					return err
 				}
-				moved++
+				movedNow++
 			}
 		}
 
-		if moved == 0 {
+		moved += movedNow
+		if movedNow == 0 {
 			break
 		}
 	}
+	migrate.SetAttributes(attribute.Int("sockd.fork.passes", passes), attribute.Int("sockd.fork.pids_moved", moved))
 	c.notifyListeners(ContainerFork)
 	return nil
 }
@@ -348,6 +670,10 @@ func (c *Container) decCgRefCount() error {
 			}
 		}
 
+		if err := c.logs.close(); err != nil {
+			c.logger.Warn("failed to close log file", "error", err)
+		}
+
 		if err := syscall.Unmount(c.rootDir, syscall.MNT_DETACH); err != nil {
 			return &ContainerError{container: c.id, err: fmt.Errorf("failed to unmount root dir: %v", err)}
 		}
@@ -362,7 +688,9 @@ func (c *Container) decCgRefCount() error {
 }
 
 func (c *Container) childExit(child *Container) error {
+	c.childMutex.Lock()
 	delete(c.children, child.ID())
+	c.childMutex.Unlock()
 	c.notifyListeners(ContainerChildExit)
 	return c.decCgRefCount()
 }
@@ -418,6 +746,9 @@ func (c *Container) AddEventHandler(handler ContainerEventHandler) {
 }
 
 func (c *Container) notifyListeners(event ContainerEventType) {
+	c.stateMutex.Lock()
+	c.timestamps[event] = time.Now()
+	c.stateMutex.Unlock()
 	for _, handler := range c.eventHandlers {
 		handler(event, c)
 	}
@@ -474,10 +805,3 @@ func (c *Container) setCommand() error {
 	}
 	return nil
 }
-
-// add ID to each log message so we know which logs correspond to
-// which containers
-func (c *Container) printf(format string, args ...any) {
-	msg := fmt.Sprintf(format, args...)
-	log.Printf("%s [SOCK %s]", strings.TrimRight(msg, "\n"), c.id)
-}
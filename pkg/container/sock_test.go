@@ -1,6 +1,7 @@
 package container
 
 import (
+	"context"
 	"os"
 	"parkerdgabel/sockd/pkg/cgroup"
 	"path/filepath"
@@ -58,17 +59,35 @@ func setupDirs(t *testing.T) (string, string, string, string, func()) {
 	}
 }
 
+// newTestCgroup returns a cgroup of a pool that is destroyed after the
+// test. The test is skipped where cgroups cannot be created.
+func newTestCgroup(t *testing.T) *cgroup.Cgroup {
+	t.Helper()
+	pool, err := cgroup.NewPool("sock-test-pool", cgroup.DefaultPoolConfig())
+	if err != nil {
+		t.Skipf("cgroups are not available: %v", err)
+	}
+	t.Cleanup(func() {
+		pool.Destroy()
+	})
+	cg, err := pool.RetrieveCgroup(time.Second)
+	if err != nil {
+		t.Fatalf("failed to retrieve cgroup: %v", err)
+	}
+	return cg
+}
+
 func TestNewContainer(t *testing.T) {
 	baseDir, rootDir, codeDir, scratchDir, teardown := setupDirs(t)
 	t.Cleanup(func() {
 		teardown()
 	})
 
-	cgroup := &cgroup.Cgroup{}
+	cgroup := newTestCgroup(t)
 	meta := &Meta{
 		Runtime: Python,
 	}
-	container, err := NewContainer(nil, baseDir, "test-id", rootDir, codeDir, scratchDir, cgroup, meta, nil)
+	container, err := NewContainer(context.Background(), nil, baseDir, "test-id", rootDir, codeDir, scratchDir, cgroup, meta, DefaultConfig(), nil)
 	if err != nil {
 		t.Fatalf("expected no error, got %v", err)
 	}
@@ -84,11 +103,11 @@ func TestContainerStartClient(t *testing.T) {
 		teardown()
 	})
 
-	cgroup := &cgroup.Cgroup{}
+	cgroup := newTestCgroup(t)
 	meta := &Meta{
 		Runtime: Python,
 	}
-	container, err := NewContainer(nil, baseDir, "test-id", rootDir, codeDir, scratchDir, cgroup, meta, nil)
+	container, err := NewContainer(context.Background(), nil, baseDir, "test-id", rootDir, codeDir, scratchDir, cgroup, meta, DefaultConfig(), nil)
 	if err != nil {
 		t.Fatalf("expected no error, got %v", err)
 	}
@@ -100,7 +119,7 @@ func TestContainerStartClient(t *testing.T) {
 
 func TestContainerDestroy(t *testing.T) {
 	baseDir, rootDir, codeDir, scratchDir, teardown := setupDirs(t)
-	cgroupPool, err := cgroup.NewPool("test-pool")
+	cgroupPool, err := cgroup.NewPool("test-pool", cgroup.DefaultPoolConfig())
 	if err != nil {
 		t.Fatalf("expected no error, got %v", err)
 	}
@@ -116,7 +135,7 @@ func TestContainerDestroy(t *testing.T) {
 	meta := &Meta{
 		Runtime: Python,
 	}
-	container, err := NewContainer(nil, baseDir, "test-id", rootDir, codeDir, scratchDir, cgroup, meta, nil)
+	container, err := NewContainer(context.Background(), nil, baseDir, "test-id", rootDir, codeDir, scratchDir, cgroup, meta, DefaultConfig(), nil)
 	if err != nil {
 		t.Fatalf("expected no error, got %v", err)
 	}
@@ -133,9 +152,9 @@ func TestContainerStart(t *testing.T) {
 		teardown()
 	})
 
-	cgroup := &cgroup.Cgroup{}
+	cgroup := newTestCgroup(t)
 	meta := &Meta{}
-	container, err := NewContainer(nil, baseDir, "test-id", rootDir, codeDir, scratchDir, cgroup, meta, nil)
+	container, err := NewContainer(context.Background(), nil, baseDir, "test-id", rootDir, codeDir, scratchDir, cgroup, meta, DefaultConfig(), nil)
 	if err != nil {
 		t.Fatalf("expected no error, got %v", err)
 	}
@@ -151,9 +170,9 @@ func TestContainerPause(t *testing.T) {
 		teardown()
 	})
 
-	cgroup := &cgroup.Cgroup{}
+	cgroup := newTestCgroup(t)
 	meta := &Meta{}
-	container, err := NewContainer(nil, baseDir, "test-id", rootDir, codeDir, scratchDir, cgroup, meta, nil)
+	container, err := NewContainer(context.Background(), nil, baseDir, "test-id", rootDir, codeDir, scratchDir, cgroup, meta, DefaultConfig(), nil)
 	if err != nil {
 		t.Fatalf("expected no error, got %v", err)
 	}
@@ -169,9 +188,9 @@ func TestContainerUnpause(t *testing.T) {
 		teardown()
 	})
 
-	cgroup := &cgroup.Cgroup{}
+	cgroup := newTestCgroup(t)
 	meta := &Meta{}
-	container, err := NewContainer(nil, baseDir, "test-id", rootDir, codeDir, scratchDir, cgroup, meta, nil)
+	container, err := NewContainer(context.Background(), nil, baseDir, "test-id", rootDir, codeDir, scratchDir, cgroup, meta, DefaultConfig(), nil)
 	if err != nil {
 		t.Fatalf("expected no error, got %v", err)
 	}
@@ -187,17 +206,17 @@ func TestContainerFork(t *testing.T) {
 		teardown()
 	})
 
-	cgroup := &cgroup.Cgroup{}
+	cgroup := newTestCgroup(t)
 	meta := &Meta{}
-	parent, err := NewContainer(nil, baseDir, "parent-id", rootDir, codeDir, scratchDir, cgroup, meta, nil)
+	parent, err := NewContainer(context.Background(), nil, baseDir, "parent-id", rootDir, codeDir, scratchDir, cgroup, meta, DefaultConfig(), nil)
 	if err != nil {
 		t.Fatalf("expected no error, got %v", err)
 	}
-	child, err := NewContainer(nil, baseDir, "child-id", rootDir, codeDir, scratchDir, cgroup, meta, nil)
+	child, err := NewContainer(context.Background(), nil, baseDir, "child-id", rootDir, codeDir, scratchDir, cgroup, meta, DefaultConfig(), nil)
 	if err != nil {
 		t.Fatalf("expected no error, got %v", err)
 	}
-	err = parent.Fork(child)
+	err = parent.Fork(context.Background(), child)
 	if err != nil {
 		t.Errorf("expected no error, got %v", err)
 	}
@@ -209,9 +228,9 @@ func TestContainerMountScratchDir(t *testing.T) {
 		teardown()
 	})
 
-	cgroup := &cgroup.Cgroup{}
+	cgroup := newTestCgroup(t)
 	meta := &Meta{}
-	container, err := NewContainer(nil, baseDir, "test-id", rootDir, codeDir, scratchDir, cgroup, meta, nil)
+	container, err := NewContainer(context.Background(), nil, baseDir, "test-id", rootDir, codeDir, scratchDir, cgroup, meta, DefaultConfig(), nil)
 	if err != nil {
 		t.Fatalf("expected no error, got %v", err)
 	}
@@ -220,3 +239,30 @@ func TestContainerMountScratchDir(t *testing.T) {
 		t.Errorf("expected no error, got %v", err)
 	}
 }
+
+func TestConfigLimits(t *testing.T) {
+	config := Config{ClientTimeout: time.Second, MemLimitMB: 128, CPUPercent: 50}
+	tests := []struct {
+		meta    Meta
+		wantMem int
+		wantCPU int
+	}{
+		{Meta{}, 128, 50},
+		{Meta{MemLimitMB: 256}, 256, 50},
+		{Meta{CPUPercent: 200}, 128, 200},
+		{Meta{MemLimitMB: -1, CPUPercent: -1}, 128, 50},
+	}
+	for _, tt := range tests {
+		mem, cpu := config.Limits(&tt.meta)
+		if mem != tt.wantMem || cpu != tt.wantCPU {
+			t.Errorf("Limits(%+v) = %d, %d, want %d, %d", tt.meta, mem, cpu, tt.wantMem, tt.wantCPU)
+		}
+	}
+	if err := config.Validate(); err != nil {
+		t.Errorf("Validate() = %v, want nil", err)
+	}
+	config.MemLimitMB = 0
+	if err := config.Validate(); err == nil {
+		t.Error("Validate() accepted a mem_limit_mb of 0")
+	}
+}
@@ -0,0 +1,165 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// State is the lifecycle state of a Container
+type State int
+
+const (
+	StateCreated State = iota
+	StateRunning
+	StatePaused
+	StateStopping
+	StateStopped
+	StateDestroyed
+)
+
+// ErrInvalidState is wrapped by every StateError, for use with errors.Is
+var ErrInvalidState = errors.New("invalid container state")
+
+// StateError is returned by lifecycle operations that are not allowed
+// in the current state of a container, e.g. pausing a stopped one
+type StateError struct {
+	container string
+	op        string
+	state     State
+}
+
+func (e *StateError) Error() string {
+	return fmt.Sprintf("Container error: %s: cannot %s a %s container", e.container, e.op, e.state)
+}
+
+func (e *StateError) Unwrap() error {
+	return ErrInvalidState
+}
+
+// State returns the state the container was in when the operation was
+// rejected
+func (e *StateError) State() State {
+	return e.state
+}
+
+func (s State) String() string {
+	switch s {
+	case StateCreated:
+		return "created"
+	case StateRunning:
+		return "running"
+	case StatePaused:
+		return "paused"
+	case StateStopping:
+		return "stopping"
+	case StateStopped:
+		return "stopped"
+	case StateDestroyed:
+		return "destroyed"
+	default:
+		return "unknown"
+	}
+}
+
+func (e ContainerEventType) String() string {
+	switch e {
+	case ContainerStart:
+		return "start"
+	case ContainerStop:
+		return "stop"
+	case ContainerPause:
+		return "pause"
+	case ContainerUnpause:
+		return "unpause"
+	case ContainerDestroy:
+		return "destroy"
+	case ContainerFork:
+		return "fork"
+	case ContainerChildExit:
+		return "child_exit"
+	case ContainerOOM:
+		return "oom"
+	case ContainerOOMKill:
+		return "oom_kill"
+	case ContainerMemoryHigh:
+		return "memory_high"
+	case ContainerMemoryMax:
+		return "memory_max"
+	case ContainerPressure:
+		return "pressure"
+	default:
+		return "unknown"
+	}
+}
+
+// Resource tells whether the event reports the resource usage of a
+// container rather than a change of its lifecycle
+func (e ContainerEventType) Resource() bool {
+	return e >= ContainerOOM
+}
+
+// ParseEventType is the inverse of ContainerEventType.String
+func ParseEventType(name string) (ContainerEventType, error) {
+	for e := ContainerStart; e <= ContainerPressure; e++ {
+		if e.String() == name {
+			return e, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown event type: %s", name)
+}
+
+// State returns the current lifecycle state of the container
+func (c *Container) State() State {
+	c.stateMutex.Lock()
+	defer c.stateMutex.Unlock()
+	return c.state
+}
+
+// checkState returns a StateError unless the container is in one of
+// the allowed states. Callers must hold opMutex, so the state cannot
+// change before they transition.
+func (c *Container) checkState(op string, allowed ...State) error {
+	state := c.State()
+	for _, s := range allowed {
+		if state == s {
+			return nil
+		}
+	}
+	return &StateError{container: c.id, op: op, state: state}
+}
+
+// transition moves the container to a new state. Callers must hold
+// opMutex and notify the listeners of the matching event before
+// releasing it, which keeps the events of a container in the order of
+// its transitions.
+func (c *Container) transition(state State) {
+	c.stateMutex.Lock()
+	from := c.state
+	c.state = state
+	c.stateMutex.Unlock()
+	c.logger.Debug("state changed", "from", from.String(), "to", state.String())
+	switch state {
+	case StateRunning:
+		c.startWatch()
+	case StateStopping, StateStopped, StateDestroyed:
+		c.stopWatch()
+	}
+}
+
+// Created returns when the container was created
+func (c *Container) Created() time.Time {
+	return c.created
+}
+
+// Timestamps returns when each kind of event last happened to the
+// container
+func (c *Container) Timestamps() map[ContainerEventType]time.Time {
+	c.stateMutex.Lock()
+	defer c.stateMutex.Unlock()
+	timestamps := make(map[ContainerEventType]time.Time, len(c.timestamps))
+	for event, t := range c.timestamps {
+		timestamps[event] = t
+	}
+	return timestamps
+}
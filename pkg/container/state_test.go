@@ -0,0 +1,114 @@
+package container
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestContainerInvalidTransitions(t *testing.T) {
+	events := 0
+	newContainer := func(state State) *Container {
+		return &Container{
+			id:     "test-id",
+			state:  state,
+			logger: logger,
+			eventHandlers: []ContainerEventHandler{
+				func(event ContainerEventType, c *Container) { events++ },
+			},
+		}
+	}
+
+	tests := []struct {
+		name  string
+		state State
+		op    func(c *Container) error
+	}{
+		{name: "start running", state: StateRunning, op: (*Container).Start},
+		{name: "pause created", state: StateCreated, op: (*Container).Pause},
+		{name: "pause stopped", state: StateStopped, op: (*Container).Pause},
+		{name: "unpause running", state: StateRunning, op: (*Container).Unpause},
+		{name: "stop created", state: StateCreated, op: (*Container).Stop},
+		{name: "destroy destroyed", state: StateDestroyed, op: (*Container).Destroy},
+		{name: "destroy stopping", state: StateStopping, op: (*Container).Destroy},
+		{name: "fork paused", state: StatePaused, op: func(c *Container) error {
+			return c.Fork(context.Background(), newContainer(StateCreated))
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newContainer(tt.state)
+			err := tt.op(c)
+			if !errors.Is(err, ErrInvalidState) {
+				t.Fatalf("expected %v, got %v", ErrInvalidState, err)
+			}
+			var stateErr *StateError
+			if !errors.As(err, &stateErr) || stateErr.State() != tt.state {
+				t.Errorf("expected a StateError in state %s, got %v", tt.state, err)
+			}
+			if c.State() != tt.state {
+				t.Errorf("state changed to %s", c.State())
+			}
+		})
+	}
+	if events != 0 {
+		t.Errorf("expected no events, got %d", events)
+	}
+}
+
+func TestContainerReleasePausesAfterLastUse(t *testing.T) {
+	events := 0
+	c := &Container{
+		id:     "test-id",
+		state:  StateRunning,
+		logger: logger,
+		eventHandlers: []ContainerEventHandler{
+			func(event ContainerEventType, c *Container) { events++ },
+		},
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := c.Acquire(); err != nil {
+			t.Fatalf("Acquire() error = %v", err)
+		}
+	}
+	if err := c.Release(true); err != nil {
+		t.Fatalf("Release() error = %v", err)
+	}
+	if c.State() != StateRunning || events != 0 {
+		t.Fatalf("paused while still in use: state %s, %d events", c.State(), events)
+	}
+
+	// the last use pauses, which fails once the container is stopped
+	c.state = StateStopped
+	if err := c.Release(false); !errors.Is(err, ErrInvalidState) {
+		t.Errorf("expected the last Release to pause, got %v", err)
+	}
+	if err := c.Acquire(); !errors.Is(err, ErrInvalidState) {
+		t.Errorf("expected %v, got %v", ErrInvalidState, err)
+	}
+}
+
+func TestContainerChildrenCopy(t *testing.T) {
+	parent := &Container{id: "parent", children: make(map[string]*Container)}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			child := &Container{id: "child"}
+			parent.AddChild(child)
+			parent.RemoveChild(child)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		for range parent.Children() {
+		}
+		parent.ChildIDs()
+	}
+	<-done
+
+	parent.Children()["other"] = &Container{id: "other"}
+	if len(parent.ChildIDs()) != 0 {
+		t.Errorf("changing the result of Children() changed the children")
+	}
+}
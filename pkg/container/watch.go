@@ -0,0 +1,129 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"parkerdgabel/sockd/pkg/cgroup"
+	"time"
+)
+
+// ErrOOMKilled is wrapped by the errors of invocations during which the
+// kernel killed a process of the container for running out of memory
+var ErrOOMKilled = errors.New("killed for running out of memory")
+
+// startWatch starts checking the memory events and pressure of the
+// container, unless it is already checked. Callers must hold opMutex.
+func (c *Container) startWatch() {
+	if c.unwatch != nil || c.config.WatchInterval <= 0 {
+		return
+	}
+	c.unwatch = make(chan struct{})
+	go c.watch(c.unwatch)
+}
+
+// stopWatch stops checking the container. Callers must hold opMutex.
+func (c *Container) stopWatch() {
+	if c.unwatch != nil {
+		close(c.unwatch)
+		c.unwatch = nil
+	}
+}
+
+// watch notifies the listeners of the memory events and pressure of the
+// container every WatchInterval, until stop is closed
+func (c *Container) watch(stop <-chan struct{}) {
+	ticker := time.NewTicker(c.config.WatchInterval)
+	defer ticker.Stop()
+	var last cgroup.MemoryEvents
+	if cg := c.Cgroup(); cg != nil {
+		if events, err := cg.MemoryEvents(); err == nil {
+			last = *events
+		}
+	}
+	pressured := false
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		// events are only sent between lifecycle operations, and never
+		// once the container stopped
+		c.opMutex.Lock()
+		select {
+		case <-stop:
+			c.opMutex.Unlock()
+			return
+		default:
+		}
+		cg := c.Cgroup()
+		if cg == nil {
+			c.opMutex.Unlock()
+			return
+		}
+		if events, err := cg.MemoryEvents(); err == nil {
+			c.notifyMemoryEvents(last, *events)
+			last = *events
+		}
+		if c.config.PressureThreshold > 0 {
+			under := c.underPressure(cg)
+			if under && !pressured {
+				c.logger.Warn("container under pressure", "threshold", c.config.PressureThreshold)
+				c.notifyListeners(ContainerPressure)
+			}
+			pressured = under
+		}
+		c.opMutex.Unlock()
+	}
+}
+
+// notifyMemoryEvents notifies the listeners of the memory events counted
+// since last
+func (c *Container) notifyMemoryEvents(last, events cgroup.MemoryEvents) {
+	if events.OOMKill > last.OOMKill {
+		c.logger.Warn("processes killed for running out of memory", "oom_kill", events.OOMKill-last.OOMKill)
+		c.notifyListeners(ContainerOOMKill)
+	} else if events.OOM > last.OOM {
+		c.notifyListeners(ContainerOOM)
+	}
+	if events.Max > last.Max {
+		c.notifyListeners(ContainerMemoryMax)
+	}
+	if events.High > last.High {
+		c.notifyListeners(ContainerMemoryHigh)
+	}
+}
+
+// underPressure tells whether the tasks of the container stalled on
+// memory or CPU for more than PressureThreshold over the last 10s
+func (c *Container) underPressure(cg *cgroup.Cgroup) bool {
+	for _, read := range []func() (*cgroup.Pressure, error){cg.MemoryPressure, cg.CPUPressure} {
+		if p, err := read(); err == nil && p.Some.Avg10 > c.config.PressureThreshold {
+			return true
+		}
+	}
+	return false
+}
+
+// OOMKills returns how many processes of the container the kernel killed
+// for running out of memory, or -1 if it cannot tell
+func (c *Container) OOMKills() int64 {
+	cg := c.Cgroup()
+	if cg == nil {
+		return -1
+	}
+	events, err := cg.MemoryEvents()
+	if err != nil {
+		return -1
+	}
+	return events.OOMKill
+}
+
+// oomError returns err as a ContainerError, wrapping ErrOOMKilled if the
+// kernel killed a process of the container since it counted before kills
+func (c *Container) oomError(before int64, err error) error {
+	if before >= 0 && c.OOMKills() > before {
+		err = fmt.Errorf("%w: %v", ErrOOMKilled, err)
+	}
+	return &ContainerError{container: c.id, err: err}
+}
@@ -0,0 +1,39 @@
+// Package message defines the wire protocol spoken by sockd on its unix
+// socket and TCP listener.
+//
+// Messages are JSON objects, one per line, so any language with a JSON
+// library can talk to the daemon. A client first sends a hello with
+// the API versions it speaks:
+//
+//	{"command":"hello","payload":{"versions":[1]}}
+//
+// and the server answers with the version it picked, or an error with
+// code "unsupported_version". Over TCP the server may also want a
+// "token" in the hello, and answers a missing or wrong one with an
+// error with code "unauthorized" before closing the connection. Every
+// other request looks like
+//
+//	{"command":"inspect","payload":{"id":"..."}}
+//
+// and is answered by
+//
+//	{"success":true,"message":"...","payload":{...}}
+//
+// or, on failure, by
+//
+//	{"success":false,"error":{"code":"not_found","message":"..."}}
+//
+// A request may carry an "id", which is copied to its responses. Requests
+// with an id are handled concurrently and may be answered in any order,
+// so a client can have many of them in flight on one connection; a
+// "cancel" request with the same id stops one early. Requests without an
+// id are answered one at a time, in order. A request may also name a
+// "tenant": containers and functions belong to a tenant and are only
+// seen by requests for it; without one, requests are for the "default"
+// tenant. Commands that stream (logs with follow set, events, stats
+// with an interval, drain with wait set) send several responses to a
+// single request.
+// Binary fields ([]byte) are base64 strings. From a shell, e.g.:
+//
+//	printf '%s\n' '{"command":"hello","payload":{"versions":[1]}}' '{"command":"list"}' | socat - UNIX-CONNECT:/var/run/sockd.sock
+package message
@@ -0,0 +1,160 @@
+package message
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// APIVersion is the newest version of the protocol this package speaks
+const APIVersion = 1
+
+// SupportedVersions are the versions of the protocol this package
+// speaks, oldest first
+var SupportedVersions = []int{1}
+
+// NegotiateVersion returns the newest version in both ours and theirs,
+// or 0 if there is none
+func NegotiateVersion(theirs []int) int {
+	best := 0
+	for _, v := range theirs {
+		for _, ours := range SupportedVersions {
+			if v == ours && v > best {
+				best = v
+			}
+		}
+	}
+	return best
+}
+
+type ErrorCode string
+
+const (
+	// ErrCodeBadRequest is returned for malformed requests, and for invalid
+	// container limits or memory limits larger than a memory pool
+	ErrCodeBadRequest ErrorCode = "bad_request"
+	// ErrCodeUnknownCommand is returned for commands the server does not know
+	ErrCodeUnknownCommand ErrorCode = "unknown_command"
+	// ErrCodeHandshakeRequired is returned for requests sent before the hello
+	ErrCodeHandshakeRequired ErrorCode = "handshake_required"
+	// ErrCodeUnauthorized is returned for a hello without a valid token
+	ErrCodeUnauthorized ErrorCode = "unauthorized"
+	// ErrCodeForbidden is returned for commands the client is not allowed to run
+	ErrCodeForbidden ErrorCode = "forbidden"
+	// ErrCodeUnsupportedVersion is returned when client and server share no API version
+	ErrCodeUnsupportedVersion ErrorCode = "unsupported_version"
+	// ErrCodeDuplicateId is returned for a request reusing the id of one still in progress
+	ErrCodeDuplicateId ErrorCode = "duplicate_id"
+	// ErrCodeNotFound is returned when a container, function, version or alias does not exist
+	ErrCodeNotFound ErrorCode = "not_found"
+	// ErrCodeInvalidState is returned when an operation is not allowed in the current state
+	ErrCodeInvalidState ErrorCode = "invalid_state"
+	// ErrCodeUnavailable is returned for new work while the server drains,
+	// or when there is not enough free memory for a new container
+	ErrCodeUnavailable ErrorCode = "unavailable"
+	// ErrCodeOOMKilled is returned for invocations that failed because the
+	// container ran out of memory
+	ErrCodeOOMKilled ErrorCode = "oom_killed"
+	// ErrCodeInternal is returned for every other failure
+	ErrCodeInternal ErrorCode = "internal"
+)
+
+// Error is the error of a failed request
+type Error struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// Is makes errors.Is match any Error with the same code
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// NewError returns an Error with a formatted message
+func NewError(code ErrorCode, format string, args ...any) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// decodePayload decodes the payload of a request into a T. A missing
+// payload decodes to the zero value.
+func decodePayload[T any](raw json.RawMessage) (any, error) {
+	var payload T
+	if len(raw) == 0 || string(raw) == "null" {
+		return payload, nil
+	}
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// the payload type of each command
+var requestPayloads = map[Command]func(json.RawMessage) (any, error){
+	CommandHello:                 decodePayload[PayloadHello],
+	CommandCreate:                decodePayload[PayloadCreate],
+	CommandDelete:                decodePayload[PayloadDelete],
+	CommandStart:                 decodePayload[PayloadStart],
+	CommandStop:                  decodePayload[PayloadStop],
+	CommandList:                  decodePayload[PayloadList],
+	CommandInspect:               decodePayload[PayloadInspect],
+	CommandLogs:                  decodePayload[PayloadLogs],
+	CommandEvents:                decodePayload[PayloadEvents],
+	CommandStats:                 decodePayload[PayloadStats],
+	CommandFork:                  decodePayload[PayloadFork],
+	CommandPause:                 decodePayload[PayloadPause],
+	CommandUnpause:               decodePayload[PayloadUnpause],
+	CommandInvoke:                decodePayload[PayloadInvoke],
+	CommandRegisterFunction:      decodePayload[PayloadRegisterFunction],
+	CommandListFunctions:         decodePayload[PayloadListFunctions],
+	CommandDescribeFunction:      decodePayload[PayloadDescribeFunction],
+	CommandDeleteFunction:        decodePayload[PayloadDeleteFunction],
+	CommandSetFunctionAlias:      decodePayload[PayloadSetFunctionAlias],
+	CommandRollbackFunctionAlias: decodePayload[PayloadRollbackFunctionAlias],
+	CommandCancel:                decodePayload[PayloadCancel],
+	CommandReload:                decodePayload[PayloadReload],
+	CommandDrain:                 decodePayload[PayloadDrain],
+	CommandResume:                decodePayload[PayloadResume],
+	CommandShutdown:              decodePayload[PayloadShutdown],
+	CommandCloseConnection:       decodePayload[PayloadCloseConnection],
+}
+
+// UnmarshalJSON decodes the payload into the type of the command, so
+// servers can switch on the command and assert the payload type. The
+// payload of an unknown command is left nil.
+func (r *Request) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Id      string            `json:"id"`
+		Command Command           `json:"command"`
+		Payload json.RawMessage   `json:"payload"`
+		Tenant  string            `json:"tenant"`
+		Trace   map[string]string `json:"trace"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	r.Id = raw.Id
+	r.Tenant = raw.Tenant
+	r.Trace = raw.Trace
+	r.Command = raw.Command
+	r.Payload = nil
+	decode, ok := requestPayloads[raw.Command]
+	if !ok {
+		return nil
+	}
+	payload, err := decode(raw.Payload)
+	if err != nil {
+		return fmt.Errorf("invalid payload for %s: %v", raw.Command, err)
+	}
+	r.Payload = payload
+	return nil
+}
+
+// KnownCommand reports whether the command is part of the protocol
+func KnownCommand(cmd Command) bool {
+	_, ok := requestPayloads[cmd]
+	return ok
+}
@@ -0,0 +1,70 @@
+package message
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRequestUnmarshalJSON(t *testing.T) {
+	var req Request
+	if err := json.Unmarshal([]byte(`{"command":"logs","payload":{"id":"c1","tail":5}}`), &req); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	payload, ok := req.Payload.(PayloadLogs)
+	if !ok {
+		t.Fatalf("Payload = %T, want PayloadLogs", req.Payload)
+	}
+	if payload.Id != "c1" || payload.Tail != 5 {
+		t.Errorf("Payload = %+v", payload)
+	}
+
+	if err := json.Unmarshal([]byte(`{"command":"list","tenant":"team-a"}`), &req); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if _, ok := req.Payload.(PayloadList); !ok {
+		t.Errorf("Payload = %T, want PayloadList", req.Payload)
+	}
+	if req.Tenant != "team-a" {
+		t.Errorf("Tenant = %q, want team-a", req.Tenant)
+	}
+
+	if err := json.Unmarshal([]byte(`{"command":"stats","payload":{"id":"c1","interval_ns":1000000000}}`), &req); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if stats, ok := req.Payload.(PayloadStats); !ok || stats.Id != "c1" || stats.Interval != time.Second {
+		t.Errorf("Payload = %#v, want PayloadStats for c1 every second", req.Payload)
+	}
+
+	if err := json.Unmarshal([]byte(`{"command":"bogus","payload":{}}`), &req); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if req.Payload != nil || KnownCommand(req.Command) {
+		t.Errorf("unknown command decoded to %+v", req)
+	}
+
+	if err := json.Unmarshal([]byte(`{"command":"inspect","payload":{"id":5}}`), &req); err == nil {
+		t.Errorf("Unmarshal() accepted a payload of the wrong type")
+	}
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	if v := NegotiateVersion([]int{0, APIVersion, APIVersion + 1}); v != APIVersion {
+		t.Errorf("NegotiateVersion() = %d, want %d", v, APIVersion)
+	}
+	if v := NegotiateVersion([]int{APIVersion + 1}); v != 0 {
+		t.Errorf("NegotiateVersion() = %d, want 0", v)
+	}
+}
+
+func TestResponseError(t *testing.T) {
+	var res Response
+	raw := `{"success":false,"error":{"code":"not_found","message":"container not found: c1"}}`
+	if err := json.Unmarshal([]byte(raw), &res); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if !errors.Is(res.Error, &Error{Code: ErrCodeNotFound}) {
+		t.Errorf("Error = %v, want code %s", res.Error, ErrCodeNotFound)
+	}
+}
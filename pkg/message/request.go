@@ -1,29 +1,16 @@
 package message
 
 import (
-	"encoding/gob"
 	"parkerdgabel/sockd/pkg/container"
+	"time"
 )
 
-func init() {
-	gob.Register(Request{})
-	gob.Register(Response{})
-	gob.Register(PayloadCreate{})
-	gob.Register(PayloadDelete{})
-	gob.Register(PayloadStart{})
-	gob.Register(PayloadStop{})
-	gob.Register(PayloadInspect{})
-	gob.Register(PayloadLogs{})
-	gob.Register(PayloadFork{})
-	gob.Register(PayloadList{})
-	gob.Register(PayloadPause{})
-	gob.Register(PayloadUnpause{})
-	gob.Register(container.Meta{})
-}
-
 type Command string
 
 const (
+	// CommandHello is used to agree on an API version, and must be
+	// the first request on a connection
+	CommandHello Command = "hello"
 	// CommandCreate is used to create a new container
 	CommandCreate Command = "create"
 	// CommandDelete is used to delete a container
@@ -38,12 +25,39 @@ const (
 	CommandInspect Command = "inspect"
 	// CommandLogs is used to get logs from a container
 	CommandLogs Command = "logs"
+	// CommandEvents is used to subscribe to container lifecycle events
+	CommandEvents Command = "events"
+	// CommandStats is used to get the resource usage of containers
+	CommandStats Command = "stats"
 	// CommandFork is used to fork a container
 	CommandFork Command = "fork"
 	// CommandPause is used to pause a container
 	CommandPause Command = "pause"
 	// CommandUnpause is used to unpause a container
 	CommandUnpause Command = "unpause"
+	// CommandInvoke is used to invoke the handler of a container
+	CommandInvoke Command = "invoke"
+	// CommandRegisterFunction is used to register a named function
+	CommandRegisterFunction Command = "register_function"
+	// CommandListFunctions is used to list all registered functions
+	CommandListFunctions Command = "list_functions"
+	// CommandDescribeFunction is used to describe a registered function
+	CommandDescribeFunction Command = "describe_function"
+	// CommandDeleteFunction is used to delete a registered function
+	CommandDeleteFunction Command = "delete_function"
+	// CommandSetFunctionAlias is used to point an alias at a function version
+	CommandSetFunctionAlias Command = "set_function_alias"
+	// CommandRollbackFunctionAlias is used to move an alias back to its previous version
+	CommandRollbackFunctionAlias Command = "rollback_function_alias"
+	// CommandCancel is used to cancel a request still in progress
+	CommandCancel Command = "cancel"
+	// CommandReload is used to make the server re-read its config file
+	CommandReload Command = "reload"
+	// CommandDrain is used to make the server refuse new creates and
+	// invocations while those in flight finish
+	CommandDrain Command = "drain"
+	// CommandResume is used to end a drain
+	CommandResume Command = "resume"
 	// CommandShutdown is used to shutdown the server
 	CommandShutdown Command = "shutdown"
 	// CommandCloseConnection is used to close the connection
@@ -52,9 +66,21 @@ const (
 
 type RequestPayload interface{}
 
+type PayloadHello struct {
+	// Versions are the API versions the client speaks
+	Versions []int `json:"versions"`
+	// Client optionally names the client, for the logs
+	Client string `json:"client"`
+	// Token authenticates the client, if the server asks for one
+	Token string `json:"token,omitempty"`
+}
+
 type PayloadCreate struct {
 	Meta container.Meta `json:"meta"`
 	Name string         `json:"name"`
+	// Function creates the container from a registered function
+	// instead of Meta, as name[:alias or version]
+	Function string `json:"function"`
 }
 
 type PayloadDelete struct {
@@ -75,6 +101,30 @@ type PayloadInspect struct {
 
 type PayloadLogs struct {
 	Id string `json:"id"`
+	// Follow keeps streaming new lines after the existing ones
+	Follow bool `json:"follow"`
+	// Since only returns lines written at or after this time (if set)
+	Since time.Time `json:"since"`
+	// Tail only returns this many of the most recent lines (if > 0)
+	Tail int `json:"tail"`
+}
+
+type PayloadEvents struct {
+	// Filters select events by "type", "container" or "parent". An
+	// event must match every key, and any of the values of a key.
+	Filters map[string][]string `json:"filters"`
+	// Since replays the buffered events at or after this time (if set)
+	// before streaming new ones
+	Since time.Time `json:"since"`
+}
+
+type PayloadStats struct {
+	// Id only returns the stats of this container (if set), which may
+	// be a Zygote
+	Id string `json:"id"`
+	// Interval streams the stats every interval (if > 0) instead of
+	// returning them once
+	Interval time.Duration `json:"interval_ns"`
 }
 
 type PayloadFork struct {
@@ -91,7 +141,72 @@ type PayloadUnpause struct {
 	Id string `json:"id"`
 }
 
+type PayloadInvoke struct {
+	Id          string `json:"id"`
+	Body        []byte `json:"body"`
+	ContentType string `json:"content_type"`
+}
+
+type PayloadRegisterFunction struct {
+	Name string         `json:"name"`
+	Meta container.Meta `json:"meta"`
+}
+
+type PayloadListFunctions struct{}
+
+type PayloadDescribeFunction struct {
+	Name string `json:"name"`
+}
+
+type PayloadDeleteFunction struct {
+	Name string `json:"name"`
+}
+
+type PayloadSetFunctionAlias struct {
+	Name         string `json:"name"`
+	Alias        string `json:"alias"`
+	Version      string `json:"version"`
+	Canary       string `json:"canary"`
+	CanaryWeight int    `json:"canary_weight"`
+}
+
+type PayloadRollbackFunctionAlias struct {
+	Name  string `json:"name"`
+	Alias string `json:"alias"`
+}
+
+type PayloadCancel struct {
+	// Id is the id of the request to cancel
+	Id string `json:"id"`
+}
+
+type PayloadReload struct{}
+
+type PayloadDrain struct {
+	// Wait streams the progress of the drain until no create or
+	// invocation is in flight
+	Wait bool `json:"wait"`
+}
+
+type PayloadResume struct{}
+
+type PayloadShutdown struct{}
+
+type PayloadCloseConnection struct{}
+
 type Request struct {
-	Command Command
-	Payload RequestPayload
+	// Id is chosen by the client and copied to every response to the
+	// request. Requests with an id are handled concurrently, so their
+	// responses may come back in any order; requests without one are
+	// handled one at a time, in order.
+	Id      string         `json:"id,omitempty"`
+	Command Command        `json:"command"`
+	Payload RequestPayload `json:"payload,omitempty"`
+	// Tenant is the tenant whose containers and functions the request
+	// is about. Empty means the default tenant.
+	Tenant string `json:"tenant,omitempty"`
+	// Trace optionally carries the W3C trace context (traceparent,
+	// tracestate) of the caller, so the work done for the request
+	// shows up in its trace
+	Trace map[string]string `json:"trace,omitempty"`
 }
@@ -1,41 +1,166 @@
 package message
 
-import "encoding/gob"
-
-func init() {
-	gob.Register(CreateResponse{})
-	gob.Register(ListResponse{})
-	gob.Register(InspectResponse{})
-	gob.Register(LogsResponse{})
-}
+import (
+	"parkerdgabel/sockd/pkg/cgroup"
+	"parkerdgabel/sockd/pkg/container"
+	"time"
+)
 
 type ResponsePayload interface{}
 
+type HelloResponse struct {
+	// Version is the API version used for the rest of the connection
+	Version int `json:"version"`
+	// Versions are all API versions the server speaks
+	Versions []int `json:"versions"`
+}
+
 type CreateResponse struct {
-	Id string
+	Id string `json:"id"`
 }
 
 type ListResponse struct {
-	Ids []string
+	Ids []string `json:"ids"`
 }
 
 type InspectResponse struct {
-	Id     string
-	Status string
+	Id         string         `json:"id"`
+	Tenant     string         `json:"tenant"`
+	Status     string         `json:"status"`
+	ParentId   string         `json:"parent_id"`
+	ChildIds   []string       `json:"child_ids"`
+	Cgroup     string         `json:"cgroup"`
+	MemUsageMB int            `json:"mem_usage_mb"`
+	MemLimitMB int            `json:"mem_limit_mb"`
+	CPUPercent int            `json:"cpu_percent"`
+	PIDs       []string       `json:"pids"`
+	RootDir    string         `json:"root_dir"`
+	CodeDir    string         `json:"code_dir"`
+	ScratchDir string         `json:"scratch_dir"`
+	Meta       container.Meta `json:"meta"`
+	Created    time.Time      `json:"created"`
+	// when each lifecycle event last happened, keyed by event name
+	Events map[string]time.Time `json:"events"`
 }
 
+type LogEntry struct {
+	Time   time.Time `json:"time"`
+	Stream string    `json:"stream"`
+	Line   string    `json:"line"`
+}
+
+// LogsResponse carries a batch of log lines. When following, the
+// server keeps sending them until one has Done set.
 type LogsResponse struct {
-	Id    string
-	Logs  string
-	Error string
+	Id      string     `json:"id"`
+	Entries []LogEntry `json:"entries"`
+	Error   string     `json:"error"`
+	Done    bool       `json:"done"`
+}
+
+// Event is a lifecycle event of a container
+type Event struct {
+	// Seq increases by one with every event the server sees
+	Seq         uint64    `json:"seq"`
+	Time        time.Time `json:"time"`
+	Type        string    `json:"type"`
+	Tenant      string    `json:"tenant"`
+	ContainerId string    `json:"container_id"`
+	ParentId    string    `json:"parent_id"`
+	Cgroup      string    `json:"cgroup"`
+}
+
+// EventsResponse carries a batch of events. The server keeps sending
+// them until one has Done set, which only happens on error.
+type EventsResponse struct {
+	Events []Event `json:"events"`
+	Error  string  `json:"error"`
+	Done   bool    `json:"done"`
+}
+
+// ContainerStats is the resource usage of a container
+type ContainerStats struct {
+	Id       string `json:"id"`
+	ParentId string `json:"parent_id"`
+	Status   string `json:"status"`
+	// Zygote is set for the Zygotes containers are forked from
+	Zygote bool         `json:"zygote"`
+	Cgroup string       `json:"cgroup"`
+	Stats  cgroup.Stats `json:"stats"`
+}
+
+// StatsResponse carries the resource usage of containers at a time.
+// When streaming, the server sends one every interval.
+type StatsResponse struct {
+	Time       time.Time        `json:"time"`
+	Containers []ContainerStats `json:"containers"`
 }
 
 type ForkResponse struct {
-	Id string
+	Id string `json:"id"`
+}
+
+type InvokeResponse struct {
+	Id         string        `json:"id"`
+	StatusCode int           `json:"status_code"`
+	Body       []byte        `json:"body"`
+	Duration   time.Duration `json:"duration_ns"`
+}
+
+type FunctionVersionResponse struct {
+	Id      string         `json:"id"`
+	Meta    container.Meta `json:"meta"`
+	CodeDir string         `json:"code_dir"`
+	Created time.Time      `json:"created"`
+}
+
+type FunctionAliasResponse struct {
+	Name         string `json:"name"`
+	Version      string `json:"version"`
+	Canary       string `json:"canary"`
+	CanaryWeight int    `json:"canary_weight"`
+}
+
+type FunctionResponse struct {
+	Name       string                    `json:"name"`
+	Latest     string                    `json:"latest"`
+	Versions   []FunctionVersionResponse `json:"versions"`
+	Aliases    []FunctionAliasResponse   `json:"aliases"`
+	Registered time.Time                 `json:"registered"`
+}
+
+type ListFunctionsResponse struct {
+	Functions []FunctionResponse `json:"functions"`
+}
+
+// ReloadResponse lists the config keys that changed on a reload
+type ReloadResponse struct {
+	// Applied were changed in the running daemon
+	Applied []string `json:"applied"`
+	// RestartRequired only take effect once the daemon is restarted
+	RestartRequired []string `json:"restart_required"`
+}
+
+// DrainResponse is the progress of a drain. A drain that was waited
+// for sends one every time it changes, until Done is set.
+type DrainResponse struct {
+	Draining bool `json:"draining"`
+	// InFlight is how many creates and invocations are still running
+	InFlight int `json:"in_flight"`
+	// Containers is how many containers the server still manages
+	Containers int `json:"containers"`
+	// Done is set once nothing is in flight
+	Done bool `json:"done"`
 }
 
+// Response answers a Request. To decode a payload into its type, set
+// Payload to a pointer to it before decoding.
 type Response struct {
-	Success bool
-	Message string
-	Payload ResponsePayload
+	// Id is the id of the request this answers
+	Id      string `json:"id,omitempty"`
+	Success bool   `json:"success"`
+	Message string `json:"message,omitempty"`
+	// Error is set when Success is false
+	Error   *Error          `json:"error,omitempty"`
+	Payload ResponsePayload `json:"payload,omitempty"`
 }
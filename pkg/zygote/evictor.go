@@ -2,20 +2,27 @@ package zygote
 
 import (
 	"container/list"
-	"fmt"
-	"log"
+	"log/slog"
+	"parkerdgabel/sockd/internal/metrics"
+	"parkerdgabel/sockd/pkg/cgroup"
 	"parkerdgabel/sockd/pkg/container"
-	"strings"
+	"sync/atomic"
+	"time"
 )
 
-const (
-	FreeContainerPercentGoal = 20
-	ConcurrentEvictions      = 8
-)
+// how often the evictor checks the memory pressure of the pool when no
+// container events come
+const pressureInterval = 5 * time.Second
 
 type Evictor struct {
-	mem    *MemPool
-	events chan container.ContainerEvent
+	config atomic.Pointer[Config]
+	// the memory limit of the containers that set none, which the
+	// evictor counts free memory in
+	memLimitMB atomic.Int64
+	mem        *MemPool
+	// pressure reads the memory pressure of the cgroup pool
+	pressure func() (*cgroup.Pressure, error)
+	events   chan container.ContainerEvent
 	// Sandbox ID => prio.  we ALWAYS evict lower priority before higher priority
 	//
 	// A Sandbox's priority is 2*NUM_CHILDEN, +1 if Unpaused.
@@ -33,6 +40,14 @@ type Evictor struct {
 
 	// Sandbox ID => List/Element position in a state queue
 	stateMap map[string]*ListLocation
+
+	// destroy evicts a container, unless it is no longer paused and
+	// force is not set, and tells whether it did
+	destroy func(c *container.Container, force bool) (bool, error)
+	// done is closed when the evictor is stopped
+	done chan struct{}
+
+	logger *slog.Logger
 }
 
 type ListLocation struct {
@@ -40,15 +55,29 @@ type ListLocation struct {
 	*list.Element
 }
 
-func NewEvictor(provider Provider) *Evictor {
+// NewEvictor returns an evictor that frees the memory pool of provider
+// by destroying idle containers. It sees the containers whose events
+// are passed to Event, which should be added as a listener of the
+// provider before it creates any.
+func NewEvictor(provider Provider, config Config, containerConfig container.Config) *Evictor {
+	return newEvictor(provider.MemPool(), provider.Pressure, config, containerConfig)
+}
+
+func newEvictor(mem *MemPool, pressure func() (*cgroup.Pressure, error), config Config, containerConfig container.Config) *Evictor {
 	evictor := &Evictor{
-		mem:        provider.MemPool(),
+		mem:        mem,
+		pressure:   pressure,
 		events:     make(chan container.ContainerEvent, 32),
 		priority:   make(map[string]int),
 		prioQueues: make([]*list.List, 3),
+		evicting:   list.New(),
 		stateMap:   make(map[string]*ListLocation),
+		destroy:    destroy,
+		done:       make(chan struct{}),
+		logger:     logger.With("component", "evictor", "pool", mem.name),
 	}
 
+	evictor.Configure(config, containerConfig)
 	for i := 0; i < 3; i++ {
 		evictor.prioQueues[i] = list.New()
 	}
@@ -57,12 +86,39 @@ func NewEvictor(provider Provider) *Evictor {
 	return evictor
 }
 
+// Configure changes the eviction thresholds, and the memory limit
+// containers are counted at, from the next round of evictions on
+func (evictor *Evictor) Configure(config Config, containerConfig container.Config) {
+	evictor.config.Store(&config)
+	evictor.memLimitMB.Store(int64(containerConfig.MemLimitMB))
+}
+
+// Event is a container.ContainerEventHandler that tells the evictor
+// about a container of its provider
+func (evictor *Evictor) Event(event container.ContainerEventType, c *container.Container) {
+	select {
+	case evictor.events <- container.ContainerEvent{Event: event, Container: c}:
+	case <-evictor.done:
+	}
+}
+
+// Stop stops evicting containers. Evictions already started go on.
+func (evictor *Evictor) Stop() {
+	close(evictor.done)
+}
+
 func (evictor *Evictor) run() {
 	// map container ID to the element that is on one of the lists
 
 	for {
-		// blocks until there's at least one update
+		// blocks until there's at least one update, or until it is
+		// time to check the memory pressure
 		evictor.updateState()
+		select {
+		case <-evictor.done:
+			return
+		default:
+		}
 
 		// select 0 or more sandboxes to evict (policy), then
 		// .Destroy them (mechanism)
@@ -72,26 +128,9 @@ func (evictor *Evictor) run() {
 
 // POLICY: how should we select a victim?
 func (evictor *Evictor) doEvictions() {
-	// TODO: consider a more sophisticated policy
-	memLimitMB := evictor.mem.totalMB / 2
-
-	// how many sandboxes could we spin up, given available mem?
-	freeSandboxes := evictor.mem.getAvailableMB() / memLimitMB
-
-	// how many sandboxes would we like to be able to spin up,
-	// without waiting for more memory?
-	freeGoal := 1 + ((evictor.mem.totalMB/memLimitMB)-2)*FreeContainerPercentGoal/100
-
-	// how many shoud we try to evict?
-	//
-	// TODO: consider counting in-flight evictions.  This will be
-	// a bit tricky, as the evictions may be of sandboxes in paused
-	// states with reduced memory limits
-	evictCount := freeGoal - freeSandboxes
-
-	evictCap := ConcurrentEvictions - evictor.evicting.Len()
-	if evictCap < evictCount {
-		evictCount = evictCap
+	evictCount, freeSandboxes, ok := evictor.evictCount()
+	if !ok {
+		return
 	}
 
 	// try evicting the desired number, starting with the paused queue
@@ -107,7 +146,7 @@ func (evictor *Evictor) doEvictions() {
 	// TODO: create some parameters to better control eviction in
 	// this state
 	if freeSandboxes <= 0 && evictor.evicting.Len() == 0 {
-		evictor.printf("WARNING!  Critically low on memory, so evicting an active Sandbox")
+		evictor.logger.Warn("critically low on memory, evicting an active container")
 		if evictor.prioQueues[1].Len() > 0 {
 			evictor.evictFront(evictor.prioQueues[1], true)
 		}
@@ -118,65 +157,139 @@ func (evictor *Evictor) doEvictions() {
 	// first
 }
 
+// evictCount returns how many idle containers to evict, and how many
+// containers the free memory of the pool holds. It is not ok for a
+// pool too small to hold a container.
+func (evictor *Evictor) evictCount() (evictCount, freeSandboxes int, ok bool) {
+	config := evictor.config.Load()
+	totalMB := evictor.mem.TotalMB()
+
+	// containers count as much as their default memory limit, and
+	// a pool holds at least two of them
+	memLimitMB := min(int(evictor.memLimitMB.Load()), totalMB/2)
+	if memLimitMB < 1 {
+		return 0, 0, false
+	}
+
+	// how many sandboxes could we spin up, given available mem?
+	freeSandboxes = evictor.mem.getAvailableMB() / memLimitMB
+
+	// how many sandboxes would we like to be able to spin up,
+	// without waiting for more memory?
+	freeGoal := 1 + ((totalMB/memLimitMB)-2)*config.FreeContainerPercentGoal/100
+
+	// how many shoud we try to evict?
+	//
+	// TODO: consider counting in-flight evictions.  This will be
+	// a bit tricky, as the evictions may be of sandboxes in paused
+	// states with reduced memory limits
+	evictCount = freeGoal - freeSandboxes
+
+	// the memory pool only counts the limits of the containers, while
+	// the kernel tells how short of memory they really are
+	if evictCount < 1 && evictor.underPressure(config) {
+		evictCount = 1
+	}
+
+	evictCap := config.ConcurrentEvictions - evictor.evicting.Len()
+	if evictCap < evictCount {
+		evictCount = evictCap
+	}
+	return evictCount, freeSandboxes, true
+}
+
+// underPressure tells whether tasks of the pool stalled on memory for
+// more than the PressureThreshold
+func (evictor *Evictor) underPressure(config *Config) bool {
+	if config.PressureThreshold <= 0 {
+		return false
+	}
+	p, err := evictor.pressure()
+	if err != nil {
+		evictor.logger.Debug("failed to read memory pressure", "error", err)
+		return false
+	}
+	if p.Some.Avg10 < config.PressureThreshold {
+		return false
+	}
+	evictor.logger.Info("under memory pressure", "avg10", p.Some.Avg10, "threshold", config.PressureThreshold)
+	return true
+}
+
 // evict whatever SB is at the front of the queue, assumes
 // queue is not empty
 func (evictor *Evictor) evictFront(queue *list.List, force bool) {
 	front := queue.Front()
 	sb := front.Value.(*container.Container)
 
-	evictor.printf("Evict Sandbox %v", sb.ID())
+	evictor.logger.Info("evicting container", "container_id", sb.ID(), "force", force)
 	evictor.move(sb, evictor.evicting)
 
 	// destroy async (we'll know when it's done, because
 	// we'll see a evDestroy event later on our chan)
 	go func() {
-
-		if force {
-			sb.Destroy()
-		} else {
-			// sb.DestroyIfPaused("idle eviction")
+		destroyed, err := evictor.destroy(sb, force)
+		if err != nil {
+			evictor.logger.Error("failed to evict container", "container_id", sb.ID(), "error", err)
+			return
 		}
-
+		if !destroyed {
+			evictor.logger.Debug("container was unpaused, not evicting it", "container_id", sb.ID())
+			return
+		}
+		metrics.Evictions.Inc()
 	}()
 }
 
+func destroy(c *container.Container, force bool) (bool, error) {
+	if force {
+		return true, c.Destroy()
+	}
+	// a container unpaused since it was picked is left alone; the
+	// unpause event moves it out of evicting
+	return c.DestroyIfPaused()
+}
+
 // update state based on messages sent to this task.  this may be
 // stale, but correctness doesn't depend on freshness.
 //
-// blocks until there's at least one event
+// blocks until there's at least one event, or for pressureInterval
 func (evictor *Evictor) updateState() {
-	event := evictor.nextEvent(true)
-
 	// update state based on incoming messages
-	for event != nil {
+	for event := evictor.nextEvent(true); event != nil; event = evictor.nextEvent(false) {
 		// add list to appropriate queue
 		c := event.Container
+		if event.Event != container.ContainerDestroy && c.State() == container.StateDestroyed {
+			// a destroyed Zygote still sees its children exit, but
+			// it is no longer ours to evict
+			continue
+		}
 		prio := evictor.priority[c.ID()]
 
+		// containers only emit events on real transitions, in order,
+		// so the priority always matches their state
 		switch event.Event {
-		case container.ContainerStart:
-			if prio != 0 {
-				panic(fmt.Sprintf("Sandboxes should be at prio 0 upon EvCreate event but it was %d for %d", prio, c.ID()))
-			}
-			prio += 1
-		case container.ContainerUnpause:
+		case container.ContainerStart, container.ContainerUnpause:
 			prio += 1
 		case container.ContainerPause:
 			prio -= 1
+		case container.ContainerStop:
+			// no longer running, but children may still be alive
+			prio -= prio % 2
 		case container.ContainerFork:
 			prio += 2
 		case container.ContainerChildExit:
 			prio -= 2
 		case container.ContainerDestroy:
 		default:
-			evictor.printf("Unknown event: %v", event.Event)
+			if event.Event.Resource() {
+				// the state of the container did not change
+				continue
+			}
+			evictor.logger.Warn("unknown event", "event", event.Event.String(), "container_id", c.ID())
 		}
 
-		evictor.printf("Evictor: Sandbox %v priority goes to %d", c.ID(), prio)
-		if prio < 0 {
-			panic(fmt.Sprintf("priority should never go negative, but it went to %d for sandbox %d", prio, c.ID()))
-
-		}
+		evictor.logger.Debug("container priority changed", "container_id", c.ID(), "priority", prio)
 
 		if event.Event == container.ContainerDestroy {
 			evictor.move(c, nil)
@@ -190,15 +303,21 @@ func (evictor *Evictor) updateState() {
 
 			evictor.move(c, evictor.prioQueues[prio])
 		}
-
-		event = evictor.nextEvent(false)
 	}
 }
 
 func (evictor *Evictor) nextEvent(block bool) *container.ContainerEvent {
 	if block {
-		event := <-evictor.events
-		return &event
+		timer := time.NewTimer(pressureInterval)
+		defer timer.Stop()
+		select {
+		case event := <-evictor.events:
+			return &event
+		case <-timer.C:
+			return nil
+		case <-evictor.done:
+			return nil
+		}
 	}
 
 	select {
@@ -226,9 +345,3 @@ func (evictor *Evictor) move(c *container.Container, target *list.List) {
 		delete(evictor.stateMap, c.ID())
 	}
 }
-
-func (_ *Evictor) printf(format string, args ...any) {
-	msg := fmt.Sprintf(format, args...)
-	log.Printf("%s [EVICTOR]", strings.TrimRight(msg, "\n"))
-
-}
@@ -0,0 +1,122 @@
+package zygote
+
+import (
+	"parkerdgabel/sockd/internal/metrics"
+	"parkerdgabel/sockd/pkg/cgroup"
+	"parkerdgabel/sockd/pkg/container"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestEvictorPressure(t *testing.T) {
+	tests := []struct {
+		name    string
+		avg10   float64
+		evicted bool
+	}{
+		{name: "under pressure", avg10: 50, evicted: true},
+		{name: "no pressure", avg10: 5, evicted: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the pool is free, so only the pressure of the cgroup
+			// pool may evict
+			pressure := func() (*cgroup.Pressure, error) {
+				return &cgroup.Pressure{Some: cgroup.PressureAverages{Avg10: tt.avg10}}, nil
+			}
+			evictor := newEvictor(NewMemPool("test", 100), pressure, DefaultConfig(), container.DefaultConfig())
+			defer evictor.Stop()
+			evicted := make(chan *container.Container, 1)
+			evictor.destroy = func(c *container.Container, force bool) (bool, error) {
+				evicted <- c
+				return true, nil
+			}
+
+			evictions := testutil.ToFloat64(metrics.Evictions)
+			c := &container.Container{}
+			evictor.Event(container.ContainerStart, c)
+			evictor.Event(container.ContainerPause, c)
+
+			select {
+			case got := <-evicted:
+				if !tt.evicted {
+					t.Fatal("evicted a container without memory pressure")
+				}
+				if got != c {
+					t.Errorf("evicted %p, want the paused container %p", got, c)
+				}
+				deadline := time.Now().Add(time.Second)
+				for testutil.ToFloat64(metrics.Evictions) != evictions+1 {
+					if time.Now().After(deadline) {
+						t.Fatalf("evictions = %g, want %g", testutil.ToFloat64(metrics.Evictions), evictions+1)
+					}
+					time.Sleep(time.Millisecond)
+				}
+			case <-time.After(100 * time.Millisecond):
+				if tt.evicted {
+					t.Fatal("no container was evicted under memory pressure")
+				}
+			}
+		})
+	}
+}
+
+func TestEvictorEvictCount(t *testing.T) {
+	noPressure := func() (*cgroup.Pressure, error) {
+		return &cgroup.Pressure{}, nil
+	}
+	tests := []struct {
+		name                string
+		freeGoal            int
+		concurrentEvictions int
+		evicting            int
+		want                int
+	}{
+		// a pool of 10 containers with 2 free
+		{name: "free goal", freeGoal: 50, concurrentEvictions: 8, want: 3},
+		{name: "no free goal", freeGoal: 0, concurrentEvictions: 8, want: -1},
+		{name: "concurrent evictions", freeGoal: 50, concurrentEvictions: 2, want: 2},
+		{name: "evictions in flight", freeGoal: 50, concurrentEvictions: 2, evicting: 1, want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultConfig()
+			config.FreeContainerPercentGoal = tt.freeGoal
+			config.ConcurrentEvictions = tt.concurrentEvictions
+			containerConfig := container.DefaultConfig()
+			containerConfig.MemLimitMB = 100
+			mem := NewMemPool("test", 1000)
+			mem.adjustAvailableMB(-800)
+			evictor := newEvictor(mem, noPressure, config, containerConfig)
+			defer evictor.Stop()
+			for i := 0; i < tt.evicting; i++ {
+				evictor.evicting.PushBack(&container.Container{})
+			}
+
+			got, free, ok := evictor.evictCount()
+			if !ok || free != 2 || got != tt.want {
+				t.Errorf("evictCount() = %d, %d, %v, want %d, 2, true", got, free, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvictorConfigure(t *testing.T) {
+	pressure := func() (*cgroup.Pressure, error) {
+		return &cgroup.Pressure{Some: cgroup.PressureAverages{Avg10: 50}}, nil
+	}
+	evictor := newEvictor(NewMemPool("test", 100), pressure, DefaultConfig(), container.DefaultConfig())
+	defer evictor.Stop()
+	if got, _, _ := evictor.evictCount(); got != 1 {
+		t.Fatalf("evictCount() = %d under memory pressure, want 1", got)
+	}
+
+	config := DefaultConfig()
+	config.PressureThreshold = 60
+	evictor.Configure(config, container.DefaultConfig())
+	if got, _, _ := evictor.evictCount(); got > 0 {
+		t.Errorf("evictCount() = %d below the new pressure threshold, want none", got)
+	}
+}
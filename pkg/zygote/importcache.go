@@ -1,9 +1,11 @@
 package zygote
 
 import (
+	"context"
 	"errors"
-	"log"
+	"parkerdgabel/sockd/internal/logging"
 	"parkerdgabel/sockd/internal/storage"
+	"parkerdgabel/sockd/internal/tracing"
 	"parkerdgabel/sockd/pkg/cgroup"
 	"parkerdgabel/sockd/pkg/container"
 	"sync"
@@ -11,10 +13,13 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 var ErrNoZygoteFound = errors.New("no Zygote found")
 
+var logger = logging.For(logging.Zygote)
+
 type importCache struct {
 	rootDirs        *storage.DirMaker
 	codeDirs        *storage.DirMaker
@@ -24,10 +29,15 @@ type importCache struct {
 	cgroupPool      *cgroup.Pool
 	pullerInstaller container.PackagePullerInstaller
 	listeners       []container.ContainerEventHandler
+	// the memory limits of the containers are taken from mem while they
+	// run
+	mem *MemPool
+	// the config of the containers created from now on
+	containerConfig atomic.Pointer[container.Config]
 }
 
-func newImportCache(rootDirs, codeDirs, scratchDirs *storage.DirMaker, baseImageDir string, cgroupPool *cgroup.Pool, pullerInstaller container.PackagePullerInstaller) *importCache {
-	return &importCache{
+func newImportCache(containerConfig container.Config, rootDirs, codeDirs, scratchDirs *storage.DirMaker, baseImageDir string, cgroupPool *cgroup.Pool, pullerInstaller container.PackagePullerInstaller) *importCache {
+	ic := &importCache{
 		rootDirs:        rootDirs,
 		codeDirs:        codeDirs,
 		scratchDirs:     scratchDirs,
@@ -37,6 +47,8 @@ func newImportCache(rootDirs, codeDirs, scratchDirs *storage.DirMaker, baseImage
 		pullerInstaller: pullerInstaller,
 		listeners:       []container.ContainerEventHandler{},
 	}
+	ic.containerConfig.Store(&containerConfig)
+	return ic
 }
 
 type importCacheNode struct {
@@ -63,20 +75,30 @@ type importCacheNode struct {
 	meta *container.Meta
 }
 
-func (ic *importCache) Create(meta *container.Meta) (*container.Container, error) {
+// Create a leaf container running the code in codeDir, forked from
+// the Zygote that best matches the packages it installs
+func (ic *importCache) Create(ctx context.Context, codeDir string, meta *container.Meta) (_ *container.Container, err error) {
+	ctx, span := tracing.Start(ctx, "zygote.create", attribute.StringSlice("sockd.packages", meta.Installs))
+	defer tracing.End(span, &err)
+
 	node := ic.root.Lookup(meta.Installs)
 	if node == nil {
 		return nil, ErrNoZygoteFound
 	}
-	log.Panicf("Creating contronaer from zygote %v", node)
-	return ic.createChildContainerFromNode(node)
+	span.SetAttributes(attribute.StringSlice("sockd.zygote.packages", node.packages))
+	logger.Debug("creating container from Zygote", "packages", node.packages, "installs", meta.Installs)
+	c, err := ic.forkFromNode(ctx, node, codeDir, meta)
+	if err == nil {
+		atomic.AddInt64(&node.createLeafChild, 1)
+	}
+	return c, err
 }
 
 func (icn *importCacheNode) Create(meta *container.Meta, baseImageDir string, codeDir string, scrachDir string, cgroupPool *cgroup.Pool) (*container.Container, error) {
 	return nil, nil
 }
 
-func (ic *importCache) getContainerInNode(node *importCacheNode, forceNew bool) (*container.Container, bool, error) {
+func (ic *importCache) getContainerInNode(ctx context.Context, node *importCacheNode, forceNew bool) (*container.Container, bool, error) {
 	node.mutex.Lock()
 	defer node.mutex.Unlock()
 
@@ -86,6 +108,12 @@ func (ic *importCache) getContainerInNode(node *importCacheNode, forceNew bool)
 		go old.Destroy()
 	}
 
+	if node.container != nil && node.container.State() == container.StateDestroyed {
+		// evicted while idle
+		node.container = nil
+		node.sbRefCount = 0
+	}
+
 	if node.container != nil {
 		// FAST PATH
 		if node.sbRefCount == 0 {
@@ -99,7 +127,7 @@ func (ic *importCache) getContainerInNode(node *importCacheNode, forceNew bool)
 	}
 
 	// SLOW PATH
-	if err := ic.createContainerInNode(node); err != nil {
+	if err := ic.createContainerInNode(ctx, node); err != nil {
 		return nil, false, err
 	}
 	node.sbRefCount = 1
@@ -107,10 +135,16 @@ func (ic *importCache) getContainerInNode(node *importCacheNode, forceNew bool)
 	return node.container, true, nil
 }
 
-func (ic *importCache) createContainerInNode(node *importCacheNode) error {
+func (ic *importCache) createContainerInNode(ctx context.Context, node *importCacheNode) (err error) {
+	ctx, span := tracing.Start(ctx, "zygote.create_zygote", attribute.StringSlice("sockd.zygote.packages", node.packages))
+	defer tracing.End(span, &err)
+
 	// populate codeDir/packages with deps, and record top-level mods)
 	if node.codeDir == "" {
-		codeDir := ic.codeDirs.Make("import-cache")
+		codeDir, err := ic.codeDirs.Make("import-cache")
+		if err != nil {
+			return err
+		}
 		// TODO: clean this up upon failure
 
 		installs, err := ic.pullerInstaller.InstallPackages(node.packages)
@@ -120,7 +154,7 @@ func (ic *importCache) createContainerInNode(node *importCacheNode) error {
 
 		topLevelMods := []string{}
 		for _, name := range node.packages {
-			pkg, err := ic.pullerInstaller.PullPackage(name)
+			pkg, err := ic.pullerInstaller.PullPackage(ctx, name)
 			if err != nil {
 				return err
 			}
@@ -139,7 +173,7 @@ func (ic *importCache) createContainerInNode(node *importCacheNode) error {
 
 	var c *container.Container
 	if node.parent != nil {
-		c, err := ic.createChildContainerFromNode(node)
+		c, err := ic.createChildContainerFromNode(ctx, node)
 		if err != nil {
 			return err
 		}
@@ -149,15 +183,12 @@ func (ic *importCache) createContainerInNode(node *importCacheNode) error {
 		}
 	} else {
 		node.meta = node.meta.MakeZygote()
-		id := uuid.NewString()
-		rootDir := ic.rootDirs.Make("import-cache-" + id)
-		scratchDir := ic.scratchDirs.Make("import-cache")
-		cgroup, err := ic.cgroupPool.RetrieveCgroup(time.Duration(1) * time.Second)
+		c, err = ic.newContainer(ctx, nil, node.codeDir, node.meta)
 		if err != nil {
 			return err
 		}
-		c, err = container.NewContainer(nil, ic.baseImageDir, id, rootDir, node.codeDir, scratchDir, cgroup, node.meta, ic.listeners)
-		if err != nil {
+		// only a running Zygote can serve fork requests
+		if err := c.Start(); err != nil {
 			return err
 		}
 	}
@@ -166,32 +197,31 @@ func (ic *importCache) createContainerInNode(node *importCacheNode) error {
 	return nil
 }
 
-func (ic *importCache) createChildContainerFromNode(node *importCacheNode) (*container.Container, error) {
+func (ic *importCache) createChildContainerFromNode(ctx context.Context, node *importCacheNode) (*container.Container, error) {
+	c, err := ic.forkFromNode(ctx, node.parent, node.codeDir, node.meta)
+	if err == nil {
+		if !node.meta.IsZygote() {
+			atomic.AddInt64(&node.createLeafChild, 1)
+		} else {
+			atomic.AddInt64(&node.createNonleafChild, 1)
+		}
+	}
+	return c, err
+}
+
+// fork a new container running codeDir from the Zygote of node
+func (ic *importCache) forkFromNode(ctx context.Context, node *importCacheNode, codeDir string, meta *container.Meta) (*container.Container, error) {
 	// try twice, restarting parent Sandbox if it fails the first time
 	forceNew := false
 	for i := 0; i < 2; i++ {
-		zygote, isNew, err := ic.getContainerInNode(node.parent, forceNew)
-		if err != nil {
-			return nil, err
-		}
-		id := uuid.NewString()
-		rootDir := ic.rootDirs.Make("import-cache-" + id)
-		scratchDir := ic.scratchDirs.Make("import-cache")
-		cgroup, err := ic.cgroupPool.RetrieveCgroup(time.Duration(1) * time.Second)
+		zygote, isNew, err := ic.getContainerInNode(ctx, node, forceNew)
 		if err != nil {
 			return nil, err
 		}
-		c, err := container.NewContainer(zygote, ic.baseImageDir, id, rootDir, node.codeDir, scratchDir, cgroup, node.meta, ic.listeners)
-		if err == nil {
-			if !node.meta.IsZygote() {
-				atomic.AddInt64(&node.createLeafChild, 1)
-			} else {
-				atomic.AddInt64(&node.createNonleafChild, 1)
-			}
-		}
+		c, err := ic.newContainer(ctx, zygote, codeDir, meta)
 
 		ic.putContainerInNode(node, zygote)
-		if isNew || err != nil {
+		if isNew || err == nil {
 			return c, err
 		}
 		forceNew = true
@@ -199,6 +229,49 @@ func (ic *importCache) createChildContainerFromNode(node *importCacheNode) (*con
 	return nil, nil
 }
 
+// newContainer creates a container running codeDir, forked from parent
+// unless it is nil, in a cgroup of the pool. Its memory limit is taken
+// from the memory pool until it is stopped or destroyed.
+func (ic *importCache) newContainer(ctx context.Context, parent *container.Container, codeDir string, meta *container.Meta) (*container.Container, error) {
+	config := *ic.containerConfig.Load()
+	memLimitMB, _ := config.Limits(meta)
+	if err := ic.mem.reserveMB(ctx, memLimitMB); err != nil {
+		return nil, err
+	}
+	var once sync.Once
+	release := func() {
+		once.Do(func() { ic.mem.adjustAvailableMB(memLimitMB) })
+	}
+	listeners := append(ic.listeners[:len(ic.listeners):len(ic.listeners)], func(event container.ContainerEventType, c *container.Container) {
+		if event == container.ContainerStop || event == container.ContainerDestroy {
+			release()
+		}
+	})
+
+	id := uuid.NewString()
+	rootDir, err := ic.rootDirs.Make("import-cache-" + id)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	scratchDir, err := ic.scratchDirs.Make("import-cache")
+	if err != nil {
+		release()
+		return nil, err
+	}
+	cgroup, err := ic.cgroupPool.RetrieveCgroup(time.Duration(1) * time.Second)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	c, err := container.NewContainer(ctx, parent, ic.baseImageDir, id, rootDir, codeDir, scratchDir, cgroup, meta, config, listeners)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return c, nil
+}
+
 func (ic *importCache) putContainerInNode(node *importCacheNode, c *container.Container) {
 	node.mutex.Lock()
 	defer node.mutex.Unlock()
@@ -215,11 +288,44 @@ func (ic *importCache) putContainerInNode(node *importCacheNode, c *container.Co
 		}
 	}
 
-	if node.sbRefCount == 0 {
+	if node.sbRefCount < 0 {
 		panic("sbRefCount should never be negative")
 	}
 }
 
+// zygotes appends the Zygotes of the node and of its descendants to
+// list, parents first
+func (icn *importCacheNode) zygotes(list []*container.Container) []*container.Container {
+	icn.mutex.Lock()
+	// an evicted Zygote is only replaced once it is needed
+	if icn.container != nil && icn.container.State() != container.StateDestroyed {
+		list = append(list, icn.container)
+	}
+	icn.mutex.Unlock()
+	for _, child := range icn.children {
+		list = child.zygotes(list)
+	}
+	return list
+}
+
+// destroy destroys the Zygotes of the node and of its descendants,
+// deepest first, carrying on past failures
+func (icn *importCacheNode) destroy() error {
+	var errs []error
+	for _, child := range icn.children {
+		errs = append(errs, child.destroy())
+	}
+	icn.mutex.Lock()
+	defer icn.mutex.Unlock()
+	if icn.container != nil && icn.container.State() != container.StateDestroyed {
+		if err := icn.container.Destroy(); err != nil {
+			errs = append(errs, err)
+		}
+		icn.container = nil
+	}
+	return errors.Join(errs...)
+}
+
 func (icn *importCacheNode) Lookup(pkgs []string) *importCacheNode {
 	// if this node imports a package that's not wanted by the
 	// lambda, neither this Zygote nor its children will work
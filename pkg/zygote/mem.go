@@ -2,16 +2,31 @@ package zygote
 
 import (
 	"container/list"
+	"context"
+	"errors"
 	"fmt"
-	"log"
-	"strings"
+	"log/slog"
+	"sync/atomic"
+	"time"
 )
 
+// ErrLimitExceedsPool is returned for a container whose memory limit is
+// more than its memory pool holds
+var ErrLimitExceedsPool = errors.New("memory limit exceeds the memory pool")
+
+// ErrOutOfMemory is returned for a container whose memory limit could
+// not be taken from its memory pool in time
+var ErrOutOfMemory = errors.New("not enough free memory in the memory pool")
+
+// how long a container waits for memory in its pool
+const memTimeout = 5 * time.Second
+
 type MemPool struct {
 	name string
 
-	// how much memory is being managed (includes free and allocated)
-	totalMB int
+	// how much memory is being managed (includes free and allocated),
+	// a copy of the state of memTask
+	totalMB atomic.Int64
 
 	// a task listens on this, with requests to decrement memory
 	// (which may block) or increment it
@@ -20,42 +35,55 @@ type MemPool struct {
 	// decrement requests read from memRequests that need to wait
 	// for memory sit here until it's available
 	memRequestsWaiting *list.List
+
+	// copies of the state of memTask, for monitoring
+	availableMB atomic.Int64
+	waiting     atomic.Int64
+
+	logger *slog.Logger
 }
 
 type memReq struct {
 	// how much we're requesting
 	mb int
 
-	// any response means the memory is allocated; the particular
-	// number indicates the total remaining memory available in
-	// the pool
+	// resize sets the total to mb instead
+	resize bool
+
+	// claim takes -mb without waiting for it to be available
+	claim bool
+
+	// any response without err means the memory is allocated; the
+	// particular number indicates the total remaining memory
+	// available in the pool
 	resp chan int
+
+	// err is set before the response to a request the pool can never
+	// serve, as it has shrunk below it
+	err error
 }
 
 func NewMemPool(name string, totalMB int) *MemPool {
 	pool := &MemPool{
 		name:               name,
-		totalMB:            totalMB,
 		memRequests:        make(chan *memReq, 32),
 		memRequestsWaiting: list.New(),
+		logger:             logger.With("pool", name),
 	}
+	pool.totalMB.Store(int64(totalMB))
+	pool.availableMB.Store(int64(totalMB))
 
 	go pool.memTask()
 
 	return pool
 }
 
-func (pool *MemPool) printf(format string, args ...any) {
-	msg := fmt.Sprintf(format, args...)
-	log.Printf("%s [MEM POOL %s]", strings.TrimRight(msg, "\n"), pool.name)
-
-}
-
 // this task is responsible for tracking available memory in the
 // system, adding to the count when memory is released, and blocking
 // requesters until enough is free
 func (pool *MemPool) memTask() {
-	availableMB := pool.totalMB
+	totalMB := int(pool.totalMB.Load())
+	availableMB := totalMB
 
 	for {
 		req, ok := <-pool.memRequests
@@ -63,14 +91,34 @@ func (pool *MemPool) memTask() {
 			return
 		}
 
-		if pool.totalMB+req.mb < 0 {
-			panic(fmt.Sprintf("received request for %d MB to pool of total size %d MB",
-				-req.mb, pool.totalMB))
-		}
-
-		if req.mb >= 0 {
+		if req.resize {
+			// what is handed out stays handed out, so the pool may
+			// be overdrawn until it is returned
+			availableMB += req.mb - totalMB
+			totalMB = req.mb
+			pool.totalMB.Store(int64(totalMB))
+			pool.logger.Info("memory pool resized", "available_mb", availableMB, "total_mb", totalMB)
+			req.resp <- availableMB
+			for e := pool.memRequestsWaiting.Front(); e != nil; {
+				next := e.Next()
+				if waiting := e.Value.(*memReq); totalMB+waiting.mb < 0 {
+					pool.memRequestsWaiting.Remove(e)
+					pool.reject(waiting, totalMB, availableMB)
+				}
+				e = next
+			}
+		} else if req.claim {
+			// the memory is in use already, so the pool may be
+			// overdrawn until it is returned
 			availableMB += req.mb
-			pool.printf("%d of %d MB available", availableMB, pool.totalMB)
+			pool.logger.Debug("memory claimed", "available_mb", availableMB, "total_mb", totalMB)
+			req.resp <- availableMB
+		} else if totalMB+req.mb < 0 {
+			// the pool shrank since the requester checked its size
+			pool.reject(req, totalMB, availableMB)
+		} else if req.mb >= 0 {
+			availableMB += req.mb
+			pool.logger.Debug("memory returned", "available_mb", availableMB, "total_mb", totalMB)
 			req.resp <- availableMB
 		} else {
 			pool.memRequestsWaiting.PushBack(req)
@@ -83,13 +131,69 @@ func (pool *MemPool) memTask() {
 			if availableMB+req.mb >= 0 {
 				pool.memRequestsWaiting.Remove(e)
 				availableMB += req.mb
-				pool.printf("%d of %d MB available", availableMB, pool.totalMB)
+				pool.logger.Debug("memory handed out", "available_mb", availableMB, "total_mb", totalMB)
 				req.resp <- availableMB
 			}
 		}
+		pool.availableMB.Store(int64(availableMB))
+		pool.waiting.Store(int64(pool.memRequestsWaiting.Len()))
 	}
 }
 
+// reject answers a request for more memory than the pool holds
+func (pool *MemPool) reject(req *memReq, totalMB, availableMB int) {
+	req.err = fmt.Errorf("%w: %d MB for a pool of %d MB", ErrLimitExceedsPool, -req.mb, totalMB)
+	req.resp <- availableMB
+}
+
+// AvailableMB returns how much memory is free, without waiting behind
+// the requests to the pool
+func (pool *MemPool) AvailableMB() int {
+	return int(pool.availableMB.Load())
+}
+
+// Waiting returns how many requests are waiting for memory
+func (pool *MemPool) Waiting() int {
+	return int(pool.waiting.Load())
+}
+
+// TotalMB returns how much memory the pool manages
+func (pool *MemPool) TotalMB() int {
+	return int(pool.totalMB.Load())
+}
+
+// Resize changes how much memory the pool manages. Memory already
+// handed out is not taken back.
+func (pool *MemPool) Resize(totalMB int) {
+	req := &memReq{
+		mb:     totalMB,
+		resize: true,
+		resp:   make(chan int),
+	}
+
+	pool.memRequests <- req
+	<-req.resp
+}
+
+// Claim takes mb out of the pool without waiting for it to be free, for
+// memory in use before the pool knew of it, such as that of a recovered
+// container. It is given back with Return.
+func (pool *MemPool) Claim(mb int) {
+	req := &memReq{
+		mb:    -mb,
+		claim: true,
+		resp:  make(chan int),
+	}
+
+	pool.memRequests <- req
+	<-req.resp
+}
+
+// Return gives back memory taken with Claim
+func (pool *MemPool) Return(mb int) {
+	pool.adjustAvailableMB(mb)
+}
+
 // this adjusts the available memory in the pool up/down, and returns
 // the remaining available after the adjustment.
 //
@@ -100,15 +204,55 @@ func (pool *MemPool) memTask() {
 // evictor (it doesn't change anything, but provides a way to monitor
 // available memory).
 func (pool *MemPool) adjustAvailableMB(mb int) (availableMB int) {
+	availableMB, _ = pool.request(mb)
+	return availableMB
+}
+
+// request sends mb to memTask. It fails with ErrLimitExceedsPool if mb
+// takes more memory than the pool holds.
+func (pool *MemPool) request(mb int) (availableMB int, err error) {
 	req := &memReq{
 		mb:   mb,
 		resp: make(chan int),
 	}
 
 	pool.memRequests <- req
-	return <-req.resp
+	availableMB = <-req.resp
+	return availableMB, req.err
 }
 
 func (pool *MemPool) getAvailableMB() (availableMB int) {
 	return pool.adjustAvailableMB(0)
 }
+
+// reserveMB takes mb out of the pool, waiting until enough is free, ctx
+// is done or memTimeout passes. The memory is given back with
+// adjustAvailableMB(mb).
+func (pool *MemPool) reserveMB(ctx context.Context, mb int) error {
+	if total := pool.TotalMB(); mb > total {
+		return fmt.Errorf("%w: %d MB for a pool of %d MB", ErrLimitExceedsPool, mb, total)
+	}
+	ctx, cancel := context.WithTimeout(ctx, memTimeout)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := pool.request(-mb)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		// the request cannot be taken back, so give the memory back
+		// once it is handed out
+		go func() {
+			if err := <-done; err == nil {
+				pool.adjustAvailableMB(mb)
+			}
+		}()
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("%w: %d MB wanted, %d MB free", ErrOutOfMemory, mb, pool.AvailableMB())
+		}
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,108 @@
+package zygote
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMemPool_ReserveMB(t *testing.T) {
+	pool := NewMemPool("test", 100)
+
+	if err := pool.reserveMB(context.Background(), 101); !errors.Is(err, ErrLimitExceedsPool) {
+		t.Errorf("reserveMB(101) error = %v, want %v", err, ErrLimitExceedsPool)
+	}
+	if err := pool.reserveMB(context.Background(), 80); err != nil {
+		t.Fatalf("reserveMB(80) error = %v", err)
+	}
+	if available := pool.getAvailableMB(); available != 20 {
+		t.Errorf("available = %d MB, want 20", available)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := pool.reserveMB(ctx, 50); !errors.Is(err, ErrOutOfMemory) {
+		t.Fatalf("reserveMB(50) error = %v, want %v", err, ErrOutOfMemory)
+	}
+	if waiting := pool.Waiting(); waiting != 1 {
+		t.Errorf("Waiting() = %d, want the timed out request", waiting)
+	}
+
+	// the timed out request gets the memory once it is free, and gives
+	// it back
+	pool.adjustAvailableMB(80)
+	deadline := time.Now().Add(time.Second)
+	for pool.getAvailableMB() != 100 {
+		if time.Now().After(deadline) {
+			t.Fatalf("available = %d MB, want 100 once the timed out request gave it back", pool.getAvailableMB())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMemPool_ReserveMBCancel(t *testing.T) {
+	pool := NewMemPool("test", 100)
+	if err := pool.reserveMB(context.Background(), 100); err != nil {
+		t.Fatalf("reserveMB(100) error = %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := pool.reserveMB(ctx, 10); !errors.Is(err, context.Canceled) {
+		t.Errorf("reserveMB() error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestMemPool_ReserveMBShrunk(t *testing.T) {
+	pool := NewMemPool("test", 100)
+	if err := pool.reserveMB(context.Background(), 80); err != nil {
+		t.Fatalf("reserveMB(80) error = %v", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- pool.reserveMB(context.Background(), 50) }()
+	for pool.Waiting() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the waiting request no longer fits in the pool
+	pool.Resize(40)
+	if err := <-done; !errors.Is(err, ErrLimitExceedsPool) {
+		t.Errorf("reserveMB(50) error = %v, want %v", err, ErrLimitExceedsPool)
+	}
+	// nor does one sent before the requester saw the new size
+	if _, err := pool.request(-50); !errors.Is(err, ErrLimitExceedsPool) {
+		t.Errorf("request(-50) error = %v, want %v", err, ErrLimitExceedsPool)
+	}
+	pool.adjustAvailableMB(80)
+	if available := pool.getAvailableMB(); available != 40 {
+		t.Errorf("available = %d MB, want 40", available)
+	}
+}
+
+func TestMemPool_Claim(t *testing.T) {
+	pool := NewMemPool("test", 100)
+	if err := pool.reserveMB(context.Background(), 80); err != nil {
+		t.Fatalf("reserveMB(80) error = %v", err)
+	}
+
+	// memory in use is claimed however little is free
+	pool.Claim(50)
+	if available := pool.getAvailableMB(); available != -30 {
+		t.Errorf("available = %d MB, want -30", available)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := pool.reserveMB(ctx, 10); !errors.Is(err, ErrOutOfMemory) {
+		t.Errorf("reserveMB(10) error = %v, want %v", err, ErrOutOfMemory)
+	}
+
+	pool.Return(50)
+	pool.adjustAvailableMB(80)
+	deadline := time.Now().Add(time.Second)
+	for pool.getAvailableMB() != 100 {
+		if time.Now().After(deadline) {
+			t.Fatalf("available = %d MB, want 100 once everything was given back", pool.getAvailableMB())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
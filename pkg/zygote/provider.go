@@ -1,14 +1,75 @@
 package zygote
 
 import (
+	"context"
+	"fmt"
 	"parkerdgabel/sockd/internal/storage"
 	"parkerdgabel/sockd/pkg/cgroup"
 	"parkerdgabel/sockd/pkg/container"
 )
 
+// Config sizes the memory pool of the Zygotes and tunes their eviction
+type Config struct {
+	// MemPoolMB is the memory shared by the containers of a base image,
+	// Zygotes and leaves, each taking its memory limit
+	MemPoolMB int `mapstructure:"mem_pool_mb"`
+	// FreeContainerPercentGoal is the share of the memory pool the
+	// evictor tries to keep free for new containers
+	FreeContainerPercentGoal int `mapstructure:"free_container_percent_goal"`
+	// ConcurrentEvictions is how many containers may be evicted at once
+	ConcurrentEvictions int `mapstructure:"concurrent_evictions"`
+	// PressureThreshold is the share of time, in percent over the last
+	// 10s, some tasks of the pool may stall on memory before the evictor
+	// evicts idle containers however much of the memory pool is free.
+	// 0 turns it off.
+	PressureThreshold float64 `mapstructure:"pressure_threshold"`
+}
+
+// DefaultConfig returns the Config used unless configured otherwise
+func DefaultConfig() Config {
+	return Config{
+		MemPoolMB:                1024,
+		FreeContainerPercentGoal: 20,
+		ConcurrentEvictions:      8,
+		PressureThreshold:        20,
+	}
+}
+
+func (c Config) Validate() error {
+	// the evictor counts containers at no more than half the pool
+	if c.MemPoolMB < 2 {
+		return fmt.Errorf("zygote mem_pool_mb must be at least 2, not %d", c.MemPoolMB)
+	}
+	if c.FreeContainerPercentGoal < 0 || c.FreeContainerPercentGoal > 100 {
+		return fmt.Errorf("zygote free_container_percent_goal must be between 0 and 100, not %d", c.FreeContainerPercentGoal)
+	}
+	if c.ConcurrentEvictions < 1 {
+		return fmt.Errorf("zygote concurrent_evictions must be at least 1, not %d", c.ConcurrentEvictions)
+	}
+	if c.PressureThreshold < 0 || c.PressureThreshold > 100 {
+		return fmt.Errorf("zygote pressure_threshold must be between 0 and 100, not %g", c.PressureThreshold)
+	}
+	return nil
+}
+
 type Provider interface {
-	ProvideZygote(codeDir string, meta *container.Meta) (*container.Container, error)
+	ProvideZygote(ctx context.Context, codeDir string, meta *container.Meta) (*container.Container, error)
 	MemPool() *MemPool
+	// Pressure returns the memory pressure of the cgroup pool the
+	// containers of the provider run in
+	Pressure() (*cgroup.Pressure, error)
+	// Configure resizes the memory pool and sets the config of the
+	// containers created from now on. Zygotes already running are kept.
+	Configure(config Config, containerConfig container.Config)
+	// AddListener adds a listener of the events of the containers the
+	// provider creates. It must be called before it creates any.
+	AddListener(handler container.ContainerEventHandler)
+	// Zygotes returns the Zygotes the provider holds, parents before
+	// their children
+	Zygotes() []*container.Container
+	// Destroy destroys the Zygotes of the provider, children before
+	// their parents
+	Destroy() error
 }
 
 type importCacheProvider struct {
@@ -20,16 +81,43 @@ func (icp *importCacheProvider) MemPool() *MemPool {
 	return icp.mem
 }
 
-func NewImportCacheProvider(ic *importCache) Provider {
-	// TODO: Configure the MemPool
-	mem := NewMemPool("zygote", 100)
+func (icp *importCacheProvider) Pressure() (*cgroup.Pressure, error) {
+	return icp.ic.cgroupPool.MemoryPressure()
+}
+
+func (icp *importCacheProvider) Configure(config Config, containerConfig container.Config) {
+	icp.mem.Resize(config.MemPoolMB)
+	icp.ic.containerConfig.Store(&containerConfig)
+}
+
+func (icp *importCacheProvider) AddListener(handler container.ContainerEventHandler) {
+	icp.ic.addListener(handler)
+}
+
+func (icp *importCacheProvider) Zygotes() []*container.Container {
+	return icp.ic.root.zygotes(nil)
+}
+
+func (icp *importCacheProvider) Destroy() error {
+	return icp.ic.root.destroy()
+}
+
+func NewImportCacheProvider(ic *importCache, config Config) Provider {
+	mem := NewMemPool("zygote", config.MemPoolMB)
+	ic.mem = mem
 	return &importCacheProvider{ic: ic, mem: mem}
 }
 
-func (icp *importCacheProvider) ProvideZygote(codeDir string, meta *container.Meta) (*container.Container, error) {
-	return icp.ic.Create(meta)
+func (icp *importCacheProvider) ProvideZygote(ctx context.Context, codeDir string, meta *container.Meta) (*container.Container, error) {
+	return icp.ic.Create(ctx, codeDir, meta)
 }
 
-func NewProvider(rootDirs, codeDirs, scratchDirs *storage.DirMaker, baseImageDir string, cgroupPool *cgroup.Pool, pullerInstaller container.PackagePullerInstaller) Provider {
-	return NewImportCacheProvider(newImportCache(rootDirs, codeDirs, scratchDirs, baseImageDir, cgroupPool, pullerInstaller))
+// NewProvider returns a Provider backed by an import cache. Listeners
+// receive the events of every container it creates, Zygotes included.
+func NewProvider(config Config, containerConfig container.Config, rootDirs, codeDirs, scratchDirs *storage.DirMaker, baseImageDir string, cgroupPool *cgroup.Pool, pullerInstaller container.PackagePullerInstaller, listeners ...container.ContainerEventHandler) Provider {
+	ic := newImportCache(containerConfig, rootDirs, codeDirs, scratchDirs, baseImageDir, cgroupPool, pullerInstaller)
+	for _, l := range listeners {
+		ic.addListener(l)
+	}
+	return NewImportCacheProvider(ic, config)
 }
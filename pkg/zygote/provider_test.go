@@ -0,0 +1,16 @@
+package zygote
+
+import "testing"
+
+func TestConfigValidate(t *testing.T) {
+	if err := DefaultConfig().Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+	for _, memPoolMB := range []int{-1, 0, 1} {
+		c := DefaultConfig()
+		c.MemPoolMB = memPoolMB
+		if err := c.Validate(); err == nil {
+			t.Errorf("Validate() accepted mem_pool_mb %d", memPoolMB)
+		}
+	}
+}